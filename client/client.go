@@ -1,7 +1,7 @@
 package client
 
 import (
-    "bufio"
+    "errors"
     "flag"
     "fmt"
     "github.com/shirou/gopsutil/cpu"
@@ -13,27 +13,49 @@ import (
     "os/exec"
     "strings"
     "time"
-    "sync"
-    "io"
     "strconv"
-    "text/tabwriter"
-    "bytes"
+    "sync"
+    "sync/atomic"
+    "os"
     "runtime"
     "log"
     "regexp"
     "io/ioutil"
+    "crypto/tls"
+    "serverandclient/protocol"
 )
 
 var (
-    clientHost string
-    clientPort int
-    clientHelp bool
+    clientHost      string
+    clientPort      int
+    clientHelp      bool
+    nodeIDFile      string
+    nodeID          string // 持久化的节点ID，握手时发送给服务端
+    nodeSecret      string // 服务端颁发的节点密钥，握手时出示，证明是同一个节点
+    enrollToken     string
+    enrollTokenFile string
+    policyFile      string
 )
 
 func init() {
     flag.StringVar(&clientHost, "h", "127.0.0.1", "服务端IP地址")
     flag.IntVar(&clientPort, "p", 4000, "服务端端口")
     flag.BoolVar(&clientHelp, "help", false, "显示帮助信息")
+    flag.StringVar(&nodeIDFile, "id-file", defaultNodeIDFile(), "保存节点ID的文件，服务端颁发的节点密钥保存在 <文件>.secret")
+    flag.BoolVar(&useTLS, "tls", false, "使用 TLS 连接服务端 (使用系统根证书校验)")
+    flag.StringVar(&tlsCAFile, "ca", "", "校验服务端证书的 CA 证书文件 (PEM)，指定后自动启用 TLS")
+    flag.StringVar(&tlsServerName, "server-name", "", "校验服务端证书时使用的主机名 (默认: 与 -h 相同)")
+    flag.StringVar(&tlsFingerprint, "fingerprint", "", "服务端证书的 SHA-256 指纹，指定后自动启用 TLS")
+    flag.StringVar(&tlsCertFile, "cert", "", "本节点的客户端证书文件 (PEM)，服务端要求客户端证书时使用，指定后自动启用 TLS")
+    flag.StringVar(&tlsKeyFile, "key", "", "客户端证书的私钥文件 (PEM)")
+    flag.StringVar(&enrollToken, "enroll-token", "", "注册令牌，首次连接时出示，有效时服务端自动批准本节点")
+    flag.StringVar(&enrollTokenFile, "enroll-token-file", "", "保存注册令牌的文件，避免令牌出现在进程列表中")
+    flag.StringVar(&policyFile, "policy", "", "命令执行策略文件 (JSON)，执行服务端发来的命令之前检查")
+    flag.StringVar(&trustedKeysFile, "trusted-keys", "", "操作员的 ed25519 公钥文件 (PEM 或 authorized_keys 格式，可包含多个)，指定后只执行这些公钥签名的命令")
+    flag.DurationVar(&maxClockSkew, "max-clock-skew", 5*time.Minute, "命令签名时间与本机时间的最大偏差")
+    flag.DurationVar(&maxSignatureTTL, "max-signature-ttl", 7*24*time.Hour, "带有效期的签名 (排队命令、预先签名的作业) 允许的最长有效期，0 表示不限制")
+    flag.Var(nodeLabels, "label", "本节点的标签，格式为 key=value，可以重复指定")
+    flag.StringVar(&labelsFile, "labels-file", "", "标签文件，每行一个 key=value，# 之后为注释")
 }
 
 func Run() {
@@ -42,50 +64,236 @@ func Run() {
         fmt.Println("客户端帮助信息:")
         fmt.Println("  -h: 服务端IP地址 (默认: 127.0.0.1)")
         fmt.Println("  -p: 服务端端口 (默认: 4000)")
+        fmt.Printf("  -id-file: 保存节点ID的文件，服务端颁发的节点密钥保存在 <文件>.secret (默认: %s)\n", defaultNodeIDFile())
+        fmt.Println("  -tls: 使用 TLS 连接服务端 (使用系统根证书校验)")
+        fmt.Println("  -ca: 校验服务端证书的 CA 证书文件 (PEM)，指定后自动启用 TLS")
+        fmt.Println("  -server-name: 校验服务端证书时使用的主机名 (默认: 与 -h 相同)")
+        fmt.Println("  -fingerprint: 服务端证书的 SHA-256 指纹，指定后自动启用 TLS；只指定指纹时允许自签名证书")
+        fmt.Println("  -cert: 本节点的客户端证书文件 (PEM)，服务端要求客户端证书时使用，指定后自动启用 TLS")
+        fmt.Println("  -key: 客户端证书的私钥文件 (PEM)")
+        fmt.Println("  -enroll-token: 注册令牌，首次连接时出示，有效时服务端自动批准本节点")
+        fmt.Println("  -enroll-token-file: 保存注册令牌的文件，避免令牌出现在进程列表中")
+        fmt.Println("  -policy: 命令执行策略文件 (JSON)，执行服务端发来的命令之前检查")
+        fmt.Println("  -trusted-keys: 操作员的 ed25519 公钥文件 (PEM 或 authorized_keys 格式，可包含多个)，指定后只执行这些公钥签名的命令；已使用的随机数保存在 <id-file>.nonces")
+        fmt.Println("  -max-clock-skew: 命令签名时间与本机时间的最大偏差 (默认: 5m)")
+        fmt.Println("  -max-signature-ttl: 带有效期的签名 (排队命令、预先签名的作业) 允许的最长有效期，0 表示不限制 (默认: 168h)")
+        fmt.Println("  -label: 本节点的标签，格式为 key=value，可以重复指定，例如 -label dc=bj1 -label role=web")
+        fmt.Println("  -labels-file: 标签文件，每行一个 key=value，# 之后为注释；与 -label 同名时以 -label 为准")
         fmt.Println("  -help: 显示帮助信息")
         fmt.Println("程序将在后台持续运行，并尝试每3秒重连服务端。")
         return
     }
 
+    id, err := loadNodeID(nodeIDFile)
+    if err != nil {
+        // 无法持久化时仍然使用一个本次运行期间不变的ID
+        log.Printf("读取节点ID失败: %v", err)
+        if id = productUUID(); id == "" {
+            id, _ = randomUUID()
+        }
+    }
+    nodeID = id
+    fmt.Printf("节点ID: %s\n", nodeID)
+    if nodeSecret, err = loadNodeSecret(nodeSecretFile(nodeIDFile)); err != nil {
+        fmt.Printf("读取节点密钥失败: %v\n", err)
+        os.Exit(1)
+    }
+
+    if enrollTokenFile != "" {
+        data, err := os.ReadFile(enrollTokenFile)
+        if err != nil {
+            fmt.Printf("读取注册令牌失败: %v\n", err)
+            os.Exit(1)
+        }
+        enrollToken = strings.TrimSpace(string(data))
+    }
+
+    if labelsFile != "" {
+        if err := loadLabelsFile(labelsFile, nodeLabels); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    if len(nodeLabels) > 0 {
+        fmt.Printf("节点标签: %s\n", nodeLabels)
+    }
+
+    if policyFile != "" {
+        if policy, err = loadPolicy(policyFile); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        if !policy.ptyAllowed() {
+            // 不声明终端能力，服务端的 connect 自动使用逐行执行模式
+            clientCapabilities = removeCapability(clientCapabilities, protocol.CapPTY)
+        }
+        fmt.Printf("已加载执行策略: %s\n", policyFile)
+    }
+
+    if trustedKeysFile != "" {
+        if trustedKeys, err = protocol.LoadTrustedKeys(trustedKeysFile); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        nonceFile = nonceFileFor(nodeIDFile)
+        if err := loadSeenNonces(nonceFile); err != nil {
+            fmt.Printf("读取已使用的随机数失败: %v\n", err)
+            os.Exit(1)
+        }
+        fmt.Printf("已加载 %d 个可信公钥，只执行签名有效的命令\n", len(trustedKeys))
+    }
+
+    var tlsConfig *tls.Config
+    if tlsEnabled() {
+        if tlsConfig, err = loadTLSConfig(); err != nil {
+            fmt.Printf("TLS 配置错误: %v\n", err)
+            os.Exit(1)
+        }
+    }
+
     go func() {
         for {
-            conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", clientHost, clientPort))
+            conn, err := dialServer(tlsConfig)
             if err != nil {
+                // 证书校验失败时拒绝继续，稍后重试
+                if tlsConfig != nil {
+                    fmt.Printf("连接服务端失败: %v\n", err)
+                }
                 time.Sleep(3 * time.Second)
                 continue
             }
 
+            enc := protocol.NewEncoder(conn)
+            dec := protocol.NewDecoder(conn)
+
+            // 握手，被拒绝时等待更长时间再重试，避免频繁重连
+            version, err := handshake(conn, enc, dec)
+            if err != nil {
+                fmt.Printf("握手失败: %v\n", err)
+                conn.Close()
+                time.Sleep(30 * time.Second)
+                continue
+            }
+
             // 发送系统信息
-            sendSystemInfo(conn)
+            if err := sendSystemInfo(enc, version); err != nil {
+                fmt.Printf("发送系统信息失败: %v\n", err)
+                conn.Close()
+                continue
+            }
 
             done := make(chan struct{})
             go func() {
-                receiveMessages(conn)
+                receiveMessages(dec, enc)
                 close(done)
             }()
 
             <-done
+            conn.Close()
         }
     }()
 
     select {}
 }
 
-func sendSystemInfo(conn net.Conn) {
-    writer := bufio.NewWriter(conn)
-    systemInfo := getSystemInfo()
-    fmt.Fprintf(writer, "SYSTEM_INFO:\n%s\n", systemInfo)
-    writer.Flush()
+// 客户端支持的能力
+var clientCapabilities = []string{protocol.CapExec}
+
+func removeCapability(caps []string, name string) []string {
+    result := make([]string, 0, len(caps))
+    for _, c := range caps {
+        if c != name {
+            result = append(result, c)
+        }
+    }
+    return result
 }
 
-func getSystemInfo() string {
-    var buffer bytes.Buffer
-    writer := tabwriter.NewWriter(&buffer, 0, 8, 2, ' ', 0)
+// handshake 发送握手并等待服务端应答，返回协商后的协议版本
+func handshake(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder) (int, error) {
+    hello := protocol.Hello{
+        ProtocolVersion:    protocol.ProtocolVersion,
+        MinProtocolVersion: protocol.MinProtocolVersion,
+        BuildVersion:       protocol.BuildVersion,
+        OS:                 runtime.GOOS,
+        Arch:               runtime.GOARCH,
+        Capabilities:       clientCapabilities,
+        NodeID:             nodeID,
+        EnrollToken:        enrollToken,
+        NodeSecret:         nodeSecret,
+        Labels:             nodeLabels,
+    }
+    if err := enc.EncodeJSON(protocol.TypeHello, hello); err != nil {
+        return 0, err
+    }
+
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    defer conn.SetReadDeadline(time.Time{})
+
+    frame, err := dec.Decode()
+    if err != nil {
+        return 0, err
+    }
+    switch frame.Type {
+    case protocol.TypeHello:
+    case protocol.TypeError:
+        return 0, fmt.Errorf("服务端拒绝连接: %s", frame.Payload)
+    default:
+        return 0, fmt.Errorf("服务端返回了意外的帧: %s", frame.Type)
+    }
+
+    var reply protocol.HelloReply
+    if err := frame.Unmarshal(&reply); err != nil {
+        return 0, err
+    }
+    if !reply.Accepted {
+        return 0, fmt.Errorf("服务端拒绝连接: %s", reply.Reason)
+    }
+    fmt.Printf("已连接服务端 (版本: %s, 协议: v%d, 能力: %s)\n",
+        reply.BuildVersion, reply.ProtocolVersion, strings.Join(reply.Capabilities, ","))
+    if reply.NodeSecret != "" {
+        // 本次运行期间即使保存失败也使用新的密钥，否则重连时无法证明身份
+        nodeSecret = reply.NodeSecret
+        path := nodeSecretFile(nodeIDFile)
+        if err := saveNodeSecret(path, nodeSecret); err != nil {
+            log.Printf("保存节点密钥失败，重启后需要在服务端使用 rekey 重新颁发: %v", err)
+        } else {
+            fmt.Printf("收到服务端颁发的节点密钥，已保存到 %s\n", path)
+        }
+    }
+    if reply.Pending {
+        fmt.Println("本节点等待服务端审批，审批通过前不会收到命令")
+    }
+    return reply.ProtocolVersion, nil
+}
+
+// sendSystemInfo 按协商的协议版本发送系统信息，旧版本的服务端只接受文本
+func sendSystemInfo(enc *protocol.Encoder, version int) error {
+    inv := collectInventory()
+    if version < protocol.InventoryJSONVersion {
+        return enc.Encode(protocol.TypeInventory, []byte(strings.Join(inv.Lines(), "\n")+"\n"))
+    }
+    return enc.EncodeJSON(protocol.TypeInventory, inv)
+}
+
+// collectInventory 采集系统信息，某一项采集失败时记录到 Errors 中，不影响其他项
+func collectInventory() *protocol.Inventory {
+    inv := &protocol.Inventory{
+        SchemaVersion: protocol.InventorySchemaVersion,
+        CollectedAt:   time.Now(),
+    }
+    addError := func(format string, args ...interface{}) {
+        inv.Errors = append(inv.Errors, fmt.Sprintf(format, args...))
+    }
+
+    if hostname, err := os.Hostname(); err == nil {
+        inv.Hostname = hostname
+    }
 
     // 获取 CPU 信息
     cpuInfo, err := cpu.Info()
-    if err != nil {
-        fmt.Fprintf(writer, "Error getting CPU info: %v\n", err)
+    if err != nil || len(cpuInfo) == 0 {
+        addError("Error getting CPU info: %v", err)
     } else {
         physicalCPUs := getPhysicalCPUCount()
         logicalCPUs := runtime.NumCPU()
@@ -101,90 +309,105 @@ func getSystemInfo() string {
             coresPerCPU = totalCores / physicalCPUs
         }
 
-        cpuDetails := fmt.Sprintf("Model: %s | Physical CPUs: %d | Logical CPUs: %d | Cores per CPU: %d | Total Cores: %d | Total Threads: %d | Frequency: %.2fGHz",
-            cpuInfo[0].ModelName, physicalCPUs, logicalCPUs, coresPerCPU, totalCores, totalThreads, cpuInfo[0].Mhz/1000)
-        fmt.Fprintf(writer, "CPU | %s\n", cpuDetails)
+        inv.CPU = protocol.CPUInfo{
+            Model:        cpuInfo[0].ModelName,
+            PhysicalCPUs: physicalCPUs,
+            LogicalCPUs:  logicalCPUs,
+            CoresPerCPU:  coresPerCPU,
+            TotalCores:   totalCores,
+            TotalThreads: totalThreads,
+            FrequencyGHz: cpuInfo[0].Mhz / 1000,
+        }
     }
 
     // 获取内存信息
     memInfo, err := mem.VirtualMemory()
     if err != nil {
-        fmt.Fprintf(writer, "Error getting memory info: %v\n", err)
+        addError("Error getting memory info: %v", err)
     } else {
-        fmt.Fprintf(writer, "Memory | %dMB\n", memInfo.Total/1024/1024)
+        inv.Memory.TotalMB = memInfo.Total / 1024 / 1024
     }
 
     // 获取磁盘信息
     diskInfo, err := disk.Usage("/")
     if err != nil {
-        fmt.Fprintf(writer, "Error getting disk info: %v\n", err)
+        addError("Error getting disk info: %v", err)
     } else {
-        fmt.Fprintf(writer, "Disk | %dGB\n", diskInfo.Total/1024/1024/1024)
+        inv.RootDisk = protocol.DiskUsage{Path: diskInfo.Path, TotalGB: diskInfo.Total / 1024 / 1024 / 1024}
     }
 
     // 获取产品信息
     product, err := ghw.Product()
     if err != nil {
-        fmt.Fprintf(writer, "Error getting product info: %v\n", err)
+        addError("Error getting product info: %v", err)
     } else {
-        fmt.Fprintf(writer, "Product | Family: %s | Name: %s | Serial Number: %s | UUID: %s | SKU: %s | Vendor: %s | Version: %s\n",
-            product.Family, product.Name, product.SerialNumber, product.UUID, product.SKU, product.Vendor, product.Version)
+        inv.Product = protocol.ProductInfo{
+            Family:       product.Family,
+            Name:         product.Name,
+            SerialNumber: product.SerialNumber,
+            UUID:         product.UUID,
+            SKU:          product.SKU,
+            Vendor:       product.Vendor,
+            Version:      product.Version,
+        }
     }
 
     // 获取磁盘类型信息
     blockInfo, err := ghw.Block()
     if err != nil {
-        fmt.Fprintf(writer, "Error getting block device info: %v\n", err)
+        addError("Error getting block device info: %v", err)
     } else {
-        var diskTypes []string
         for _, disk := range blockInfo.Disks {
             if strings.HasPrefix(disk.Name, "dm-") || strings.HasPrefix(disk.Name, "nvme0c0n1") {
                 continue
             }
-            name := disk.Name
-            driveType := disk.DriveType.String()
-            size := disk.SizeBytes / 1024 / 1024 / 1024
-
-            diskInfo := fmt.Sprintf("Name: %s | Type: %s | Size: %dGB", name, driveType, size)
-            diskTypes = append(diskTypes, diskInfo)
+            inv.Disks = append(inv.Disks, protocol.BlockDisk{
+                Name:   disk.Name,
+                Type:   disk.DriveType.String(),
+                SizeGB: disk.SizeBytes / 1024 / 1024 / 1024,
+            })
         }
-        fmt.Fprintf(writer, "Disk Types | %s\n", strings.Join(diskTypes, "\n"))
     }
 
     // 获取 RAID 信息
-    raidDetails := getRaidInfo()
-    fmt.Fprintf(writer, "RAID Info | %s\n", raidDetails)
+    raidInfo, err := getRaidInfo()
+    if err != nil {
+        addError("Error getting RAID info: %v", err)
+    }
+    inv.RAID = raidInfo
 
     // 获取网络接口信息
-    networkInterfaces := getNetworkInterfaces()
-    fmt.Fprintf(writer, "Network Interfaces | %s\n", strings.Join(networkInterfaces, "\n"))
+    networkInterfaces, err := getNetworkInterfaces()
+    if err != nil {
+        addError("Error getting network interfaces: %v", err)
+    }
+    inv.NetworkInterfaces = networkInterfaces
 
-    writer.Flush()
-    return buffer.String()
+    return inv
 }
 
-
-
-
-func getNetworkInterfaces() []string {
+func getNetworkInterfaces() ([]protocol.NetworkInterface, error) {
     interfaces, err := ghwNet.Interfaces()
     if err != nil {
-        fmt.Printf("Error getting network interfaces: %v", err)
+        return nil, err
     }
 
-    networkInfo := make([]string, 0)
+    networkInfo := make([]protocol.NetworkInterface, 0)
     for _, iface := range interfaces {
         if iface.HardwareAddr != "" {
             ipAddresses := make([]string, 0)
             for _, addr := range iface.Addrs {
                 ipAddresses = append(ipAddresses, addr.Addr)
             }
-            netInfo := fmt.Sprintf("Name: %s MAC: %s IPs: [%s]", iface.Name, iface.HardwareAddr, strings.Join(ipAddresses, " "))
-            networkInfo = append(networkInfo, netInfo)
+            networkInfo = append(networkInfo, protocol.NetworkInterface{
+                Name: iface.Name,
+                MAC:  iface.HardwareAddr,
+                IPs:  ipAddresses,
+            })
         }
     }
 
-    return networkInfo
+    return networkInfo, nil
 }
 
 
@@ -237,52 +460,44 @@ func getPhysicalCPUCount() int {
         // 对于其他操作系统,返回逻辑 CPU 数量
         return runtime.NumCPU()
     }
-    return 0
 }
 
 // 通过执行系统命令获取 RAID 信息
-func getRaidInfo() string {
+func getRaidInfo() ([]protocol.StorageController, error) {
     if runtime.GOOS == "windows" {
-        return "RAID information not available on Windows"
+        return nil, fmt.Errorf("RAID information not available on Windows")
     } else {
         out, err := exec.Command("lshw", "-class", "storage").Output()
         if err != nil {
-            return fmt.Sprintf("Error getting RAID info: %v", err)
+            return nil, err
         }
 
         lines := strings.Split(string(out), "\n")
-        raidInfo := make([]string, 0)
-        var currentType, description, product, vendor, driver string
+        raidInfo := make([]protocol.StorageController, 0)
+        var current *protocol.StorageController
 
         for _, line := range lines {
             line = strings.TrimSpace(line)
             if strings.HasPrefix(line, "*-") {
-                if currentType != "" {
-                    raidInfo = append(raidInfo, fmt.Sprintf("%s, %s, %s, %s, %s", currentType, description, product, vendor, driver))
-                }
-                currentType = strings.TrimPrefix(line, "*-")
-                description, product, vendor, driver = "", "", "", ""
+                raidInfo = append(raidInfo, protocol.StorageController{Class: strings.TrimPrefix(line, "*-")})
+                current = &raidInfo[len(raidInfo)-1]
+            } else if current == nil {
+                continue
             } else if strings.HasPrefix(line, "description:") {
-                description = strings.TrimPrefix(line, "description: ")
+                current.Description = strings.TrimPrefix(line, "description: ")
             } else if strings.HasPrefix(line, "product:") {
-                product = strings.TrimPrefix(line, "product: ")
+                current.Product = strings.TrimPrefix(line, "product: ")
             } else if strings.HasPrefix(line, "vendor:") {
-                vendor = strings.TrimPrefix(line, "vendor: ")
+                current.Vendor = strings.TrimPrefix(line, "vendor: ")
             } else if strings.HasPrefix(line, "configuration: driver=") {
-                driver = strings.TrimPrefix(line, "configuration: driver=")
+                // 只保留驱动名，去掉后面的 latency= 等配置项
+                if fields := strings.Fields(strings.TrimPrefix(line, "configuration: driver=")); len(fields) > 0 {
+                    current.Driver = fields[0]
+                }
             }
         }
 
-        // 处理最后一个条目
-        if currentType != "" {
-            raidInfo = append(raidInfo, fmt.Sprintf("%s, %s, %s, %s, %s", currentType, description, product, vendor, driver))
-        }
-
-        if len(raidInfo) == 0 {
-            return "No RAID information available"
-        }
-
-        return strings.Join(raidInfo, "; ")
+        return raidInfo, nil
     }
 }
 
@@ -305,86 +520,212 @@ func getMacAddresses() []string {
 
 
 
-func receiveMessages(conn net.Conn) {
-    reader := bufio.NewReader(conn)
-    writer := bufio.NewWriter(conn)
-
+func receiveMessages(dec *protocol.Decoder, enc *protocol.Encoder) {
     for {
-        message, err := reader.ReadString('\n')
+        frame, err := dec.Decode()
         if err != nil {
             fmt.Printf("接收消息错误: %v\n", err)
             return
         }
-        message = strings.TrimSpace(message)
-        if message == "exit" {
-            fmt.Println("接收到退出命令，退出交互模式但不关闭连接")
-            continue
-        }
-        if message == "PING" {
-            fmt.Fprintf(writer, "PONG\n")
-            writer.Flush()
-            continue
+        switch frame.Type {
+        case protocol.TypePing:
+            enc.Encode(protocol.TypePong, nil)
+        case protocol.TypeExecRequest:
+            var req protocol.ExecRequest
+            if err := frame.Unmarshal(&req); err != nil {
+                enc.EncodeRequest(protocol.TypeError, frame.ID, []byte(err.Error()))
+                continue
+            }
+            fmt.Printf("收到命令 [%d]: %s\n", frame.ID, req.Command)
+            if err := verifyRequest(protocol.SignKindExec, req.SignedBody(), req.Signature); err != nil {
+                sendPolicyDenied(enc, frame.ID, err)
+                continue
+            }
+            // 在读取下一帧之前登记，紧随其后的取消请求不会因为命令尚未启动而被忽略
+            rc := trackCommand(frame.ID, interruptProcessGroup)
+            go executeCommandAndStreamOutput(frame.ID, rc, req, enc)
+        case protocol.TypeCancel:
+            fmt.Printf("取消命令 [%d]\n", frame.ID)
+            cancelCommand(frame.ID)
+        case protocol.TypePTYOpen:
+            var req protocol.PTYRequest
+            if err := frame.Unmarshal(&req); err != nil {
+                enc.EncodeRequest(protocol.TypeError, frame.ID, []byte(err.Error()))
+                continue
+            }
+            fmt.Printf("打开交互式终端 [%d]\n", frame.ID)
+            if err := verifyRequest(protocol.SignKindPTY, req.SignedBody(), req.Signature); err != nil {
+                sendPolicyDenied(enc, frame.ID, err)
+                continue
+            }
+            // pty.Start 使用 Setsid 创建新会话，shell 即进程组组长，取消时挂断整个进程组
+            rc := trackCommand(frame.ID, hangupProcessGroup)
+            go runPTYSession(frame.ID, rc, req, enc)
+        case protocol.TypePTYData:
+            writePTY(frame.ID, frame.Payload)
+        case protocol.TypePTYResize:
+            var size protocol.WindowSize
+            if err := frame.Unmarshal(&size); err == nil {
+                resizePTY(frame.ID, size)
+            }
+        default:
+            fmt.Printf("忽略未知消息类型: %s\n", frame.Type)
         }
-        fmt.Printf("收到命令: %s\n", message)
-        go executeCommandAndStreamOutput(message, writer)
     }
 }
 
-func executeCommandAndStreamOutput(command string, writer *bufio.Writer) {
-    fmt.Fprintf(writer, "SERVERANDCLIENTSTB\n")
-    writer.Flush()
+// 取消命令时，发送 SIGINT 后等待这么久仍未退出则强制结束
+const cancelGracePeriod = 3 * time.Second
 
-    var cmd *exec.Cmd
-    if runtime.GOOS == "windows" {
-        cmd = exec.Command("cmd.exe", "/c", command)
-    } else {
-        cmd = exec.Command("bash", "-c", command)
-    }
+// errCanceledBeforeStart 命令在启动之前已被取消，不再启动
+var errCanceledBeforeStart = errors.New("命令在启动之前已被取消")
 
-    stdout, err := cmd.StdoutPipe()
-    if err != nil {
-        fmt.Fprintf(writer, "创建StdoutPipe失败: %v\n<SERVERANDCLIENTEOF>\n", err)
-        writer.Flush()
-        return
+// 正在执行的命令或终端会话，收到请求时即登记，启动之前收到的取消也会生效
+type runningCommand struct {
+    mu        sync.Mutex
+    cmd       *exec.Cmd             // 启动之后才设置，由 mu 保护
+    interrupt func(*exec.Cmd) error // 取消时首先调用，宽限期后再强制结束
+    done      chan struct{}         // 命令结束后关闭
+    canceled  atomic.Bool
+}
+
+// start 调用 startFn 启动命令 cmd；启动之前已被取消时不再启动，返回 errCanceledBeforeStart
+func (rc *runningCommand) start(cmd *exec.Cmd, startFn func() error) error {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    if rc.canceled.Load() {
+        return errCanceledBeforeStart
     }
-    defer stdout.Close()
+    if err := startFn(); err != nil {
+        return err
+    }
+    rc.cmd = cmd
+    return nil
+}
 
-    stderr, err := cmd.StderrPipe()
-    if err != nil {
-        fmt.Fprintf(writer, "创建StderrPipe失败: %v\n<SERVERANDCLIENTEOF>\n", err)
-        writer.Flush()
+var (
+    running   = make(map[uint32]*runningCommand) // 按请求ID索引
+    runningMu sync.Mutex
+)
+
+// trackCommand 登记收到的请求，使其在启动前后都可以被取消，请求结束时需调用 untrackCommand
+func trackCommand(id uint32, interrupt func(*exec.Cmd) error) *runningCommand {
+    rc := &runningCommand{interrupt: interrupt, done: make(chan struct{})}
+    runningMu.Lock()
+    running[id] = rc
+    runningMu.Unlock()
+    return rc
+}
+
+// untrackCommand 命令结束后移除登记
+func untrackCommand(id uint32, rc *runningCommand) {
+    runningMu.Lock()
+    delete(running, id)
+    runningMu.Unlock()
+    close(rc.done)
+}
+
+// cancelCommand 先中断命令所在的进程组，超过宽限期仍未退出则强制结束；命令尚未启动时不再启动
+func cancelCommand(id uint32) {
+    runningMu.Lock()
+    rc, ok := running[id]
+    runningMu.Unlock()
+    if !ok {
         return
     }
-    defer stderr.Close()
 
-    if err := cmd.Start(); err != nil {
-        fmt.Fprintf(writer, "命令启动失败: %v\n<SERVERANDCLIENTEOF>\n", err)
-        writer.Flush()
+    rc.mu.Lock()
+    rc.canceled.Store(true)
+    cmd := rc.cmd
+    rc.mu.Unlock()
+    if cmd == nil {
         return
     }
-
-    var wg sync.WaitGroup
-    wg.Add(2)
-
+    if err := rc.interrupt(cmd); err != nil {
+        log.Printf("中断命令 [%d] 失败: %v", id, err)
+    }
     go func() {
-        defer wg.Done()
-        io.Copy(writer, stdout)
-        writer.Flush()
+        select {
+        case <-rc.done:
+        case <-time.After(cancelGracePeriod):
+            if err := killProcessGroup(cmd); err != nil {
+                log.Printf("结束命令 [%d] 失败: %v", id, err)
+            }
+        }
     }()
+}
 
-    go func() {
-        defer wg.Done()
-        io.Copy(writer, stderr)
-        writer.Flush()
-    }()
+func executeCommandAndStreamOutput(id uint32, rc *runningCommand, req protocol.ExecRequest, enc *protocol.Encoder) {
+    defer untrackCommand(id, rc)
+    if err := policy.check(req.Command); err != nil {
+        sendPolicyDenied(enc, id, err)
+        return
+    }
 
-    wg.Wait()
+    var cmd *exec.Cmd
+    if runtime.GOOS == "windows" {
+        cmd = exec.Command("cmd.exe", "/c", req.Command)
+    } else {
+        cmd = exec.Command("bash", "-c", req.Command)
+    }
+    setProcessGroup(cmd)
+    if err := policy.apply(cmd); err != nil {
+        enc.EncodeRequest(protocol.TypeError, id, []byte(fmt.Sprintf("命令启动失败: %v", err)))
+        return
+    }
+    // 进程被结束后，最多再等待这么久让输出管道关闭，避免脱离进程组的子进程拖住 Wait
+    cmd.WaitDelay = 5 * time.Second
+
+    // stdout 和 stderr 分别以不同类型的帧发送
+    cmd.Stdout = protocol.NewChunkWriter(enc, protocol.TypeStdout, id)
+    cmd.Stderr = protocol.NewChunkWriter(enc, protocol.TypeStderr, id)
+
+    startedAt := time.Now()
+    if err := rc.start(cmd, cmd.Start); err == errCanceledBeforeStart {
+        enc.EncodeRequestJSON(protocol.TypeExitStatus, id, protocol.ExitStatus{
+            ExitCode:   -1,
+            StartedAt:  startedAt,
+            FinishedAt: startedAt,
+            Canceled:   true,
+            Error:      "命令已被服务端取消",
+        })
+        return
+    } else if err != nil {
+        enc.EncodeRequest(protocol.TypeError, id, []byte(fmt.Sprintf("命令启动失败: %v", err)))
+        return
+    }
 
-    err = cmd.Wait()
-    if err != nil {
-        fmt.Fprintf(writer, "命令执行失败: %v\n", err)
+    var timedOut atomic.Bool
+    timeout := policy.timeout(req.Timeout())
+    if timeout > 0 {
+        timer := time.AfterFunc(timeout, func() {
+            timedOut.Store(true)
+            if err := killProcessGroup(cmd); err != nil {
+                log.Printf("结束超时命令 [%d] 失败: %v", id, err)
+            }
+        })
+        defer timer.Stop()
     }
 
-    fmt.Fprintf(writer, "<SERVERANDCLIENTEOF>\n")
-    writer.Flush()
+    err := cmd.Wait()
+    finishedAt := time.Now()
+
+    status := protocol.ExitStatus{
+        ExitCode:   cmd.ProcessState.ExitCode(),
+        StartedAt:  startedAt,
+        FinishedAt: finishedAt,
+        DurationMs: finishedAt.Sub(startedAt).Milliseconds(),
+    }
+    if timedOut.Load() {
+        status.TimedOut = true
+        status.Error = fmt.Sprintf("命令执行超时 (%s)，已结束进程组", timeout)
+    } else if rc.canceled.Load() {
+        status.Canceled = true
+        status.Error = "命令已被服务端取消"
+    } else if err != nil {
+        if _, ok := err.(*exec.ExitError); !ok {
+            status.Error = fmt.Sprintf("命令执行失败: %v", err)
+        }
+    }
+    enc.EncodeRequestJSON(protocol.TypeExitStatus, id, status)
 }
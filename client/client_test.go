@@ -0,0 +1,89 @@
+//go:build !windows
+
+package client
+
+import (
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// readExitStatus 读取请求 id 的 exit-status，忽略输出帧
+func readExitStatus(t *testing.T, dec *protocol.Decoder, id uint32) protocol.ExitStatus {
+    t.Helper()
+    for {
+        frame, err := dec.Decode()
+        if err != nil {
+            t.Fatalf("读取应答失败: %v", err)
+        }
+        if frame.ID != id {
+            continue
+        }
+        switch frame.Type {
+        case protocol.TypeExitStatus:
+            var status protocol.ExitStatus
+            if err := frame.Unmarshal(&status); err != nil {
+                t.Fatal(err)
+            }
+            return status
+        case protocol.TypeError:
+            t.Fatalf("命令 [%d] 出错: %s", id, frame.Payload)
+        }
+    }
+}
+
+func TestCancelBeforeStart(t *testing.T) {
+    server, conn := net.Pipe()
+    defer server.Close()
+    defer conn.Close()
+    enc := protocol.NewEncoder(conn)
+    marker := filepath.Join(t.TempDir(), "marker")
+
+    // 取消在命令启动之前到达，命令不再启动
+    rc := trackCommand(1, interruptProcessGroup)
+    cancelCommand(1)
+    go executeCommandAndStreamOutput(1, rc, protocol.ExecRequest{Command: "touch " + marker}, enc)
+
+    status := readExitStatus(t, protocol.NewDecoder(server), 1)
+    if !status.Canceled {
+        t.Errorf("exit-status 为 %+v，应标记为已取消", status)
+    }
+    if _, err := os.Stat(marker); !os.IsNotExist(err) {
+        t.Error("启动之前被取消的命令不应执行")
+    }
+    <-rc.done
+    runningMu.Lock()
+    defer runningMu.Unlock()
+    if _, ok := running[1]; ok {
+        t.Error("命令结束后应移除登记")
+    }
+}
+
+func TestCancelImmediatelyAfterExec(t *testing.T) {
+    server, conn := net.Pipe()
+    defer server.Close()
+    defer conn.Close()
+    go receiveMessages(protocol.NewDecoder(conn), protocol.NewEncoder(conn))
+
+    // 取消紧跟在命令之后发送，此时命令多半尚未启动
+    enc := protocol.NewEncoder(server)
+    if err := enc.EncodeRequestJSON(protocol.TypeExecRequest, 7, protocol.ExecRequest{Command: "sleep 30"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := enc.EncodeRequest(protocol.TypeCancel, 7, nil); err != nil {
+        t.Fatal(err)
+    }
+
+    start := time.Now()
+    status := readExitStatus(t, protocol.NewDecoder(server), 7)
+    if !status.Canceled {
+        t.Errorf("exit-status 为 %+v，应标记为已取消", status)
+    }
+    if elapsed := time.Since(start); elapsed > cancelGracePeriod+2*time.Second {
+        t.Errorf("取消后 %s 才结束，取消请求没有生效", elapsed)
+    }
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+    "crypto/rand"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/jaypipes/ghw"
+)
+
+// 主板厂商未填写时常见的无效 UUID
+var invalidProductUUIDs = map[string]bool{
+    "":                                     true,
+    "unknown":                              true,
+    "00000000-0000-0000-0000-000000000000": true,
+    "ffffffff-ffff-ffff-ffff-ffffffffffff": true,
+    "03000200-0400-0500-0006-000700080009": true,
+}
+
+// defaultNodeIDFile 返回节点ID文件的默认路径
+func defaultNodeIDFile() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        dir = "."
+    }
+    return filepath.Join(dir, "serverandclient", "node-id")
+}
+
+// loadNodeID 读取持久化的节点ID。文件不存在时优先使用主板 UUID，
+// 没有有效 UUID 时随机生成，并写入文件，保证重连和重启后不变
+func loadNodeID(path string) (string, error) {
+    data, err := os.ReadFile(path)
+    if err == nil {
+        if id := strings.TrimSpace(string(data)); id != "" {
+            restrictPermissions(path)
+            return id, nil
+        }
+    } else if !os.IsNotExist(err) {
+        return "", err
+    }
+
+    id := productUUID()
+    if id == "" {
+        if id, err = randomUUID(); err != nil {
+            return "", err
+        }
+    }
+
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return "", err
+    }
+    if err := os.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+        return "", err
+    }
+    return id, nil
+}
+
+// restrictPermissions 把旧版本以 0644 创建的文件改为只有所有者可读写
+func restrictPermissions(path string) {
+    if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+        os.Chmod(path, 0600)
+    }
+}
+
+// nodeSecretFile 返回保存节点密钥的文件，与节点ID文件放在一起
+func nodeSecretFile(idFile string) string {
+    return idFile + ".secret"
+}
+
+// loadNodeSecret 读取服务端颁发的节点密钥，尚未颁发时返回空字符串
+func loadNodeSecret(path string) (string, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return "", nil
+    }
+    if err != nil {
+        return "", err
+    }
+    restrictPermissions(path)
+    return strings.TrimSpace(string(data)), nil
+}
+
+// saveNodeSecret 保存服务端颁发的节点密钥，只有所有者可读写。先写入临时文件再改名，
+// 避免写到一半时退出而丢失原有的密钥
+func saveNodeSecret(path, secret string) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, []byte(secret+"\n"), 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// productUUID 返回主板 UUID，无效时返回空字符串
+func productUUID() string {
+    product, err := ghw.Product()
+    if err != nil {
+        return ""
+    }
+    id := strings.ToLower(strings.TrimSpace(product.UUID))
+    if invalidProductUUIDs[id] {
+        return ""
+    }
+    return id
+}
+
+// randomUUID 生成随机的 UUID v4
+func randomUUID() (string, error) {
+    var b [16]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", err
+    }
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
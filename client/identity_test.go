@@ -0,0 +1,59 @@
+package client
+
+import (
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+)
+
+func TestNodeIDFilePermissions(t *testing.T) {
+    if runtime.GOOS == "windows" {
+        t.Skip("Windows 不使用 Unix 权限位")
+    }
+    dir := t.TempDir()
+    path := filepath.Join(dir, "conf", "node-id")
+    id, err := loadNodeID(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again, err := loadNodeID(path); err != nil || again != id {
+        t.Errorf("再次读取的节点ID为 %q (%v)，应为 %q", again, err, id)
+    }
+    if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+        t.Errorf("节点ID文件的权限为 %v (%v)，应为 0600", fi.Mode().Perm(), err)
+    }
+
+    // 旧版本创建的文件读取时改为 0600
+    old := filepath.Join(dir, "old-node-id")
+    if err := os.WriteFile(old, []byte("old-id\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if id, err := loadNodeID(old); err != nil || id != "old-id" {
+        t.Fatalf("读取旧的节点ID为 %q (%v)", id, err)
+    }
+    if fi, _ := os.Stat(old); fi.Mode().Perm() != 0600 {
+        t.Errorf("旧的节点ID文件的权限为 %v，应改为 0600", fi.Mode().Perm())
+    }
+}
+
+func TestNodeSecretFile(t *testing.T) {
+    path := nodeSecretFile(filepath.Join(t.TempDir(), "node-id"))
+    if secret, err := loadNodeSecret(path); err != nil || secret != "" {
+        t.Fatalf("尚未颁发时读取到 %q (%v)", secret, err)
+    }
+    if err := saveNodeSecret(path, "s3cret"); err != nil {
+        t.Fatal(err)
+    }
+    if err := saveNodeSecret(path, "s3cret-2"); err != nil {
+        t.Fatal(err)
+    }
+    if secret, err := loadNodeSecret(path); err != nil || secret != "s3cret-2" {
+        t.Errorf("读取到 %q (%v)，应为最后保存的密钥", secret, err)
+    }
+    if runtime.GOOS != "windows" {
+        if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+            t.Errorf("节点密钥文件的权限为 %v (%v)，应为 0600", fi.Mode().Perm(), err)
+        }
+    }
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+
+    "serverandclient/protocol"
+)
+
+// 本节点声明的标签，握手时发送给服务端。服务端设置的同名标签优先
+var (
+    nodeLabels = labelFlag{}
+    labelsFile string
+)
+
+// labelFlag 可以重复指定的 -label key=value
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+    pairs := make([]string, 0, len(l))
+    for k, v := range l {
+        pairs = append(pairs, k+"="+v)
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ",")
+}
+
+func (l labelFlag) Set(s string) error {
+    key, value, ok := strings.Cut(s, "=")
+    if !ok {
+        return fmt.Errorf("标签格式应为 key=value: %s", s)
+    }
+    key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+    if err := protocol.ValidateLabel(key, value); err != nil {
+        return err
+    }
+    l[key] = value
+    return nil
+}
+
+// loadLabelsFile 读取标签文件，每行一个 key=value，# 之后为注释。
+// 命令行的 -label 优先于文件中的同名标签
+func loadLabelsFile(path string, labels labelFlag) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("读取标签文件失败: %v", err)
+    }
+    defer f.Close()
+
+    fromFile := labelFlag{}
+    scanner := bufio.NewScanner(f)
+    for n := 1; scanner.Scan(); n++ {
+        line := scanner.Text()
+        if i := strings.Index(line, "#"); i >= 0 {
+            line = line[:i]
+        }
+        if line = strings.TrimSpace(line); line == "" {
+            continue
+        }
+        if err := fromFile.Set(line); err != nil {
+            return fmt.Errorf("标签文件 %s 第 %d 行: %v", path, n, err)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("读取标签文件失败: %v", err)
+    }
+    for k, v := range fromFile {
+        if _, ok := labels[k]; !ok {
+            labels[k] = v
+        }
+    }
+    return nil
+}
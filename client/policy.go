@@ -0,0 +1,189 @@
+package client
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "os/user"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// execPolicy 客户端的命令执行策略，在执行服务端发来的命令之前检查。
+// 策略文件为 JSON，例如:
+//
+//	{
+//	  "allow_executables": ["uptime", "df", "free"],
+//	  "allow_patterns": ["^systemctl status [a-z0-9@._-]+$"],
+//	  "deny_patterns": ["\\brm\\b"],
+//	  "run_as": "nobody",
+//	  "max_runtime": "5m"
+//	}
+type execPolicy struct {
+    DisableExec      bool     `json:"disable_exec"`      // 拒绝所有命令和交互式终端
+    AllowExecutables []string `json:"allow_executables"` // 允许的可执行文件 (命令的第一个词)
+    AllowPatterns    []string `json:"allow_patterns"`    // 允许的命令正则，匹配整条命令
+    DenyPatterns     []string `json:"deny_patterns"`     // 拒绝的命令正则，优先于允许规则
+    RunAs            string   `json:"run_as"`            // 以该用户身份执行，需要客户端以 root 运行
+    MaxRuntime       string   `json:"max_runtime"`       // 最长执行时间，例如 "5m"，服务端的超时更短时以服务端为准
+    AllowPTY         *bool    `json:"allow_pty"`         // 是否允许交互式终端，默认只在没有允许/拒绝规则时允许
+
+    allow      []*regexp.Regexp
+    deny       []*regexp.Regexp
+    maxRuntime time.Duration
+    runAs      *user.User
+}
+
+// 客户端的执行策略，未指定 -policy 时为 nil，不做任何限制
+var policy *execPolicy
+
+// 只允许可执行文件时，命令中出现这些字符会被拒绝，避免通过 shell 串联其他命令
+const shellMetaChars = ";&|`$()<>^%\r\n"
+
+// loadPolicy 读取并校验策略文件
+func loadPolicy(path string) (*execPolicy, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取执行策略失败: %v", err)
+    }
+    p := &execPolicy{}
+    if err := json.Unmarshal(data, p); err != nil {
+        return nil, fmt.Errorf("解析执行策略失败: %v", err)
+    }
+
+    for _, pattern := range p.AllowPatterns {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("allow_patterns 中的正则无效: %v", err)
+        }
+        p.allow = append(p.allow, re)
+    }
+    for _, pattern := range p.DenyPatterns {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("deny_patterns 中的正则无效: %v", err)
+        }
+        p.deny = append(p.deny, re)
+    }
+    if p.MaxRuntime != "" {
+        if p.maxRuntime, err = time.ParseDuration(p.MaxRuntime); err != nil || p.maxRuntime <= 0 {
+            return nil, fmt.Errorf("max_runtime 格式错误: %s", p.MaxRuntime)
+        }
+    }
+    if p.RunAs != "" {
+        if p.runAs, err = user.Lookup(p.RunAs); err != nil {
+            return nil, fmt.Errorf("run_as 用户无效: %v", err)
+        }
+    }
+    return p, nil
+}
+
+// check 判断是否允许执行命令，返回的错误即拒绝原因
+func (p *execPolicy) check(command string) error {
+    if p == nil {
+        return nil
+    }
+    if p.DisableExec {
+        return errors.New("本节点禁止执行远程命令")
+    }
+    for _, re := range p.deny {
+        if re.MatchString(command) {
+            return fmt.Errorf("命令匹配拒绝规则 %s", re)
+        }
+    }
+    if len(p.AllowExecutables) == 0 && len(p.allow) == 0 {
+        return nil
+    }
+
+    for _, re := range p.allow {
+        if re.MatchString(command) {
+            return nil
+        }
+    }
+    if len(p.AllowExecutables) > 0 && !strings.ContainsAny(command, shellMetaChars) {
+        if fields := strings.Fields(command); len(fields) > 0 && p.executableAllowed(fields[0]) {
+            return nil
+        }
+    }
+    return errors.New("命令不在允许列表中")
+}
+
+// executableAllowed 不含路径的规则只匹配同样不含路径 (从 PATH 查找) 的命令，
+// 避免 /tmp/cat 之类的文件冒充 cat
+func (p *execPolicy) executableAllowed(name string) bool {
+    for _, allowed := range p.AllowExecutables {
+        if strings.ContainsAny(allowed, `/\`) {
+            if filepath.Clean(name) == filepath.Clean(allowed) {
+                return true
+            }
+        } else if name == allowed {
+            return true
+        }
+    }
+    return false
+}
+
+// ptyAllowed 交互式终端无法逐条检查命令，只有策略明确允许或没有任何允许/拒绝规则时才允许
+func (p *execPolicy) ptyAllowed() bool {
+    if p == nil {
+        return true
+    }
+    if p.DisableExec {
+        return false
+    }
+    if p.AllowPTY != nil {
+        return *p.AllowPTY
+    }
+    return len(p.AllowExecutables) == 0 && len(p.allow) == 0 && len(p.deny) == 0
+}
+
+// timeout 返回服务端要求的超时与策略最长执行时间中较短的一个，0 表示不限制
+func (p *execPolicy) timeout(requested time.Duration) time.Duration {
+    if p == nil || p.maxRuntime == 0 {
+        return requested
+    }
+    if requested == 0 || requested > p.maxRuntime {
+        return p.maxRuntime
+    }
+    return requested
+}
+
+// runAsUser 返回策略指定的运行身份，没有指定时为 nil (客户端自身的用户)
+func (p *execPolicy) runAsUser() *user.User {
+    if p == nil {
+        return nil
+    }
+    return p.runAs
+}
+
+// apply 按策略设置命令的运行身份、环境变量和工作目录 (该用户的主目录)，需要在 setProcessGroup 之后调用
+func (p *execPolicy) apply(cmd *exec.Cmd) error {
+    if p == nil || p.runAs == nil {
+        return nil
+    }
+    if err := setCredential(cmd, p.runAs); err != nil {
+        return err
+    }
+    cmd.Env = append(os.Environ(), "HOME="+p.runAs.HomeDir, "USER="+p.runAs.Username, "LOGNAME="+p.runAs.Username)
+    cmd.Dir = p.runAs.HomeDir
+    return nil
+}
+
+// sendPolicyDenied 向服务端报告请求被执行策略拒绝
+func sendPolicyDenied(enc *protocol.Encoder, id uint32, reason error) {
+    fmt.Printf("执行策略拒绝请求 [%d]: %v\n", id, reason)
+    now := time.Now()
+    enc.EncodeRequestJSON(protocol.TypeExitStatus, id, protocol.ExitStatus{
+        ExitCode:     -1,
+        StartedAt:    now,
+        FinishedAt:   now,
+        PolicyDenied: true,
+        Error:        reason.Error(),
+    })
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// writePolicy 把策略写入临时文件并读取
+func writePolicy(t *testing.T, content string) (*execPolicy, error) {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "policy.json")
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return loadPolicy(path)
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+    for _, content := range []string{
+        `{`,
+        `{"allow_patterns": ["("]}`,
+        `{"deny_patterns": ["[a-"]}`,
+        `{"max_runtime": "5 minutes"}`,
+        `{"max_runtime": "-1s"}`,
+        `{"run_as": "no-such-user-for-policy-test"}`,
+    } {
+        if _, err := writePolicy(t, content); err == nil {
+            t.Errorf("策略 %s 应读取失败", content)
+        }
+    }
+}
+
+func TestPolicyCheck(t *testing.T) {
+    p, err := writePolicy(t, `{
+        "allow_executables": ["uptime", "df", "/usr/bin/free"],
+        "allow_patterns": ["^systemctl status [a-z0-9@._-]+$"],
+        "deny_patterns": ["\\brm\\b", "^df -i"]
+    }`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        command string
+        allowed bool
+    }{
+        {"uptime", true},
+        {"df -h /", true},
+        {"  uptime  ", true},
+        {"/usr/bin/free -m", true},
+        {"/usr/bin/../bin/free", true},
+        {"free", false},           // 规则带路径，只匹配同一路径
+        {"/tmp/uptime", false},    // 规则不带路径，不匹配带路径的命令
+        {"./uptime", false},
+        {"systemctl status sshd", true},
+        {"systemctl status sshd; reboot", false},
+        {"systemctl restart sshd", false},
+        {"df -i", false},          // 拒绝规则优先
+        {"uptime; rm -rf /", false},
+        {"ls", false},
+        {"", false},
+    }
+    // 只允许可执行文件时，命令中的 shell 元字符都会被拒绝
+    for _, c := range shellMetaChars {
+        tests = append(tests, struct {
+            command string
+            allowed bool
+        }{"uptime " + string(c) + " reboot", false})
+    }
+    for _, tt := range tests {
+        err := p.check(tt.command)
+        if (err == nil) != tt.allowed {
+            t.Errorf("check(%q) = %v，应允许: %v", tt.command, err, tt.allowed)
+        }
+    }
+}
+
+func TestPolicyCheckOpen(t *testing.T) {
+    var none *execPolicy
+    if err := none.check("rm -rf /"); err != nil {
+        t.Errorf("没有策略时应允许所有命令: %v", err)
+    }
+
+    p, err := writePolicy(t, `{"deny_patterns": ["\\breboot\\b"]}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := p.check("uptime; ls | wc -l"); err != nil {
+        t.Errorf("只有拒绝规则时，其他命令 (包括 shell 元字符) 应允许: %v", err)
+    }
+    if err := p.check("sudo reboot"); err == nil {
+        t.Error("匹配拒绝规则的命令应被拒绝")
+    }
+
+    p, err = writePolicy(t, `{"disable_exec": true}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := p.check("uptime"); err == nil {
+        t.Error("disable_exec 时应拒绝所有命令")
+    }
+}
+
+func TestPolicyPTYAllowed(t *testing.T) {
+    tests := []struct {
+        content string
+        allowed bool
+    }{
+        {`{}`, true},
+        {`{"max_runtime": "1m"}`, true},
+        {`{"disable_exec": true}`, false},
+        {`{"disable_exec": true, "allow_pty": true}`, false},
+        {`{"allow_executables": ["uptime"]}`, false},
+        {`{"deny_patterns": ["rm"]}`, false},
+        {`{"deny_patterns": ["rm"], "allow_pty": true}`, true},
+        {`{"allow_pty": false}`, false},
+    }
+    for _, tt := range tests {
+        p, err := writePolicy(t, tt.content)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := p.ptyAllowed(); got != tt.allowed {
+            t.Errorf("策略 %s 的 ptyAllowed() = %v，应为 %v", tt.content, got, tt.allowed)
+        }
+    }
+}
+
+func TestPolicyTimeout(t *testing.T) {
+    var none *execPolicy
+    if got := none.timeout(time.Minute); got != time.Minute {
+        t.Errorf("没有策略时 timeout(1m) = %s", got)
+    }
+
+    p, err := writePolicy(t, `{"max_runtime": "5m"}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        requested, want time.Duration
+    }{
+        {0, 5 * time.Minute}, // 不限制时使用策略的最长执行时间，终端会话也是如此
+        {time.Minute, time.Minute},
+        {time.Hour, 5 * time.Minute},
+    }
+    for _, tt := range tests {
+        if got := p.timeout(tt.requested); got != tt.want {
+            t.Errorf("timeout(%s) = %s，应为 %s", tt.requested, got, tt.want)
+        }
+    }
+}
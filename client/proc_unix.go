@@ -0,0 +1,51 @@
+//go:build !windows
+
+package client
+
+import (
+    "os/exec"
+    "os/user"
+    "strconv"
+    "syscall"
+)
+
+// setProcessGroup 让命令在独立的进程组中运行，以便连同子进程一起结束
+func setProcessGroup(cmd *exec.Cmd) {
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup 强制结束命令所在的整个进程组
+func killProcessGroup(cmd *exec.Cmd) error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// interruptProcessGroup 向命令所在的进程组发送 SIGINT，相当于在终端按下 Ctrl-C
+func interruptProcessGroup(cmd *exec.Cmd) error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
+
+// setCredential 让命令以用户 u 的身份 (包括附加组) 运行
+func setCredential(cmd *exec.Cmd, u *user.User) error {
+    uid, err := strconv.ParseUint(u.Uid, 10, 32)
+    if err != nil {
+        return err
+    }
+    gid, err := strconv.ParseUint(u.Gid, 10, 32)
+    if err != nil {
+        return err
+    }
+    var groups []uint32
+    if ids, err := u.GroupIds(); err == nil {
+        for _, id := range ids {
+            if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+                groups = append(groups, uint32(g))
+            }
+        }
+    }
+
+    if cmd.SysProcAttr == nil {
+        cmd.SysProcAttr = &syscall.SysProcAttr{}
+    }
+    cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+    return nil
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package client
+
+import (
+    "errors"
+    "os/exec"
+    "os/user"
+    "strconv"
+    "syscall"
+)
+
+// setProcessGroup 让命令在独立的进程组中运行，以便连同子进程一起结束
+func setProcessGroup(cmd *exec.Cmd) {
+    cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup 强制结束命令及其所有子进程
+func killProcessGroup(cmd *exec.Cmd) error {
+    return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// interruptProcessGroup Windows 上无法向其他进程组发送 Ctrl-C，直接强制结束
+func interruptProcessGroup(cmd *exec.Cmd) error {
+    return killProcessGroup(cmd)
+}
+
+// setCredential Windows 客户端不支持切换运行身份
+func setCredential(cmd *exec.Cmd, u *user.User) error {
+    return errors.New("Windows 客户端不支持 run_as")
+}
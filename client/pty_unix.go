@@ -0,0 +1,188 @@
+//go:build !windows
+
+package client
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "os/exec"
+    "os/user"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "github.com/creack/pty"
+    "serverandclient/protocol"
+)
+
+func init() {
+    clientCapabilities = append(clientCapabilities, protocol.CapPTY)
+}
+
+var (
+    ptySessions   = make(map[uint32]*os.File) // 按请求ID索引的终端主设备
+    ptySessionsMu sync.Mutex
+)
+
+// runPTYSession 在伪终端中启动登录 shell (策略指定 run_as 时为该用户的)，并把输出转发给服务端，
+// shell 退出或超过策略的最长执行时间后发送 exit-status
+func runPTYSession(id uint32, rc *runningCommand, req protocol.PTYRequest, enc *protocol.Encoder) {
+    defer untrackCommand(id, rc)
+    if !policy.ptyAllowed() {
+        sendPolicyDenied(enc, id, errors.New("本节点的执行策略不允许交互式终端"))
+        return
+    }
+
+    runAs := policy.runAsUser()
+    shell := loginShell(runAs)
+    cmd := exec.Command(shell, "-l")
+    // 指定 run_as 时 apply 把工作目录设为该用户的主目录
+    if err := policy.apply(cmd); err != nil {
+        enc.EncodeRequest(protocol.TypeError, id, []byte(fmt.Sprintf("启动终端失败: %v", err)))
+        return
+    }
+    if runAs == nil {
+        if home, err := os.UserHomeDir(); err == nil {
+            cmd.Dir = home
+        }
+    }
+    if cmd.Env == nil {
+        cmd.Env = os.Environ()
+    }
+    cmd.Env = append(cmd.Env, "TERM="+req.Term, "SHELL="+shell)
+
+    startedAt := time.Now()
+    var ptmx *os.File
+    err := rc.start(cmd, func() (err error) {
+        ptmx, err = pty.StartWithSize(cmd, &pty.Winsize{Rows: req.Rows, Cols: req.Cols})
+        return err
+    })
+    if err == errCanceledBeforeStart {
+        enc.EncodeRequestJSON(protocol.TypeExitStatus, id, protocol.ExitStatus{
+            ExitCode:   -1,
+            StartedAt:  startedAt,
+            FinishedAt: startedAt,
+            Canceled:   true,
+        })
+        return
+    } else if err != nil {
+        enc.EncodeRequest(protocol.TypeError, id, []byte(fmt.Sprintf("启动终端失败: %v", err)))
+        return
+    }
+    defer ptmx.Close()
+
+    ptySessionsMu.Lock()
+    ptySessions[id] = ptmx
+    ptySessionsMu.Unlock()
+    defer func() {
+        ptySessionsMu.Lock()
+        delete(ptySessions, id)
+        ptySessionsMu.Unlock()
+    }()
+
+    // 终端会话同样受策略的最长执行时间限制
+    var timedOut atomic.Bool
+    timeout := policy.timeout(0)
+    if timeout > 0 {
+        timer := time.AfterFunc(timeout, func() {
+            timedOut.Store(true)
+            if err := killProcessGroup(cmd); err != nil {
+                log.Printf("结束超时的终端会话 [%d] 失败: %v", id, err)
+            }
+        })
+        defer timer.Stop()
+    }
+
+    copied := make(chan struct{})
+    go func() {
+        io.Copy(protocol.NewChunkWriter(enc, protocol.TypePTYData, id), ptmx)
+        close(copied)
+    }()
+
+    err = cmd.Wait()
+    finishedAt := time.Now()
+
+    // 等待剩余输出发送完毕；后台进程仍占用终端时不再等待
+    select {
+    case <-copied:
+    case <-time.After(time.Second):
+    }
+
+    status := protocol.ExitStatus{
+        ExitCode:   cmd.ProcessState.ExitCode(),
+        StartedAt:  startedAt,
+        FinishedAt: finishedAt,
+        DurationMs: finishedAt.Sub(startedAt).Milliseconds(),
+        Canceled:   rc.canceled.Load(),
+    }
+    if timedOut.Load() {
+        status.TimedOut = true
+        status.Error = fmt.Sprintf("终端会话超过最长执行时间 (%s)，已结束进程组", timeout)
+    } else if err != nil {
+        if _, ok := err.(*exec.ExitError); !ok {
+            status.Error = fmt.Sprintf("终端会话异常结束: %v", err)
+        }
+    }
+    enc.EncodeRequestJSON(protocol.TypeExitStatus, id, status)
+}
+
+func writePTY(id uint32, data []byte) {
+    ptySessionsMu.Lock()
+    ptmx, ok := ptySessions[id]
+    ptySessionsMu.Unlock()
+    if ok {
+        ptmx.Write(data)
+    }
+}
+
+func resizePTY(id uint32, size protocol.WindowSize) {
+    ptySessionsMu.Lock()
+    ptmx, ok := ptySessions[id]
+    ptySessionsMu.Unlock()
+    if ok {
+        pty.Setsize(ptmx, &pty.Winsize{Rows: size.Rows, Cols: size.Cols})
+    }
+}
+
+// hangupProcessGroup 向终端会话的进程组发送 SIGHUP，相当于关闭终端
+func hangupProcessGroup(cmd *exec.Cmd) error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+}
+
+// loginShell 返回用户 u 的登录 shell，u 为 nil 时为当前用户。当前用户优先使用 $SHELL，
+// 其他用户的 $SHELL 不可知，只查 /etc/passwd，都没有时为 /bin/sh
+func loginShell(u *user.User) string {
+    uid := strconv.Itoa(os.Getuid())
+    if u != nil {
+        uid = u.Uid
+    } else if shell := os.Getenv("SHELL"); shell != "" {
+        return shell
+    }
+
+    if f, err := os.Open("/etc/passwd"); err == nil {
+        defer f.Close()
+        if shell := passwdShell(f, uid); shell != "" {
+            return shell
+        }
+    }
+    return "/bin/sh"
+}
+
+// passwdShell 在 passwd 格式的内容中查找 uid 的登录 shell，没有时返回空字符串
+func passwdShell(r io.Reader, uid string) string {
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        fields := strings.Split(scanner.Text(), ":")
+        if len(fields) == 7 && fields[2] == uid && fields[6] != "" {
+            return fields[6]
+        }
+    }
+    return ""
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package client
+
+import (
+    "os/user"
+    "strings"
+    "testing"
+)
+
+func TestPasswdShell(t *testing.T) {
+    passwd := strings.Join([]string{
+        "root:x:0:0:root:/root:/bin/bash",
+        "nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin",
+        "alice:x:1000:1000::/home/alice:",
+        "broken line",
+    }, "\n")
+    tests := map[string]string{
+        "0":     "/bin/bash",
+        "65534": "/usr/sbin/nologin",
+        "1000":  "", // 没有填写 shell
+        "1001":  "",
+    }
+    for uid, want := range tests {
+        if got := passwdShell(strings.NewReader(passwd), uid); got != want {
+            t.Errorf("passwdShell(%s) = %q，应为 %q", uid, got, want)
+        }
+    }
+}
+
+func TestLoginShellRunAs(t *testing.T) {
+    // 指定的用户不使用客户端自身的 $SHELL
+    t.Setenv("SHELL", "/bin/agent-shell")
+    if got := loginShell(nil); got != "/bin/agent-shell" {
+        t.Errorf("当前用户的 shell 为 %q，应使用 $SHELL", got)
+    }
+    u := &user.User{Uid: "4294967294", Username: "no-such-user"}
+    if got := loginShell(u); got != "/bin/sh" {
+        t.Errorf("不在 /etc/passwd 中的用户的 shell 为 %q，应为 /bin/sh", got)
+    }
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package client
+
+import (
+    "os/exec"
+
+    "serverandclient/protocol"
+)
+
+// Windows 客户端不声明 CapPTY 能力，服务端不会发起终端会话
+func runPTYSession(id uint32, rc *runningCommand, req protocol.PTYRequest, enc *protocol.Encoder) {
+    untrackCommand(id, rc)
+    enc.EncodeRequest(protocol.TypeError, id, []byte("Windows 客户端不支持交互式终端"))
+}
+
+func writePTY(id uint32, data []byte) {}
+
+func resizePTY(id uint32, size protocol.WindowSize) {}
+
+// hangupProcessGroup 没有终端会话可挂断，直接强制结束
+func hangupProcessGroup(cmd *exec.Cmd) error {
+    return killProcessGroup(cmd)
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    useTLS         bool
+    tlsCAFile      string
+    tlsServerName  string
+    tlsFingerprint string
+    tlsCertFile    string
+    tlsKeyFile     string
+)
+
+// tlsEnabled 指定了任一 TLS 相关参数时使用 TLS 连接
+func tlsEnabled() bool {
+    return useTLS || tlsCAFile != "" || tlsFingerprint != "" || tlsCertFile != "" || tlsKeyFile != ""
+}
+
+// loadTLSConfig 根据命令行参数构造客户端的 TLS 配置。指定 CA 时只信任该 CA，
+// 否则使用系统根证书；指定指纹时服务端证书的 SHA-256 指纹必须一致，
+// 只指定指纹时允许服务端使用自签名证书。指定证书和私钥时向服务端出示
+// 本节点的客户端证书
+func loadTLSConfig() (*tls.Config, error) {
+    config := &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        ServerName: tlsServerName,
+    }
+    if config.ServerName == "" {
+        config.ServerName = clientHost
+    }
+
+    if tlsCertFile != "" || tlsKeyFile != "" {
+        if tlsCertFile == "" || tlsKeyFile == "" {
+            return nil, errors.New("-cert 和 -key 需要同时指定")
+        }
+        cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("读取客户端证书失败: %v", err)
+        }
+        config.Certificates = []tls.Certificate{cert}
+    }
+
+    if tlsCAFile != "" {
+        pem, err := os.ReadFile(tlsCAFile)
+        if err != nil {
+            return nil, fmt.Errorf("读取 CA 证书失败: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("CA 证书文件 %s 中没有有效的证书", tlsCAFile)
+        }
+        config.RootCAs = pool
+    }
+
+    if tlsFingerprint != "" {
+        pin, err := parseFingerprint(tlsFingerprint)
+        if err != nil {
+            return nil, err
+        }
+        if tlsCAFile == "" {
+            // 只校验指纹: 跳过证书链校验，由 VerifyPeerCertificate 比较指纹
+            config.InsecureSkipVerify = true
+        }
+        config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+            if len(rawCerts) == 0 {
+                return errors.New("服务端没有提供证书")
+            }
+            sum := sha256.Sum256(rawCerts[0])
+            if string(sum[:]) != string(pin) {
+                return fmt.Errorf("服务端证书指纹不匹配: %s", hex.EncodeToString(sum[:]))
+            }
+            return nil
+        }
+    }
+    return config, nil
+}
+
+// parseFingerprint 解析十六进制的 SHA-256 指纹，允许使用冒号分隔
+func parseFingerprint(s string) ([]byte, error) {
+    pin, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+    if err != nil || len(pin) != sha256.Size {
+        return nil, fmt.Errorf("证书指纹应为 64 位十六进制的 SHA-256 值: %s", s)
+    }
+    return pin, nil
+}
+
+// dialServer 连接服务端，tlsConfig 不为 nil 时完成 TLS 握手和证书校验
+func dialServer(tlsConfig *tls.Config) (net.Conn, error) {
+    addr := net.JoinHostPort(clientHost, strconv.Itoa(clientPort))
+    dialer := &net.Dialer{Timeout: 10 * time.Second}
+    if tlsConfig == nil {
+        return dialer.Dial("tcp", addr)
+    }
+    return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
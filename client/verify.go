@@ -0,0 +1,142 @@
+package client
+
+import (
+    "crypto/ed25519"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+var (
+    trustedKeysFile string
+    maxClockSkew    time.Duration
+    maxSignatureTTL time.Duration
+    trustedKeys     map[string]ed25519.PublicKey // 未指定 -trusted-keys 时为 nil，不要求签名
+    nonceFile       string                       // 保存已使用的随机数，为空时只保存在内存中
+)
+
+// 已使用过的随机数及其失效时间 (签名时间加 maxClockSkew，带有效期的签名为过期时间加 maxClockSkew)。
+// 超过失效时间的请求直接因过期被拒绝，所以只需要记住仍然有效的签名的随机数。
+// 随机数同时保存到 nonceFile，客户端重启后仍能发现重放
+var (
+    seenNonces   = make(map[string]time.Time)
+    seenNoncesMu sync.Mutex
+)
+
+// nonceFileFor 返回保存随机数的文件，与节点ID文件放在一起
+func nonceFileFor(idFile string) string {
+    return idFile + ".nonces"
+}
+
+// verifyRequest 在执行请求之前校验操作员的签名、时间戳和随机数，
+// 拒绝未签名、签名无效、时间偏差过大、已过期和重放的请求
+func verifyRequest(kind, body string, sig *protocol.Signature) error {
+    if trustedKeys == nil {
+        return nil
+    }
+    if err := checkSignature(kind, body, sig, time.Now()); err != nil {
+        return fmt.Errorf("请求签名校验失败: %v", err)
+    }
+    return nil
+}
+
+// checkSignature 按本机时间 now 校验签名。没有有效期的签名只在签名时间前后 maxClockSkew 内有效；
+// 带有效期的签名从签名时间到过期时间有效 (两端各放宽 maxClockSkew)，有效期不能超过 maxSignatureTTL
+func checkSignature(kind, body string, sig *protocol.Signature, now time.Time) error {
+    if err := protocol.VerifySignature(trustedKeys, kind, nodeID, body, sig); err != nil {
+        return err
+    }
+
+    signedAt := sig.Time()
+    if signedAt.After(now.Add(maxClockSkew)) {
+        return fmt.Errorf("签名时间 %s 晚于本机时间，超出允许的偏差 (%s)",
+            signedAt.Format("2006-01-02 15:04:05"), maxClockSkew)
+    }
+    validUntil := signedAt.Add(maxClockSkew)
+    expires := sig.ExpiresAt()
+    if !expires.IsZero() {
+        if expires.Before(signedAt) {
+            return errors.New("签名的过期时间早于签名时间")
+        }
+        if ttl := expires.Sub(signedAt); maxSignatureTTL > 0 && ttl > maxSignatureTTL {
+            return fmt.Errorf("签名的有效期 %s 超过允许的 %s", ttl.Round(time.Second), maxSignatureTTL)
+        }
+        validUntil = expires.Add(maxClockSkew)
+    }
+    if now.After(validUntil) {
+        if expires.IsZero() {
+            return fmt.Errorf("签名时间 %s 超出允许的偏差 (%s)",
+                signedAt.Format("2006-01-02 15:04:05"), maxClockSkew)
+        }
+        return fmt.Errorf("签名已于 %s 过期", expires.Format("2006-01-02 15:04:05"))
+    }
+
+    seenNoncesMu.Lock()
+    defer seenNoncesMu.Unlock()
+    for nonce, until := range seenNonces {
+        if now.After(until) {
+            delete(seenNonces, nonce)
+        }
+    }
+    if _, ok := seenNonces[sig.Nonce]; ok {
+        return fmt.Errorf("随机数 %s 已使用过，疑似重放", sig.Nonce)
+    }
+    seenNonces[sig.Nonce] = validUntil
+    if nonceFile != "" {
+        // 无法保存时拒绝执行，否则重启后同一个签名可以再次使用
+        if err := saveSeenNoncesLocked(nonceFile); err != nil {
+            return fmt.Errorf("保存已使用的随机数失败: %v", err)
+        }
+    }
+    return nil
+}
+
+// loadSeenNonces 读取之前保存的随机数，丢弃已失效的，文件不存在时不报错
+func loadSeenNonces(path string) error {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    var saved map[string]int64
+    if err := json.Unmarshal(data, &saved); err != nil {
+        return fmt.Errorf("解析 %s 失败: %v", path, err)
+    }
+    now := time.Now()
+    seenNoncesMu.Lock()
+    defer seenNoncesMu.Unlock()
+    for nonce, ms := range saved {
+        if until := time.UnixMilli(ms); until.After(now) {
+            seenNonces[nonce] = until
+        }
+    }
+    return nil
+}
+
+// saveSeenNoncesLocked 保存仍然有效的随机数，先写入临时文件再改名，调用者需持有 seenNoncesMu
+func saveSeenNoncesLocked(path string) error {
+    saved := make(map[string]int64, len(seenNonces))
+    for nonce, until := range seenNonces {
+        saved[nonce] = until.UnixMilli()
+    }
+    data, err := json.Marshal(saved)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// withTrustedKey 在测试期间信任一个新生成的密钥，并清空已使用的随机数
+func withTrustedKey(t *testing.T) protocol.KeySigner {
+    t.Helper()
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key := protocol.KeySigner(priv)
+    savedKeys, savedNode, savedSkew, savedTTL, savedFile := trustedKeys, nodeID, maxClockSkew, maxSignatureTTL, nonceFile
+    trustedKeys = map[string]ed25519.PublicKey{protocol.KeyID(key.Public()): key.Public()}
+    nodeID, maxClockSkew, maxSignatureTTL, nonceFile = "node-a", 5*time.Minute, 24*time.Hour, ""
+    seenNoncesMu.Lock()
+    seenNonces = make(map[string]time.Time)
+    seenNoncesMu.Unlock()
+    t.Cleanup(func() {
+        trustedKeys, nodeID, maxClockSkew, maxSignatureTTL, nonceFile = savedKeys, savedNode, savedSkew, savedTTL, savedFile
+    })
+    return key
+}
+
+func TestCheckSignature(t *testing.T) {
+    key := withTrustedKey(t)
+    now := time.Now()
+    tests := []struct {
+        name    string
+        expires time.Duration // 相对签名时间，0 表示没有有效期
+        at      time.Duration // 校验时相对签名时间的偏移
+        want    string        // 为空表示应通过
+    }{
+        {name: "立即执行"},
+        {name: "时间偏差内", at: 4 * time.Minute},
+        {name: "签名时间略晚于本机", at: -4 * time.Minute},
+        {name: "超出时间偏差", at: 6 * time.Minute, want: "超出允许的偏差"},
+        {name: "签名时间在未来", at: -6 * time.Minute, want: "晚于本机时间"},
+        {name: "有效期内", expires: 2 * time.Hour, at: time.Hour},
+        {name: "过期后的偏差内", expires: 2 * time.Hour, at: 2*time.Hour + 4*time.Minute},
+        {name: "已过期", expires: 2 * time.Hour, at: 3 * time.Hour, want: "过期"},
+        {name: "有效期过长", expires: 48 * time.Hour, want: "超过允许的"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var expires time.Time
+            if tt.expires != 0 {
+                expires = now.Add(tt.expires)
+            }
+            sig, err := protocol.Sign(key, protocol.SignKindExec, "node-a", "0\nuptime", expires)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = checkSignature(protocol.SignKindExec, "0\nuptime", sig, sig.Time().Add(tt.at))
+            if tt.want == "" && err != nil {
+                t.Errorf("应通过校验: %v", err)
+            }
+            if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+                t.Errorf("校验结果为 %v，应包含 %q", err, tt.want)
+            }
+        })
+    }
+
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", nil); err == nil {
+        t.Error("配置了可信公钥时，没有签名的请求应被拒绝")
+    }
+}
+
+func TestNonceReplay(t *testing.T) {
+    key := withTrustedKey(t)
+    sig, err := protocol.Sign(key, protocol.SignKindExec, "node-a", "0\nuptime", time.Time{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", sig); err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", sig); err == nil || !strings.Contains(err.Error(), "重放") {
+        t.Errorf("重放同一个签名的结果为 %v，应被拒绝", err)
+    }
+
+    // 随机数失效之后从内存中清除，签名本身也已经过期
+    later := sig.Time().Add(10 * time.Minute)
+    if err := checkSignature(protocol.SignKindExec, "0\nuptime", sig, later); err == nil || strings.Contains(err.Error(), "重放") {
+        t.Errorf("失效的签名的结果为 %v，应因过期被拒绝", err)
+    }
+}
+
+func TestNonceReplayAfterRestart(t *testing.T) {
+    key := withTrustedKey(t)
+    nonceFile = filepath.Join(t.TempDir(), "node-id.nonces")
+
+    // 排队命令的签名有效期较长，客户端重启之后仍应发现重放
+    long, err := protocol.Sign(key, protocol.SignKindExec, "node-a", "0\nuptime", time.Now().Add(time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", long); err != nil {
+        t.Fatal(err)
+    }
+
+    seenNoncesMu.Lock()
+    seenNonces = make(map[string]time.Time)
+    seenNoncesMu.Unlock()
+    if err := loadSeenNonces(nonceFile); err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", long); err == nil || !strings.Contains(err.Error(), "重放") {
+        t.Errorf("重启后重放的结果为 %v，应被拒绝", err)
+    }
+
+    // 没有有效期的签名在时间偏差内同样可能被重放，随机数也要保存
+    short, err := protocol.Sign(key, protocol.SignKindExec, "node-a", "0\nuptime", time.Time{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", short); err != nil {
+        t.Fatal(err)
+    }
+    seenNoncesMu.Lock()
+    seenNonces = make(map[string]time.Time)
+    seenNoncesMu.Unlock()
+    if err := loadSeenNonces(nonceFile); err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyRequest(protocol.SignKindExec, "0\nuptime", short); err == nil || !strings.Contains(err.Error(), "重放") {
+        t.Errorf("重启后重放没有有效期的签名的结果为 %v，应被拒绝", err)
+    }
+    seenNoncesMu.Lock()
+    until := seenNonces[short.Nonce]
+    seenNoncesMu.Unlock()
+    if want := short.Time().Add(maxClockSkew); !until.Equal(want) {
+        t.Errorf("随机数的失效时间为 %s，应为签名时间加 %s", until, maxClockSkew)
+    }
+
+    // 文件不存在时不报错
+    if err := loadSeenNonces(filepath.Join(t.TempDir(), "missing")); err != nil {
+        t.Errorf("文件不存在时: %v", err)
+    }
+}
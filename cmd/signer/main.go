@@ -0,0 +1,7 @@
+package main
+
+import "serverandclient/signer"
+
+func main() {
+    signer.Run()
+}
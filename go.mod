@@ -3,8 +3,12 @@ module serverandclient
 go 1.21.4
 
 require (
+	github.com/creack/pty v1.1.21
 	github.com/jaypipes/ghw v0.12.0
 	github.com/shirou/gopsutil v3.21.11+incompatible
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.24.0
+	golang.org/x/term v0.21.0
 )
 
 require (
@@ -12,6 +16,7 @@ require (
 	github.com/ghodss/yaml v1.0.0 // indirect
 	github.com/go-ole/go-ole v1.3.0 // indirect
 	github.com/jaypipes/pcidb v1.0.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/tklauser/go-sysconf v0.3.14 // indirect
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+    "crypto/ed25519"
+    "errors"
+    "fmt"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+)
+
+// AgentSigner 用 ssh-agent 中的 ed25519 密钥签名，私钥不离开 agent。
+// ed25519 的 SSH 签名就是原始的 ed25519 签名，客户端按相同的方式校验
+type AgentSigner struct {
+    agent agent.Agent
+    key   ssh.PublicKey
+    pub   ed25519.PublicKey
+}
+
+func (a *AgentSigner) Public() ed25519.PublicKey {
+    return a.pub
+}
+
+// Key 返回 agent 中对应的 SSH 公钥
+func (a *AgentSigner) Key() ssh.PublicKey {
+    return a.key
+}
+
+func (a *AgentSigner) SignPayload(payload []byte) ([]byte, error) {
+    sig, err := a.agent.Sign(a.key, payload)
+    if err != nil {
+        return nil, fmt.Errorf("ssh-agent 签名失败: %v", err)
+    }
+    if sig.Format != ssh.KeyAlgoED25519 || len(sig.Blob) != ed25519.SignatureSize {
+        return nil, fmt.Errorf("ssh-agent 返回了 %s 格式的签名", sig.Format)
+    }
+    return sig.Blob, nil
+}
+
+// AgentSigners 返回 agent 中所有 ed25519 密钥的签名者，按 agent 列出的顺序
+func AgentSigners(a agent.Agent) ([]*AgentSigner, error) {
+    keys, err := a.List()
+    if err != nil {
+        return nil, fmt.Errorf("读取 ssh-agent 中的密钥失败: %v", err)
+    }
+    var signers []*AgentSigner
+    for _, k := range keys {
+        key, err := ssh.ParsePublicKey(k.Marshal())
+        if err != nil {
+            continue
+        }
+        if pub, ok := SSHEd25519Key(key); ok {
+            signers = append(signers, &AgentSigner{agent: a, key: key, pub: pub})
+        }
+    }
+    if len(signers) == 0 {
+        return nil, errors.New("ssh-agent 中没有 ed25519 密钥")
+    }
+    return signers, nil
+}
+
+// SSHEd25519Key 取出 SSH 公钥中的 ed25519 公钥，其他类型的公钥返回 false
+func SSHEd25519Key(key ssh.PublicKey) (ed25519.PublicKey, bool) {
+    crypto, ok := key.(ssh.CryptoPublicKey)
+    if !ok {
+        return nil, false
+    }
+    pub, ok := crypto.CryptoPublicKey().(ed25519.PublicKey)
+    return pub, ok
+}
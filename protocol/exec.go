@@ -0,0 +1,35 @@
+package protocol
+
+import (
+    "time"
+)
+
+// ExecRequest exec-request 帧的负载，请求ID在帧中携带
+type ExecRequest struct {
+    Command   string     `json:"command"`
+    TimeoutMs int64      `json:"timeout_ms,omitempty"` // 超时时间，0 表示不限制
+    Signature *Signature `json:"signature,omitempty"`  // 操作员的签名，客户端配置了可信公钥时必需
+}
+
+func (r *ExecRequest) Timeout() time.Duration {
+    return time.Duration(r.TimeoutMs) * time.Millisecond
+}
+
+// ExitStatus exit-status 帧的负载，命令结束后由客户端发送
+type ExitStatus struct {
+    ExitCode     int       `json:"exit_code"`
+    StartedAt    time.Time `json:"started_at"`
+    FinishedAt   time.Time `json:"finished_at"`
+    DurationMs   int64     `json:"duration_ms"`
+    TimedOut     bool      `json:"timed_out,omitempty"`     // 超时后被强制结束
+    Canceled     bool      `json:"canceled,omitempty"`      // 被服务端取消
+    PolicyDenied bool      `json:"policy_denied,omitempty"` // 被客户端的执行策略拒绝，命令没有运行
+    Error        string    `json:"error,omitempty"`         // 非正常退出时的附加说明，策略拒绝时为拒绝原因
+}
+
+func (s *ExitStatus) Duration() time.Duration {
+    return time.Duration(s.DurationMs) * time.Millisecond
+}
+
+// CancelVersion 支持 cancel 帧的最低协议版本
+const CancelVersion = 3
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+    "fmt"
+    "strings"
+    "unicode"
+)
+
+// ProtocolVersion 当前实现的协议版本
+//
+//	v1: 初始分帧协议
+//	v2: 请求类帧携带请求ID，支持同一连接上并发执行多个命令
+//	v3: 新增 cancel 帧，服务端可以取消客户端上正在执行的命令
+//	v4: inventory 帧改为带结构版本的 JSON (Inventory)，不再是文本
+//	v5: 服务端在握手应答中为节点颁发节点密钥，节点之后的连接在 hello 中出示
+const ProtocolVersion = 5
+
+// NodeSecretVersion 支持节点密钥的最低协议版本，更早的客户端只能通过客户端证书证明身份
+const NodeSecretVersion = 5
+
+// MinProtocolVersion 仍然兼容的最低协议版本。v1 的请求类帧不带请求ID，分帧方式不同；
+// v2、v3 的对端不支持取消命令 (见 CancelVersion)，系统信息为文本 (见 InventoryJSONVersion)
+const MinProtocolVersion = 2
+
+// BuildVersion 程序的构建版本，发布时通过
+// -ldflags "-X serverandclient/protocol.BuildVersion=v1.2.3" 注入
+var BuildVersion = "dev"
+
+// 能力名称，握手时由双方声明
+const (
+    CapExec         = "exec"          // 远程执行命令
+    CapPTY          = "pty"           // 交互式终端
+    CapFileTransfer = "file-transfer" // 文件传输
+    CapMetrics      = "metrics"       // 指标采集
+)
+
+// Hello 客户端建立连接后发送的第一帧
+type Hello struct {
+    ProtocolVersion    int      `json:"protocol_version"`
+    MinProtocolVersion int      `json:"min_protocol_version"`
+    BuildVersion       string   `json:"build_version"`
+    OS                 string   `json:"os"`
+    Arch               string   `json:"arch"`
+    Capabilities       []string `json:"capabilities"`
+    NodeID             string   `json:"node_id,omitempty"`      // 客户端持久化的节点ID，重连后保持不变
+    EnrollToken        string   `json:"enroll_token,omitempty"` // 注册令牌，新节点出示有效令牌时自动批准
+    NodeSecret         string   `json:"node_secret,omitempty"`  // 服务端颁发的节点密钥，证明是同一个节点
+
+    Labels map[string]string `json:"labels,omitempty"` // 客户端通过 -label 或 -labels-file 声明的标签
+}
+
+// 标签值的最大长度
+const MaxLabelValue = 256
+
+// ValidateLabel 检查节点标签。键由字母、数字和 _ - . / 组成，以字母或数字开头；
+// 值不能为空，不能包含控制字符
+func ValidateLabel(key, value string) error {
+    if key == "" {
+        return fmt.Errorf("标签的键不能为空")
+    }
+    for i, r := range key {
+        if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || (i > 0 && strings.ContainsRune("_-./", r))) {
+            return fmt.Errorf("标签的键 %q 只能包含字母、数字和 _ - . /，并以字母或数字开头", key)
+        }
+    }
+    if value == "" {
+        return fmt.Errorf("标签 %s 的值不能为空", key)
+    }
+    if len(value) > MaxLabelValue {
+        return fmt.Errorf("标签 %s 的值超过 %d 字节", key, MaxLabelValue)
+    }
+    if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+        return fmt.Errorf("标签 %s 的值不能包含控制字符", key)
+    }
+    return nil
+}
+
+// HelloReply 服务端对握手的应答
+type HelloReply struct {
+    Accepted        bool     `json:"accepted"`
+    Reason          string   `json:"reason,omitempty"`
+    ProtocolVersion int      `json:"protocol_version"` // 协商后双方使用的版本
+    BuildVersion    string   `json:"build_version"`
+    Capabilities    []string `json:"capabilities"`      // 双方都支持的能力
+    Pending         bool     `json:"pending,omitempty"` // 节点等待服务端审批，审批通过前不会收到命令
+    NodeSecret      string   `json:"node_secret,omitempty"` // 新颁发的节点密钥，客户端需要保存并在之后的连接中出示
+}
+
+// Negotiate 根据本端支持的版本范围和能力处理对端的握手，
+// 对端版本较高但兼容时降级到本端版本，不兼容时拒绝并给出原因
+func Negotiate(h *Hello, minVersion, maxVersion int, supported []string) HelloReply {
+    reply := HelloReply{BuildVersion: BuildVersion}
+
+    peerMin := h.MinProtocolVersion
+    if peerMin == 0 {
+        peerMin = h.ProtocolVersion
+    }
+
+    version := h.ProtocolVersion
+    if version > maxVersion {
+        version = maxVersion
+    }
+    if version < minVersion || version < peerMin {
+        reply.Reason = fmt.Sprintf("协议版本不兼容: 对端支持 v%d-v%d, 本端支持 v%d-v%d",
+            peerMin, h.ProtocolVersion, minVersion, maxVersion)
+        return reply
+    }
+
+    reply.Accepted = true
+    reply.ProtocolVersion = version
+    reply.Capabilities = IntersectCapabilities(h.Capabilities, supported)
+    return reply
+}
+
+// IntersectCapabilities 返回两端都声明的能力，保持 a 中的顺序
+func IntersectCapabilities(a, b []string) []string {
+    set := make(map[string]bool, len(b))
+    for _, c := range b {
+        set[c] = true
+    }
+    result := make([]string, 0, len(a))
+    for _, c := range a {
+        if set[c] {
+            result = append(result, c)
+            delete(set, c)
+        }
+    }
+    return result
+}
+
+// HasCapability 判断能力列表中是否包含指定能力
+func HasCapability(caps []string, name string) bool {
+    for _, c := range caps {
+        if c == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestNegotiate(t *testing.T) {
+    supported := []string{CapExec, CapPTY}
+    tests := []struct {
+        name             string
+        peerMin, peerMax int
+        caps             []string
+        accepted         bool
+        version          int
+        wantCaps         []string
+    }{
+        {name: "相同版本", peerMin: 2, peerMax: ProtocolVersion, caps: []string{CapExec, CapPTY}, accepted: true, version: ProtocolVersion, wantCaps: []string{CapExec, CapPTY}},
+        {name: "对端较新但兼容", peerMin: 3, peerMax: ProtocolVersion + 2, caps: []string{CapMetrics, CapExec}, accepted: true, version: ProtocolVersion, wantCaps: []string{CapExec}},
+        {name: "对端较旧", peerMin: 0, peerMax: 3, caps: []string{CapExec}, accepted: true, version: 3, wantCaps: []string{CapExec}},
+        {name: "最低兼容版本", peerMin: 2, peerMax: 2, accepted: true, version: 2, wantCaps: []string{}},
+        {name: "对端过旧", peerMin: 0, peerMax: 1},
+        {name: "对端要求更新的版本", peerMin: ProtocolVersion + 1, peerMax: ProtocolVersion + 2},
+    }
+    for _, tt := range tests {
+        h := &Hello{ProtocolVersion: tt.peerMax, MinProtocolVersion: tt.peerMin, Capabilities: tt.caps}
+        reply := Negotiate(h, MinProtocolVersion, ProtocolVersion, supported)
+        if reply.Accepted != tt.accepted {
+            t.Errorf("%s: Accepted = %v (%s)，应为 %v", tt.name, reply.Accepted, reply.Reason, tt.accepted)
+            continue
+        }
+        if !tt.accepted {
+            if reply.Reason == "" {
+                t.Errorf("%s: 拒绝时应给出原因", tt.name)
+            }
+            continue
+        }
+        if reply.ProtocolVersion != tt.version || !reflect.DeepEqual(reply.Capabilities, tt.wantCaps) {
+            t.Errorf("%s: 协商结果为 v%d %v，应为 v%d %v", tt.name, reply.ProtocolVersion, reply.Capabilities, tt.version, tt.wantCaps)
+        }
+    }
+}
+
+func TestMinProtocolVersion(t *testing.T) {
+    // 仍然兼容的旧版本必须覆盖代码中按版本区分的行为，否则这些分支永远不会执行
+    for name, v := range map[string]int{"CancelVersion": CancelVersion, "InventoryJSONVersion": InventoryJSONVersion, "NodeSecretVersion": NodeSecretVersion} {
+        if v <= MinProtocolVersion || v > ProtocolVersion {
+            t.Errorf("%s = %d 应在 (%d, %d] 之间", name, v, MinProtocolVersion, ProtocolVersion)
+        }
+    }
+}
+
+func TestInventoryLines(t *testing.T) {
+    inv := &Inventory{Hostname: "web-01", Disks: []BlockDisk{{Name: "sda", Type: "SSD", SizeGB: 480}}, Errors: []string{"no lshw"}}
+    lines := inv.Lines()
+    if lines[0] != "Hostname: web-01" || lines[5] != "Disk Type | Name: sda | Type: SSD | Size: 480GB" || lines[len(lines)-1] != "Error | no lshw" {
+        t.Errorf("Lines() = %q", lines)
+    }
+
+    // 旧版本客户端上报的文本原样按行返回
+    text := &Inventory{Text: "CPU | Model: x\nMemory | 1024MB\n"}
+    if got := text.Lines(); !reflect.DeepEqual(got, []string{"CPU | Model: x", "Memory | 1024MB"}) {
+        t.Errorf("Lines() = %q", got)
+    }
+}
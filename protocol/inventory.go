@@ -0,0 +1,113 @@
+package protocol
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// InventorySchemaVersion 系统信息结构的版本，字段有不兼容的变化时递增
+const InventorySchemaVersion = 1
+
+// InventoryJSONVersion inventory 帧为 JSON 的最低协议版本，更早的版本为 Lines 格式的文本
+const InventoryJSONVersion = 4
+
+// Inventory inventory 帧的负载，客户端采集的系统信息
+type Inventory struct {
+    SchemaVersion     int                 `json:"schema_version"`
+    CollectedAt       time.Time           `json:"collected_at"`
+    Hostname          string              `json:"hostname"`
+    CPU               CPUInfo             `json:"cpu"`
+    Memory            MemoryInfo          `json:"memory"`
+    RootDisk          DiskUsage           `json:"root_disk"`
+    Product           ProductInfo         `json:"product"`
+    Disks             []BlockDisk         `json:"disks"`
+    RAID              []StorageController `json:"raid"`
+    NetworkInterfaces []NetworkInterface  `json:"network_interfaces"`
+    Errors            []string            `json:"errors,omitempty"` // 采集失败的项目及原因
+
+    Text string `json:"text,omitempty"` // v4 之前的客户端上报的文本，此时其他字段为空
+}
+
+// Lines 把系统信息渲染为文本行，v4 之前的协议直接以这种格式发送系统信息
+func (inv *Inventory) Lines() []string {
+    if inv.Text != "" {
+        return strings.Split(strings.TrimRight(inv.Text, "\n"), "\n")
+    }
+    p := inv.Product
+    lines := []string{
+        fmt.Sprintf("Hostname: %s", inv.Hostname),
+        fmt.Sprintf("CPU | Model: %s | Physical CPUs: %d | Logical CPUs: %d | Cores per CPU: %d | Total Cores: %d | Total Threads: %d | Frequency: %.2fGHz",
+            inv.CPU.Model, inv.CPU.PhysicalCPUs, inv.CPU.LogicalCPUs, inv.CPU.CoresPerCPU, inv.CPU.TotalCores, inv.CPU.TotalThreads, inv.CPU.FrequencyGHz),
+        fmt.Sprintf("Memory | %dMB", inv.Memory.TotalMB),
+        fmt.Sprintf("Disk | %s %dGB", inv.RootDisk.Path, inv.RootDisk.TotalGB),
+        fmt.Sprintf("Product | Family: %s | Name: %s | Serial Number: %s | UUID: %s | SKU: %s | Vendor: %s | Version: %s",
+            p.Family, p.Name, p.SerialNumber, p.UUID, p.SKU, p.Vendor, p.Version),
+    }
+    for _, d := range inv.Disks {
+        lines = append(lines, fmt.Sprintf("Disk Type | Name: %s | Type: %s | Size: %dGB", d.Name, d.Type, d.SizeGB))
+    }
+    for _, r := range inv.RAID {
+        lines = append(lines, fmt.Sprintf("Storage Controller | %s | %s | Product: %s | Vendor: %s | Driver: %s",
+            r.Class, r.Description, r.Product, r.Vendor, r.Driver))
+    }
+    for _, n := range inv.NetworkInterfaces {
+        lines = append(lines, fmt.Sprintf("Network Interface | Name: %s | MAC: %s | IPs: [%s]", n.Name, n.MAC, strings.Join(n.IPs, " ")))
+    }
+    for _, e := range inv.Errors {
+        lines = append(lines, "Error | "+e)
+    }
+    return lines
+}
+
+type CPUInfo struct {
+    Model        string  `json:"model"`
+    PhysicalCPUs int     `json:"physical_cpus"`
+    LogicalCPUs  int     `json:"logical_cpus"`
+    CoresPerCPU  int     `json:"cores_per_cpu"`
+    TotalCores   int     `json:"total_cores"`
+    TotalThreads int     `json:"total_threads"`
+    FrequencyGHz float64 `json:"frequency_ghz"`
+}
+
+type MemoryInfo struct {
+    TotalMB uint64 `json:"total_mb"`
+}
+
+// DiskUsage 文件系统容量
+type DiskUsage struct {
+    Path    string `json:"path"`
+    TotalGB uint64 `json:"total_gb"`
+}
+
+type ProductInfo struct {
+    Family       string `json:"family"`
+    Name         string `json:"name"`
+    SerialNumber string `json:"serial_number"`
+    UUID         string `json:"uuid"`
+    SKU          string `json:"sku"`
+    Vendor       string `json:"vendor"`
+    Version      string `json:"version"`
+}
+
+// BlockDisk 物理磁盘
+type BlockDisk struct {
+    Name   string `json:"name"`
+    Type   string `json:"type"` // HDD、SSD 等
+    SizeGB uint64 `json:"size_gb"`
+}
+
+// StorageController lshw 报告的存储控制器 (包括 RAID 卡)
+type StorageController struct {
+    Class       string `json:"class"`
+    Description string `json:"description"`
+    Product     string `json:"product"`
+    Vendor      string `json:"vendor"`
+    Driver      string `json:"driver"`
+}
+
+type NetworkInterface struct {
+    Name string   `json:"name"`
+    MAC  string   `json:"mac"`
+    IPs  []string `json:"ips"`
+}
@@ -0,0 +1,218 @@
+package protocol
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+)
+
+// FrameType 帧类型
+type FrameType uint8
+
+const (
+    TypeHello       FrameType = iota + 1 // 握手
+    TypeInventory                        // 系统信息
+    TypePing                             // 心跳请求
+    TypePong                             // 心跳应答
+    TypeExecRequest                      // 执行命令请求
+    TypeStdout                           // 标准输出片段
+    TypeStderr                           // 标准错误片段
+    TypeExitStatus                       // 命令退出状态
+    TypeError                            // 错误信息
+    TypeCancel                           // 取消正在执行的命令
+    TypePTYOpen                          // 打开交互式终端
+    TypePTYData                          // 终端输入/输出数据
+    TypePTYResize                        // 终端窗口大小变化
+)
+
+var frameTypeNames = map[FrameType]string{
+    TypeHello:       "hello",
+    TypeInventory:   "inventory",
+    TypePing:        "ping",
+    TypePong:        "pong",
+    TypeExecRequest: "exec-request",
+    TypeStdout:      "stdout-chunk",
+    TypeStderr:      "stderr-chunk",
+    TypeExitStatus:  "exit-status",
+    TypeError:       "error",
+    TypeCancel:      "cancel",
+    TypePTYOpen:     "pty-open",
+    TypePTYData:     "pty-data",
+    TypePTYResize:   "pty-resize",
+}
+
+// HasRequestID 判断该类型的帧是否属于某个请求。这类帧在负载前
+// 附带 4 字节大端序的请求ID，用于在同一连接上并发执行多个命令
+func (t FrameType) HasRequestID() bool {
+    switch t {
+    case TypeExecRequest, TypeStdout, TypeStderr, TypeExitStatus, TypeError, TypeCancel,
+        TypePTYOpen, TypePTYData, TypePTYResize:
+        return true
+    }
+    return false
+}
+
+func (t FrameType) String() string {
+    if name, ok := frameTypeNames[t]; ok {
+        return name
+    }
+    return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// 帧头: 1 字节类型 + 4 字节大端序负载长度
+const headerSize = 5
+
+// 请求类帧负载开头的请求ID长度
+const requestIDSize = 4
+
+// MaxPayloadSize 单帧负载的最大长度，超过则视为协议错误
+const MaxPayloadSize = 16 << 20
+
+var ErrFrameTooLarge = errors.New("帧负载超过上限")
+
+// Frame 一个完整的协议帧
+type Frame struct {
+    Type    FrameType
+    ID      uint32 // 请求ID，仅 HasRequestID 为真的类型有效，0 表示不属于任何请求
+    Payload []byte
+}
+
+// Encoder 将帧写入底层连接，可被多个 goroutine 并发使用
+type Encoder struct {
+    mu sync.Mutex
+    w  *bufio.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+    return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode 写入一帧并立即刷新
+func (e *Encoder) Encode(t FrameType, payload []byte) error {
+    return e.EncodeRequest(t, 0, payload)
+}
+
+// EncodeRequest 写入属于请求 id 的一帧并立即刷新
+func (e *Encoder) EncodeRequest(t FrameType, id uint32, payload []byte) error {
+    length := len(payload)
+    if t.HasRequestID() {
+        length += requestIDSize
+    }
+    if length > MaxPayloadSize {
+        return ErrFrameTooLarge
+    }
+
+    var header [headerSize + requestIDSize]byte
+    header[0] = byte(t)
+    binary.BigEndian.PutUint32(header[1:], uint32(length))
+    n := headerSize
+    if t.HasRequestID() {
+        binary.BigEndian.PutUint32(header[headerSize:], id)
+        n += requestIDSize
+    }
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    if _, err := e.w.Write(header[:n]); err != nil {
+        return err
+    }
+    if _, err := e.w.Write(payload); err != nil {
+        return err
+    }
+    return e.w.Flush()
+}
+
+// EncodeJSON 将 v 序列化为 JSON 后作为负载写入一帧
+func (e *Encoder) EncodeJSON(t FrameType, v interface{}) error {
+    return e.EncodeRequestJSON(t, 0, v)
+}
+
+// EncodeRequestJSON 将 v 序列化为 JSON 后作为请求 id 的负载写入一帧
+func (e *Encoder) EncodeRequestJSON(t FrameType, id uint32, v interface{}) error {
+    payload, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return e.EncodeRequest(t, id, payload)
+}
+
+// Decoder 从底层连接读取帧
+type Decoder struct {
+    r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+    return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode 读取下一帧，连接关闭时返回 io.EOF
+func (d *Decoder) Decode() (*Frame, error) {
+    var header [headerSize]byte
+    if _, err := io.ReadFull(d.r, header[:]); err != nil {
+        return nil, err
+    }
+
+    length := binary.BigEndian.Uint32(header[1:])
+    if length > MaxPayloadSize {
+        return nil, ErrFrameTooLarge
+    }
+
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(d.r, payload); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, err
+    }
+
+    frame := &Frame{Type: FrameType(header[0]), Payload: payload}
+    if frame.Type.HasRequestID() {
+        if len(payload) < requestIDSize {
+            return nil, fmt.Errorf("%s 帧缺少请求ID", frame.Type)
+        }
+        frame.ID = binary.BigEndian.Uint32(payload)
+        frame.Payload = payload[requestIDSize:]
+    }
+    return frame, nil
+}
+
+// Unmarshal 将帧负载按 JSON 解析到 v
+func (f *Frame) Unmarshal(v interface{}) error {
+    if err := json.Unmarshal(f.Payload, v); err != nil {
+        return fmt.Errorf("解析 %s 帧失败: %v", f.Type, err)
+    }
+    return nil
+}
+
+// ChunkWriter 把每次 Write 的数据作为属于请求 id 的指定类型帧发送，
+// 用于把命令的 stdout/stderr 直接 io.Copy 到连接上
+type ChunkWriter struct {
+    enc *Encoder
+    t   FrameType
+    id  uint32
+}
+
+func NewChunkWriter(enc *Encoder, t FrameType, id uint32) *ChunkWriter {
+    return &ChunkWriter{enc: enc, t: t, id: id}
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := len(p)
+        if n > MaxPayloadSize-requestIDSize {
+            n = MaxPayloadSize - requestIDSize
+        }
+        if err := w.enc.EncodeRequest(w.t, w.id, p[:n]); err != nil {
+            return written, err
+        }
+        written += n
+        p = p[n:]
+    }
+    return written, nil
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "strings"
+    "testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+    tests := []struct {
+        typ     FrameType
+        id      uint32
+        payload []byte
+    }{
+        {TypePing, 0, nil},
+        {TypeHello, 0, []byte(`{"protocol_version":4}`)},
+        {TypeInventory, 0, []byte("中文系统信息")},
+        {TypeExecRequest, 1, []byte(`{"command":"uptime"}`)},
+        {TypeStdout, 0xfffffffe, []byte("out\n")},
+        {TypeStderr, 7, []byte{}},
+        {TypeExitStatus, 42, []byte(`{"exit_code":0}`)},
+        {TypeError, 3, []byte("失败")},
+        {TypePTYData, 0, bytes.Repeat([]byte{0, 0xff}, 1000)},
+        {TypeInventory, 0, bytes.Repeat([]byte("x"), MaxPayloadSize)},
+        {TypeStdout, 9, bytes.Repeat([]byte("y"), MaxPayloadSize-requestIDSize)},
+    }
+
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+    for _, tt := range tests {
+        if err := enc.EncodeRequest(tt.typ, tt.id, tt.payload); err != nil {
+            t.Fatalf("EncodeRequest(%s, %d): %v", tt.typ, tt.id, err)
+        }
+    }
+    dec := NewDecoder(&buf)
+    for _, tt := range tests {
+        frame, err := dec.Decode()
+        if err != nil {
+            t.Fatalf("Decode %s: %v", tt.typ, err)
+        }
+        wantID := tt.id
+        if !tt.typ.HasRequestID() {
+            wantID = 0 // 非请求类帧不携带请求ID
+        }
+        if frame.Type != tt.typ || frame.ID != wantID || !bytes.Equal(frame.Payload, tt.payload) {
+            t.Errorf("帧 %s/%d 解码为 %s/%d，负载 %d 字节，应为 %d 字节", tt.typ, tt.id, frame.Type, frame.ID, len(frame.Payload), len(tt.payload))
+        }
+    }
+    if _, err := dec.Decode(); err != io.EOF {
+        t.Errorf("连接结束时 Decode 返回 %v，应为 io.EOF", err)
+    }
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+    var buf bytes.Buffer
+    enc := NewEncoder(&buf)
+    if err := enc.Encode(TypeInventory, make([]byte, MaxPayloadSize+1)); err != ErrFrameTooLarge {
+        t.Errorf("超过上限的负载返回 %v，应为 ErrFrameTooLarge", err)
+    }
+    // 请求ID 也计入负载长度
+    if err := enc.EncodeRequest(TypeStdout, 1, make([]byte, MaxPayloadSize-requestIDSize+1)); err != ErrFrameTooLarge {
+        t.Errorf("加上请求ID 后超过上限的负载返回 %v，应为 ErrFrameTooLarge", err)
+    }
+    if buf.Len() != 0 {
+        t.Errorf("被拒绝的帧不应写入连接，写入了 %d 字节", buf.Len())
+    }
+}
+
+// header 构造帧头
+func header(t FrameType, length uint32) []byte {
+    h := make([]byte, headerSize)
+    h[0] = byte(t)
+    binary.BigEndian.PutUint32(h[1:], length)
+    return h
+}
+
+func TestDecodeErrors(t *testing.T) {
+    tests := []struct {
+        name  string
+        input []byte
+        want  error  // 为 nil 时检查错误信息
+        msg   string // 错误信息应包含的内容
+    }{
+        {name: "空连接", input: nil, want: io.EOF},
+        {name: "帧头不完整", input: []byte{byte(TypePing), 0, 0}, want: io.ErrUnexpectedEOF},
+        {name: "负载超过上限", input: header(TypeInventory, MaxPayloadSize+1), want: ErrFrameTooLarge},
+        {name: "负载长度为最大值", input: header(TypeInventory, 0xffffffff), want: ErrFrameTooLarge},
+        {name: "负载为空", input: header(TypeInventory, 10), want: io.ErrUnexpectedEOF},
+        {name: "负载不完整", input: append(header(TypeInventory, 10), "short"...), want: io.ErrUnexpectedEOF},
+        {name: "缺少请求ID", input: append(header(TypeStdout, 2), 0, 1), msg: "缺少请求ID"},
+    }
+    for _, tt := range tests {
+        _, err := NewDecoder(bytes.NewReader(tt.input)).Decode()
+        switch {
+        case err == nil:
+            t.Errorf("%s: Decode 应返回错误", tt.name)
+        case tt.want != nil && !errors.Is(err, tt.want):
+            t.Errorf("%s: Decode 返回 %v，应为 %v", tt.name, err, tt.want)
+        case tt.msg != "" && !strings.Contains(err.Error(), tt.msg):
+            t.Errorf("%s: Decode 返回 %v，应包含 %q", tt.name, err, tt.msg)
+        }
+    }
+}
+
+func TestChunkWriter(t *testing.T) {
+    var buf bytes.Buffer
+    w := NewChunkWriter(NewEncoder(&buf), TypeStdout, 5)
+    data := bytes.Repeat([]byte("z"), MaxPayloadSize+100)
+    if n, err := w.Write(data); n != len(data) || err != nil {
+        t.Fatalf("Write = %d, %v", n, err)
+    }
+
+    // 超过单帧上限的数据拆分为多帧
+    dec := NewDecoder(&buf)
+    var got []byte
+    frames := 0
+    for {
+        frame, err := dec.Decode()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        if frame.Type != TypeStdout || frame.ID != 5 {
+            t.Fatalf("帧为 %s/%d，应为 %s/5", frame.Type, frame.ID, TypeStdout)
+        }
+        got = append(got, frame.Payload...)
+        frames++
+    }
+    if frames != 2 || !bytes.Equal(got, data) {
+        t.Errorf("收到 %d 帧共 %d 字节，应为 2 帧共 %d 字节", frames, len(got), len(data))
+    }
+}
+
+func TestFrameTypeString(t *testing.T) {
+    if got := TypeExitStatus.String(); got != "exit-status" {
+        t.Errorf("TypeExitStatus.String() = %q", got)
+    }
+    if got := FrameType(200).String(); got != "unknown(200)" {
+        t.Errorf("FrameType(200).String() = %q", got)
+    }
+}
@@ -0,0 +1,19 @@
+package protocol
+
+// 交互式终端会话复用请求ID: 服务端发送 pty-open 打开会话，双方用 pty-data
+// 传输原始字节，服务端用 pty-resize 同步窗口大小、用 cancel 关闭会话，
+// 客户端在 shell 退出后发送 exit-status。需要双方都声明 CapPTY 能力
+
+// PTYRequest pty-open 帧的负载
+type PTYRequest struct {
+    Term      string     `json:"term"` // TERM 环境变量
+    Rows      uint16     `json:"rows"`
+    Cols      uint16     `json:"cols"`
+    Signature *Signature `json:"signature,omitempty"` // 操作员的签名，客户端配置了可信公钥时必需
+}
+
+// WindowSize pty-resize 帧的负载
+type WindowSize struct {
+    Rows uint16 `json:"rows"`
+    Cols uint16 `json:"cols"`
+}
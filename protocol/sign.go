@@ -0,0 +1,235 @@
+package protocol
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// 请求签名: 操作员在自己一侧用 ed25519 私钥 (本地密钥文件或 ssh-agent) 对会在
+// 客户端上执行代码的请求 (exec-request、pty-open) 签名，服务端只转发签名，
+// 不持有私钥。客户端用配置的可信公钥校验签名、时间戳和随机数，拒绝未签名、
+// 签名无效、过期或重放的请求。签名覆盖请求类型、目标节点ID、时间戳、有效期、
+// 随机数和请求内容，因此不能转用到其他节点或其他命令
+const (
+    SignKindExec = "exec"
+    SignKindPTY  = "pty"
+)
+
+// Signature 请求携带的签名
+type Signature struct {
+    KeyID     string `json:"key_id"`    // 签名公钥的指纹
+    Timestamp int64  `json:"timestamp"` // 签名时间，Unix 毫秒
+    Expires   int64  `json:"expires,omitempty"` // 过期时间，Unix 毫秒，0 表示只在客户端允许的时间偏差内有效
+    Nonce     string `json:"nonce"`     // 随机数 (十六进制)，用于检测重放
+    Sig       string `json:"sig"`       // base64 编码的 ed25519 签名
+}
+
+func (s *Signature) Time() time.Time {
+    return time.UnixMilli(s.Timestamp)
+}
+
+// SignedBody 返回 exec-request 中需要签名的内容
+func (r *ExecRequest) SignedBody() string {
+    return strconv.FormatInt(r.TimeoutMs, 10) + "\n" + r.Command
+}
+
+// SignedBody 返回 pty-open 中需要签名的内容，窗口大小不影响执行的内容，不参与签名
+func (r *PTYRequest) SignedBody() string {
+    return r.Term
+}
+
+// ExpiresAt 返回签名的过期时间，没有指定有效期时为零值
+func (s *Signature) ExpiresAt() time.Time {
+    if s.Expires == 0 {
+        return time.Time{}
+    }
+    return time.UnixMilli(s.Expires)
+}
+
+// signingPayload 拼接签名覆盖的内容。没有有效期的签名与旧版本的格式相同，
+// 旧版本的客户端仍能校验
+func signingPayload(kind, nodeID string, s *Signature, body string) []byte {
+    if s.Expires == 0 {
+        return []byte(fmt.Sprintf("serverandclient-request-v1\n%s\n%s\n%s\n%d\n%s\n%s",
+            kind, nodeID, s.KeyID, s.Timestamp, s.Nonce, body))
+    }
+    return []byte(fmt.Sprintf("serverandclient-request-v2\n%s\n%s\n%s\n%d\n%d\n%s\n%s",
+        kind, nodeID, s.KeyID, s.Timestamp, s.Expires, s.Nonce, body))
+}
+
+// KeyID 返回公钥的指纹 (SHA-256 的前 16 个十六进制字符)
+func KeyID(pub ed25519.PublicKey) string {
+    sum := sha256.Sum256(pub)
+    return hex.EncodeToString(sum[:8])
+}
+
+// Signer 持有操作员私钥的一方: 本地的私钥文件 (KeySigner) 或 ssh-agent 中的密钥 (AgentSigner)
+type Signer interface {
+    Public() ed25519.PublicKey
+    SignPayload(payload []byte) ([]byte, error)
+}
+
+// KeySigner 用本地的 ed25519 私钥签名
+type KeySigner ed25519.PrivateKey
+
+func (k KeySigner) Public() ed25519.PublicKey {
+    return ed25519.PrivateKey(k).Public().(ed25519.PublicKey)
+}
+
+func (k KeySigner) SignPayload(payload []byte) ([]byte, error) {
+    return ed25519.Sign(ed25519.PrivateKey(k), payload), nil
+}
+
+// Sign 为发往 nodeID 的请求生成签名，expires 为零值时签名只在客户端允许的时间偏差内有效
+func Sign(signer Signer, kind, nodeID, body string, expires time.Time) (*Signature, error) {
+    var nonce [16]byte
+    if _, err := rand.Read(nonce[:]); err != nil {
+        return nil, err
+    }
+    s := &Signature{
+        KeyID:     KeyID(signer.Public()),
+        Timestamp: time.Now().UnixMilli(),
+        Nonce:     hex.EncodeToString(nonce[:]),
+    }
+    if !expires.IsZero() {
+        s.Expires = expires.UnixMilli()
+    }
+    sig, err := signer.SignPayload(signingPayload(kind, nodeID, s, body))
+    if err != nil {
+        return nil, err
+    }
+    s.Sig = base64.StdEncoding.EncodeToString(sig)
+    return s, nil
+}
+
+// VerifySignature 用 keys (按 KeyID 索引) 校验签名本身，时间戳和重放由调用者检查
+func VerifySignature(keys map[string]ed25519.PublicKey, kind, nodeID, body string, s *Signature) error {
+    if s == nil {
+        return errors.New("请求没有签名")
+    }
+    pub, ok := keys[s.KeyID]
+    if !ok {
+        return fmt.Errorf("签名公钥 %s 不受信任", s.KeyID)
+    }
+    sig, err := base64.StdEncoding.DecodeString(s.Sig)
+    if err != nil || !ed25519.Verify(pub, signingPayload(kind, nodeID, s, body), sig) {
+        return errors.New("签名无效")
+    }
+    return nil
+}
+
+// LoadSigningKey 读取 PEM (PKCS#8) 格式的 ed25519 私钥，
+// 可以用 openssl genpkey -algorithm ed25519 生成
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取签名私钥失败: %v", err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("%s 不是 PEM 格式的私钥", path)
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("解析签名私钥失败: %v", err)
+    }
+    priv, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("%s 不是 ed25519 私钥", path)
+    }
+    return priv, nil
+}
+
+// LoadTrustedKeys 读取文件中的所有 ed25519 公钥，按 KeyID 索引。公钥可以是 PEM 格式，
+// 也可以是 authorized_keys 格式的 ssh-ed25519 公钥 (用 ssh-agent 签名的操作员)，两种格式可以混合
+func LoadTrustedKeys(path string) (map[string]ed25519.PublicKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取可信公钥失败: %v", err)
+    }
+    keys := make(map[string]ed25519.PublicKey)
+    // ParseAuthorizedKey 跳过无法解析的行，包括 PEM 的内容
+    for in := data; ; {
+        key, _, _, rest, err := ssh.ParseAuthorizedKey(in)
+        if err != nil {
+            break
+        }
+        pub, ok := SSHEd25519Key(key)
+        if !ok {
+            return nil, fmt.Errorf("%s 中包含非 ed25519 公钥 (%s)", path, key.Type())
+        }
+        keys[KeyID(pub)] = pub
+        in = rest
+    }
+    for rest := data; ; {
+        var block *pem.Block
+        block, rest = pem.Decode(rest)
+        if block == nil {
+            break
+        }
+        if block.Type != "PUBLIC KEY" {
+            continue
+        }
+        key, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return nil, fmt.Errorf("解析可信公钥失败: %v", err)
+        }
+        pub, ok := key.(ed25519.PublicKey)
+        if !ok {
+            return nil, fmt.Errorf("%s 中包含非 ed25519 公钥", path)
+        }
+        keys[KeyID(pub)] = pub
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("%s 中没有 ed25519 公钥", path)
+    }
+    return keys, nil
+}
+
+// GenerateSigningKey 生成新的 ed25519 密钥对，私钥写入 path，公钥写入 path.pub
+func GenerateSigningKey(path string) (ed25519.PublicKey, error) {
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+    if err != nil {
+        return nil, err
+    }
+    pubDER, err := x509.MarshalPKIXPublicKey(pub)
+    if err != nil {
+        return nil, err
+    }
+    if err := writeNewFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+        return nil, err
+    }
+    if err := writeNewFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+        return nil, err
+    }
+    return pub, nil
+}
+
+// writeNewFile 创建文件并写入，文件已存在时失败，避免覆盖已有的密钥
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
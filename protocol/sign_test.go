@@ -0,0 +1,175 @@
+package protocol
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+)
+
+func newTestKey(t *testing.T) KeySigner {
+    t.Helper()
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return KeySigner(priv)
+}
+
+func TestVerifySignature(t *testing.T) {
+    key, other := newTestKey(t), newTestKey(t)
+    keys := map[string]ed25519.PublicKey{KeyID(key.Public()): key.Public()}
+    body := (&ExecRequest{Command: "uptime", TimeoutMs: 60000}).SignedBody()
+
+    tests := []struct {
+        name    string
+        signer  Signer
+        expires time.Time
+        modify  func(s *Signature)
+        kind    string
+        nodeID  string
+        body    string
+        wantErr bool
+    }{
+        {name: "有效"},
+        {name: "带有效期", expires: time.Now().Add(time.Hour)},
+        {name: "不受信任的公钥", signer: other, wantErr: true},
+        {name: "其他节点", nodeID: "node-b", wantErr: true},
+        {name: "其他请求类型", kind: SignKindPTY, wantErr: true},
+        {name: "其他命令", body: (&ExecRequest{Command: "reboot", TimeoutMs: 60000}).SignedBody(), wantErr: true},
+        {name: "其他超时", body: (&ExecRequest{Command: "uptime"}).SignedBody(), wantErr: true},
+        {name: "修改时间戳", modify: func(s *Signature) { s.Timestamp += 1000 }, wantErr: true},
+        {name: "修改随机数", modify: func(s *Signature) { s.Nonce = "00" + s.Nonce[2:] }, wantErr: true},
+        {name: "延长有效期", expires: time.Now().Add(time.Hour), modify: func(s *Signature) { s.Expires += 3600000 }, wantErr: true},
+        {name: "去掉有效期", expires: time.Now().Add(time.Hour), modify: func(s *Signature) { s.Expires = 0 }, wantErr: true},
+        {name: "加上有效期", modify: func(s *Signature) { s.Expires = s.Timestamp + 3600000 }, wantErr: true},
+        {name: "签名不是 base64", modify: func(s *Signature) { s.Sig = "!" }, wantErr: true},
+        {name: "冒用受信任的 KeyID", signer: other, modify: func(s *Signature) { s.KeyID = KeyID(key.Public()) }, wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            signer := tt.signer
+            if signer == nil {
+                signer = key
+            }
+            sig, err := Sign(signer, SignKindExec, "node-a", body, tt.expires)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if tt.modify != nil {
+                tt.modify(sig)
+            }
+            kind, nodeID, signed := SignKindExec, "node-a", body
+            if tt.kind != "" {
+                kind = tt.kind
+            }
+            if tt.nodeID != "" {
+                nodeID = tt.nodeID
+            }
+            if tt.body != "" {
+                signed = tt.body
+            }
+            err = VerifySignature(keys, kind, nodeID, signed, sig)
+            if (err != nil) != tt.wantErr {
+                t.Errorf("VerifySignature() = %v，应失败: %v", err, tt.wantErr)
+            }
+        })
+    }
+
+    if err := VerifySignature(keys, SignKindExec, "node-a", body, nil); err == nil {
+        t.Error("没有签名时应失败")
+    }
+}
+
+func TestAgentSigner(t *testing.T) {
+    keyring := agent.NewKeyring()
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    key := newTestKey(t)
+    for _, k := range []interface{}{rsaKey, ed25519.PrivateKey(key)} {
+        if err := keyring.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    signers, err := AgentSigners(keyring)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(signers) != 1 || KeyID(signers[0].Public()) != KeyID(key.Public()) {
+        t.Fatalf("agent 中应只有一个 ed25519 签名者，得到 %d 个", len(signers))
+    }
+    // agent 的签名与本地私钥的签名一样可以校验
+    sig, err := Sign(signers[0], SignKindPTY, "node-a", "xterm", time.Time{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    keys := map[string]ed25519.PublicKey{KeyID(key.Public()): key.Public()}
+    if err := VerifySignature(keys, SignKindPTY, "node-a", "xterm", sig); err != nil {
+        t.Errorf("agent 的签名校验失败: %v", err)
+    }
+
+    if _, err := AgentSigners(agent.NewKeyring()); err == nil {
+        t.Error("agent 中没有 ed25519 密钥时应失败")
+    }
+}
+
+func TestLoadTrustedKeys(t *testing.T) {
+    dir := t.TempDir()
+    pemPub, err := GenerateSigningKey(filepath.Join(dir, "op.key"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    pemData, err := os.ReadFile(filepath.Join(dir, "op.key.pub"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    sshKey := newTestKey(t)
+    sshPub, err := ssh.NewPublicKey(sshKey.Public())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // PEM 和 authorized_keys 两种格式可以混合
+    path := filepath.Join(dir, "trusted")
+    content := "# 操作员公钥\n" + string(ssh.MarshalAuthorizedKey(sshPub)) + string(pemData)
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    keys, err := LoadTrustedKeys(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(keys) != 2 || keys[KeyID(pemPub)] == nil || keys[KeyID(sshKey.Public())] == nil {
+        t.Errorf("读取到 %d 个公钥，应包含 PEM 和 authorized_keys 格式的公钥", len(keys))
+    }
+
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, content := range map[string]string{
+        "rsa":   string(ssh.MarshalAuthorizedKey(rsaPub)),
+        "empty": "# 没有公钥\n",
+    } {
+        path := filepath.Join(dir, name)
+        if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := LoadTrustedKeys(path); err == nil {
+            t.Errorf("%s: 应读取失败", name)
+        }
+    }
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+    "bufio"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/crypto/bcrypt"
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/term"
+)
+
+var (
+    adminAddr     string
+    adminHostKey  string
+    operatorsFile string
+    hashPassword  bool
+)
+
+// 操作员文件的格式，每次登录时重新读取，修改后不需要重启服务端
+type operatorsConfig struct {
+    Operators []operatorAccount `json:"operators"`
+}
+
+type operatorAccount struct {
+    Name           string   `json:"name"`
+    Role           string   `json:"role"`                      // viewer、operator 或 admin
+    PasswordHash   string   `json:"password_hash,omitempty"`   // bcrypt 哈希，使用 -hash-password 生成
+    AuthorizedKeys []string `json:"authorized_keys,omitempty"` // authorized_keys 格式的 SSH 公钥
+    APITokens      []string `json:"api_tokens,omitempty"`      // HTTP API 令牌的 SHA-256 哈希，使用 -gen-api-token 生成
+}
+
+var errAuthFailed = errors.New("认证失败")
+
+// loadOperators 读取并校验操作员文件
+func loadOperators(path string) (map[string]*operatorAccount, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var config operatorsConfig
+    if err := json.Unmarshal(data, &config); err != nil {
+        return nil, fmt.Errorf("解析操作员文件 %s 失败: %v", path, err)
+    }
+    accounts := make(map[string]*operatorAccount)
+    for i := range config.Operators {
+        a := &config.Operators[i]
+        if a.Name == "" {
+            return nil, fmt.Errorf("操作员文件 %s 中第 %d 个操作员没有名称", path, i+1)
+        }
+        if _, err := parseRole(a.Role); err != nil {
+            return nil, fmt.Errorf("操作员 %s: %v", a.Name, err)
+        }
+        accounts[a.Name] = a
+    }
+    return accounts, nil
+}
+
+// lookupOperator 按名称查找操作员
+func lookupOperator(name string) (*operatorAccount, error) {
+    accounts, err := loadOperators(operatorsFile)
+    if err != nil {
+        fmt.Printf("读取操作员文件失败: %v\n> ", err)
+        return nil, errAuthFailed
+    }
+    a, ok := accounts[name]
+    if !ok {
+        return nil, errAuthFailed
+    }
+    return a, nil
+}
+
+// permissions 认证成功后随连接保存操作员的名称和角色
+func (a *operatorAccount) permissions() *ssh.Permissions {
+    return &ssh.Permissions{Extensions: map[string]string{"operator": a.Name, "role": a.Role}}
+}
+
+func checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+    a, err := lookupOperator(meta.User())
+    if err != nil {
+        return nil, err
+    }
+    if a.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), password) != nil {
+        return nil, errAuthFailed
+    }
+    return a.permissions(), nil
+}
+
+func checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+    a, err := lookupOperator(meta.User())
+    if err != nil {
+        return nil, err
+    }
+    for _, line := range a.AuthorizedKeys {
+        authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+        if err != nil {
+            continue
+        }
+        if string(authorized.Marshal()) == string(key.Marshal()) {
+            perms := a.permissions()
+            perms.Extensions["login-key"] = ssh.FingerprintSHA256(key)
+            return perms, nil
+        }
+    }
+    return nil, errAuthFailed
+}
+
+// startAdminServer 在管理端口上启动 SSH 服务，操作员使用普通的 ssh 客户端登录
+func startAdminServer(addr string) error {
+    if operatorsFile == "" {
+        return errors.New("启用管理端口需要使用 -operators 指定操作员文件")
+    }
+    if _, err := loadOperators(operatorsFile); err != nil {
+        return err
+    }
+    if adminHostKey == "" {
+        adminHostKey = filepath.Join(dataDir, "admin_host_key")
+    }
+    hostKey, err := loadHostKey(adminHostKey)
+    if err != nil {
+        return err
+    }
+
+    config := &ssh.ServerConfig{
+        PasswordCallback:  checkPassword,
+        PublicKeyCallback: checkPublicKey,
+        AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
+            if err != nil && method != "none" {
+                auditEvent(&auditEntry{Operator: meta.User(), Action: "operator-login-failed",
+                    Address: meta.RemoteAddr().String(), Detail: method})
+            }
+        },
+    }
+    config.AddHostKey(hostKey)
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("管理端口已启动，监听地址: %s, 主机密钥指纹: %s\n", addr, ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                fmt.Printf("接受管理连接失败: %v\n> ", err)
+                return
+            }
+            go handleAdminConn(conn, config)
+        }
+    }()
+    return nil
+}
+
+// loadHostKey 读取管理端口的主机密钥，文件不存在时生成新的 ed25519 密钥
+func loadHostKey(path string) (ssh.Signer, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        _, priv, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        der, err := x509.MarshalPKCS8PrivateKey(priv)
+        if err != nil {
+            return nil, err
+        }
+        data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+        if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+            return nil, err
+        }
+        if err := os.WriteFile(path, data, 0600); err != nil {
+            return nil, fmt.Errorf("保存主机密钥失败: %v", err)
+        }
+    } else if err != nil {
+        return nil, err
+    }
+    signer, err := ssh.ParsePrivateKey(data)
+    if err != nil {
+        return nil, fmt.Errorf("解析主机密钥 %s 失败: %v", path, err)
+    }
+    return signer, nil
+}
+
+// handleAdminConn 完成 SSH 握手和认证，然后处理操作员打开的会话
+func handleAdminConn(conn net.Conn, config *ssh.ServerConfig) {
+    sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    defer sconn.Close()
+    go ssh.DiscardRequests(reqs)
+
+    name := sconn.Permissions.Extensions["operator"]
+    role, _ := parseRole(sconn.Permissions.Extensions["role"])
+    remote := sconn.RemoteAddr().String()
+    auditEvent(&auditEntry{Operator: name, Action: "operator-login", Address: remote, Detail: roleNames[role]})
+    fmt.Printf("操作员 %s (%s) 已从 %s 登录\n> ", name, roleNames[role], remote)
+
+    for newChannel := range chans {
+        if newChannel.ChannelType() != "session" {
+            newChannel.Reject(ssh.UnknownChannelType, "只支持 session 通道")
+            continue
+        }
+        channel, requests, err := newChannel.Accept()
+        if err != nil {
+            continue
+        }
+        go handleAdminSession(sconn, channel, requests, name, role, remote)
+    }
+
+    auditEvent(&auditEntry{Operator: name, Action: "operator-logout", Address: remote})
+    fmt.Printf("操作员 %s 已从 %s 退出\n> ", name, remote)
+}
+
+// SSH 会话请求的负载，参见 RFC 4254
+type ptyRequestMsg struct {
+    Term   string
+    Cols   uint32
+    Rows   uint32
+    Width  uint32
+    Height uint32
+    Modes  string
+}
+
+type windowChangeMsg struct {
+    Cols   uint32
+    Rows   uint32
+    Width  uint32
+    Height uint32
+}
+
+type execRequestMsg struct {
+    Command string
+}
+
+type exitStatusMsg struct {
+    Status uint32
+}
+
+// handleAdminSession 处理一个 session 通道: shell 请求进入命令提示符，
+// exec 请求执行单条命令 (例如 ssh -p 4022 alice@server list)。
+// 操作员使用 ssh -A 转发 agent 时，发往客户端的请求用 agent 中的密钥签名
+func handleAdminSession(sconn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request, name string, role int, remote string) {
+    var (
+        tty      bool
+        termName string
+        rows     uint16
+        cols     uint16
+        signer   requestSigner
+        s        *operatorSession
+    )
+
+    run := func(fn func(s *operatorSession)) {
+        s = newRemoteSession(name, role, remote, channel, tty, termName, rows, cols, signer)
+        go func() {
+            s.login()
+            fn(s)
+            s.logout()
+            s.in.close()
+            channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusMsg{}))
+            channel.Close()
+        }()
+    }
+
+    for req := range requests {
+        ok := false
+        switch req.Type {
+        case "pty-req":
+            var msg ptyRequestMsg
+            if ssh.Unmarshal(req.Payload, &msg) == nil && s == nil {
+                tty, termName = true, msg.Term
+                rows, cols = uint16(msg.Rows), uint16(msg.Cols)
+                ok = true
+            }
+        case "auth-agent-req@openssh.com":
+            if s == nil {
+                signer = newForwardedSigner(sconn, sconn.Permissions.Extensions["login-key"])
+                ok = true
+            }
+        case "window-change":
+            var msg windowChangeMsg
+            if ssh.Unmarshal(req.Payload, &msg) == nil {
+                rows, cols = uint16(msg.Rows), uint16(msg.Cols)
+                if s != nil {
+                    s.setWindowSize(rows, cols)
+                }
+            }
+        case "shell":
+            if s == nil {
+                ok = true
+                run(func(s *operatorSession) {
+                    fmt.Fprintf(s.out, "欢迎, %s (角色: %s)，输入 help 查看可用命令\n", name, roleNames[role])
+                    handleCommands(s)
+                })
+            }
+        case "exec":
+            var msg execRequestMsg
+            if ssh.Unmarshal(req.Payload, &msg) == nil && s == nil {
+                ok = true
+                command := strings.TrimSpace(msg.Command)
+                run(func(s *operatorSession) {
+                    if command != "" {
+                        handleCommand(s, command)
+                    }
+                })
+            }
+        }
+        if req.WantReply {
+            req.Reply(ok, nil)
+        }
+    }
+}
+
+// printPasswordHash 从标准输入读取密码并输出 bcrypt 哈希，用于填写操作员文件
+func printPasswordHash() error {
+    var password []byte
+    fd := int(os.Stdin.Fd())
+    if term.IsTerminal(fd) {
+        fmt.Print("密码: ")
+        p, err := term.ReadPassword(fd)
+        fmt.Println()
+        if err != nil {
+            return err
+        }
+        password = p
+    } else {
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && line == "" {
+            return err
+        }
+        password = []byte(strings.TrimRight(line, "\r\n"))
+    }
+    if len(password) == 0 {
+        return errors.New("密码不能为空")
+    }
+    hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+    fmt.Println(string(hash))
+    return nil
+}
@@ -0,0 +1,1022 @@
+package server
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+var (
+    apiAddr     string
+    genAPIToken bool
+)
+
+// 长轮询作业结果时最多等待的时间
+const maxJobWait = 5 * time.Minute
+
+// startAPIServer 在 addr 上启动 HTTP API，操作员使用操作员文件中的 API 令牌认证。
+// 指定了 -tls-cert 和 -tls-key 时 API 也使用 HTTPS
+func startAPIServer(addr string) error {
+    if operatorsFile == "" {
+        return errors.New("启用 HTTP API 需要使用 -operators 指定操作员文件")
+    }
+    if _, err := loadOperators(operatorsFile); err != nil {
+        return err
+    }
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    srv := &http.Server{
+        Handler:           http.HandlerFunc(serveAPI),
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    scheme := "http"
+    if tlsCertFile != "" && tlsKeyFile != "" {
+        scheme = "https"
+    }
+    fmt.Printf("HTTP API 已启动，地址: %s://%s/api/v1/\n", scheme, addr)
+
+    go func() {
+        var err error
+        if scheme == "https" {
+            err = srv.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+        } else {
+            err = srv.Serve(listener)
+        }
+        fmt.Printf("HTTP API 已停止: %v\n> ", err)
+    }()
+    return nil
+}
+
+// generateAPIToken 生成随机的 API 令牌，并输出写入操作员文件的哈希
+func generateAPIToken() error {
+    var buf [32]byte
+    if _, err := rand.Read(buf[:]); err != nil {
+        return err
+    }
+    token := hex.EncodeToString(buf[:])
+    fmt.Printf("API 令牌: %s\n", token)
+    fmt.Printf("令牌哈希: %s\n", apiTokenHash(token))
+    fmt.Println("请把令牌哈希加入操作员文件中对应操作员的 api_tokens，令牌本身只显示这一次")
+    return nil
+}
+
+func apiTokenHash(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// authenticateAPI 根据 Authorization: Bearer <令牌> 查找操作员。浏览器的 EventSource
+// 不能设置请求头，events 端点另外接受一次性的票据 (查询参数 ticket)，见 issueStreamTicket。
+// 长期有效的令牌不能放在 URL 中，以免出现在代理和访问日志里
+func authenticateAPI(r *http.Request) (*operatorAccount, int, error) {
+    header := r.Header.Get("Authorization")
+    if !strings.HasPrefix(header, "Bearer ") {
+        if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+            return redeemStreamTicket(r, ticket)
+        }
+        return nil, 0, errors.New("缺少 API 令牌")
+    }
+    token := strings.TrimPrefix(header, "Bearer ")
+    accounts, err := loadOperators(operatorsFile)
+    if err != nil {
+        fmt.Printf("读取操作员文件失败: %v\n> ", err)
+        return nil, 0, errAuthFailed
+    }
+    hash := apiTokenHash(token)
+    for _, a := range accounts {
+        for _, h := range a.APITokens {
+            if subtle.ConstantTimeCompare([]byte(strings.ToLower(h)), []byte(hash)) == 1 {
+                role, _ := parseRole(a.Role)
+                return a, role, nil
+            }
+        }
+    }
+    return nil, 0, errAuthFailed
+}
+
+// 事件流票据的有效期，只能使用一次
+const streamTicketTTL = 30 * time.Second
+
+// streamTicket 换取自 API 令牌的一次性票据，只能用于一个作业的 events 端点
+type streamTicket struct {
+    operator string
+    role     int
+    jobID    int
+    expires  time.Time
+}
+
+var (
+    ticketsMu sync.Mutex
+    tickets   = make(map[string]*streamTicket) // 票据的 SHA-256 -> 票据
+)
+
+// issueStreamTicket 为操作员生成一张作业 jobID 的事件流票据
+func issueStreamTicket(operator string, role, jobID int) (string, time.Time, error) {
+    var buf [24]byte
+    if _, err := rand.Read(buf[:]); err != nil {
+        return "", time.Time{}, err
+    }
+    ticket := hex.EncodeToString(buf[:])
+    now := time.Now()
+    expires := now.Add(streamTicketTTL)
+
+    ticketsMu.Lock()
+    defer ticketsMu.Unlock()
+    for hash, t := range tickets {
+        if now.After(t.expires) {
+            delete(tickets, hash)
+        }
+    }
+    tickets[apiTokenHash(ticket)] = &streamTicket{operator: operator, role: role, jobID: jobID, expires: expires}
+    return ticket, expires, nil
+}
+
+// redeemStreamTicket 校验并作废票据，票据只能用于 GET 签发时指定的作业的 events 端点
+func redeemStreamTicket(r *http.Request, ticket string) (*operatorAccount, int, error) {
+    ticketsMu.Lock()
+    t, ok := tickets[apiTokenHash(ticket)]
+    delete(tickets, apiTokenHash(ticket))
+    ticketsMu.Unlock()
+    if !ok || time.Now().After(t.expires) || r.Method != http.MethodGet ||
+        r.URL.Path != fmt.Sprintf("/api/v1/jobs/%d/events", t.jobID) {
+        return nil, 0, errAuthFailed
+    }
+    return &operatorAccount{Name: t.operator}, t.role, nil
+}
+
+// apiEventsTicket POST /api/v1/jobs/{id}/events-ticket，换取用于 EventSource 的一次性票据
+func apiEventsTicket(w http.ResponseWriter, r *apiRequest) {
+    j, ok := r.job(w)
+    if !ok {
+        return
+    }
+    ticket, expires, err := issueStreamTicket(r.operator, r.role, j.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "ticket":     ticket,
+        "expires_at": expires,
+        "url":        fmt.Sprintf("/api/v1/jobs/%d/events?ticket=%s", j.ID, ticket),
+    })
+}
+
+// apiRequest 一次已认证的 API 请求
+type apiRequest struct {
+    *http.Request
+    operator string
+    role     int
+    path     []string // /api/v1/ 之后按 / 分割的路径
+}
+
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+    if !strings.HasPrefix(r.URL.Path, "/api/v1/") {
+        writeError(w, http.StatusNotFound, "未知的路径")
+        return
+    }
+    account, role, err := authenticateAPI(r)
+    if err != nil {
+        auditEvent(&auditEntry{Action: "api-auth-failed", Address: r.RemoteAddr, Command: r.Method + " " + r.URL.Path})
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        writeError(w, http.StatusUnauthorized, err.Error())
+        return
+    }
+
+    req := &apiRequest{
+        Request:  r,
+        operator: account.Name,
+        role:     role,
+        path:     strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/"),
+    }
+    if r.Method != http.MethodGet {
+        auditEvent(&auditEntry{Operator: req.operator, Action: "api", Address: r.RemoteAddr, Command: r.Method + " " + r.URL.Path})
+    }
+
+    p := req.path
+    switch {
+    case len(p) == 1 && p[0] == "nodes" && r.Method == http.MethodGet:
+        req.handle(w, roleViewer, apiListNodes)
+    case len(p) == 2 && p[0] == "nodes" && r.Method == http.MethodGet:
+        req.handle(w, roleViewer, apiGetNode)
+    case len(p) == 3 && p[0] == "nodes" && p[2] == "disconnect" && r.Method == http.MethodPost:
+        req.handle(w, roleAdmin, apiDisconnectNode)
+    case len(p) == 3 && p[0] == "nodes" && p[2] == "labels" && r.Method == http.MethodPatch:
+        req.handle(w, roleOperator, apiPatchLabels)
+    case len(p) == 1 && p[0] == "groups" && r.Method == http.MethodGet:
+        req.handle(w, roleViewer, apiListGroups)
+    case len(p) == 2 && p[0] == "groups" && r.Method == http.MethodGet:
+        req.handle(w, roleViewer, apiGetGroup)
+    case len(p) == 2 && p[0] == "groups" && r.Method == http.MethodPut:
+        req.handle(w, roleOperator, apiPutGroup)
+    case len(p) == 2 && p[0] == "groups" && r.Method == http.MethodDelete:
+        req.handle(w, roleOperator, apiDeleteGroup)
+    case len(p) == 1 && p[0] == "jobs" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiListJobs)
+    case len(p) == 1 && p[0] == "jobs" && r.Method == http.MethodPost:
+        req.handle(w, roleOperator, apiCreateJob)
+    case len(p) == 2 && p[0] == "jobs" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiGetJob)
+    case len(p) == 3 && p[0] == "jobs" && p[2] == "results" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiStreamJobResults)
+    case len(p) == 3 && p[0] == "jobs" && p[2] == "events" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiJobEvents)
+    case len(p) == 3 && p[0] == "jobs" && p[2] == "events-ticket" && r.Method == http.MethodPost:
+        req.handle(w, roleOperator, apiEventsTicket)
+    case len(p) == 3 && p[0] == "jobs" && p[2] == "groups" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiJobGroups)
+    case len(p) == 3 && p[0] == "jobs" && p[2] == "cancel" && r.Method == http.MethodPost:
+        req.handle(w, roleOperator, apiCancelJob)
+    case len(p) == 1 && p[0] == "queue" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiListQueue)
+    case len(p) == 1 && p[0] == "queue" && r.Method == http.MethodPost:
+        req.handle(w, roleOperator, apiEnqueue)
+    case len(p) == 2 && p[0] == "queue" && r.Method == http.MethodGet:
+        req.handle(w, roleOperator, apiGetQueueItem)
+    case len(p) == 2 && p[0] == "queue" && r.Method == http.MethodDelete:
+        req.handle(w, roleOperator, apiCancelQueueItem)
+    default:
+        writeError(w, http.StatusNotFound, "未知的路径或方法")
+    }
+}
+
+// handle 检查角色后调用处理函数
+func (r *apiRequest) handle(w http.ResponseWriter, role int, fn func(http.ResponseWriter, *apiRequest)) {
+    if r.role < role {
+        writeError(w, http.StatusForbidden, fmt.Sprintf("权限不足: 需要 %s 角色，当前角色为 %s", roleNames[role], roleNames[r.role]))
+        return
+    }
+    fn(w, r)
+}
+
+// pathID 解析路径中第 i 段的编号
+func (r *apiRequest) pathID(i int) (int, error) {
+    id, err := strconv.Atoi(r.path[i])
+    if err != nil {
+        return 0, fmt.Errorf("编号应为整数: %s", r.path[i])
+    }
+    return id, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "  ")
+    enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+    writeJSON(w, status, map[string]string{"error": message})
+}
+
+// nodeView 节点在 API 中的表示
+type nodeView struct {
+    ID              int                 `json:"id"`
+    NodeID          string              `json:"node_id"`
+    Address         string              `json:"address"`
+    Online          bool                `json:"online"`
+    Approval        string              `json:"approval"`
+    FirstSeen       time.Time           `json:"first_seen"`
+    ConnectedAt     time.Time           `json:"connected_at"`
+    LastSeen        time.Time           `json:"last_seen"`
+    Hostname        string              `json:"hostname,omitempty"`
+    BuildVersion    string              `json:"build_version,omitempty"`
+    OS              string              `json:"os,omitempty"`
+    Arch            string              `json:"arch,omitempty"`
+    ProtocolVersion int                 `json:"protocol_version,omitempty"`
+    Capabilities    []string            `json:"capabilities"`
+    CertIdentity    string              `json:"cert_identity,omitempty"`
+    Labels          map[string]string   `json:"labels,omitempty"`       // 客户端声明的标签和操作员设置的标签
+    ServerLabels    map[string]string   `json:"server_labels,omitempty"` // 其中由操作员设置的标签
+    Groups          []string            `json:"groups,omitempty"`
+    Inventory       *protocol.Inventory `json:"inventory,omitempty"`
+}
+
+// nodeViewLocked 返回客户端的 API 表示，调用者需持有 mu
+func nodeViewLocked(c *client, withInventory bool) *nodeView {
+    v := &nodeView{
+        ID:              c.id,
+        NodeID:          c.nodeID,
+        Address:         c.addr,
+        Online:          c.online,
+        Approval:        c.approval,
+        FirstSeen:       c.firstSeen,
+        ConnectedAt:     c.connectedAt,
+        LastSeen:        c.lastSeen,
+        BuildVersion:    c.hello.BuildVersion,
+        OS:              c.hello.OS,
+        Arch:            c.hello.Arch,
+        ProtocolVersion: c.protocolVersion,
+        Capabilities:    c.capabilities,
+        CertIdentity:    c.certIdentity,
+        Labels:          c.labelsLocked(),
+        ServerLabels:    c.labels,
+        Groups:          groupNamesLocked(c),
+    }
+    if v.Approval == "" {
+        v.Approval = approvalApproved
+    }
+    if info := clientInfo[c.id]; info != nil {
+        v.Hostname = info.Hostname
+        if withInventory {
+            v.Inventory = info
+        }
+    }
+    return v
+}
+
+// apiListNodes GET /api/v1/nodes，支持以下查询参数过滤:
+// q (选择器，与 search 命令相同)、status (online 或 offline)、approval、os
+func apiListNodes(w http.ResponseWriter, r *apiRequest) {
+    query := r.URL.Query()
+    var sel *selector
+    if q := query.Get("q"); q != "" {
+        var err error
+        if sel, err = parseSelector(q); err != nil {
+            writeError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+    }
+    status := query.Get("status")
+    if status != "" && status != "online" && status != "offline" {
+        writeError(w, http.StatusBadRequest, "status 应为 online 或 offline")
+        return
+    }
+    approval := query.Get("approval")
+    osName := query.Get("os")
+    withInventory := query.Get("inventory") == "true"
+
+    mu.Lock()
+    defer mu.Unlock()
+    nodes := []*nodeView{}
+    for _, id := range sortedClientIDs() {
+        c := clients[id]
+        v := nodeViewLocked(c, withInventory)
+        if status != "" && v.Online != (status == "online") {
+            continue
+        }
+        if approval != "" && v.Approval != approval {
+            continue
+        }
+        if osName != "" && v.OS != osName {
+            continue
+        }
+        if sel != nil && !sel.matchLocked(c) {
+            continue
+        }
+        nodes = append(nodes, v)
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"nodes": nodes})
+}
+
+// inventoryMatches 判断系统信息中是否有包含关键字 (小写) 的行，即选择器中的搜索词
+func inventoryMatches(info *protocol.Inventory, keyword string) bool {
+    for _, line := range inventoryLines(info) {
+        if strings.Contains(strings.ToLower(line), keyword) {
+            return true
+        }
+    }
+    return false
+}
+
+// apiGetNode GET /api/v1/nodes/{id}，包含完整的系统信息
+func apiGetNode(w http.ResponseWriter, r *apiRequest) {
+    id, err := r.pathID(1)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    mu.Lock()
+    c, ok := clients[id]
+    var v *nodeView
+    if ok {
+        v = nodeViewLocked(c, true)
+    }
+    mu.Unlock()
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有找到编号为 %d 的客户端", id))
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
+
+// apiDisconnectNode POST /api/v1/nodes/{id}/disconnect，断开节点当前的连接。
+// 节点没有被拒绝，客户端会按自己的重试间隔重新连接
+func apiDisconnectNode(w http.ResponseWriter, r *apiRequest) {
+    id, err := r.pathID(1)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    mu.Lock()
+    c, ok := clients[id]
+    online := ok && c.online
+    mu.Unlock()
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有找到编号为 %d 的客户端", id))
+        return
+    }
+    if !online {
+        writeError(w, http.StatusConflict, fmt.Sprintf("客户端 %d 当前离线", id))
+        return
+    }
+    auditClient(c, r.operator, "force-disconnect", "")
+    markOffline(c)
+    writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "disconnected": true})
+}
+
+// apiPatchLabels PATCH /api/v1/nodes/{id}/labels，请求体为 {"key": "value", "old": null}，
+// 值为 null 的标签被删除，只修改由操作员设置的标签
+func apiPatchLabels(w http.ResponseWriter, r *apiRequest) {
+    id, err := r.pathID(1)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    var body map[string]*string
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "请求格式错误: "+err.Error())
+        return
+    }
+    set := make(map[string]string)
+    var remove []string
+    for key, value := range body {
+        if value == nil {
+            remove = append(remove, key)
+            continue
+        }
+        if err := protocol.ValidateLabel(key, *value); err != nil {
+            writeError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+        set[key] = *value
+    }
+
+    mu.Lock()
+    c, ok := clients[id]
+    mu.Unlock()
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有找到编号为 %d 的客户端", id))
+        return
+    }
+    c = updateLabels(c, r.operator, set, remove)
+    mu.Lock()
+    v := nodeViewLocked(c, false)
+    mu.Unlock()
+    writeJSON(w, http.StatusOK, v)
+}
+
+// groupView 分组在 API 中的表示，包含当前的成员
+type groupView struct {
+    *nodeGroup
+    Nodes []int `json:"nodes"`
+}
+
+func groupViewLocked(g *nodeGroup) *groupView {
+    v := &groupView{nodeGroup: g, Nodes: []int{}}
+    for _, c := range g.membersLocked() {
+        v.Nodes = append(v.Nodes, c.id)
+    }
+    return v
+}
+
+// apiListGroups GET /api/v1/groups
+func apiListGroups(w http.ResponseWriter, r *apiRequest) {
+    mu.Lock()
+    list := []*groupView{}
+    for _, g := range groups {
+        list = append(list, groupViewLocked(g))
+    }
+    mu.Unlock()
+    sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+    writeJSON(w, http.StatusOK, map[string]interface{}{"groups": list})
+}
+
+// apiGetGroup GET /api/v1/groups/{name}
+func apiGetGroup(w http.ResponseWriter, r *apiRequest) {
+    mu.Lock()
+    g, ok := groups[r.path[1]]
+    var v *groupView
+    if ok {
+        v = groupViewLocked(g)
+    }
+    mu.Unlock()
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有名为 %s 的分组", r.path[1]))
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
+
+// 创建或替换分组的请求，members 和 selector 只能指定其中之一
+type putGroupRequest struct {
+    Members  []int  `json:"members"`
+    Selector string `json:"selector"`
+}
+
+// apiPutGroup PUT /api/v1/groups/{name}，创建或替换分组
+func apiPutGroup(w http.ResponseWriter, r *apiRequest) {
+    var body putGroupRequest
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "请求格式错误: "+err.Error())
+        return
+    }
+    if body.Members != nil && body.Selector != "" {
+        writeError(w, http.StatusBadRequest, "members 和 selector 只能指定其中之一")
+        return
+    }
+    g, err := saveGroup(r.operator, r.path[1], body.Members, body.Selector)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    mu.Lock()
+    v := groupViewLocked(g)
+    mu.Unlock()
+    writeJSON(w, http.StatusOK, v)
+}
+
+// apiDeleteGroup DELETE /api/v1/groups/{name}
+func apiDeleteGroup(w http.ResponseWriter, r *apiRequest) {
+    if getGroup(r.path[1]) == nil {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有名为 %s 的分组", r.path[1]))
+        return
+    }
+    if err := removeGroup(r.operator, r.path[1]); err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"name": r.path[1], "deleted": true})
+}
+
+// 创建作业的请求
+type createJobRequest struct {
+    Command  string `json:"command"`
+    Nodes    []int  `json:"nodes,omitempty"`
+    Target   string `json:"target,omitempty"`   // 代替 nodes: all、编号列表 (例如 1,3,5-8)、group:<分组> 或选择器
+    Timeout  string `json:"timeout,omitempty"`  // 例如 30s，默认使用 -timeout，0 表示不限制
+    Parallel *int   `json:"parallel,omitempty"` // 同时执行的节点数，默认使用 -parallel，0 表示不限制
+
+    // 滚动执行，batch_size 和 batch_percent 最多指定一个
+    BatchSize    int    `json:"batch_size,omitempty"`    // 每批的节点数
+    BatchPercent int    `json:"batch_percent,omitempty"` // 每批的节点数占全部节点的百分比
+    MaxFailures  int    `json:"max_failures,omitempty"`  // 失败的节点数超过该值时停止，默认 0
+    HealthCheck  string `json:"health_check,omitempty"`  // 每批结束后在成功的节点上执行的命令
+
+    // 操作员预先生成的签名 (cmd/signer)，按节点ID索引，服务端原样转发给客户端。
+    // 指定后必须包含每个目标节点，签名时的 timeout 必须与请求相同
+    Signatures            map[string]*protocol.Signature `json:"signatures,omitempty"`
+    HealthCheckSignatures map[string]*protocol.Signature `json:"health_check_signatures,omitempty"`
+}
+
+// 带签名的请求体上限，每个节点的签名约 250 字节
+const maxSignedRequestBody = 8 << 20
+
+// presignedFor 检查预先生成的签名是否包含每个目标节点，没有指定签名时返回 nil (不签名)
+func presignedFor(field string, sigs map[string]*protocol.Signature, targets []*client) (requestSigner, error) {
+    if len(sigs) == 0 {
+        return nil, nil
+    }
+    for _, c := range targets {
+        if sigs[c.nodeID] == nil {
+            return nil, fmt.Errorf("%s 中缺少节点 %s (客户端 %d) 的签名", field, c.nodeID, c.id)
+        }
+    }
+    return presignedSignatures(sigs), nil
+}
+
+// checkQueueSignatures 要求排队命令的预签名带有效期: 没有有效期的签名只在签名时间前后的
+// 时间偏差内有效，节点离线一段时间后送达的命令会被客户端拒绝
+func checkQueueSignatures(sigs map[string]*protocol.Signature, targets []*client) error {
+    for _, c := range targets {
+        if sig := sigs[c.nodeID]; sig != nil && sig.Expires == 0 {
+            return fmt.Errorf("节点 %s (客户端 %d) 的签名没有有效期，排队的命令请使用 signer -ttl 生成签名", c.nodeID, c.id)
+        }
+    }
+    return nil
+}
+
+// apiCreateJob POST /api/v1/jobs，在 nodes 或 target 指定的节点上执行命令，返回作业编号
+func apiCreateJob(w http.ResponseWriter, r *apiRequest) {
+    var body createJobRequest
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignedRequestBody))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "请求格式错误: "+err.Error())
+        return
+    }
+    if strings.TrimSpace(body.Command) == "" {
+        writeError(w, http.StatusBadRequest, "command 不能为空")
+        return
+    }
+    if (len(body.Nodes) == 0) == (body.Target == "") {
+        writeError(w, http.StatusBadRequest, "需要指定 nodes 或 target 其中之一")
+        return
+    }
+    parallel := defaultParallel
+    if body.Parallel != nil {
+        if *body.Parallel < 0 {
+            writeError(w, http.StatusBadRequest, "parallel 应为非负整数，0 表示不限制")
+            return
+        }
+        parallel = *body.Parallel
+    }
+    spec := jobSpec{Operator: r.operator, Command: body.Command, Parallel: parallel, BatchSize: body.BatchSize,
+        BatchPercent: body.BatchPercent, MaxFailures: body.MaxFailures, HealthCheck: body.HealthCheck}
+    if err := spec.validate(); err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    timeout := commandTimeout
+    if body.Timeout != "" {
+        d, err := time.ParseDuration(body.Timeout)
+        if err != nil || d < 0 {
+            writeError(w, http.StatusBadRequest, "timeout 格式错误，例如 30s，0 表示不限制")
+            return
+        }
+        timeout = d
+    }
+
+    var targets []*client
+    if body.Target != "" {
+        var err error
+        if targets, err = resolveTargets(body.Target); err != nil {
+            writeError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+        if len(targets) == 0 {
+            writeError(w, http.StatusBadRequest, "没有匹配的在线节点")
+            return
+        }
+    }
+    if len(body.Nodes) > 0 {
+        var err error
+        if targets, err = lookupClients(body.Nodes); err != nil {
+            writeError(w, http.StatusNotFound, err.Error())
+            return
+        }
+    }
+
+    var err error
+    if spec.Signer, err = presignedFor("signatures", body.Signatures, targets); err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    if body.HealthCheck != "" {
+        if spec.HealthSigner, err = presignedFor("health_check_signatures", body.HealthCheckSignatures, targets); err != nil {
+            writeError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+    }
+
+    spec.Timeout = timeout
+    j := startJob(spec, targets)
+    w.Header().Set("Location", fmt.Sprintf("/api/v1/jobs/%d", j.ID))
+    writeJSON(w, http.StatusAccepted, j.status())
+}
+
+// lookupClients 按编号查找客户端 (包括离线的)，重复的编号只保留一次
+func lookupClients(ids []int) ([]*client, error) {
+    mu.Lock()
+    defer mu.Unlock()
+    var targets []*client
+    seen := make(map[int]bool)
+    for _, id := range ids {
+        c, ok := clients[id]
+        if !ok {
+            return nil, fmt.Errorf("没有找到编号为 %d 的客户端", id)
+        }
+        if !seen[id] {
+            seen[id] = true
+            targets = append(targets, c)
+        }
+    }
+    return targets, nil
+}
+
+// apiListJobs GET /api/v1/jobs，只返回作业的摘要，不包含输出
+func apiListJobs(w http.ResponseWriter, r *apiRequest) {
+    list := []*jobStatus{}
+    for _, j := range listJobs() {
+        s := j.status()
+        s.Tasks = nil
+        list = append(list, s)
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": list})
+}
+
+// apiGetJob GET /api/v1/jobs/{id}，wait=<时长> 时等待作业结束 (长轮询) 后再返回
+func apiGetJob(w http.ResponseWriter, r *apiRequest) {
+    j, ok := r.job(w)
+    if !ok {
+        return
+    }
+    if wait := r.URL.Query().Get("wait"); wait != "" {
+        d, err := time.ParseDuration(wait)
+        if err != nil || d < 0 {
+            writeError(w, http.StatusBadRequest, "wait 格式错误，例如 30s")
+            return
+        }
+        if d > maxJobWait {
+            d = maxJobWait
+        }
+        j.wait(d)
+    }
+    writeJSON(w, http.StatusOK, j.status())
+}
+
+// apiJobGroups GET /api/v1/jobs/{id}/groups，把已结束节点中结果相同的合并为一组，
+// 节点多的组在前
+func apiJobGroups(w http.ResponseWriter, r *apiRequest) {
+    j, ok := r.job(w)
+    if !ok {
+        return
+    }
+    s := j.status()
+    groups := s.groups()
+    s.Tasks = nil
+    writeJSON(w, http.StatusOK, map[string]interface{}{"job": s, "groups": groups})
+}
+
+// apiCancelJob POST /api/v1/jobs/{id}/cancel，未开始的节点不再执行，正在执行的命令被中断
+func apiCancelJob(w http.ResponseWriter, r *apiRequest) {
+    j, ok := r.job(w)
+    if !ok {
+        return
+    }
+    j.cancel()
+    writeJSON(w, http.StatusAccepted, j.status())
+}
+
+// apiStreamJobResults GET /api/v1/jobs/{id}/results，以 JSON lines 格式
+// 在每个节点完成时输出其结果，全部完成后结束响应
+func apiStreamJobResults(w http.ResponseWriter, r *apiRequest) {
+    j, ok := r.job(w)
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+    w.WriteHeader(http.StatusOK)
+    flusher, _ := w.(http.Flusher)
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(false)
+
+    sent := make(map[int]bool)
+    for {
+        j.mu.Lock()
+        changed := j.changed
+        j.mu.Unlock()
+
+        s := j.status()
+        for i, t := range s.Tasks {
+            if !sent[i] && (t.State == taskDone || t.State == taskFailed) {
+                sent[i] = true
+                enc.Encode(t)
+            }
+        }
+        if flusher != nil {
+            flusher.Flush()
+        }
+        if s.State == "finished" {
+            return
+        }
+        select {
+        case <-changed:
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+// SSE 连接上发送注释行的间隔，避免代理因空闲断开连接
+const sseKeepAlive = 15 * time.Second
+
+// apiJobEvents GET /api/v1/jobs/{id}/events，以 Server-Sent Events 实时转发作业的输出。
+// 每个观看者都从第一个事件开始接收，断线重连时根据 Last-Event-ID 从下一个事件继续，
+// 作业结束后发送 done 事件并关闭连接
+func apiJobEvents(w http.ResponseWriter, r *apiRequest) {
+    j, ok := r.job(w)
+    if !ok {
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeError(w, http.StatusInternalServerError, "连接不支持流式输出")
+        return
+    }
+    seq := 0
+    if last := r.Header.Get("Last-Event-ID"); last != "" {
+        seq, _ = strconv.Atoi(last)
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    keepAlive := time.NewTicker(sseKeepAlive)
+    defer keepAlive.Stop()
+    for {
+        events, changed, finished := j.eventsSince(seq)
+        for _, ev := range events {
+            var data bytes.Buffer
+            enc := json.NewEncoder(&data)
+            enc.SetEscapeHTML(false)
+            if err := enc.Encode(ev.Data); err != nil {
+                continue
+            }
+            // Encode 输出的 JSON 以换行结尾，正好作为 data 行的结束
+            fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n", ev.Seq, ev.Type, data.Bytes())
+            seq = ev.Seq
+        }
+        flusher.Flush()
+        if finished {
+            // done 事件与结束状态在同一把锁下记录，此时已经发送
+            return
+        }
+        select {
+        case <-changed:
+        case <-keepAlive.C:
+            fmt.Fprint(w, ": keep-alive\n\n")
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+// job 解析路径中的作业编号并查找作业，失败时写入错误响应
+func (r *apiRequest) job(w http.ResponseWriter) (*job, bool) {
+    id, err := r.pathID(1)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return nil, false
+    }
+    j := getJob(id)
+    if j == nil {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有找到编号为 %d 的作业", id))
+        return nil, false
+    }
+    return j, true
+}
+
+// apiListQueue GET /api/v1/queue，node 和 state 参数过滤，不包含输出
+func apiListQueue(w http.ResponseWriter, r *apiRequest) {
+    clientID := 0
+    if node := r.URL.Query().Get("node"); node != "" {
+        id, err := strconv.Atoi(node)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "node 应为客户端编号")
+            return
+        }
+        clientID = id
+    }
+    list := queueSnapshot(clientID, r.URL.Query().Get("state"))
+    for i := range list {
+        list[i].Stdout, list[i].Stderr = "", ""
+    }
+    writeJSON(w, http.StatusOK, map[string]interface{}{"items": list})
+}
+
+// 排队命令的请求
+type enqueueRequest struct {
+    Command string `json:"command"`
+    Nodes   []int  `json:"nodes,omitempty"`
+    Target  string `json:"target,omitempty"`  // 代替 nodes: 编号列表、all、group:<分组> 或选择器，包括离线的节点
+    Timeout string `json:"timeout,omitempty"` // 例如 30s，默认使用 -timeout，0 表示不限制
+    TTL     string `json:"ttl,omitempty"`     // 有效期，例如 24h，默认使用 -queue-ttl，0 表示不过期
+
+    // 操作员在排队时预先生成的签名 (cmd/signer)，按节点ID索引，与命令一起保存，送达时原样转发。
+    // 指定后必须包含每个目标节点，且签名必须带有效期 (signer -ttl)；签名的过期时间早于 ttl 时命令随签名一起过期
+    Signatures map[string]*protocol.Signature `json:"signatures,omitempty"`
+}
+
+// apiEnqueue POST /api/v1/queue，为每个节点排队一条命令，返回排队的命令
+func apiEnqueue(w http.ResponseWriter, r *apiRequest) {
+    var body enqueueRequest
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSignedRequestBody))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "请求格式错误: "+err.Error())
+        return
+    }
+    if strings.TrimSpace(body.Command) == "" {
+        writeError(w, http.StatusBadRequest, "command 不能为空")
+        return
+    }
+    if (len(body.Nodes) == 0) == (body.Target == "") {
+        writeError(w, http.StatusBadRequest, "需要指定 nodes 或 target 其中之一")
+        return
+    }
+    timeout := commandTimeout
+    if body.Timeout != "" {
+        d, err := time.ParseDuration(body.Timeout)
+        if err != nil || d < 0 {
+            writeError(w, http.StatusBadRequest, "timeout 格式错误，例如 30s，0 表示不限制")
+            return
+        }
+        timeout = d
+    }
+    ttl := queueTTL
+    if body.TTL != "" {
+        d, err := time.ParseDuration(body.TTL)
+        if err != nil || d < 0 {
+            writeError(w, http.StatusBadRequest, "ttl 格式错误，例如 24h，0 表示不过期")
+            return
+        }
+        ttl = d
+    }
+
+    var (
+        targets []*client
+        err     error
+    )
+    if body.Target != "" {
+        if targets, err = selectTargets(body.Target, false); err != nil {
+            writeError(w, http.StatusBadRequest, err.Error())
+            return
+        }
+        if len(targets) == 0 {
+            writeError(w, http.StatusBadRequest, "没有匹配的客户端")
+            return
+        }
+    } else if targets, err = lookupClients(body.Nodes); err != nil {
+        writeError(w, http.StatusNotFound, err.Error())
+        return
+    }
+
+    signer, err := presignedFor("signatures", body.Signatures, targets)
+    if err == nil {
+        err = checkQueueSignatures(body.Signatures, targets)
+    }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    items, err := enqueueCommand(r.operator, targets, body.Command, timeout, ttl, signer)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    list := make([]queueItem, len(items))
+    for i, item := range items {
+        item, _ := getQueueItem(item.ID)
+        list[i] = item
+    }
+    writeJSON(w, http.StatusCreated, map[string]interface{}{"items": list})
+}
+
+// apiGetQueueItem GET /api/v1/queue/{id}，包含命令的输出
+func apiGetQueueItem(w http.ResponseWriter, r *apiRequest) {
+    id, err := r.pathID(1)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    item, ok := getQueueItem(id)
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有找到编号为 %d 的排队命令", id))
+        return
+    }
+    writeJSON(w, http.StatusOK, item)
+}
+
+// apiCancelQueueItem DELETE /api/v1/queue/{id}，取消尚未送达的命令
+func apiCancelQueueItem(w http.ResponseWriter, r *apiRequest) {
+    id, err := r.pathID(1)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    if _, ok := getQueueItem(id); !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("没有找到编号为 %d 的排队命令", id))
+        return
+    }
+    if err := cancelQueued(r.operator, id); err != nil {
+        writeError(w, http.StatusConflict, err.Error())
+        return
+    }
+    item, _ := getQueueItem(id)
+    writeJSON(w, http.StatusOK, item)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+func TestStreamTicket(t *testing.T) {
+    ticket, _, err := issueStreamTicket("carol", roleOperator, 7)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // 只能用于签发时指定的作业的 events 端点
+    for _, target := range []string{"/api/v1/jobs/8/events", "/api/v1/jobs/7", "/api/v1/nodes"} {
+        other, _, _ := issueStreamTicket("carol", roleOperator, 7)
+        if _, _, err := redeemStreamTicket(httptest.NewRequest("GET", target+"?ticket="+other, nil), other); err == nil {
+            t.Errorf("票据不应能用于 %s", target)
+        }
+    }
+    other, _, _ := issueStreamTicket("carol", roleOperator, 7)
+    if _, _, err := redeemStreamTicket(httptest.NewRequest("POST", "/api/v1/jobs/7/events", nil), other); err == nil {
+        t.Error("票据不应能用于 POST")
+    }
+
+    r := httptest.NewRequest("GET", "/api/v1/jobs/7/events?ticket="+ticket, nil)
+    account, role, err := redeemStreamTicket(r, ticket)
+    if err != nil {
+        t.Fatalf("票据应有效: %v", err)
+    }
+    if account.Name != "carol" || role != roleOperator {
+        t.Errorf("票据的操作员为 %s/%d，应为 carol/%d", account.Name, role, roleOperator)
+    }
+    if _, _, err := redeemStreamTicket(r, ticket); err == nil {
+        t.Error("票据只能使用一次")
+    }
+
+    expired, _, _ := issueStreamTicket("carol", roleOperator, 7)
+    ticketsMu.Lock()
+    tickets[apiTokenHash(expired)].expires = time.Now().Add(-time.Second)
+    ticketsMu.Unlock()
+    if _, _, err := redeemStreamTicket(httptest.NewRequest("GET", "/api/v1/jobs/7/events", nil), expired); err == nil {
+        t.Error("过期的票据不应有效")
+    }
+}
+
+func TestPresignedFor(t *testing.T) {
+    targets := []*client{{id: 1, nodeID: "node-a"}, {id: 2, nodeID: "node-b"}}
+    if signer, err := presignedFor("signatures", nil, targets); signer != nil || err != nil {
+        t.Errorf("没有签名时应不签名，得到 %v, %v", signer, err)
+    }
+    partial := map[string]*protocol.Signature{"node-a": {KeyID: "k"}}
+    if _, err := presignedFor("signatures", partial, targets); err == nil || !strings.Contains(err.Error(), "node-b") {
+        t.Errorf("缺少节点 node-b 的签名时应失败，得到 %v", err)
+    }
+    full := map[string]*protocol.Signature{"node-a": {KeyID: "k"}, "node-b": {KeyID: "k"}}
+    signer, err := presignedFor("signatures", full, targets)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sig, _ := signer.sign(protocol.SignKindExec, "node-b", "", time.Time{}); sig != full["node-b"] {
+        t.Errorf("应原样返回节点 node-b 的签名，得到 %+v", sig)
+    }
+}
+
+func TestCheckQueueSignatures(t *testing.T) {
+    targets := []*client{{id: 1, nodeID: "node-a"}, {id: 2, nodeID: "node-b"}}
+    if err := checkQueueSignatures(nil, targets); err != nil {
+        t.Errorf("没有签名时应通过，得到 %v", err)
+    }
+    expires := time.Now().Add(time.Hour).UnixMilli()
+    sigs := map[string]*protocol.Signature{"node-a": {KeyID: "k", Expires: expires}, "node-b": {KeyID: "k", Expires: expires}}
+    if err := checkQueueSignatures(sigs, targets); err != nil {
+        t.Errorf("签名都带有效期时应通过，得到 %v", err)
+    }
+    sigs["node-b"] = &protocol.Signature{KeyID: "k"}
+    if err := checkQueueSignatures(sigs, targets); err == nil || !strings.Contains(err.Error(), "signer -ttl") {
+        t.Errorf("节点 node-b 的签名没有有效期时应失败并提示 signer -ttl，得到 %v", err)
+    }
+}
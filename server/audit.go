@@ -0,0 +1,604 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+var (
+    auditFile      string
+    auditHashChain bool
+    auditKeyFile   string
+    audit          *auditLog
+)
+
+// hashHMAC 记录的哈希使用 -audit-key 的密钥计算 HMAC-SHA256，没有密钥无法伪造
+const hashHMAC = "hmac-sha256"
+
+// consoleOperator 服务端控制台的操作员，即运行服务端的系统用户
+var consoleOperator = func() string {
+    if u, err := user.Current(); err == nil {
+        return "console:" + u.Username
+    }
+    return "console"
+}()
+
+// 审计日志的一条记录
+type auditEntry struct {
+    Seq         uint64    `json:"seq"`
+    Time        time.Time `json:"time"`
+    Operator    string    `json:"operator,omitempty"`
+    Action      string    `json:"action"`
+    ClientID    int       `json:"client_id,omitempty"`
+    NodeID      string    `json:"node_id,omitempty"`
+    Address     string    `json:"address,omitempty"`
+    RequestID   uint32    `json:"request_id,omitempty"`
+    Command     string    `json:"command,omitempty"`
+    KeyID       string    `json:"key_id,omitempty"` // 请求签名的公钥指纹
+    Result      string    `json:"result,omitempty"` // ok、failed、timed_out、canceled、policy_denied、error、client_gone
+    ExitCode    *int      `json:"exit_code,omitempty"`
+    DurationMs  int64     `json:"duration_ms,omitempty"`
+    StdoutBytes int64     `json:"stdout_bytes,omitempty"`
+    StderrBytes int64     `json:"stderr_bytes,omitempty"`
+    Detail      string    `json:"detail,omitempty"`
+    PrevHash    string    `json:"prev_hash,omitempty"` // 上一条记录的哈希，启用哈希链时有效
+    HashAlg     string    `json:"hash_alg,omitempty"`  // 为 hmac-sha256 时使用密钥计算，为空时是 SHA-256
+    Hash        string    `json:"hash,omitempty"`      // 本条记录 (不含 hash 字段) 的哈希
+}
+
+// auditLog 只追加的 JSON lines 审计日志。启用哈希链时每条记录包含上一条
+// 记录的哈希，删除或修改任何一条都会使之后的校验失败；最后一条记录的序号和
+// 哈希同时保存在数据库中，用于发现日志末尾被截断
+type auditLog struct {
+    mu       sync.Mutex
+    path     string
+    f        *os.File
+    chain    bool
+    key      []byte // HMAC 密钥，为 nil 时使用 SHA-256
+    store    *store // 保存最后一条记录，为 nil 时不保存
+    seq      uint64
+    lastHash string
+}
+
+// openAuditLog 打开审计日志，从最后一条记录继续编号和哈希链。日志已经使用
+// 哈希链或 HMAC 时继续使用，不会因为启动参数不同而中断；key 为 nil 时不使用 HMAC，
+// s 为 nil 时不在数据库中保存最后一条记录
+func openAuditLog(path string, chain bool, key []byte, s *store) (*auditLog, error) {
+    path, err := filepath.Abs(path)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, err
+    }
+    l := &auditLog{path: path, chain: chain || key != nil, key: key, store: s}
+    last, err := lastAuditEntry(path)
+    if err != nil {
+        return nil, err
+    }
+    if last != nil {
+        if last.HashAlg == hashHMAC && key == nil {
+            return nil, errors.New("审计日志使用 HMAC，需要用 -audit-key 指定密钥")
+        }
+        if last.Hash != "" && !l.chain {
+            fmt.Println("审计日志已经使用哈希链，继续使用")
+            l.chain = true
+        }
+        l.seq = last.Seq
+        l.lastHash = last.Hash
+    }
+
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return nil, fmt.Errorf("打开审计日志失败: %v", err)
+    }
+    l.f = f
+
+    // 日志中的最后一条早于数据库中的记录，说明末尾被截断或修改，记录下来，
+    // 之后的写入会覆盖数据库中的记录
+    if problem, err := l.checkHead(last); err != nil {
+        f.Close()
+        return nil, err
+    } else if problem != "" {
+        fmt.Printf("警告: %s，请使用 audit verify 检查\n", problem)
+        l.write(&auditEntry{Operator: consoleOperator, Action: "audit-mismatch", Detail: problem})
+    }
+    if l.chain && l.seq > 0 {
+        // 输出到服务端的日志中，可以与之后的 audit verify 结果对照
+        fmt.Printf("审计日志: %s，最后一条记录 #%d，哈希 %s\n", path, l.seq, l.lastHash)
+    }
+    return l, nil
+}
+
+// loadAuditKey 读取 HMAC 密钥文件，去掉首尾的空白
+func loadAuditKey(path string) ([]byte, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取审计日志密钥失败: %v", err)
+    }
+    key := bytes.TrimSpace(data)
+    if len(key) < 32 {
+        return nil, fmt.Errorf("审计日志密钥 %s 太短，至少需要 32 个字符", path)
+    }
+    return key, nil
+}
+
+// checkHead 比较日志的最后一条记录与数据库中保存的记录，一致时返回空字符串。
+// 日志中的记录可以多一条 (写入日志后、保存到数据库前服务端退出)
+func (l *auditLog) checkHead(last *auditEntry) (string, error) {
+    if l.store == nil {
+        return "", nil
+    }
+    head, err := l.store.loadAuditHead(l.path)
+    if err != nil || head == nil {
+        return "", err
+    }
+    var seq uint64
+    if last != nil {
+        seq = last.Seq
+    }
+    switch {
+    case seq < head.Seq:
+        return fmt.Sprintf("审计日志的最后一条为 #%d，数据库中记录的最后一条为 #%d，日志末尾的记录被删除", seq, head.Seq), nil
+    case seq == head.Seq && last.Hash != head.Hash:
+        return fmt.Sprintf("审计日志的最后一条 #%d 与数据库中记录的哈希不一致，记录被修改", seq), nil
+    }
+    return "", nil
+}
+
+func (l *auditLog) Close() error {
+    return l.f.Close()
+}
+
+// lastAuditEntry 读取日志的最后一条记录，日志不存在或为空时返回 nil
+func lastAuditEntry(path string) (*auditEntry, error) {
+    var last *auditEntry
+    err := scanAudit(path, func(e *auditEntry, _ []byte) error {
+        last = e
+        return nil
+    })
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    return last, err
+}
+
+// scanAudit 按顺序读取日志中的每条记录
+func scanAudit(path string, fn func(e *auditEntry, line []byte) error) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), protocol.MaxPayloadSize)
+    for n := 1; scanner.Scan(); n++ {
+        line := scanner.Bytes()
+        if len(line) == 0 {
+            continue
+        }
+        e := &auditEntry{}
+        if err := json.Unmarshal(line, e); err != nil {
+            return fmt.Errorf("审计日志第 %d 行无法解析: %v", n, err)
+        }
+        if err := fn(e, line); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+// entryHash 计算记录 (不含 hash 字段) 的哈希，hash_alg 为 hmac-sha256 时使用 key
+func entryHash(e *auditEntry, key []byte) string {
+    unhashed := *e
+    unhashed.Hash = ""
+    data, _ := json.Marshal(&unhashed)
+    if e.HashAlg == hashHMAC {
+        mac := hmac.New(sha256.New, key)
+        mac.Write(data)
+        return hex.EncodeToString(mac.Sum(nil))
+    }
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// write 追加一条记录并同步到磁盘
+func (l *auditLog) write(e *auditEntry) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.seq++
+    e.Seq = l.seq
+    if e.Time.IsZero() {
+        e.Time = time.Now()
+    }
+    if l.chain {
+        e.PrevHash = l.lastHash
+        if l.key != nil {
+            e.HashAlg = hashHMAC
+        }
+        e.Hash = entryHash(e, l.key)
+    }
+    data, err := json.Marshal(e)
+    if err == nil {
+        data = append(data, '\n')
+        if _, err = l.f.Write(data); err == nil {
+            err = l.f.Sync()
+        }
+    }
+    if err != nil {
+        fmt.Printf("写入审计日志失败: %v\n> ", err)
+        return
+    }
+    l.lastHash = e.Hash
+    if l.store != nil {
+        if err := l.store.saveAuditHead(l.path, &auditHead{Seq: e.Seq, Hash: e.Hash}); err != nil {
+            fmt.Printf("保存审计日志的最后一条记录失败: %v\n> ", err)
+        }
+    }
+}
+
+// auditEvent 记录一条审计日志，审计日志未打开时忽略
+func auditEvent(e *auditEntry) {
+    if audit != nil {
+        audit.write(e)
+    }
+}
+
+// auditClient 记录与客户端有关的事件
+func auditClient(c *client, operator, action, detail string) {
+    auditEvent(&auditEntry{
+        Operator: operator,
+        Action:   action,
+        ClientID: c.id,
+        NodeID:   c.nodeID,
+        Address:  c.addr,
+        Detail:   detail,
+    })
+}
+
+// auditStart 记录请求已发送给客户端
+func (ex *execution) auditStart() {
+    action := "exec-start"
+    if ex.kind == protocol.TypePTYOpen {
+        action = "pty-open"
+    }
+    auditEvent(&auditEntry{
+        Time:      ex.startedAt,
+        Operator:  ex.operator,
+        Action:    action,
+        ClientID:  ex.client.id,
+        NodeID:    ex.client.nodeID,
+        Address:   ex.client.addr,
+        RequestID: ex.id,
+        Command:   ex.command,
+        KeyID:     ex.keyID,
+    })
+}
+
+// auditFinish 记录请求的最终结果，frame 为 exit-status 或 error 帧，
+// 为 nil 表示客户端在请求结束前断开。同一个请求只记录第一次调用
+func (ex *execution) auditFinish(frame *protocol.Frame) {
+    if !ex.audited.CompareAndSwap(false, true) {
+        return
+    }
+    e := &auditEntry{
+        Operator:    ex.operator,
+        Action:      "exec",
+        ClientID:    ex.client.id,
+        NodeID:      ex.client.nodeID,
+        Address:     ex.client.addr,
+        RequestID:   ex.id,
+        Command:     ex.command,
+        DurationMs:  time.Since(ex.startedAt).Milliseconds(),
+        StdoutBytes: ex.stdoutBytes,
+        StderrBytes: ex.stderrBytes,
+    }
+    if ex.kind == protocol.TypePTYOpen {
+        e.Action = "pty-close"
+    }
+
+    switch {
+    case frame == nil:
+        e.Result = "client_gone"
+    case frame.Type == protocol.TypeError:
+        e.Result = "error"
+        e.Detail = string(frame.Payload)
+    default:
+        var status protocol.ExitStatus
+        if err := frame.Unmarshal(&status); err != nil {
+            e.Result = "error"
+            e.Detail = err.Error()
+            break
+        }
+        code := status.ExitCode
+        e.ExitCode = &code
+        e.Detail = status.Error
+        if status.DurationMs > 0 {
+            e.DurationMs = status.DurationMs
+        }
+        switch {
+        case status.PolicyDenied:
+            e.Result = "policy_denied"
+        case status.TimedOut:
+            e.Result = "timed_out"
+        case status.Canceled:
+            e.Result = "canceled"
+        case status.ExitCode == 0 && status.Error == "":
+            e.Result = "ok"
+        default:
+            e.Result = "failed"
+        }
+    }
+    auditEvent(e)
+}
+
+// 审计日志查询条件
+type auditQuery struct {
+    clientID int
+    since    time.Time
+    until    time.Time
+    text     string
+    limit    int
+}
+
+// parseAuditQuery 解析 audit 命令的参数:
+// [node <编号>] [since <时间>] [until <时间>] [limit <条数>] [关键字...]
+func parseAuditQuery(args []string) (*auditQuery, error) {
+    q := &auditQuery{limit: 50}
+    var words []string
+    for i := 0; i < len(args); i++ {
+        key := args[i]
+        if key != "node" && key != "since" && key != "until" && key != "limit" {
+            words = append(words, key)
+            continue
+        }
+        if i+1 >= len(args) {
+            return nil, fmt.Errorf("%s 缺少参数", key)
+        }
+        i++
+        value := args[i]
+        var err error
+        switch key {
+        case "node":
+            q.clientID, err = strconv.Atoi(value)
+        case "since":
+            q.since, err = parseAuditTime(value)
+        case "until":
+            q.until, err = parseAuditTime(value)
+        case "limit":
+            q.limit, err = strconv.Atoi(value)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s 的参数无效: %s", key, value)
+        }
+    }
+    q.text = strings.ToLower(strings.Join(words, " "))
+    return q, nil
+}
+
+// parseAuditTime 解析时间: 2006-01-02、2006-01-02T15:04:05，或 1h 这样的时长表示多久以前
+func parseAuditTime(s string) (time.Time, error) {
+    if d, err := time.ParseDuration(s); err == nil {
+        return time.Now().Add(-d), nil
+    }
+    for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    return time.Parse(time.RFC3339, s)
+}
+
+func (q *auditQuery) match(e *auditEntry, line []byte) bool {
+    if q.clientID != 0 && e.ClientID != q.clientID {
+        return false
+    }
+    if !q.since.IsZero() && e.Time.Before(q.since) {
+        return false
+    }
+    if !q.until.IsZero() && e.Time.After(q.until) {
+        return false
+    }
+    return q.text == "" || strings.Contains(strings.ToLower(string(line)), q.text)
+}
+
+// queryAudit 返回最近 limit 条符合条件的记录
+func queryAudit(q *auditQuery) ([]*auditEntry, error) {
+    var entries []*auditEntry
+    err := scanAudit(audit.path, func(e *auditEntry, line []byte) error {
+        if q.match(e, line) {
+            entries = append(entries, e)
+            if q.limit > 0 && len(entries) > q.limit {
+                entries = entries[1:]
+            }
+        }
+        return nil
+    })
+    return entries, err
+}
+
+// showAudit 处理 audit 命令
+func showAudit(w io.Writer, args []string) {
+    if audit == nil {
+        fmt.Fprintln(w, "审计日志未启用")
+        return
+    }
+    if len(args) == 1 && args[0] == "verify" {
+        verifyAudit(w)
+        return
+    }
+
+    q, err := parseAuditQuery(args)
+    if err != nil {
+        fmt.Fprintf(w, "%v\n命令格式: audit [node <客户端编号>] [since <时间>] [until <时间>] [limit <条数>] [关键字]\n", err)
+        return
+    }
+    entries, err := queryAudit(q)
+    if err != nil {
+        fmt.Fprintf(w, "读取审计日志失败: %v\n", err)
+        return
+    }
+    if len(entries) == 0 {
+        fmt.Fprintln(w, "没有匹配的审计记录")
+        return
+    }
+    for _, e := range entries {
+        fmt.Fprintln(w, e.summary())
+    }
+}
+
+// summary 返回记录的单行描述
+func (e *auditEntry) summary() string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "%s #%d", e.Time.Format("2006-01-02 15:04:05"), e.Seq)
+    if e.Operator != "" {
+        fmt.Fprintf(&b, " [%s]", e.Operator)
+    }
+    fmt.Fprintf(&b, " %s", e.Action)
+    if e.ClientID != 0 {
+        fmt.Fprintf(&b, " 客户端 %d", e.ClientID)
+    }
+    if e.RequestID != 0 {
+        fmt.Fprintf(&b, " [%d]", e.RequestID)
+    }
+    if e.Command != "" {
+        fmt.Fprintf(&b, ": %s", e.Command)
+    }
+    if e.KeyID != "" {
+        fmt.Fprintf(&b, " [签名: %s]", e.KeyID)
+    }
+    if e.Result != "" {
+        fmt.Fprintf(&b, " => %s", e.Result)
+    }
+    if e.ExitCode != nil {
+        fmt.Fprintf(&b, ", 退出码: %d", *e.ExitCode)
+    }
+    if e.Action == "exec" || e.Action == "pty-close" {
+        fmt.Fprintf(&b, ", 耗时: %s, 输出: %d/%d 字节", time.Duration(e.DurationMs)*time.Millisecond, e.StdoutBytes, e.StderrBytes)
+    }
+    if e.Detail != "" {
+        fmt.Fprintf(&b, " (%s)", e.Detail)
+    }
+    return b.String()
+}
+
+// verifyAudit 校验审计日志
+func verifyAudit(w io.Writer) {
+    audit.verify(w)
+}
+
+// verify 校验序号的连续性和哈希链，并与数据库中保存的最后一条记录比较。
+// 哈希链开始后，缺少哈希的记录视为被修改；出现 HMAC 记录后，改用 SHA-256 的记录同样视为被修改
+func (l *auditLog) verify(w io.Writer) {
+    // 先读数据库再读日志，校验期间写入的记录只会使日志更长
+    var head *auditHead
+    if l.store != nil {
+        var err error
+        if head, err = l.store.loadAuditHead(l.path); err != nil {
+            fmt.Fprintf(w, "读取数据库中的审计日志记录失败: %v\n", err)
+            return
+        }
+    }
+
+    var prev *auditEntry
+    total, chained, problems := 0, 0, 0
+    keyed := false
+    err := scanAudit(l.path, func(e *auditEntry, _ []byte) error {
+        total++
+        switch {
+        case prev == nil && e.Seq != 1:
+            fmt.Fprintf(w, "  #%d: 日志应从 #1 开始，开头的记录被删除\n", e.Seq)
+            problems++
+        case prev != nil && e.Seq != prev.Seq+1:
+            fmt.Fprintf(w, "  #%d: 序号不连续 (上一条为 #%d)\n", e.Seq, prev.Seq)
+            problems++
+        }
+        if e.Action == "audit-mismatch" {
+            // 启动时发现的问题，之后的写入已经覆盖了数据库中的记录
+            fmt.Fprintf(w, "  #%d: 启动时发现: %s\n", e.Seq, e.Detail)
+            problems++
+        }
+        if e.Hash == "" {
+            if chained > 0 {
+                fmt.Fprintf(w, "  #%d: 缺少哈希，哈希链开始后的每条记录都应带哈希\n", e.Seq)
+                problems++
+            }
+            prev = e
+            return nil
+        }
+
+        chained++
+        switch {
+        case e.HashAlg == hashHMAC:
+            keyed = true
+            if l.key == nil {
+                fmt.Fprintf(w, "  #%d: 使用 HMAC，需要用 -audit-key 指定密钥才能校验\n", e.Seq)
+                problems++
+            } else if !hmac.Equal([]byte(entryHash(e, l.key)), []byte(e.Hash)) {
+                fmt.Fprintf(w, "  #%d: 哈希不匹配，记录已被修改\n", e.Seq)
+                problems++
+            }
+        case e.HashAlg != "":
+            fmt.Fprintf(w, "  #%d: 未知的哈希算法 %s\n", e.Seq, e.HashAlg)
+            problems++
+        case keyed:
+            fmt.Fprintf(w, "  #%d: 没有使用 HMAC，之前的记录已经使用，记录可能被替换\n", e.Seq)
+            problems++
+        case entryHash(e, nil) != e.Hash:
+            fmt.Fprintf(w, "  #%d: 哈希不匹配，记录已被修改\n", e.Seq)
+            problems++
+        }
+        // 日志开头或启用哈希链之前的记录没有哈希，此时 prev_hash 应为空
+        prevHash := ""
+        if prev != nil {
+            prevHash = prev.Hash
+        }
+        if e.PrevHash != prevHash {
+            fmt.Fprintf(w, "  #%d: 与上一条记录的哈希不连续，可能有记录被删除或插入\n", e.Seq)
+            problems++
+        }
+        prev = e
+        return nil
+    })
+    if err != nil && !(os.IsNotExist(err) && head != nil) {
+        fmt.Fprintf(w, "读取审计日志失败: %v\n", err)
+        return
+    }
+    if head != nil {
+        var seq uint64
+        if prev != nil {
+            seq = prev.Seq
+        }
+        switch {
+        case seq < head.Seq:
+            fmt.Fprintf(w, "  日志的最后一条为 #%d，数据库中记录的最后一条为 #%d，日志末尾的记录被删除\n", seq, head.Seq)
+            problems++
+        case seq == head.Seq && prev.Hash != head.Hash:
+            fmt.Fprintf(w, "  #%d: 与数据库中记录的最后一条的哈希不一致，记录被修改\n", seq)
+            problems++
+        }
+    }
+    if problems > 0 {
+        fmt.Fprintf(w, "审计日志校验失败，发现 %d 个问题\n", problems)
+        return
+    }
+    fmt.Fprintf(w, "审计日志校验通过，共 %d 条记录，其中 %d 条带哈希链\n", total, chained)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestAuditLog 在临时目录中创建带哈希链的审计日志并写入 4 条记录
+func newTestAuditLog(t *testing.T, key []byte) *auditLog {
+    t.Helper()
+    dir := t.TempDir()
+    s, err := openStore(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    l, err := openAuditLog(filepath.Join(dir, "audit.log"), true, key, s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        l.Close()
+        s.Close()
+    })
+    for _, command := range []string{"uptime", "hostname", "df -h", "whoami"} {
+        l.write(&auditEntry{Operator: "alice", Action: "exec-start", ClientID: 1, Command: command})
+    }
+    return l
+}
+
+func readAuditEntries(t *testing.T, path string) []*auditEntry {
+    t.Helper()
+    var entries []*auditEntry
+    if err := scanAudit(path, func(e *auditEntry, _ []byte) error {
+        entries = append(entries, e)
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+    return entries
+}
+
+func writeAuditEntries(t *testing.T, path string, entries []*auditEntry) {
+    t.Helper()
+    var b bytes.Buffer
+    for _, e := range entries {
+        data, err := json.Marshal(e)
+        if err != nil {
+            t.Fatal(err)
+        }
+        b.Write(data)
+        b.WriteByte('\n')
+    }
+    if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestVerifyAudit(t *testing.T) {
+    tests := []struct {
+        name   string
+        key    []byte
+        tamper func([]*auditEntry) []*auditEntry
+        want   string
+    }{
+        {"未修改", nil, nil, "审计日志校验通过"},
+        {"HMAC 未修改", testAuditKey, nil, "审计日志校验通过"},
+        {"修改记录", nil, func(es []*auditEntry) []*auditEntry {
+            es[1].Command = "rm -rf /"
+            return es
+        }, "#2: 哈希不匹配"},
+        {"修改记录并删除哈希", nil, func(es []*auditEntry) []*auditEntry {
+            es[1].Command = "rm -rf /"
+            es[1].Hash, es[1].PrevHash = "", ""
+            return es
+        }, "#2: 缺少哈希"},
+        {"删除中间的记录", nil, func(es []*auditEntry) []*auditEntry {
+            return append(es[:1], es[2:]...)
+        }, "#3: 序号不连续"},
+        {"删除开头的记录", nil, func(es []*auditEntry) []*auditEntry {
+            return es[1:]
+        }, "#2: 日志应从 #1 开始"},
+        {"截断末尾", nil, func(es []*auditEntry) []*auditEntry {
+            return es[:3]
+        }, "日志末尾的记录被删除"},
+        {"删除所有哈希", nil, func(es []*auditEntry) []*auditEntry {
+            for _, e := range es {
+                e.Hash, e.PrevHash = "", ""
+            }
+            return es
+        }, "#4: 与数据库中记录的最后一条的哈希不一致"},
+        {"用 SHA-256 替换 HMAC", testAuditKey, func(es []*auditEntry) []*auditEntry {
+            for _, e := range es[1:] {
+                e.Command = "rm -rf /"
+                e.HashAlg = ""
+                e.Hash = entryHash(e, nil)
+            }
+            return es
+        }, "#2: 没有使用 HMAC"},
+        {"用其他密钥伪造 HMAC", testAuditKey, func(es []*auditEntry) []*auditEntry {
+            es[3].Command = "rm -rf /"
+            es[3].Hash = entryHash(es[3], []byte("another key, not the audit key!!"))
+            return es
+        }, "#4: 哈希不匹配"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            l := newTestAuditLog(t, tt.key)
+            if tt.tamper != nil {
+                writeAuditEntries(t, l.path, tt.tamper(readAuditEntries(t, l.path)))
+            }
+            var out bytes.Buffer
+            l.verify(&out)
+            if !strings.Contains(out.String(), tt.want) {
+                t.Errorf("校验结果为:\n%s应包含 %q", out.String(), tt.want)
+            }
+        })
+    }
+}
+
+func TestOpenAuditLogTruncated(t *testing.T) {
+    l := newTestAuditLog(t, nil)
+    l.Close()
+    writeAuditEntries(t, l.path, readAuditEntries(t, l.path)[:2])
+
+    // 不带 -audit-hash-chain 重新打开，仍继续哈希链，并记录日志被截断
+    reopened, err := openAuditLog(l.path, false, nil, l.store)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reopened.Close()
+    if !reopened.chain {
+        t.Error("日志已经使用哈希链，重新打开后应继续使用")
+    }
+    entries := readAuditEntries(t, l.path)
+    last := entries[len(entries)-1]
+    if last.Action != "audit-mismatch" || last.Seq != 3 || last.Hash == "" {
+        t.Errorf("最后一条记录为 %+v，应为带哈希的 #3 audit-mismatch", last)
+    }
+    var out bytes.Buffer
+    reopened.verify(&out)
+    if !strings.Contains(out.String(), "#3: 启动时发现") {
+        t.Errorf("校验结果为:\n%s应报告启动时发现的截断", out.String())
+    }
+}
+
+func TestOpenAuditLogNeedsKey(t *testing.T) {
+    l := newTestAuditLog(t, testAuditKey)
+    if _, err := openAuditLog(l.path, true, nil, nil); err == nil {
+        t.Error("日志使用 HMAC 时，没有密钥应无法打开")
+    }
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+    "bytes"
+    "io"
+    "os"
+    "unicode/utf8"
+)
+
+// 控制台输入的一次读取结果
+type consoleChunk struct {
+    data []byte
+    err  error
+}
+
+// console 服务端的标准输入。只有一个协程读取 os.Stdin，行模式的命令
+// 提示符和原始模式的终端会话共用它，切换模式时不会丢失或抢读数据
+type console struct {
+    chunks  chan consoleChunk
+    done    chan struct{} // 关闭后读取协程不再发送，读到错误或下一段输入时退出
+    pending []byte
+    err     error
+}
+
+var stdin = newConsole(os.Stdin)
+
+func newConsole(r io.Reader) *console {
+    c := &console{chunks: make(chan consoleChunk), done: make(chan struct{})}
+    go func() {
+        send := func(chunk consoleChunk) bool {
+            select {
+            case c.chunks <- chunk:
+                return true
+            case <-c.done:
+                return false
+            }
+        }
+        for {
+            buf := make([]byte, 4096)
+            n, err := r.Read(buf)
+            if n > 0 && !send(consoleChunk{data: buf[:n]}) {
+                return
+            }
+            if err != nil {
+                send(consoleChunk{err: err})
+                return
+            }
+        }
+    }()
+    return c
+}
+
+// close 在会话结束后调用，不再有人读取时让读取协程退出，而不是永远阻塞在发送上。
+// 读取协程在 r.Read 返回后退出，调用者还需要关闭 r (例如 SSH 通道)
+func (c *console) close() {
+    close(c.done)
+}
+
+// ReadString 读取到 delim 为止的内容 (包含 delim)，与 bufio.Reader 的语义相同
+func (c *console) ReadString(delim byte) (string, error) {
+    for {
+        if i := bytes.IndexByte(c.pending, delim); i >= 0 {
+            line := string(c.pending[:i+1])
+            c.pending = c.pending[i+1:]
+            return line, nil
+        }
+        if c.err != nil {
+            line := string(c.pending)
+            c.pending = nil
+            return line, c.err
+        }
+        chunk := <-c.chunks
+        c.pending = append(c.pending, chunk.data...)
+        c.err = chunk.err
+    }
+}
+
+// readChunk 读取当前可用的原始输入，stop 被关闭时返回 nil, nil
+func (c *console) readChunk(stop <-chan struct{}) ([]byte, error) {
+    if len(c.pending) > 0 {
+        data := c.pending
+        c.pending = nil
+        return data, nil
+    }
+    if c.err != nil {
+        return nil, c.err
+    }
+    select {
+    case <-stop:
+        return nil, nil
+    case chunk := <-c.chunks:
+        c.err = chunk.err
+        return chunk.data, chunk.err
+    }
+}
+
+// unread 把数据放回输入的开头，下一次读取时首先返回
+func (c *console) unread(data []byte) {
+    if len(data) > 0 {
+        c.pending = append(append([]byte(nil), data...), c.pending...)
+    }
+}
+
+// readLine 从原始模式的终端 (例如管理端口的 SSH 会话) 读取一行，
+// 自行回显输入并处理退格、Ctrl-U、Ctrl-C 和 Ctrl-D，忽略方向键等转义序列。
+// Ctrl-C 放弃当前行并返回空行，空行上的 Ctrl-D 返回 io.EOF
+func (c *console) readLine(echo io.Writer) (string, error) {
+    var line []rune
+    for {
+        data, err := c.readChunk(nil)
+        if len(data) == 0 && err != nil {
+            return "", err
+        }
+
+        for i := 0; i < len(data); i++ {
+            b := data[i]
+            switch {
+            case b == '\r' || b == '\n':
+                if b == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+                    i++
+                }
+                echo.Write([]byte("\r\n"))
+                c.unread(data[i+1:])
+                return string(line), nil
+            case b == 0x7f || b == 0x08:
+                if len(line) > 0 {
+                    line = line[:len(line)-1]
+                    echo.Write([]byte("\b \b"))
+                }
+            case b == 0x15: // Ctrl-U
+                echo.Write(bytes.Repeat([]byte("\b \b"), len(line)))
+                line = line[:0]
+            case b == 0x03: // Ctrl-C
+                echo.Write([]byte("^C\r\n"))
+                c.unread(data[i+1:])
+                return "", nil
+            case b == 0x04: // Ctrl-D
+                if len(line) == 0 {
+                    return "", io.EOF
+                }
+            case b == 0x1b:
+                // 跳过 ESC [ ... 或 ESC O x 形式的转义序列
+                if i+1 < len(data) && (data[i+1] == '[' || data[i+1] == 'O') {
+                    i += 2
+                    for i < len(data) && (data[i] < 0x40 || data[i] > 0x7e) {
+                        i++
+                    }
+                }
+            case b < 0x20:
+                // 忽略其他控制字符
+            default:
+                r, size := utf8.DecodeRune(data[i:])
+                if r == utf8.RuneError && size <= 1 && !utf8.FullRune(data[i:]) {
+                    // 多字节字符被分在两次读取之间
+                    c.unread(data[i:])
+                    data = data[:i]
+                    break
+                }
+                line = append(line, r)
+                echo.Write(data[i : i+size])
+                i += size - 1
+            }
+        }
+        if err != nil {
+            return "", err
+        }
+    }
+}
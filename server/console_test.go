@@ -0,0 +1,68 @@
+package server
+
+import (
+    "bytes"
+    "io"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// endlessReader 每次读取都返回一行，记录被读取的次数
+type endlessReader struct {
+    reads atomic.Int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+    r.reads.Add(1)
+    return copy(p, "line\n"), nil
+}
+
+func TestConsoleClose(t *testing.T) {
+    r := &endlessReader{}
+    c := newConsole(r)
+    if line, err := c.ReadString('\n'); line != "line\n" || err != nil {
+        t.Fatalf("ReadString = %q, %v", line, err)
+    }
+    c.close()
+
+    // 关闭后读取协程最多再读取一次，之后退出
+    time.Sleep(50 * time.Millisecond)
+    before := r.reads.Load()
+    time.Sleep(50 * time.Millisecond)
+    if after := r.reads.Load(); after != before {
+        t.Errorf("关闭后读取协程仍在读取: %d -> %d", before, after)
+    }
+}
+
+func TestConsoleReadLine(t *testing.T) {
+    tests := []struct {
+        input string
+        lines []string
+        echo  string
+    }{
+        {input: "list\r", lines: []string{"list"}, echo: "list\r\n"},
+        {input: "ab\x7fc\r\n", lines: []string{"ac"}, echo: "ab\b \bc\r\n"},
+        {input: "xyz\x15ok\r", lines: []string{"ok"}, echo: "xyz\b \b\b \b\b \bok\r\n"},
+        {input: "a\x1b[Ab\r", lines: []string{"ab"}, echo: "ab\r\n"},
+        {input: "bad\x03good\r", lines: []string{"", "good"}, echo: "bad^C\r\ngood\r\n"},
+        {input: "中文\rnext\r", lines: []string{"中文", "next"}, echo: "中文\r\nnext\r\n"},
+    }
+    for _, tt := range tests {
+        c := newConsole(strings.NewReader(tt.input))
+        var echo bytes.Buffer
+        for _, want := range tt.lines {
+            if got, err := c.readLine(&echo); got != want || err != nil {
+                t.Errorf("输入 %q: readLine = %q, %v，应为 %q", tt.input, got, err, want)
+            }
+        }
+        if echo.String() != tt.echo {
+            t.Errorf("输入 %q 的回显为 %q，应为 %q", tt.input, echo.String(), tt.echo)
+        }
+        if _, err := c.readLine(&echo); err != io.EOF {
+            t.Errorf("输入 %q 结束后 readLine 返回 %v，应为 io.EOF", tt.input, err)
+        }
+        c.close()
+    }
+}
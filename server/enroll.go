@@ -0,0 +1,236 @@
+package server
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+
+    "serverandclient/protocol"
+)
+
+// 节点的审批状态，只有已批准的节点可以接收命令
+const (
+    approvalPending  = "pending"
+    approvalApproved = "approved"
+    approvalRejected = "rejected"
+)
+
+var (
+    enrollTokenFile string
+    autoApprove     bool
+    enrollTokens    []string // 有效的注册令牌
+)
+
+var errNotApproved = errors.New("客户端尚未通过审批")
+
+// loadEnrollTokens 读取注册令牌文件，每行一个令牌，# 开头的行为注释。
+// 同时允许多个令牌，便于轮换
+func loadEnrollTokens(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取注册令牌失败: %v", err)
+    }
+    defer f.Close()
+
+    var tokens []string
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        tokens = append(tokens, line)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if len(tokens) == 0 {
+        return nil, fmt.Errorf("注册令牌文件 %s 中没有令牌", path)
+    }
+    return tokens, nil
+}
+
+func validEnrollToken(token string) bool {
+    valid := false
+    for _, t := range enrollTokens {
+        if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+            valid = true
+        }
+    }
+    return valid
+}
+
+// newNodeSecret 生成颁发给节点的密钥，返回密钥和保存在服务端的哈希
+func newNodeSecret() (secret, hash string, err error) {
+    var b [32]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", "", err
+    }
+    secret = hex.EncodeToString(b[:])
+    return secret, nodeSecretHash(secret), nil
+}
+
+func nodeSecretHash(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// enrollmentStatus 决定握手的节点的审批状态。节点ID可以被其他人读到，不能证明身份，
+// 已知的节点需要出示颁发给它的节点密钥 (已颁发时必须出示)，或者以绑定的证书身份
+// identity 连接，proven 表示证明了身份。已拒绝的节点不允许连接；已批准的节点证明身份后
+// 直接通过，否则与新节点一样: 出示有效令牌 (或开启了 -auto-approve) 时自动批准，
+// 否则进入待审批状态。没有证明身份的连接不能替代在线的同一节点
+func enrollmentStatus(hello *protocol.Hello, identity string) (approval string, proven bool, err error) {
+    mu.Lock()
+    var known *client
+    if id, ok := nodeIDs[hello.NodeID]; ok && hello.NodeID != "" {
+        known = clients[id]
+    }
+    recorded, secretHash, bound, online := "", "", "", false
+    if known != nil {
+        recorded, secretHash, bound, online = known.approval, known.secretHash, known.certIdentity, known.online
+    }
+    mu.Unlock()
+
+    if recorded == approvalRejected {
+        return "", false, fmt.Errorf("节点 %s 已被拒绝", hello.NodeID)
+    }
+    if secretHash != "" {
+        if subtle.ConstantTimeCompare([]byte(nodeSecretHash(hello.NodeSecret)), []byte(secretHash)) != 1 {
+            return "", false, fmt.Errorf("节点 %s 的节点密钥不正确", hello.NodeID)
+        }
+        proven = true
+    } else if identity != "" && identity == bound {
+        proven = true
+    }
+    if known != nil && !proven && online {
+        return "", false, fmt.Errorf("节点 %s 已在线，无法证明身份的连接不能替代它", hello.NodeID)
+    }
+    if proven && recorded == approvalApproved {
+        return approvalApproved, true, nil
+    }
+
+    if hello.EnrollToken != "" {
+        if !validEnrollToken(hello.EnrollToken) {
+            return "", false, errors.New("注册令牌无效")
+        }
+        return approvalApproved, proven, nil
+    }
+    if autoApprove {
+        return approvalApproved, proven, nil
+    }
+    return approvalPending, proven, nil
+}
+
+// approvalLocked 返回审批状态的描述，已批准时为空，调用者需持有 mu
+func (c *client) approvalLocked() string {
+    switch c.approval {
+    case approvalPending:
+        return "待审批"
+    case approvalRejected:
+        return "已拒绝"
+    }
+    return ""
+}
+
+func (c *client) isApproved() bool {
+    mu.Lock()
+    defer mu.Unlock()
+    return c.approval == approvalApproved
+}
+
+// listPending 列出等待审批的客户端
+func listPending(w io.Writer) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    found := false
+    for _, id := range sortedClientIDs() {
+        c := clients[id]
+        if c.approval != approvalPending {
+            continue
+        }
+        if !found {
+            fmt.Fprintln(w, "等待审批的客户端:")
+            found = true
+        }
+        hostname := ""
+        if info := clientInfo[id]; info != nil {
+            hostname = info.Hostname
+        }
+        fmt.Fprintf(w, "  客户端 %d [%s]: 节点ID: %s, 主机名: %s, IP地址: %s, 版本: %s, 系统: %s/%s, 首次连接: %s\n",
+            id, c.statusLocked(), c.nodeID, hostname, c.addr, c.hello.BuildVersion, c.hello.OS, c.hello.Arch,
+            c.firstSeen.Format("2006-01-02 15:04:05"))
+        if c.certIdentity != "" {
+            fmt.Fprintf(w, "           证书身份: %s\n", c.certIdentity)
+        }
+    }
+    if !found {
+        fmt.Fprintln(w, "没有等待审批的客户端")
+    }
+}
+
+// setApproval 由操作员 operator 批准或拒绝客户端并持久化，拒绝时断开其连接
+func setApproval(w io.Writer, operator string, id int, approval string) {
+    mu.Lock()
+    c, ok := clients[id]
+    if ok {
+        c.approval = approval
+    }
+    online := ok && c.online
+    mu.Unlock()
+
+    if !ok {
+        fmt.Fprintf(w, "没有找到编号为 %d 的客户端\n", id)
+        return
+    }
+    persistClients(c)
+    action := "approve"
+    if approval == approvalRejected {
+        action = "reject"
+    }
+    auditClient(c, operator, action, "")
+
+    if approval == approvalApproved {
+        fmt.Fprintf(w, "客户端 %d (节点ID: %s) 已批准\n", id, c.nodeID)
+        go deliverQueued(id)
+        return
+    }
+    fmt.Fprintf(w, "客户端 %d (节点ID: %s) 已拒绝，之后不再接受该节点的连接\n", id, c.nodeID)
+    if online {
+        markOffline(c)
+    }
+}
+
+// resetNodeSecret 由操作员 operator 清除客户端的节点密钥 (例如节点重新安装后丢失了密钥)，
+// 节点下次连接时颁发新的密钥，并需要重新审批
+func resetNodeSecret(w io.Writer, operator string, id int) {
+    mu.Lock()
+    c, ok := clients[id]
+    if ok {
+        c.secretHash = ""
+        if c.approval == approvalApproved {
+            c.approval = approvalPending
+        }
+    }
+    online := ok && c.online
+    mu.Unlock()
+
+    if !ok {
+        fmt.Fprintf(w, "没有找到编号为 %d 的客户端\n", id)
+        return
+    }
+    persistClients(c)
+    auditClient(c, operator, "rekey", "")
+    fmt.Fprintf(w, "客户端 %d (节点ID: %s) 的节点密钥已清除，节点下次连接时颁发新的密钥，需要重新批准\n", id, c.nodeID)
+    if online {
+        markOffline(c)
+    }
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+    "testing"
+
+    "serverandclient/protocol"
+)
+
+// withNodes 在测试期间使用给定的客户端，并按节点ID建立索引
+func withNodes(t *testing.T, cs ...*client) {
+    t.Helper()
+    mu.Lock()
+    savedClients, savedNodeIDs := clients, nodeIDs
+    clients, nodeIDs = make(map[int]*client), make(map[string]int)
+    for _, c := range cs {
+        clients[c.id] = c
+        nodeIDs[c.nodeID] = c.id
+    }
+    mu.Unlock()
+    savedAuto, savedTokens := autoApprove, enrollTokens
+    t.Cleanup(func() {
+        mu.Lock()
+        clients, nodeIDs = savedClients, savedNodeIDs
+        mu.Unlock()
+        autoApprove, enrollTokens = savedAuto, savedTokens
+    })
+}
+
+func TestNodeSecret(t *testing.T) {
+    secret, hash, err := newNodeSecret()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(secret) != 64 || hash != nodeSecretHash(secret) || hash == secret {
+        t.Errorf("密钥 %q 的哈希为 %q", secret, hash)
+    }
+    other, _, _ := newNodeSecret()
+    if other == secret {
+        t.Error("两次生成的密钥相同")
+    }
+}
+
+func TestEnrollmentStatus(t *testing.T) {
+    const secret = "node-secret-of-node-a"
+    withNodes(t,
+        &client{id: 1, nodeID: "node-a", approval: approvalApproved, secretHash: nodeSecretHash(secret)},
+        &client{id: 2, nodeID: "node-legacy", approval: approvalApproved},
+        &client{id: 3, nodeID: "node-cert", approval: approvalApproved, certIdentity: "web-01"},
+        &client{id: 4, nodeID: "node-online", approval: approvalApproved, online: true},
+        &client{id: 5, nodeID: "node-rejected", approval: approvalRejected},
+        &client{id: 6, nodeID: "node-pending", approval: approvalPending, secretHash: nodeSecretHash(secret)},
+    )
+    enrollTokens = []string{"good-token"}
+
+    tests := []struct {
+        name     string
+        hello    protocol.Hello
+        identity string
+        auto     bool
+        approval string
+        proven   bool
+        wantErr  bool
+    }{
+        {name: "新节点", hello: protocol.Hello{NodeID: "node-new"}, approval: approvalPending},
+        {name: "新节点 auto-approve", hello: protocol.Hello{NodeID: "node-new"}, auto: true, approval: approvalApproved},
+        {name: "新节点带令牌", hello: protocol.Hello{NodeID: "node-new", EnrollToken: "good-token"}, approval: approvalApproved},
+        {name: "令牌无效", hello: protocol.Hello{NodeID: "node-new", EnrollToken: "bad"}, wantErr: true},
+        {name: "出示正确的密钥", hello: protocol.Hello{NodeID: "node-a", NodeSecret: secret}, approval: approvalApproved, proven: true},
+        {name: "只知道节点ID", hello: protocol.Hello{NodeID: "node-a"}, wantErr: true},
+        {name: "密钥错误", hello: protocol.Hello{NodeID: "node-a", NodeSecret: "guess"}, wantErr: true},
+        {name: "密钥错误时令牌也无效", hello: protocol.Hello{NodeID: "node-a", NodeSecret: "guess", EnrollToken: "good-token"}, wantErr: true},
+        {name: "没有密钥的已批准节点需要重新审批", hello: protocol.Hello{NodeID: "node-legacy"}, approval: approvalPending},
+        {name: "没有密钥的已批准节点 auto-approve", hello: protocol.Hello{NodeID: "node-legacy"}, auto: true, approval: approvalApproved},
+        {name: "绑定的证书身份", hello: protocol.Hello{NodeID: "node-cert"}, identity: "web-01", approval: approvalApproved, proven: true},
+        {name: "其他证书身份", hello: protocol.Hello{NodeID: "node-cert"}, identity: "web-02", approval: approvalPending},
+        {name: "不能替代在线的节点", hello: protocol.Hello{NodeID: "node-online"}, auto: true, wantErr: true},
+        {name: "已拒绝", hello: protocol.Hello{NodeID: "node-rejected"}, auto: true, wantErr: true},
+        {name: "待审批的节点出示密钥", hello: protocol.Hello{NodeID: "node-pending", NodeSecret: secret}, approval: approvalPending, proven: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            autoApprove = tt.auto
+            approval, proven, err := enrollmentStatus(&tt.hello, tt.identity)
+            if tt.wantErr {
+                if err == nil {
+                    t.Errorf("应拒绝连接，实际为 %s", approval)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if approval != tt.approval || proven != tt.proven {
+                t.Errorf("审批状态为 %s，证明身份: %v，应为 %s、%v", approval, proven, tt.approval, tt.proven)
+            }
+        })
+    }
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+var (
+    errClientGone        = errors.New("客户端已断开连接")
+    errInterrupted       = errors.New("命令执行被中断")
+    errCancelUnsupported = errors.New("客户端协议版本过旧，不支持取消远程命令")
+)
+
+// 取消命令后等待客户端返回最终状态的最长时间，应大于客户端的宽限期
+const cancelDrainTimeout = 10 * time.Second
+
+// 每个请求排队等待处理的帧数和字节数上限。处理方 (例如慢速的终端) 跟不上时
+// 只让这个请求失败，读取协程不会因此阻塞，同一连接上的其他请求不受影响
+const (
+    maxQueuedFrames = 4096
+    maxQueuedBytes  = 32 << 20
+)
+
+var errRequestOverflow = errors.New("服务端处理输出过慢，请求已中止")
+
+// 一条远程命令的完整结果，stdout 与 stderr 分开保存
+type commandResult struct {
+    ClientID     int           `json:"client_id"`
+    RequestID    uint32        `json:"request_id"`
+    Command      string        `json:"command"`
+    ExitCode     int           `json:"exit_code"`
+    StartedAt    time.Time     `json:"started_at"`
+    FinishedAt   time.Time     `json:"finished_at"`
+    Duration     time.Duration `json:"duration"`
+    TimedOut     bool          `json:"timed_out"`
+    Canceled     bool          `json:"canceled"`
+    PolicyDenied bool          `json:"policy_denied"` // 被客户端的执行策略拒绝，命令没有运行
+    Stdout       []byte        `json:"stdout"`
+    Stderr       []byte        `json:"stderr"`
+    Error        string        `json:"error,omitempty"` // 命令未能启动或异常结束时的说明
+}
+
+// Success 判断命令是否正常执行并以 0 退出
+func (r *commandResult) Success() bool {
+    return r.Error == "" && !r.TimedOut && !r.Canceled && !r.PolicyDenied && r.ExitCode == 0
+}
+
+// summary 返回一行结果摘要
+func (r *commandResult) summary() string {
+    if r.PolicyDenied {
+        return fmt.Sprintf("命令被客户端的执行策略拒绝: %s", r.Error)
+    }
+    if r.StartedAt.IsZero() {
+        return fmt.Sprintf("命令执行出错: %s", r.Error)
+    }
+    line := fmt.Sprintf("退出码: %d, 开始: %s, 结束: %s, 耗时: %s",
+        r.ExitCode, r.StartedAt.Format("2006-01-02 15:04:05.000"), r.FinishedAt.Format("15:04:05.000"), r.Duration)
+    if r.TimedOut {
+        line += ", 已超时"
+    } else if r.Canceled {
+        line += ", 已取消"
+    } else if r.Error != "" {
+        line += ", 错误: " + r.Error
+    }
+    return line
+}
+
+// 一次远程命令执行，客户端返回的帧按请求ID放入各自的队列，再由 forward 协程送到 frames
+type execution struct {
+    id        uint32
+    client    *client
+    kind      protocol.FrameType // exec-request 或 pty-open
+    command   string
+    operator  string // 发起请求的操作员，记录在审计日志中
+    keyID     string // 请求签名的公钥指纹，未签名时为空
+    startedAt time.Time
+    frames    chan *protocol.Frame // 收到 exit-status/error 或连接断开，并且队列中的帧送完后关闭
+
+    queueMu     sync.Mutex
+    queueCond   *sync.Cond
+    queue       []*protocol.Frame
+    queuedBytes int
+    ended       bool // 不再接收新的帧
+
+    audited atomic.Bool // 最终结果已经记录在审计日志中
+
+    // 已收到的输出字节数，只在读取协程中访问
+    stdoutBytes int64
+    stderrBytes int64
+}
+
+// startExec 以操作员 operator 的身份在客户端上启动一条命令，可以对同一客户端并发调用。
+// timeout 由客户端负责执行，超时后结束整个进程组，0 表示不限制。signer 提供操作员的签名，
+// 为 nil 时请求不签名
+func (c *client) startExec(operator, command string, timeout time.Duration, signer requestSigner) (*execution, error) {
+    req := protocol.ExecRequest{
+        Command:   command,
+        TimeoutMs: timeout.Milliseconds(),
+    }
+    sig, err := signRequest(signer, protocol.SignKindExec, c.nodeID, req.SignedBody(), time.Time{})
+    if err != nil {
+        return nil, err
+    }
+    req.Signature = sig
+    return c.startRequest(operator, protocol.TypeExecRequest, command, req, sig)
+}
+
+// startRequest 分配请求ID并登记，然后发送类型为 t 的请求帧，sig 为请求携带的签名，只用于审计
+func (c *client) startRequest(operator string, t protocol.FrameType, command string, req interface{}, sig *protocol.Signature) (*execution, error) {
+    if !c.isApproved() {
+        return nil, errNotApproved
+    }
+
+    c.execMu.Lock()
+    if c.closed {
+        c.execMu.Unlock()
+        return nil, errClientGone
+    }
+    c.nextReqID++
+    ex := &execution{
+        id:        c.nextReqID,
+        client:    c,
+        kind:      t,
+        command:   command,
+        operator:  operator,
+        startedAt: time.Now(),
+        frames:    make(chan *protocol.Frame),
+    }
+    if sig != nil {
+        ex.keyID = sig.KeyID
+    }
+    ex.queueCond = sync.NewCond(&ex.queueMu)
+    c.pending[ex.id] = ex
+    c.execMu.Unlock()
+    go ex.forward()
+
+    // 先记录审计日志，保证在客户端返回结果之前
+    ex.auditStart()
+    if err := c.enc.EncodeRequestJSON(t, ex.id, req); err != nil {
+        // 连接可能同时断开，closeExecutions 也会结束这个执行，end 和 auditFinish 都只生效一次
+        c.execMu.Lock()
+        delete(c.pending, ex.id)
+        c.execMu.Unlock()
+        ex.end(nil)
+        ex.auditFinish(&protocol.Frame{Type: protocol.TypeError, Payload: []byte("发送请求失败: " + err.Error())})
+        return nil, err
+    }
+    return ex, nil
+}
+
+// dispatch 把属于请求的帧投递给对应的执行，只在读取协程中调用
+func (c *client) dispatch(frame *protocol.Frame) {
+    terminal := frame.Type == protocol.TypeExitStatus || frame.Type == protocol.TypeError
+
+    c.execMu.Lock()
+    ex, ok := c.pending[frame.ID]
+    if ok && terminal {
+        delete(c.pending, frame.ID)
+    }
+    c.execMu.Unlock()
+
+    if !ok {
+        // 未知或已结束的请求，丢弃
+        return
+    }
+    switch frame.Type {
+    case protocol.TypeStdout, protocol.TypePTYData:
+        ex.stdoutBytes += int64(len(frame.Payload))
+    case protocol.TypeStderr:
+        ex.stderrBytes += int64(len(frame.Payload))
+    }
+    if terminal {
+        ex.end(frame)
+        ex.auditFinish(frame)
+        return
+    }
+    if !ex.push(frame) {
+        // 处理方跟不上，只结束这个请求，之后收到的帧按未知请求丢弃
+        c.execMu.Lock()
+        delete(c.pending, frame.ID)
+        c.execMu.Unlock()
+        failed := &protocol.Frame{Type: protocol.TypeError, ID: frame.ID, Payload: []byte(errRequestOverflow.Error())}
+        ex.end(failed)
+        ex.auditFinish(failed)
+        go ex.interrupt()
+    }
+}
+
+// push 把帧放入请求的队列，不会阻塞，队列超过上限时返回 false
+func (ex *execution) push(frame *protocol.Frame) bool {
+    ex.queueMu.Lock()
+    defer ex.queueMu.Unlock()
+    if ex.ended {
+        return true
+    }
+    if len(ex.queue) >= maxQueuedFrames || ex.queuedBytes+len(frame.Payload) > maxQueuedBytes {
+        return false
+    }
+    ex.queue = append(ex.queue, frame)
+    ex.queuedBytes += len(frame.Payload)
+    ex.queueCond.Signal()
+    return true
+}
+
+// end 放入最后一帧 (为 nil 时没有) 并停止接收，队列中的帧送完后关闭 frames，只有第一次调用生效
+func (ex *execution) end(last *protocol.Frame) {
+    ex.queueMu.Lock()
+    defer ex.queueMu.Unlock()
+    if ex.ended {
+        return
+    }
+    if last != nil {
+        ex.queue = append(ex.queue, last)
+    }
+    ex.ended = true
+    ex.queueCond.Signal()
+}
+
+// forward 按顺序把队列中的帧送到 frames，每个执行一个协程
+func (ex *execution) forward() {
+    defer close(ex.frames)
+    for {
+        ex.queueMu.Lock()
+        for len(ex.queue) == 0 && !ex.ended {
+            ex.queueCond.Wait()
+        }
+        if len(ex.queue) == 0 {
+            ex.queueMu.Unlock()
+            return
+        }
+        frame := ex.queue[0]
+        ex.queue[0] = nil
+        ex.queue = ex.queue[1:]
+        ex.queuedBytes -= len(frame.Payload)
+        ex.queueMu.Unlock()
+        ex.frames <- frame
+    }
+}
+
+// closeExecutions 连接断开时结束所有未完成的执行，只在读取协程中调用
+func (c *client) closeExecutions() {
+    c.execMu.Lock()
+    c.closed = true
+    pending := c.pending
+    c.pending = make(map[uint32]*execution)
+    c.execMu.Unlock()
+
+    for _, ex := range pending {
+        ex.end(nil)
+        ex.auditFinish(nil)
+    }
+}
+
+// wait 等待命令结束并返回结果。输出在到达时写入 stdout/stderr，为 nil 时
+// 保存在结果中返回，否则结果中没有输出。stop 被关闭时放弃等待并返回 errInterrupted，
+// 此时调用者需要继续 cancel 或 discard，否则剩余输出会一直堆积在请求的队列中
+func (ex *execution) wait(stdout, stderr io.Writer, stop <-chan struct{}) (*commandResult, error) {
+    result := &commandResult{
+        ClientID:  ex.client.id,
+        RequestID: ex.id,
+        Command:   ex.command,
+        ExitCode:  -1,
+    }
+    var outBuf, errBuf bytes.Buffer
+    if stdout == nil {
+        stdout = &outBuf
+    }
+    if stderr == nil {
+        stderr = &errBuf
+    }
+
+    for {
+        select {
+        case <-stop:
+            return nil, errInterrupted
+        case frame, ok := <-ex.frames:
+            if !ok {
+                return nil, errClientGone
+            }
+            switch frame.Type {
+            case protocol.TypeStdout:
+                stdout.Write(frame.Payload)
+            case protocol.TypeStderr:
+                stderr.Write(frame.Payload)
+            case protocol.TypeExitStatus:
+                var status protocol.ExitStatus
+                if err := frame.Unmarshal(&status); err != nil {
+                    ex.discard()
+                    return nil, err
+                }
+                result.ExitCode = status.ExitCode
+                result.StartedAt = status.StartedAt
+                result.FinishedAt = status.FinishedAt
+                result.Duration = status.Duration()
+                result.TimedOut = status.TimedOut
+                result.Canceled = status.Canceled
+                result.PolicyDenied = status.PolicyDenied
+                result.Error = status.Error
+                result.Stdout = outBuf.Bytes()
+                result.Stderr = errBuf.Bytes()
+                return result, nil
+            case protocol.TypeError:
+                result.Error = string(frame.Payload)
+                result.Stdout = outBuf.Bytes()
+                result.Stderr = errBuf.Bytes()
+                return result, nil
+            }
+        }
+    }
+}
+
+// runCommand 在客户端上执行命令并等待完整结果，供程序化调用
+func runCommand(c *client, operator, command string, timeout time.Duration, signer requestSigner) (*commandResult, error) {
+    ex, err := c.startExec(operator, command, timeout, signer)
+    if err != nil {
+        return nil, err
+    }
+    return ex.wait(nil, nil, nil)
+}
+
+// cancel 请求客户端结束命令 (先 SIGINT，宽限期后 SIGKILL)，丢弃其剩余输出，
+// 并等待最终状态，使同一会话中的后续命令不受影响
+func (ex *execution) cancel() (*commandResult, error) {
+    if err := ex.interrupt(); err != nil {
+        ex.discard()
+        return nil, err
+    }
+
+    stop := make(chan struct{})
+    timer := time.AfterFunc(cancelDrainTimeout, func() { close(stop) })
+    defer timer.Stop()
+
+    result, err := ex.wait(nil, nil, stop)
+    if err == errInterrupted {
+        ex.discard()
+    }
+    return result, err
+}
+
+// interrupt 只通知客户端取消命令，不等待结果，最终状态 (已取消) 由正在 wait 的协程接收
+func (ex *execution) interrupt() error {
+    if ex.client.protocolVersion < protocol.CancelVersion {
+        return errCancelUnsupported
+    }
+    return ex.client.enc.EncodeRequest(protocol.TypeCancel, ex.id, nil)
+}
+
+// discard 在后台丢弃剩余的输出，等待者放弃等待时调用，避免输出堆积在队列中
+func (ex *execution) discard() {
+    go func() {
+        for range ex.frames {
+        }
+    }()
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// newTestClient 返回已审批、请求帧写入 io.Discard 的客户端
+func newTestClient() *client {
+    return &client{
+        id:              1,
+        enc:             protocol.NewEncoder(io.Discard),
+        approval:        approvalApproved,
+        protocolVersion: protocol.CancelVersion,
+        pending:         make(map[uint32]*execution),
+    }
+}
+
+// dispatchAll 在后台投递帧，读取协程被阻塞时测试失败
+func dispatchAll(t *testing.T, c *client, frames ...*protocol.Frame) {
+    t.Helper()
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for _, frame := range frames {
+            c.dispatch(frame)
+        }
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("dispatch 被没有读取输出的请求阻塞")
+    }
+}
+
+func TestDispatchOverflow(t *testing.T) {
+    c := newTestClient()
+    slow, err := c.startRequest("op", protocol.TypeExecRequest, "yes", nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := c.startRequest("op", protocol.TypeExecRequest, "true", nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // slow 的输出没有人读取，超过上限后只有 slow 失败。forward 可能已经取出一帧在等待发送，
+    // 所以多投递一帧
+    var frames []*protocol.Frame
+    for i := 0; i <= maxQueuedFrames+1; i++ {
+        frames = append(frames, &protocol.Frame{Type: protocol.TypeStdout, ID: slow.id, Payload: []byte("y\n")})
+    }
+    dispatchAll(t, c, frames...)
+
+    c.execMu.Lock()
+    _, slowPending := c.pending[slow.id]
+    _, otherPending := c.pending[other.id]
+    c.execMu.Unlock()
+    if slowPending || !otherPending {
+        t.Fatalf("溢出后 slow 仍在等待: %v，other 仍在等待: %v，应只移除 slow", slowPending, otherPending)
+    }
+
+    status, err := json.Marshal(protocol.ExitStatus{ExitCode: 0})
+    if err != nil {
+        t.Fatal(err)
+    }
+    dispatchAll(t, c,
+        &protocol.Frame{Type: protocol.TypeStdout, ID: other.id, Payload: []byte("ok\n")},
+        &protocol.Frame{Type: protocol.TypeExitStatus, ID: other.id, Payload: status},
+    )
+    result, err := other.wait(nil, nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(result.Stdout) != "ok\n" || result.ExitCode != 0 || result.Error != "" {
+        t.Errorf("other 的结果为 %+v，应不受 slow 影响", result)
+    }
+
+    result, err = slow.wait(nil, nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Error != errRequestOverflow.Error() || len(result.Stdout) != 2*maxQueuedFrames {
+        t.Errorf("slow 的错误为 %q，输出 %d 字节，应为 %q 和溢出前的 %d 字节",
+            result.Error, len(result.Stdout), errRequestOverflow, 2*maxQueuedFrames)
+    }
+}
+
+func TestAuditFinishOnce(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    l, err := openAuditLog(path, true, nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    saved := audit
+    audit = l
+    t.Cleanup(func() {
+        audit = saved
+        l.Close()
+    })
+
+    c := newTestClient()
+    ex, err := c.startRequest("op", protocol.TypeExecRequest, "true", nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 请求结束的同时连接断开
+    ex.auditFinish(&protocol.Frame{Type: protocol.TypeError, Payload: []byte("发送请求失败")})
+    c.closeExecutions()
+    if _, ok := <-ex.frames; ok {
+        t.Error("连接断开后 frames 应被关闭")
+    }
+
+    var results []string
+    err = scanAudit(path, func(e *auditEntry, _ []byte) error {
+        if e.Action == "exec" {
+            results = append(results, e.Result)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 1 || results[0] != "error" {
+        t.Errorf("审计日志中的结束记录为 %v，应只有一条 error", results)
+    }
+}
+
+func TestStartExecSignature(t *testing.T) {
+    var buf bytes.Buffer
+    c := newTestClient()
+    c.nodeID = "node-a"
+    c.enc = protocol.NewEncoder(&buf)
+
+    // 服务端原样转发预先生成的签名，不自己签名
+    sig := &protocol.Signature{KeyID: "op-key", Timestamp: 1, Nonce: "n1", Sig: "c2ln"}
+    ex, err := c.startExec("alice", "uptime", time.Minute, presignedSignatures{"node-a": sig, "node-b": {KeyID: "other"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ex.keyID != "op-key" {
+        t.Errorf("审计记录的签名公钥为 %q", ex.keyID)
+    }
+    unsigned, err := c.startExec("alice", "uptime", time.Minute, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    dec := protocol.NewDecoder(&buf)
+    for _, want := range []*protocol.Signature{sig, nil} {
+        frame, err := dec.Decode()
+        if err != nil {
+            t.Fatal(err)
+        }
+        var req protocol.ExecRequest
+        if err := json.Unmarshal(frame.Payload, &req); err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(req.Signature, want) {
+            t.Errorf("请求 %d 的签名为 %+v，应为 %+v", frame.ID, req.Signature, want)
+        }
+    }
+    c.closeExecutions()
+    ex.wait(nil, nil, nil)
+    unsigned.wait(nil, nil, nil)
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+)
+
+// nodeGroup 命名的节点分组，保存在数据库中。静态分组包含固定的客户端编号；
+// 选择器分组保存一个选择器，成员随节点的系统信息和标签变化
+type nodeGroup struct {
+    Name      string    `json:"name"`
+    Members   []int     `json:"members,omitempty"`
+    Selector  string    `json:"selector,omitempty"`
+    UpdatedBy string    `json:"updated_by"`
+    UpdatedAt time.Time `json:"updated_at"`
+
+    sel *selector // 解析后的 Selector
+}
+
+// 所有分组，由 mu 保护
+var groups = make(map[string]*nodeGroup)
+
+// groupEditMu 串行化分组的修改: 校验 (成员、循环引用) 之后到写入数据库和 groups 之前
+// 不会插入其他修改。写入数据库时不持有 mu
+var groupEditMu sync.Mutex
+
+// restoreGroups 从数据库读取所有分组
+func restoreGroups() error {
+    list, err := db.loadGroups()
+    if err != nil {
+        return err
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    for _, g := range list {
+        if g.Selector != "" {
+            if g.sel, err = parseSelector(g.Selector); err != nil {
+                fmt.Printf("跳过分组 %s: %v\n", g.Name, err)
+                continue
+            }
+        }
+        groups[g.Name] = g
+    }
+    return nil
+}
+
+// validateGroupName 分组名称由字母、数字和 _ - . 组成，以字母或数字开头
+func validateGroupName(name string) error {
+    if name == "" || len(name) > 64 {
+        return errors.New("分组名称的长度应为 1 到 64 个字符")
+    }
+    for i, r := range name {
+        if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || (i > 0 && strings.ContainsRune("_-.", r))) {
+            return fmt.Errorf("分组名称 %q 只能包含字母、数字和 _ - .，并以字母或数字开头", name)
+        }
+    }
+    return nil
+}
+
+// containsLocked 判断客户端是否属于分组，调用者需持有 mu
+func (g *nodeGroup) containsLocked(c *client) bool {
+    n := &selectorNodeFacts{c: c, info: clientInfo[c.id]}
+    return n.memberLocked(g)
+}
+
+// memberLocked 判断节点是否属于分组，结果在本次求值中缓存。
+// 正在计算的分组先记为不属于，数据库中遗留的循环引用因此不会无限递归
+func (n *selectorNodeFacts) memberLocked(g *nodeGroup) bool {
+    if member, ok := n.groups[g.Name]; ok {
+        return member
+    }
+    if n.groups == nil {
+        n.groups = make(map[string]bool)
+    }
+    n.groups[g.Name] = false
+    member := false
+    if g.sel != nil {
+        member = g.sel.expr.match(n)
+    } else {
+        for _, id := range g.Members {
+            if id == n.c.id {
+                member = true
+                break
+            }
+        }
+    }
+    n.groups[g.Name] = member
+    return member
+}
+
+// inGroupLocked 判断节点是否属于名为 name 的分组，调用者需持有 mu
+func (n *selectorNodeFacts) inGroupLocked(name string) bool {
+    g, ok := groups[name]
+    return ok && n.memberLocked(g)
+}
+
+// membersLocked 返回分组当前的成员，按编号排序，调用者需持有 mu
+func (g *nodeGroup) membersLocked() []*client {
+    var members []*client
+    for _, id := range sortedClientIDs() {
+        if c := clients[id]; g.containsLocked(c) {
+            members = append(members, c)
+        }
+    }
+    return members
+}
+
+// groupNamesLocked 返回客户端所属的分组名称，按名称排序，调用者需持有 mu
+func groupNamesLocked(c *client) []string {
+    n := &selectorNodeFacts{c: c, info: clientInfo[c.id]}
+    return n.groupNamesLocked()
+}
+
+func (n *selectorNodeFacts) groupNamesLocked() []string {
+    var names []string
+    for name := range groups {
+        if n.inGroupLocked(name) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// groupRefs 返回选择器通过 group 字段引用的分组，names 为可能被引用的分组名称
+func (s *selector) groupRefs(names []string) []string {
+    var refs []string
+    var walk func(e selectorNode)
+    walk = func(e selectorNode) {
+        switch e := e.(type) {
+        case *andNode:
+            walk(e.left)
+            walk(e.right)
+        case *orNode:
+            walk(e.left)
+            walk(e.right)
+        case *notNode:
+            walk(e.expr)
+        case *groupNode:
+            for _, name := range names {
+                if strings.EqualFold(name, e.name) {
+                    refs = append(refs, name)
+                }
+            }
+        case *compareNode:
+            if e.field != selectorFields["group"] {
+                return
+            }
+            for _, name := range names {
+                if e.re != nil && e.re.MatchString(name) || e.re == nil && globMatch(e.value, strings.ToLower(name)) {
+                    refs = append(refs, name)
+                }
+            }
+        }
+    }
+    walk(s.expr)
+    return refs
+}
+
+// groupCycleLocked 返回保存分组 g 后形成的循环引用路径，没有循环时返回 nil，调用者需持有 mu。
+// g 代替 groups 中的同名分组
+func groupCycleLocked(g *nodeGroup) []string {
+    lookup := func(name string) *nodeGroup {
+        if name == g.Name {
+            return g
+        }
+        return groups[name]
+    }
+    names := []string{g.Name}
+    for name := range groups {
+        if name != g.Name {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    const (
+        visiting = 1
+        visited  = 2
+    )
+    state := make(map[string]int)
+    var path []string
+    var visit func(name string) bool
+    visit = func(name string) bool {
+        path = append(path, name)
+        switch state[name] {
+        case visiting:
+            return true
+        case visited:
+            path = path[:len(path)-1]
+            return false
+        }
+        state[name] = visiting
+        if h := lookup(name); h != nil && h.sel != nil {
+            for _, ref := range h.sel.groupRefs(names) {
+                if visit(ref) {
+                    return true
+                }
+            }
+        }
+        state[name] = visited
+        path = path[:len(path)-1]
+        return false
+    }
+    if visit(g.Name) {
+        return path
+    }
+    return nil
+}
+
+// saveGroup 创建或替换分组。members 和 selector 只能指定其中之一
+func saveGroup(operator, name string, members []int, selectorText string) (*nodeGroup, error) {
+    groupEditMu.Lock()
+    defer groupEditMu.Unlock()
+    return saveGroupEditing(operator, name, members, selectorText)
+}
+
+// editGroup 添加或移除静态分组的成员，读取现有成员和保存之间不会插入其他修改
+func editGroup(operator, name, op string, ids []int) (*nodeGroup, error) {
+    groupEditMu.Lock()
+    defer groupEditMu.Unlock()
+    members, err := editMembers(name, op, ids)
+    if err != nil {
+        return nil, err
+    }
+    return saveGroupEditing(operator, name, members, "")
+}
+
+// saveGroupEditing 校验并保存分组，调用者需持有 groupEditMu
+func saveGroupEditing(operator, name string, members []int, selectorText string) (*nodeGroup, error) {
+    if err := validateGroupName(name); err != nil {
+        return nil, err
+    }
+    g := &nodeGroup{Name: name, UpdatedBy: operator, UpdatedAt: time.Now()}
+    if selectorText != "" {
+        sel, err := parseSelector(selectorText)
+        if err != nil {
+            return nil, err
+        }
+        g.Selector, g.sel = selectorText, sel
+    } else {
+        g.Members = append([]int(nil), members...)
+        sort.Ints(g.Members)
+    }
+
+    mu.Lock()
+    for _, id := range g.Members {
+        if _, ok := clients[id]; !ok {
+            mu.Unlock()
+            return nil, fmt.Errorf("没有找到编号为 %d 的客户端", id)
+        }
+    }
+    if cycle := groupCycleLocked(g); cycle != nil {
+        mu.Unlock()
+        return nil, fmt.Errorf("分组 %s 形成循环引用: %s", name, strings.Join(cycle, " -> "))
+    }
+    mu.Unlock()
+
+    if err := db.saveGroup(g); err != nil {
+        return nil, fmt.Errorf("保存分组失败: %v", err)
+    }
+    mu.Lock()
+    groups[name] = g
+    mu.Unlock()
+    auditEvent(&auditEntry{Operator: operator, Action: "group", Detail: g.describe()})
+    return g, nil
+}
+
+// removeGroup 删除分组
+func removeGroup(operator, name string) error {
+    groupEditMu.Lock()
+    defer groupEditMu.Unlock()
+    mu.Lock()
+    _, ok := groups[name]
+    mu.Unlock()
+    if !ok {
+        return fmt.Errorf("没有名为 %s 的分组", name)
+    }
+    if err := db.deleteGroup(name); err != nil {
+        return fmt.Errorf("删除分组失败: %v", err)
+    }
+    mu.Lock()
+    delete(groups, name)
+    mu.Unlock()
+    auditEvent(&auditEntry{Operator: operator, Action: "group-delete", Detail: name})
+    return nil
+}
+
+func getGroup(name string) *nodeGroup {
+    mu.Lock()
+    defer mu.Unlock()
+    return groups[name]
+}
+
+// describe 返回分组定义的单行描述
+func (g *nodeGroup) describe() string {
+    if g.sel != nil {
+        return fmt.Sprintf("%s: 选择器 %s", g.Name, g.Selector)
+    }
+    return fmt.Sprintf("%s: 客户端 %s", g.Name, formatIDs(g.Members))
+}
+
+// listGroups 处理 groups 命令，列出所有分组及其当前成员
+func listGroups(w io.Writer) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    if len(groups) == 0 {
+        fmt.Fprintln(w, "没有分组，使用 group set 或 group select 创建")
+        return
+    }
+    names := make([]string, 0, len(groups))
+    for name := range groups {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    fmt.Fprintln(w, "分组列表:")
+    for _, name := range names {
+        g := groups[name]
+        members := g.membersLocked()
+        ids := make([]int, len(members))
+        online := 0
+        for i, c := range members {
+            ids[i] = c.id
+            if c.online {
+                online++
+            }
+        }
+        kind := "静态"
+        if g.sel != nil {
+            kind = "选择器: " + g.Selector
+        }
+        fmt.Fprintf(w, "  %s [%s] 成员: %d (在线 %d)", name, kind, len(members), online)
+        if len(ids) > 0 {
+            fmt.Fprintf(w, ", 客户端 %s", formatIDs(ids))
+        }
+        fmt.Fprintf(w, ", 修改: %s %s\n", g.UpdatedBy, g.UpdatedAt.Format("2006-01-02 15:04:05"))
+    }
+}
+
+// handleGroup 处理 group 命令:
+//   group set <名称> <编号列表>      创建或替换静态分组
+//   group add <名称> <编号列表>      向静态分组添加客户端，分组不存在时创建
+//   group remove <名称> <编号列表>   从静态分组移除客户端
+//   group select <名称> <选择器>     创建或替换选择器分组
+//   group delete <名称>              删除分组
+func handleGroup(w io.Writer, operator, args string) {
+    usage := "命令格式错误，应为: group set|add|remove <名称> <编号列表>、group select <名称> <选择器> 或 group delete <名称>"
+    sub, rest := nextToken(args)
+    name, rest := nextToken(rest)
+    if name == "" {
+        fmt.Fprintln(w, usage)
+        return
+    }
+
+    var (
+        g   *nodeGroup
+        err error
+    )
+    switch sub {
+    case "delete":
+        if err = removeGroup(operator, name); err == nil {
+            fmt.Fprintf(w, "分组 %s 已删除\n", name)
+        }
+    case "select":
+        if rest == "" {
+            fmt.Fprintln(w, usage)
+            return
+        }
+        g, err = saveGroup(operator, name, nil, rest)
+    case "set", "add", "remove":
+        if rest == "" {
+            fmt.Fprintln(w, usage)
+            return
+        }
+        var ids []int
+        if ids, err = parseIDList(rest); err != nil {
+            break
+        }
+        if sub == "set" {
+            g, err = saveGroup(operator, name, ids, "")
+        } else {
+            g, err = editGroup(operator, name, sub, ids)
+        }
+    default:
+        fmt.Fprintln(w, usage)
+        return
+    }
+    if err != nil {
+        fmt.Fprintln(w, err)
+        return
+    }
+    if g != nil {
+        mu.Lock()
+        count := len(g.membersLocked())
+        mu.Unlock()
+        fmt.Fprintf(w, "分组 %s 已保存，当前有 %d 个成员\n", g.describe(), count)
+    }
+}
+
+// editMembers 在静态分组现有成员的基础上添加或移除客户端，调用者需持有 groupEditMu
+func editMembers(name, op string, ids []int) ([]int, error) {
+    g := getGroup(name)
+    if g == nil {
+        if op == "remove" {
+            return nil, fmt.Errorf("没有名为 %s 的分组", name)
+        }
+        return ids, nil
+    }
+    if g.sel != nil {
+        return nil, fmt.Errorf("分组 %s 由选择器定义，不能直接添加或移除成员", name)
+    }
+    members := make(map[int]bool)
+    for _, id := range g.Members {
+        members[id] = true
+    }
+    for _, id := range ids {
+        members[id] = op == "add"
+    }
+    var result []int
+    for id, ok := range members {
+        if ok {
+            result = append(result, id)
+        }
+    }
+    return result, nil
+}
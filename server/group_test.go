@@ -0,0 +1,184 @@
+package server
+
+import (
+    "fmt"
+    "reflect"
+    "sync"
+    "testing"
+)
+
+// withGroups 在测试期间替换全局的客户端和分组
+func withGroups(t *testing.T, cs map[int]*client, gs ...*nodeGroup) {
+    t.Helper()
+    mu.Lock()
+    savedClients, savedGroups := clients, groups
+    clients, groups = cs, make(map[string]*nodeGroup)
+    for _, g := range gs {
+        groups[g.Name] = g
+    }
+    mu.Unlock()
+    t.Cleanup(func() {
+        mu.Lock()
+        clients, groups = savedClients, savedGroups
+        mu.Unlock()
+    })
+}
+
+func selectorGroup(t *testing.T, name, expr string) *nodeGroup {
+    t.Helper()
+    sel, err := parseSelector(expr)
+    if err != nil {
+        t.Fatalf("parseSelector(%q): %v", expr, err)
+    }
+    return &nodeGroup{Name: name, Selector: expr, sel: sel}
+}
+
+func TestGroupMembership(t *testing.T) {
+    cs := map[int]*client{
+        1: {id: 1, labels: map[string]string{"role": "web"}},
+        2: {id: 2, labels: map[string]string{"role": "db"}},
+        3: {id: 3},
+    }
+    gs := []*nodeGroup{
+        {Name: "pinned", Members: []int{3}},
+        selectorGroup(t, "web", "label.role = web"),
+        selectorGroup(t, "Web-or-pinned", "group = web or group = PINNED"),
+        selectorGroup(t, "not-web", "group != web"),
+        selectorGroup(t, "any-web", "group = w*"),
+    }
+    // 链式引用不受嵌套深度限制
+    prev := "web"
+    for i := 0; i < 12; i++ {
+        name := fmt.Sprintf("chain%d", i)
+        gs = append(gs, selectorGroup(t, name, "group = "+prev))
+        prev = name
+    }
+    withGroups(t, cs, gs...)
+
+    mu.Lock()
+    defer mu.Unlock()
+    tests := []struct {
+        group string
+        want  []int
+    }{
+        {"pinned", []int{3}},
+        {"web", []int{1}},
+        {"Web-or-pinned", []int{1, 3}},
+        {"not-web", []int{2, 3}},
+        {"any-web", []int{1, 3}},
+        {"chain11", []int{1}},
+    }
+    for _, tt := range tests {
+        var got []int
+        for _, c := range groups[tt.group].membersLocked() {
+            got = append(got, c.id)
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("分组 %s 的成员为 %v，应为 %v", tt.group, got, tt.want)
+        }
+    }
+    if got := groupNamesLocked(cs[2]); !reflect.DeepEqual(got, []string{"not-web"}) {
+        t.Errorf("客户端 2 所属的分组为 %v", got)
+    }
+}
+
+func TestGroupEvaluatedOnce(t *testing.T) {
+    // 每个分组引用之前的所有分组，不缓存时计算量随分组数指数增长
+    gs := []*nodeGroup{{Name: "g00", Members: []int{1}}}
+    for i := 1; i < 40; i++ {
+        gs = append(gs, selectorGroup(t, fmt.Sprintf("g%02d", i), "group = g* and not offline"))
+    }
+    withGroups(t, map[int]*client{1: {id: 1, online: true}}, gs...)
+
+    mu.Lock()
+    defer mu.Unlock()
+    // 通配符也匹配分组自身，自身在计算过程中按不属于处理
+    if got := len(groupNamesLocked(clients[1])); got != 40 {
+        t.Errorf("客户端 1 属于 %d 个分组，应为 40", got)
+    }
+}
+
+func TestGroupCycle(t *testing.T) {
+    withGroups(t, map[int]*client{},
+        selectorGroup(t, "a", "group = b"),
+        selectorGroup(t, "b", "label.role = web"),
+        selectorGroup(t, "c", "group ~ '^x'"),
+    )
+
+    tests := []struct {
+        group *nodeGroup
+        cycle bool
+    }{
+        {selectorGroup(t, "self", "group = self"), true},
+        {selectorGroup(t, "self", "group = SELF"), true},
+        {selectorGroup(t, "b", "group = a"), true},
+        {selectorGroup(t, "b", "group = a*"), true},
+        {selectorGroup(t, "x1", "group = c"), true},
+        {selectorGroup(t, "b", "group = c"), false},
+        {selectorGroup(t, "d", "group = a or group = b"), false},
+        {selectorGroup(t, "d", "group != d2"), false},
+        {&nodeGroup{Name: "b", Members: []int{1}}, false},
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    for _, tt := range tests {
+        cycle := groupCycleLocked(tt.group)
+        if (cycle != nil) != tt.cycle {
+            t.Errorf("保存分组 %s (%s) 的循环引用为 %v，应为 %v", tt.group.Name, tt.group.Selector, cycle, tt.cycle)
+        }
+    }
+}
+
+// withGroupStore 在测试期间使用临时数据库保存分组
+func withGroupStore(t *testing.T) {
+    t.Helper()
+    s, err := openStore(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    savedDB := db
+    db = s
+    t.Cleanup(func() {
+        db = savedDB
+        s.Close()
+    })
+}
+
+func TestConcurrentGroupEdits(t *testing.T) {
+    withGroupStore(t)
+    cs := make(map[int]*client)
+    for id := 1; id <= 20; id++ {
+        cs[id] = &client{id: id}
+    }
+    withGroups(t, cs)
+
+    // 两个分组同时互相引用，只能有一个成功
+    for i := 0; i < 20; i++ {
+        a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+        var wg sync.WaitGroup
+        errs := make([]error, 2)
+        wg.Add(2)
+        go func() { defer wg.Done(); _, errs[0] = saveGroup("test", a, nil, "group = "+b) }()
+        go func() { defer wg.Done(); _, errs[1] = saveGroup("test", b, nil, "group = "+a) }()
+        wg.Wait()
+        if (errs[0] == nil) == (errs[1] == nil) {
+            t.Fatalf("同时保存 %s 和 %s 的结果为 %v 和 %v，应只有一个成功", a, b, errs[0], errs[1])
+        }
+    }
+
+    // 同时向静态分组添加成员，不会丢失修改
+    var wg sync.WaitGroup
+    for id := 1; id <= 20; id++ {
+        wg.Add(1)
+        go func(id int) {
+            defer wg.Done()
+            if _, err := editGroup("test", "web", "add", []int{id}); err != nil {
+                t.Error(err)
+            }
+        }(id)
+    }
+    wg.Wait()
+    if g := getGroup("web"); len(g.Members) != 20 {
+        t.Errorf("分组 web 有 %d 个成员，应为 20", len(g.Members))
+    }
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+    "fmt"
+    "strings"
+
+    "serverandclient/protocol"
+)
+
+// inventoryLines 把系统信息渲染为便于显示和搜索的文本行
+func inventoryLines(inv *protocol.Inventory) []string {
+    if inv == nil {
+        return []string{"尚未收到系统信息"}
+    }
+    return inv.Lines()
+}
+
+// diskSummary 返回磁盘列表的简短描述，例如 "sda (SSD, 480GB), sdb (HDD, 4000GB)"
+func diskSummary(disks []protocol.BlockDisk) string {
+    parts := make([]string, 0, len(disks))
+    for _, d := range disks {
+        parts = append(parts, fmt.Sprintf("%s (%s, %dGB)", d.Name, d.Type, d.SizeGB))
+    }
+    return strings.Join(parts, ", ")
+}
+
+// inventorySummary 返回一行系统信息摘要，完整信息使用 search 查看
+func inventorySummary(inv *protocol.Inventory) string {
+    if inv.Text != "" {
+        return fmt.Sprintf("旧版本客户端上报的文本, %d 行", len(inv.Lines()))
+    }
+    summary := fmt.Sprintf("%s, %d 核, 内存 %dMB", inv.Hostname, inv.CPU.TotalCores, inv.Memory.TotalMB)
+    if inv.Product.Vendor != "" || inv.Product.Name != "" {
+        summary += ", " + strings.TrimSpace(inv.Product.Vendor+" "+inv.Product.Name)
+    }
+    if len(inv.Errors) > 0 {
+        summary += fmt.Sprintf(", %d 项采集失败", len(inv.Errors))
+    }
+    return summary
+}
@@ -0,0 +1,844 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// 内存中最多保留的作业数，超过时丢弃最早完成的作业
+const maxJobs = 500
+
+// 每个节点保存的 stdout/stderr 上限和每个作业保存的输出总量上限，超出部分在接收时丢弃。
+// 输出事件只包含保存下来的部分
+const (
+    maxTaskOutput = 1 << 20
+    maxJobOutput  = 16 << 20
+)
+
+// 已完成的作业保存的输出总量上限，超过时与 maxJobs 一样丢弃最早完成的作业
+const maxRetainedOutput = 256 << 20
+
+// 作业同时执行的默认节点数，由 -parallel 指定
+var defaultParallel int
+
+var errJobCanceled = errors.New("作业已取消")
+
+// 作业中单个节点的状态
+const (
+    taskPending = "pending"
+    taskRunning = "running"
+    taskDone    = "done"   // 命令已结束，退出码见结果
+    taskFailed  = "failed" // 命令没有运行或没有得到结果，原因见 error
+    taskSkipped = "skipped" // 滚动执行停止后没有执行
+)
+
+// job 在一个或多个节点上执行同一条命令，由 API 或控制台创建，结果保存在内存中
+type job struct {
+    ID        int       `json:"id"`
+    Command   string    `json:"command"`
+    Operator  string    `json:"operator"`
+    TimeoutMs int64     `json:"timeout_ms"`         // 0 表示不限制
+    Parallel  int       `json:"parallel,omitempty"` // 同时执行的节点数，0 表示不限制
+    CreatedAt time.Time `json:"created_at"`
+
+    // 滚动执行: 按批次依次执行，每批结束后检查失败数并执行健康检查
+    BatchSize   int    `json:"batch_size,omitempty"` // 每批的节点数，0 表示不分批
+    Batches     int    `json:"batches,omitempty"`
+    MaxFailures *int   `json:"max_failures,omitempty"` // 允许失败的节点数，超过时停止
+    HealthCheck string `json:"health_check,omitempty"`
+
+    signer       requestSigner // 为命令签名，为 nil 时不签名
+    healthSigner requestSigner // 为健康检查命令签名
+
+    mu         sync.Mutex
+    tasks      []*jobTask
+    canceled   bool
+    batch      int    // 正在执行的批次，从 1 开始
+    haltReason string // 滚动执行停止的原因，为空表示没有停止
+    outputSize int    // 所有节点已保存的输出字节数
+    events     []jobEvent // 按发生顺序记录的事件，供多个观看者从头回放
+    finishedAt time.Time
+    changed    chan struct{} // 任一节点状态变化时关闭并替换，用于等待
+}
+
+// jobEvent 作业的一个事件: start (节点开始执行)、stdout/stderr (一段输出)、
+// exit (节点结束，不含输出) 和 done (整个作业结束)。滚动执行还有 batch (开始一批)、
+// health (节点的健康检查结束) 和 halt (停止执行剩余的批次)。Seq 从 1 开始
+type jobEvent struct {
+    Seq  int
+    Type string
+    Data interface{}
+}
+
+// jobChunk start、stdout 和 stderr 事件的内容
+type jobChunk struct {
+    ClientID int    `json:"client_id"`
+    NodeID   string `json:"node_id"`
+    Data     string `json:"data,omitempty"`
+}
+
+// jobBatch batch 事件的内容
+type jobBatch struct {
+    Batch   int   `json:"batch"`
+    Batches int   `json:"batches"`
+    Clients []int `json:"clients"`
+}
+
+// jobHalt halt 事件的内容
+type jobHalt struct {
+    Batch  int    `json:"batch"`
+    Reason string `json:"reason"`
+}
+
+// jobTask 作业在单个节点上的执行
+type jobTask struct {
+    ClientID     int        `json:"client_id"`
+    NodeID       string     `json:"node_id"`
+    State        string     `json:"state"`
+    ExitCode     *int       `json:"exit_code,omitempty"`
+    StartedAt    *time.Time `json:"started_at,omitempty"`
+    FinishedAt   *time.Time `json:"finished_at,omitempty"`
+    DurationMs   int64      `json:"duration_ms,omitempty"`
+    TimedOut     bool       `json:"timed_out,omitempty"`
+    Canceled     bool       `json:"canceled,omitempty"`
+    PolicyDenied bool       `json:"policy_denied,omitempty"`
+    Stdout       string     `json:"stdout"` // 只在快照中填写，见 snapshotLocked
+    Stderr       string     `json:"stderr"`
+    Truncated    bool       `json:"truncated,omitempty"` // 输出超过上限，只保存了开头的部分
+    Error        string     `json:"error,omitempty"`
+    Batch        int        `json:"batch,omitempty"`  // 滚动执行时所在的批次
+    Health       *taskHealth `json:"health,omitempty"` // 健康检查的结果，没有执行时为空
+
+    stdout, stderr []byte     // 已保存的输出
+    ex             *execution // 正在执行的远程命令 (包括健康检查)，用于取消作业
+    checking       bool       // 正在执行健康检查
+}
+
+// snapshotLocked 返回包含输出的节点结果副本，调用者需持有 j.mu
+func (t *jobTask) snapshotLocked() jobTask {
+    s := *t
+    s.Stdout, s.Stderr = string(t.stdout), string(t.stderr)
+    s.stdout, s.stderr, s.ex = nil, nil, nil
+    return s
+}
+
+// taskHealth 节点在一批结束后执行健康检查命令的结果
+type taskHealth struct {
+    ExitCode *int   `json:"exit_code,omitempty"`
+    TimedOut bool   `json:"timed_out,omitempty"`
+    Stdout   string `json:"stdout,omitempty"`
+    Stderr   string `json:"stderr,omitempty"`
+    Error    string `json:"error,omitempty"`
+}
+
+func (h *taskHealth) ok() bool {
+    return h.ExitCode != nil && *h.ExitCode == 0 && !h.TimedOut && h.Error == ""
+}
+
+// outcome 返回健康检查结果的一行描述
+func (h *taskHealth) outcome() string {
+    switch {
+    case h.ok():
+        return "通过"
+    case h.ExitCode == nil:
+        return "失败: " + h.Error
+    case h.TimedOut:
+        return fmt.Sprintf("失败: 退出码 %d, 已超时", *h.ExitCode)
+    case h.Error != "":
+        return fmt.Sprintf("失败: 退出码 %d, 错误: %s", *h.ExitCode, h.Error)
+    }
+    return fmt.Sprintf("失败: 退出码 %d", *h.ExitCode)
+}
+
+// succeeded 判断节点的命令是否以 0 退出，并且通过了健康检查 (如果有)
+func (t *jobTask) succeeded() bool {
+    return t.State == taskDone && t.ExitCode != nil && *t.ExitCode == 0 && t.Error == "" && !t.TimedOut && !t.Canceled &&
+        (t.Health == nil || t.Health.ok())
+}
+
+// jobSpec 创建作业的参数
+type jobSpec struct {
+    Operator string
+    Command  string
+    Timeout  time.Duration
+    Parallel int // 同时执行的节点数，0 表示不限制
+
+    // 以下用于滚动执行，BatchSize 和 BatchPercent 最多指定一个
+    BatchSize    int    // 每批的节点数
+    BatchPercent int    // 每批的节点数占全部节点的百分比，向上取整
+    MaxFailures  int    // 失败的节点数超过该值时停止
+    HealthCheck  string // 每批结束后在成功的节点上执行的命令，失败时停止
+
+    // 操作员的签名: 控制台的 ssh-agent 在每个节点开始执行时签名，API 使用预先生成的签名
+    Signer       requestSigner
+    HealthSigner requestSigner
+}
+
+// validate 检查滚动执行的参数
+func (spec *jobSpec) validate() error {
+    switch {
+    case spec.BatchSize < 0:
+        return errors.New("每批的节点数应为正整数")
+    case spec.BatchPercent < 0 || spec.BatchPercent > 100:
+        return errors.New("每批的百分比应在 1 到 100 之间")
+    case spec.BatchSize > 0 && spec.BatchPercent > 0:
+        return errors.New("每批的节点数和百分比只能指定一个")
+    case spec.MaxFailures < 0:
+        return errors.New("失败上限应为非负整数")
+    case spec.BatchSize == 0 && spec.BatchPercent == 0 && (spec.MaxFailures > 0 || spec.HealthCheck != ""):
+        return errors.New("失败上限和健康检查只能用于分批执行")
+    }
+    return nil
+}
+
+// batchSize 返回 n 个节点时每批的节点数，0 表示不分批
+func (spec *jobSpec) batchSize(n int) int {
+    if spec.BatchPercent > 0 {
+        size := (n*spec.BatchPercent + 99) / 100
+        if size < 1 {
+            size = 1
+        }
+        return size
+    }
+    return spec.BatchSize
+}
+
+// jobStatus 作业某一时刻的快照，用于输出
+type jobStatus struct {
+    *job
+    State      string     `json:"state"` // running 或 finished
+    Canceled   bool       `json:"canceled,omitempty"`
+    Halted     bool       `json:"halted,omitempty"`
+    HaltReason string     `json:"halt_reason,omitempty"`
+    Batch      int        `json:"batch,omitempty"` // 正在执行或最后执行的批次
+    FinishedAt *time.Time `json:"finished_at,omitempty"`
+    Total      int        `json:"total"`
+    Succeeded  int        `json:"succeeded"`
+    Failed     int        `json:"failed"`
+    Skipped    int        `json:"skipped,omitempty"`
+    Tasks      []jobTask  `json:"tasks,omitempty"`
+}
+
+var (
+    jobsMu    sync.Mutex
+    jobs      = make(map[int]*job)
+    nextJobID = 0
+)
+
+// startJob 在 targets 上执行命令，同时最多执行 spec.Parallel 个节点，
+// 按 targets 的顺序开始执行，立即返回作业。指定了批次时按批滚动执行，见 rollout
+func startJob(spec jobSpec, targets []*client) *job {
+    j := &job{
+        Command:   spec.Command,
+        Operator:  spec.Operator,
+        TimeoutMs: spec.Timeout.Milliseconds(),
+        Parallel:  spec.Parallel,
+        CreatedAt: time.Now(),
+        changed:   make(chan struct{}),
+        signer:    spec.Signer,
+    }
+    if size := spec.batchSize(len(targets)); size > 0 {
+        maxFailures := spec.MaxFailures
+        j.BatchSize = size
+        j.Batches = (len(targets) + size - 1) / size
+        j.MaxFailures = &maxFailures
+        j.HealthCheck = spec.HealthCheck
+        j.healthSigner = spec.HealthSigner
+    }
+    for i, c := range targets {
+        t := &jobTask{ClientID: c.id, NodeID: c.nodeID, State: taskPending}
+        if j.BatchSize > 0 {
+            t.Batch = i/j.BatchSize + 1
+        }
+        j.tasks = append(j.tasks, t)
+    }
+
+    jobsMu.Lock()
+    nextJobID++
+    j.ID = nextJobID
+    jobs[j.ID] = j
+    pruneJobsLocked()
+    jobsMu.Unlock()
+
+    var sem chan struct{}
+    if spec.Parallel > 0 {
+        sem = make(chan struct{}, spec.Parallel)
+    }
+    go func() {
+        if j.BatchSize > 0 {
+            j.rollout(targets, sem)
+        } else {
+            j.runTasks(j.tasks, targets, sem, j.run)
+        }
+        j.finish()
+    }()
+    return j
+}
+
+// runTasks 对每个节点调用 fn，同时最多执行 cap(sem) 个，sem 为 nil 表示不限制，等待全部结束
+func (j *job) runTasks(tasks []*jobTask, targets []*client, sem chan struct{}, fn func(*jobTask, *client)) {
+    var wg sync.WaitGroup
+    for i, c := range targets {
+        if sem != nil {
+            sem <- struct{}{}
+        }
+        wg.Add(1)
+        go func(t *jobTask, c *client) {
+            defer wg.Done()
+            if sem != nil {
+                defer func() { <-sem }()
+            }
+            fn(t, c)
+        }(tasks[i], c)
+    }
+    wg.Wait()
+}
+
+// rollout 按批次依次执行: 等待一批全部结束，失败的节点数超过 MaxFailures 时停止；
+// 否则在这一批成功的节点上执行健康检查，任一节点检查失败时停止。停止后剩余的批次不再执行
+func (j *job) rollout(targets []*client, sem chan struct{}) {
+    for start, batch := 0, 1; start < len(targets); start, batch = start+j.BatchSize, batch+1 {
+        // 取消后剩余的节点由 run 直接记为已取消
+        if j.isCanceled() {
+            j.runTasks(j.tasks[start:], targets[start:], sem, j.run)
+            return
+        }
+        end := start + j.BatchSize
+        if end > len(targets) {
+            end = len(targets)
+        }
+        tasks := j.tasks[start:end]
+        j.update(func() {
+            j.batch = batch
+            ids := make([]int, len(tasks))
+            for i, t := range tasks {
+                ids[i] = t.ClientID
+            }
+            j.eventLocked("batch", jobBatch{Batch: batch, Batches: j.Batches, Clients: ids})
+        })
+        j.runTasks(tasks, targets[start:end], sem, j.run)
+        if j.isCanceled() {
+            continue
+        }
+
+        reason := j.checkFailures()
+        if reason == "" && j.HealthCheck != "" {
+            j.runTasks(tasks, targets[start:end], sem, j.healthCheck)
+            reason = j.checkHealth(tasks)
+        }
+        // 最后一批之后没有剩余的节点，失败和健康检查的结果只记录在各节点中
+        if reason != "" && end < len(targets) {
+            j.halt(batch, reason, j.tasks[end:])
+            return
+        }
+    }
+}
+
+// checkFailures 失败的节点数超过上限时返回停止的原因
+func (j *job) checkFailures() string {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    failed := 0
+    for _, t := range j.tasks {
+        if (t.State == taskDone || t.State == taskFailed) && !t.succeeded() {
+            failed++
+        }
+    }
+    if failed > *j.MaxFailures {
+        return fmt.Sprintf("失败的节点数 %d 超过上限 %d", failed, *j.MaxFailures)
+    }
+    return ""
+}
+
+// checkHealth 这一批有节点的健康检查失败时返回停止的原因
+func (j *job) checkHealth(tasks []*jobTask) string {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    var ids []int
+    for _, t := range tasks {
+        if t.Health != nil && !t.Health.ok() {
+            ids = append(ids, t.ClientID)
+        }
+    }
+    if len(ids) > 0 {
+        return fmt.Sprintf("客户端 %s 的健康检查失败", formatIDs(ids))
+    }
+    return ""
+}
+
+// healthCheck 在命令成功的节点上执行健康检查命令，使用与作业相同的超时
+func (j *job) healthCheck(t *jobTask, c *client) {
+    j.mu.Lock()
+    skip := !t.succeeded() || j.canceled
+    j.mu.Unlock()
+    if skip {
+        return
+    }
+
+    h := &taskHealth{}
+    err := checkExecTarget(c)
+    var ex *execution
+    if err == nil {
+        ex, err = c.startExec(j.Operator, j.HealthCheck, time.Duration(j.TimeoutMs)*time.Millisecond, j.healthSigner)
+    }
+    if err == nil {
+        j.update(func() {
+            t.ex = ex
+            t.checking = true
+        })
+        if j.isCanceled() {
+            ex.interrupt()
+        }
+        var result *commandResult
+        stdout := &cappedBuffer{max: maxTaskOutput}
+        stderr := &cappedBuffer{max: maxTaskOutput}
+        if result, err = ex.wait(stdout, stderr, nil); err == nil {
+            if !result.StartedAt.IsZero() && !result.PolicyDenied {
+                exitCode := result.ExitCode
+                h.ExitCode = &exitCode
+            }
+            h.TimedOut = result.TimedOut
+            h.Stdout = stdout.String()
+            h.Stderr = stderr.String()
+            h.Error = result.Error
+            if result.Canceled && h.Error == "" {
+                h.Error = errJobCanceled.Error()
+            }
+        }
+    }
+    if err != nil {
+        h.Error = err.Error()
+    }
+    j.update(func() {
+        t.checking = false
+        t.Health = h
+        j.taskEventLocked("health", t)
+    })
+}
+
+// halt 停止滚动执行，剩余的节点记为已跳过
+func (j *job) halt(batch int, reason string, rest []*jobTask) {
+    j.update(func() {
+        j.haltReason = reason
+        j.eventLocked("halt", jobHalt{Batch: batch, Reason: reason})
+        for _, t := range rest {
+            t.State = taskSkipped
+            t.Error = "滚动执行已停止"
+            j.exitEventLocked(t)
+        }
+    })
+}
+
+// pruneJobsLocked 丢弃超出数量或输出总量上限的最早完成的作业，调用者需持有 jobsMu
+func pruneJobsLocked() {
+    ids := make([]int, 0, len(jobs))
+    retained := 0
+    for id, j := range jobs {
+        ids = append(ids, id)
+        retained += j.retainedOutput()
+    }
+    sort.Ints(ids)
+    for _, id := range ids {
+        if len(jobs) <= maxJobs && retained <= maxRetainedOutput {
+            return
+        }
+        if j := jobs[id]; j.finished() {
+            retained -= j.retainedOutput()
+            delete(jobs, id)
+        }
+    }
+}
+
+// retainedOutput 返回作业保存的输出字节数，输出事件中的副本也计算在内
+func (j *job) retainedOutput() int {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return 2 * j.outputSize
+}
+
+func getJob(id int) *job {
+    jobsMu.Lock()
+    defer jobsMu.Unlock()
+    return jobs[id]
+}
+
+// listJobs 返回按编号排序的所有作业
+func listJobs() []*job {
+    jobsMu.Lock()
+    defer jobsMu.Unlock()
+    list := make([]*job, 0, len(jobs))
+    for _, j := range jobs {
+        list = append(list, j)
+    }
+    sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+    return list
+}
+
+// run 在一个节点上执行作业的命令并记录结果，输出在到达时追加到节点的结果和事件中
+func (j *job) run(t *jobTask, c *client) {
+    fail := func(err error) {
+        j.update(func() {
+            t.State = taskFailed
+            t.Error = err.Error()
+            j.exitEventLocked(t)
+        })
+    }
+    if j.isCanceled() {
+        fail(errJobCanceled)
+        return
+    }
+    if err := checkExecTarget(c); err != nil {
+        fail(err)
+        return
+    }
+    ex, err := c.startExec(j.Operator, j.Command, time.Duration(j.TimeoutMs)*time.Millisecond, j.signer)
+    if err != nil {
+        fail(err)
+        return
+    }
+    j.update(func() {
+        t.State = taskRunning
+        t.ex = ex
+        j.eventLocked("start", jobChunk{ClientID: t.ClientID, NodeID: t.NodeID})
+    })
+    // 在登记执行之前作业被取消时，cancel 没有看到这个执行
+    if j.isCanceled() {
+        ex.interrupt()
+    }
+
+    stdout := &taskOutput{j: j, t: t, stream: "stdout"}
+    stderr := &taskOutput{j: j, t: t, stream: "stderr"}
+    result, err := ex.wait(stdout, stderr, nil)
+    stdout.flush()
+    stderr.flush()
+    j.update(func() {
+        defer j.exitEventLocked(t)
+        if err != nil {
+            t.State = taskFailed
+            t.Error = err.Error()
+            return
+        }
+        t.State = taskDone
+        if result.StartedAt.IsZero() {
+            t.State = taskFailed
+        } else {
+            exitCode := result.ExitCode
+            t.ExitCode = &exitCode
+            t.StartedAt = &result.StartedAt
+            t.FinishedAt = &result.FinishedAt
+            t.DurationMs = result.Duration.Milliseconds()
+        }
+        if result.PolicyDenied {
+            t.State = taskFailed
+        }
+        t.TimedOut = result.TimedOut
+        t.Canceled = result.Canceled
+        t.PolicyDenied = result.PolicyDenied
+        t.Error = result.Error
+    })
+}
+
+// checkExecTarget 检查客户端当前能否执行命令
+func checkExecTarget(c *client) error {
+    if !c.isOnline() {
+        return fmt.Errorf("客户端 %d 当前离线", c.id)
+    }
+    if !c.isApproved() {
+        return errNotApproved
+    }
+    if !c.hasCapability(protocol.CapExec) {
+        return fmt.Errorf("客户端 %d 不支持远程执行命令", c.id)
+    }
+    return nil
+}
+
+// update 在持有锁的情况下修改节点状态并通知等待者
+func (j *job) update(fn func()) {
+    j.mu.Lock()
+    fn()
+    close(j.changed)
+    j.changed = make(chan struct{})
+    j.mu.Unlock()
+}
+
+// eventLocked 记录一个事件，调用者需持有 j.mu 并在之后通知等待者
+func (j *job) eventLocked(kind string, data interface{}) {
+    j.events = append(j.events, jobEvent{Seq: len(j.events) + 1, Type: kind, Data: data})
+}
+
+// exitEventLocked 记录节点结束的事件，输出已经通过 stdout/stderr 事件发送过，不再重复
+func (j *job) exitEventLocked(t *jobTask) {
+    j.taskEventLocked("exit", t)
+}
+
+// taskEventLocked 记录以节点当前状态 (不含输出) 为内容的事件
+func (j *job) taskEventLocked(kind string, t *jobTask) {
+    final := *t
+    final.stdout, final.stderr, final.ex = nil, nil, nil
+    j.eventLocked(kind, final)
+}
+
+// eventsSince 返回序号大于 seq 的事件，以及用于等待后续变化的通道和作业是否已结束
+func (j *job) eventsSince(seq int) ([]jobEvent, <-chan struct{}, bool) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if seq < 0 || seq > len(j.events) {
+        seq = len(j.events)
+    }
+    return j.events[seq:], j.changed, !j.finishedAt.IsZero()
+}
+
+func (j *job) finish() {
+    j.mu.Lock()
+    if j.finishedAt.IsZero() {
+        j.finishedAt = time.Now()
+        j.eventLocked("done", j.summaryLocked())
+        close(j.changed)
+        j.changed = make(chan struct{})
+    }
+    j.mu.Unlock()
+}
+
+// taskOutput 把节点的一段输出追加到结果中并记录为事件，超过 maxTaskOutput 或 maxJobOutput 的部分丢弃。
+// 末尾不完整的 UTF-8 字符留到下一段，避免在事件中被替换为乱码，命令结束后由 flush 保存
+type taskOutput struct {
+    j       *job
+    t       *jobTask
+    stream  string // stdout 或 stderr
+    pending []byte
+}
+
+func (o *taskOutput) Write(p []byte) (int, error) {
+    data := append(o.pending, p...)
+    cut := utf8Boundary(data)
+    o.pending = append([]byte(nil), data[cut:]...)
+    if cut > 0 {
+        o.store(data[:cut])
+    }
+    return len(p), nil
+}
+
+// flush 保存末尾剩余的不完整字符，在命令结束后调用
+func (o *taskOutput) flush() {
+    if len(o.pending) > 0 {
+        o.store(o.pending)
+        o.pending = nil
+    }
+}
+
+func (o *taskOutput) store(data []byte) {
+    o.j.update(func() {
+        buf := &o.t.stdout
+        if o.stream == "stderr" {
+            buf = &o.t.stderr
+        }
+        if room := min(maxTaskOutput-len(*buf), maxJobOutput-o.j.outputSize); len(data) > room {
+            data = data[:utf8Boundary(data[:max(room, 0)])]
+            o.t.Truncated = true
+        }
+        if len(data) == 0 {
+            return
+        }
+        *buf = append(*buf, data...)
+        o.j.outputSize += len(data)
+        o.j.eventLocked(o.stream, jobChunk{ClientID: o.t.ClientID, NodeID: o.t.NodeID, Data: string(data)})
+    })
+}
+
+// cancel 取消作业: 尚未开始的节点不再执行，正在执行的命令通知客户端取消
+func (j *job) cancel() {
+    var running []*execution
+    j.update(func() {
+        if j.canceled || !j.finishedAt.IsZero() {
+            return
+        }
+        j.canceled = true
+        for _, t := range j.tasks {
+            if (t.State == taskRunning || t.checking) && t.ex != nil {
+                running = append(running, t.ex)
+            }
+        }
+    })
+    for _, ex := range running {
+        ex.interrupt()
+    }
+}
+
+func (j *job) isCanceled() bool {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return j.canceled
+}
+
+func (j *job) finished() bool {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    return !j.finishedAt.IsZero()
+}
+
+// wait 等待作业结束，最多等待 timeout，返回作业是否已结束
+func (j *job) wait(timeout time.Duration) bool {
+    deadline := time.After(timeout)
+    for {
+        j.mu.Lock()
+        done := !j.finishedAt.IsZero()
+        changed := j.changed
+        j.mu.Unlock()
+        if done {
+            return true
+        }
+        select {
+        case <-changed:
+        case <-deadline:
+            return false
+        }
+    }
+}
+
+// status 返回作业当前的快照
+func (j *job) status() *jobStatus {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    s := j.summaryLocked()
+    s.Tasks = make([]jobTask, len(j.tasks))
+    for i, t := range j.tasks {
+        s.Tasks[i] = t.snapshotLocked()
+    }
+    return s
+}
+
+// summaryLocked 返回不含各节点结果的作业快照，调用者需持有 j.mu
+func (j *job) summaryLocked() *jobStatus {
+    s := &jobStatus{job: j, State: "running", Canceled: j.canceled, Total: len(j.tasks),
+        Halted: j.haltReason != "", HaltReason: j.haltReason, Batch: j.batch}
+    if !j.finishedAt.IsZero() {
+        s.State = "finished"
+        finishedAt := j.finishedAt
+        s.FinishedAt = &finishedAt
+    }
+    for _, t := range j.tasks {
+        switch {
+        case t.succeeded():
+            s.Succeeded++
+        case t.State == taskDone || t.State == taskFailed:
+            s.Failed++
+        case t.State == taskSkipped:
+            s.Skipped++
+        }
+    }
+    return s
+}
+
+// showJobs 处理 jobs 命令: 不带参数时列出作业，指定编号时显示每个节点的结果
+func showJobs(w io.Writer, arg string) {
+    if arg == "" {
+        list := listJobs()
+        if len(list) == 0 {
+            fmt.Fprintln(w, "没有作业")
+            return
+        }
+        fmt.Fprintln(w, "作业列表:")
+        for _, j := range list {
+            s := j.status()
+            state := s.State
+            if s.Halted {
+                state += ", 已停止"
+            }
+            fmt.Fprintf(w, "  作业 %d [%s] 操作员: %s, 创建: %s, 节点: %d, 成功: %d, 失败: %d, 命令: %s\n",
+                j.ID, state, j.Operator, j.CreatedAt.Format("2006-01-02 15:04:05"), s.Total, s.Succeeded, s.Failed, j.Command)
+        }
+        return
+    }
+
+    id, err := strconv.Atoi(arg)
+    if err != nil {
+        fmt.Fprintln(w, "作业编号应为整数")
+        return
+    }
+    j := getJob(id)
+    if j == nil {
+        fmt.Fprintf(w, "没有找到编号为 %d 的作业\n", id)
+        return
+    }
+    s := j.status()
+    fmt.Fprintf(w, "作业 %d [%s] 操作员: %s, 命令: %s\n", j.ID, s.State, j.Operator, j.Command)
+    if j.BatchSize > 0 {
+        fmt.Fprintf(w, "滚动执行: %s\n", j.describeRollout())
+        if s.Halted {
+            fmt.Fprintf(w, "在第 %d 批后停止: %s\n", s.Batch, s.HaltReason)
+        }
+    }
+    for _, t := range s.Tasks {
+        if t.State == taskSkipped {
+            fmt.Fprintf(w, "--- 客户端 %d (节点ID: %s) [%s] %s\n", t.ClientID, t.NodeID, t.State, t.Error)
+            continue
+        }
+        fmt.Fprintf(w, "--- 客户端 %d (节点ID: %s) [%s]\n", t.ClientID, t.NodeID, t.State)
+        if t.Stdout != "" {
+            fmt.Fprint(w, t.Stdout)
+            if !strings.HasSuffix(t.Stdout, "\n") {
+                fmt.Fprintln(w)
+            }
+        }
+        if t.Stderr != "" {
+            stderrWriter{w}.Write([]byte(t.Stderr))
+            if !strings.HasSuffix(t.Stderr, "\n") {
+                fmt.Fprintln(w)
+            }
+        }
+        if t.Truncated {
+            fmt.Fprintln(w, "(输出超过上限，只保存了开头的部分)")
+        }
+        if t.ExitCode != nil {
+            fmt.Fprintf(w, "退出码: %d, 耗时: %s", *t.ExitCode, time.Duration(t.DurationMs)*time.Millisecond)
+            if t.TimedOut {
+                fmt.Fprint(w, ", 已超时")
+            } else if t.Canceled {
+                fmt.Fprint(w, ", 已取消")
+            }
+            fmt.Fprintln(w)
+        }
+        if t.Error != "" {
+            fmt.Fprintf(w, "错误: %s\n", t.Error)
+        }
+        if t.Health != nil {
+            fmt.Fprintf(w, "健康检查: %s\n", t.Health.outcome())
+            if !t.Health.ok() {
+                printHealthOutput(w, t.Health)
+            }
+        }
+    }
+}
+
+// describeRollout 返回滚动执行参数的一行描述
+func (j *job) describeRollout() string {
+    line := fmt.Sprintf("共 %d 批, 每批 %d 个节点, 失败上限 %d", j.Batches, j.BatchSize, *j.MaxFailures)
+    if j.HealthCheck != "" {
+        line += ", 健康检查: " + j.HealthCheck
+    }
+    return line
+}
+
+// printHealthOutput 显示健康检查的输出
+func printHealthOutput(w io.Writer, h *taskHealth) {
+    if h.Stdout != "" {
+        fmt.Fprint(w, h.Stdout)
+        if !strings.HasSuffix(h.Stdout, "\n") {
+            fmt.Fprintln(w)
+        }
+    }
+    if h.Stderr != "" {
+        stderrWriter{w}.Write([]byte(h.Stderr))
+        if !strings.HasSuffix(h.Stderr, "\n") {
+            fmt.Fprintln(w)
+        }
+    }
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+    "strings"
+    "testing"
+    "time"
+    "unicode/utf8"
+)
+
+func newTestJob(clientIDs ...int) *job {
+    j := &job{changed: make(chan struct{})}
+    for _, id := range clientIDs {
+        j.tasks = append(j.tasks, &jobTask{ClientID: id, State: taskRunning})
+    }
+    return j
+}
+
+// outputEvents 返回作业中某个节点的 stdout 事件内容
+func outputEvents(j *job, clientID int) string {
+    events, _, _ := j.eventsSince(0)
+    var b strings.Builder
+    for _, ev := range events {
+        if c, ok := ev.Data.(jobChunk); ok && ev.Type == "stdout" && c.ClientID == clientID {
+            b.WriteString(c.Data)
+        }
+    }
+    return b.String()
+}
+
+func TestTaskOutputUTF8(t *testing.T) {
+    j := newTestJob(1)
+    o := &taskOutput{j: j, t: j.tasks[0], stream: "stdout"}
+    data := []byte("中文输出")
+    // 逐字节写入，事件中不应出现被截断的字符
+    for i := range data {
+        o.Write(data[i : i+1])
+    }
+    o.Write([]byte{0xe4, 0xb8}) // 命令结束时不完整的字符
+    o.flush()
+
+    events, _, _ := j.eventsSince(0)
+    for _, ev := range events[:len(events)-1] {
+        if c := ev.Data.(jobChunk); !utf8.ValidString(c.Data) {
+            t.Errorf("事件中有不完整的字符: %q", c.Data)
+        }
+    }
+    if got := string(j.status().Tasks[0].Stdout); got != "中文输出\xe4\xb8" {
+        t.Errorf("保存的输出为 %q", got)
+    }
+    if got := outputEvents(j, 1); got != "中文输出\xe4\xb8" {
+        t.Errorf("事件中的输出为 %q", got)
+    }
+}
+
+func TestTaskOutputLimit(t *testing.T) {
+    j := newTestJob(1)
+    o := &taskOutput{j: j, t: j.tasks[0], stream: "stdout"}
+    chunk := strings.Repeat("a", 1000) + "中"
+    for written := 0; written < 2*maxTaskOutput; written += len(chunk) {
+        if n, err := o.Write([]byte(chunk)); n != len(chunk) || err != nil {
+            t.Fatalf("Write = %d, %v", n, err)
+        }
+    }
+    o.flush()
+
+    task := j.status().Tasks[0]
+    if !task.Truncated {
+        t.Error("超过上限的输出应标记为已截断")
+    }
+    if len(task.Stdout) > maxTaskOutput || len(task.Stdout) < maxTaskOutput-3 {
+        t.Errorf("保存了 %d 字节的输出，上限为 %d", len(task.Stdout), maxTaskOutput)
+    }
+    if !utf8.ValidString(task.Stdout) {
+        t.Errorf("截断位置不在字符边界: %q", task.Stdout[len(task.Stdout)-8:])
+    }
+    if got := outputEvents(j, 1); got != task.Stdout {
+        t.Errorf("事件中的输出 (%d 字节) 应与保存的输出 (%d 字节) 相同", len(got), len(task.Stdout))
+    }
+}
+
+func TestJobOutputLimit(t *testing.T) {
+    n := maxJobOutput/maxTaskOutput + 2
+    ids := make([]int, n)
+    for i := range ids {
+        ids[i] = i + 1
+    }
+    j := newTestJob(ids...)
+    chunk := []byte(strings.Repeat("x", 64<<10))
+    for _, task := range j.tasks {
+        o := &taskOutput{j: j, t: task, stream: "stdout"}
+        for written := 0; written < maxTaskOutput; written += len(chunk) {
+            o.Write(chunk)
+        }
+    }
+
+    s := j.status()
+    total := 0
+    for _, task := range s.Tasks {
+        total += len(task.Stdout)
+    }
+    if total != maxJobOutput {
+        t.Errorf("作业保存了 %d 字节的输出，上限为 %d", total, maxJobOutput)
+    }
+    if last := s.Tasks[n-1]; last.Stdout != "" || !last.Truncated {
+        t.Errorf("超过作业上限后的节点应没有输出并标记为已截断，得到 %d 字节", len(last.Stdout))
+    }
+}
+
+func TestPruneJobs(t *testing.T) {
+    jobsMu.Lock()
+    saved := jobs
+    jobs = make(map[int]*job)
+    defer func() {
+        jobs = saved
+        jobsMu.Unlock()
+    }()
+
+    // 输出总量超过上限时丢弃最早完成的作业，未完成的作业保留
+    per := maxRetainedOutput / 2 / 4
+    for id := 1; id <= 6; id++ {
+        j := newTestJob()
+        j.ID, j.outputSize = id, per
+        if id != 1 {
+            j.finishedAt = time.Now()
+        }
+        jobs[id] = j
+    }
+    pruneJobsLocked()
+    for id, want := range map[int]bool{1: true, 2: false, 3: false, 4: true, 5: true, 6: true} {
+        if _, ok := jobs[id]; ok != want {
+            t.Errorf("作业 %d 保留 = %v，应为 %v", id, ok, want)
+        }
+    }
+}
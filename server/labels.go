@@ -0,0 +1,130 @@
+package server
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+
+    "serverandclient/protocol"
+)
+
+// labelsLocked 返回客户端的全部标签: 客户端声明的标签，加上操作员设置的标签
+// (同名时以操作员设置的为准)。调用者需持有 mu，返回的 map 不能修改
+func (c *client) labelsLocked() map[string]string {
+    if len(c.hello.Labels) == 0 {
+        return c.labels
+    }
+    if len(c.labels) == 0 {
+        return c.hello.Labels
+    }
+    merged := make(map[string]string, len(c.hello.Labels)+len(c.labels))
+    for k, v := range c.hello.Labels {
+        merged[k] = v
+    }
+    for k, v := range c.labels {
+        merged[k] = v
+    }
+    return merged
+}
+
+// formatLabels 返回按键排序的 key=value 列表
+func formatLabels(labels map[string]string) string {
+    pairs := make([]string, 0, len(labels))
+    for k, v := range labels {
+        pairs = append(pairs, k+"="+v)
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ", ")
+}
+
+// updateLabels 修改客户端上由操作员设置的标签，remove 中的键被删除，返回修改后的客户端。
+// 标签 map 整体替换而不是原地修改，persistClients 可以在 mu 之外安全地序列化
+func updateLabels(c *client, operator string, set map[string]string, remove []string) *client {
+    mu.Lock()
+    // 客户端可能在选择目标之后重新连接，修改当前的连接
+    if current := clients[c.id]; current != nil {
+        c = current
+    }
+    labels := make(map[string]string, len(c.labels)+len(set))
+    for k, v := range c.labels {
+        labels[k] = v
+    }
+    for _, k := range remove {
+        delete(labels, k)
+    }
+    for k, v := range set {
+        labels[k] = v
+    }
+    if len(labels) == 0 {
+        labels = nil
+    }
+    c.labels = labels
+    mu.Unlock()
+
+    persistClients(c)
+    auditClient(c, operator, "label", formatLabels(labels))
+    return c
+}
+
+// parseLabelArgs 解析 label 命令的参数: key=value 设置标签，key- 删除标签
+func parseLabelArgs(args []string) (map[string]string, []string, error) {
+    set := make(map[string]string)
+    var remove []string
+    for _, arg := range args {
+        if key, value, ok := strings.Cut(arg, "="); ok {
+            if err := protocol.ValidateLabel(key, value); err != nil {
+                return nil, nil, err
+            }
+            set[key] = value
+            continue
+        }
+        key := strings.TrimSuffix(arg, "-")
+        if key == arg {
+            return nil, nil, fmt.Errorf("参数应为 key=value (设置) 或 key- (删除): %s", arg)
+        }
+        if err := protocol.ValidateLabel(key, "-"); err != nil {
+            return nil, nil, err
+        }
+        remove = append(remove, key)
+    }
+    if len(set) == 0 && len(remove) == 0 {
+        return nil, nil, fmt.Errorf("没有指定要设置或删除的标签")
+    }
+    return set, remove, nil
+}
+
+// labelClients 处理 label 命令: label <目标> key=value ... key- ...
+// 目标的格式与 run 相同，但 all、分组和选择器也包括离线的节点
+func labelClients(w io.Writer, operator, args string) {
+    target, rest := nextToken(args)
+    if target == "" || rest == "" {
+        fmt.Fprintln(w, "命令格式错误，应为: label <编号列表|group:分组|选择器> key=value ... key- ...")
+        return
+    }
+    set, remove, err := parseLabelArgs(strings.Fields(rest))
+    if err != nil {
+        fmt.Fprintln(w, err)
+        return
+    }
+    targets, err := selectTargets(target, false)
+    if err != nil {
+        fmt.Fprintln(w, err)
+        return
+    }
+    if len(targets) == 0 {
+        fmt.Fprintln(w, "没有匹配的客户端")
+        return
+    }
+
+    for _, c := range targets {
+        c = updateLabels(c, operator, set, remove)
+        mu.Lock()
+        labels := formatLabels(c.labelsLocked())
+        mu.Unlock()
+        if labels == "" {
+            labels = "(无)"
+        }
+        fmt.Fprintf(w, "客户端 %d 的标签: %s\n", c.id, labels)
+    }
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "sort"
+    "sync"
+    "syscall"
+    "time"
+
+    "golang.org/x/term"
+)
+
+// 操作员角色，权限依次递增
+const (
+    roleViewer = iota + 1
+    roleOperator
+    roleAdmin
+)
+
+var roleNames = map[int]string{
+    roleViewer:   "viewer",
+    roleOperator: "operator",
+    roleAdmin:    "admin",
+}
+
+// parseRole 解析操作员文件中的角色名
+func parseRole(name string) (int, error) {
+    for role, n := range roleNames {
+        if n == name {
+            return role, nil
+        }
+    }
+    return 0, fmt.Errorf("未知的角色 %q，应为 viewer、operator 或 admin", name)
+}
+
+// commandRoles 每个控制台命令需要的最低角色
+var commandRoles = map[string]int{
+    "help":     roleViewer,
+    "list":     roleViewer,
+    "search":   roleViewer,
+    "history":  roleViewer,
+    "who":      roleViewer,
+    "groups":   roleViewer,
+    "exit":     roleViewer,
+    "connect":  roleOperator,
+    "exec":     roleOperator,
+    "sessions": roleOperator,
+    "replay":   roleOperator,
+    "pending":  roleOperator,
+    "jobs":     roleOperator,
+    "run":      roleOperator,
+    "label":    roleOperator,
+    "group":    roleOperator,
+    "queue":    roleOperator,
+    "approve":  roleAdmin,
+    "reject":   roleAdmin,
+    "rekey":    roleAdmin,
+    "audit":    roleAdmin,
+}
+
+// operatorSession 一个操作员的命令行会话: 服务端自身的控制台，或者通过管理端口
+// 登录的远程会话。每个会话有独立的输入输出和命令队列，多个操作员可以同时
+// 连接不同或相同的客户端而互不影响
+type operatorSession struct {
+    name    string
+    role    int
+    remote  string // 远程会话的地址，控制台为空
+    loginAt time.Time
+    in      *console
+    out     io.Writer // 行模式的输出，远程终端上把 \n 转换为 \r\n
+    raw     io.Writer // 原始输出，用于交互式终端和回放
+    tty     bool      // 远程会话是否分配了终端，控制台总是为 false
+    term    string    // 远程终端的类型 (TERM)
+    signer  requestSigner // 为发往客户端的请求签名，操作员没有提供 ssh-agent 时为 nil
+
+    mu      sync.Mutex
+    rows    uint16
+    cols    uint16
+    resized chan struct{} // 远程终端窗口大小变化时通知
+
+    queue []string // 逐行执行模式的命令队列
+}
+
+var (
+    operatorsMu sync.Mutex
+    operators   = make(map[*operatorSession]bool) // 当前登录的操作员
+)
+
+// newConsoleSession 返回服务端控制台的会话，控制台操作员拥有全部权限
+func newConsoleSession() *operatorSession {
+    return &operatorSession{
+        name:    consoleOperator,
+        role:    roleAdmin,
+        loginAt: time.Now(),
+        in:      stdin,
+        out:     os.Stdout,
+        raw:     os.Stdout,
+        signer:  newConsoleSigner(os.Getenv("SSH_AUTH_SOCK")),
+    }
+}
+
+// newRemoteSession 返回管理端口上的会话，rw 为 SSH 通道
+func newRemoteSession(name string, role int, remote string, rw io.ReadWriter, tty bool, termName string, rows, cols uint16, signer requestSigner) *operatorSession {
+    s := &operatorSession{
+        name:    name,
+        role:    role,
+        remote:  remote,
+        loginAt: time.Now(),
+        in:      newConsole(rw),
+        out:     rw,
+        raw:     rw,
+        tty:     tty,
+        term:    termName,
+        rows:    rows,
+        cols:    cols,
+        resized: make(chan struct{}, 1),
+        signer:  signer,
+    }
+    if tty {
+        s.out = &newlineWriter{w: rw}
+    }
+    return s
+}
+
+func (s *operatorSession) isRemote() bool {
+    return s.remote != ""
+}
+
+// login 登记会话，who 命令列出所有登记的会话
+func (s *operatorSession) login() {
+    operatorsMu.Lock()
+    operators[s] = true
+    operatorsMu.Unlock()
+}
+
+func (s *operatorSession) logout() {
+    operatorsMu.Lock()
+    delete(operators, s)
+    operatorsMu.Unlock()
+}
+
+// can 判断会话的角色是否允许执行命令
+func (s *operatorSession) can(command string) bool {
+    role, ok := commandRoles[command]
+    return ok && s.role >= role
+}
+
+// readLine 显示提示符并读取一行命令，远程终端上由 console 负责回显和行编辑
+func (s *operatorSession) readLine(prompt string) (string, error) {
+    fmt.Fprint(s.out, prompt)
+    if s.tty {
+        return s.in.readLine(s.out)
+    }
+    return s.in.ReadString('\n')
+}
+
+// terminalSize 返回操作员终端的行列数
+func (s *operatorSession) terminalSize() (uint16, uint16) {
+    if !s.isRemote() {
+        return terminalSize()
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.rows == 0 || s.cols == 0 {
+        return 24, 80
+    }
+    return s.rows, s.cols
+}
+
+// setWindowSize 记录远程终端的新大小并通知正在运行的交互式终端
+func (s *operatorSession) setWindowSize(rows, cols uint16) {
+    s.mu.Lock()
+    s.rows, s.cols = rows, cols
+    s.mu.Unlock()
+    select {
+    case s.resized <- struct{}{}:
+    default:
+    }
+}
+
+// watchResize 在操作员终端窗口大小变化时通知，调用返回的函数停止
+func (s *operatorSession) watchResize() (<-chan struct{}, func()) {
+    if s.isRemote() {
+        return s.resized, func() {}
+    }
+    sig := make(chan os.Signal, 1)
+    notifyWindowResize(sig)
+    ch := make(chan struct{}, 1)
+    done := make(chan struct{})
+    go func() {
+        for {
+            select {
+            case <-sig:
+                select {
+                case ch <- struct{}{}:
+                default:
+                }
+            case <-done:
+                return
+            }
+        }
+    }()
+    return ch, func() {
+        signal.Stop(sig)
+        close(done)
+    }
+}
+
+// makeRaw 把控制台切换到原始模式，返回恢复函数。远程终端由 SSH 客户端负责
+func (s *operatorSession) makeRaw() func() {
+    fd := int(os.Stdin.Fd())
+    if s.isRemote() || !term.IsTerminal(fd) {
+        return func() {}
+    }
+    oldState, err := term.MakeRaw(fd)
+    if err != nil {
+        fmt.Printf("设置终端原始模式失败: %v\n", err)
+        return func() {}
+    }
+    return func() { term.Restore(fd, oldState) }
+}
+
+// holdInterrupts 在逐行执行会话期间捕获控制台的 Ctrl-C，避免误按时退出服务端
+func (s *operatorSession) holdInterrupts() func() {
+    if s.isRemote() {
+        return func() {}
+    }
+    sink := make(chan os.Signal, 1)
+    signal.Notify(sink, syscall.SIGINT)
+    return func() { signal.Stop(sink) }
+}
+
+// watchInterrupt 在操作员按下 Ctrl-C 时关闭返回的通道，调用返回的函数停止监听。
+// 远程会话在监听期间读取输入，其余按键在停止后放回输入中
+func (s *operatorSession) watchInterrupt() (<-chan struct{}, func()) {
+    ch := make(chan struct{})
+    if !s.isRemote() {
+        sig := make(chan os.Signal, 1)
+        signal.Notify(sig, syscall.SIGINT)
+        done := make(chan struct{})
+        go func() {
+            select {
+            case <-sig:
+                close(ch)
+            case <-done:
+            }
+        }()
+        return ch, func() {
+            signal.Stop(sig)
+            close(done)
+        }
+    }
+
+    stop := make(chan struct{})
+    finished := make(chan struct{})
+    var typed []byte
+    go func() {
+        defer close(finished)
+        for {
+            data, err := s.in.readChunk(stop)
+            if data == nil && err == nil {
+                return
+            }
+            if bytes.IndexByte(data, 0x03) >= 0 || err != nil {
+                close(ch)
+                return
+            }
+            typed = append(typed, data...)
+        }
+    }()
+    return ch, func() {
+        close(stop)
+        <-finished
+        s.in.unread(typed)
+    }
+}
+
+// listOperators 列出当前登录的操作员
+func listOperators(w io.Writer) {
+    operatorsMu.Lock()
+    sessions := make([]*operatorSession, 0, len(operators))
+    for s := range operators {
+        sessions = append(sessions, s)
+    }
+    operatorsMu.Unlock()
+
+    sort.Slice(sessions, func(i, j int) bool { return sessions[i].loginAt.Before(sessions[j].loginAt) })
+    fmt.Fprintln(w, "当前登录的操作员:")
+    for _, s := range sessions {
+        from := "控制台"
+        if s.isRemote() {
+            from = s.remote
+        }
+        fmt.Fprintf(w, "  %s [%s]  来自: %s, 登录时间: %s\n", s.name, roleNames[s.role], from, s.loginAt.Format("2006-01-02 15:04:05"))
+    }
+}
+
+// newlineWriter 把单独的 \n 转换为 \r\n，远程终端处于原始模式，不会自动回车
+type newlineWriter struct {
+    mu sync.Mutex
+    w  io.Writer
+    cr bool // 上一次写入是否以 \r 结尾
+}
+
+func (n *newlineWriter) Write(p []byte) (int, error) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    buf := make([]byte, 0, len(p)+8)
+    for _, b := range p {
+        if b == '\n' && !n.cr {
+            buf = append(buf, '\r')
+        }
+        buf = append(buf, b)
+        n.cr = b == '\r'
+    }
+    if _, err := n.w.Write(buf); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
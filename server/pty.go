@@ -0,0 +1,136 @@
+package server
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "time"
+
+    "golang.org/x/term"
+    "serverandclient/protocol"
+)
+
+// 交互式终端中按下该键 (Ctrl-]) 返回服务端的 > 提示符
+const detachKey = 0x1d
+
+// runTerminalSession 在客户端上打开伪终端运行登录 shell，期间操作员的终端
+// 处于原始模式，按键和窗口大小变化原样转发，直到 shell 退出或按下 Ctrl-]
+func runTerminalSession(s *operatorSession, c *client) {
+    out := s.raw
+    rows, cols := s.terminalSize()
+    termName := os.Getenv("TERM")
+    if s.isRemote() {
+        termName = s.term
+    }
+    if termName == "" {
+        termName = "xterm-256color"
+    }
+
+    req := protocol.PTYRequest{
+        Term: termName,
+        Rows: rows,
+        Cols: cols,
+    }
+    sig, err := signRequest(s.signer, protocol.SignKindPTY, c.nodeID, req.SignedBody(), time.Time{})
+    if err != nil {
+        fmt.Fprintf(s.out, "打开终端失败: %v\n", err)
+        return
+    }
+    req.Signature = sig
+    ex, err := c.startRequest(s.name, protocol.TypePTYOpen, "<pty>", req, sig)
+    if err != nil {
+        fmt.Fprintf(s.out, "打开终端失败: %v\n", err)
+        return
+    }
+
+    fmt.Fprintf(out, "已打开客户端 %d (%s) 的交互式终端，按 Ctrl-] 返回 > 提示符\r\n", c.id, c.addr)
+
+    rec := openRecording(s, c, rows, cols, fmt.Sprintf("客户端 %d (%s) 交互式终端", c.id, c.addr))
+    defer rec.Close()
+
+    defer s.makeRaw()()
+
+    resize, stopResize := s.watchResize()
+    defer stopResize()
+
+    // 转发本地输入，遇到 Ctrl-] 时通知退出
+    stop := make(chan struct{})
+    detach := make(chan struct{})
+    inputDone := make(chan struct{})
+    go func() {
+        defer close(inputDone)
+        for {
+            data, err := s.in.readChunk(stop)
+            if data == nil && err == nil {
+                return
+            }
+            if i := bytes.IndexByte(data, detachKey); i >= 0 {
+                if i > 0 {
+                    c.enc.EncodeRequest(protocol.TypePTYData, ex.id, data[:i])
+                }
+                close(detach)
+                return
+            }
+            if len(data) > 0 {
+                c.enc.EncodeRequest(protocol.TypePTYData, ex.id, data)
+            }
+            if err != nil {
+                close(detach)
+                return
+            }
+        }
+    }()
+    defer func() {
+        close(stop)
+        <-inputDone
+    }()
+
+    for {
+        select {
+        case frame, ok := <-ex.frames:
+            if !ok {
+                fmt.Fprint(out, "\r\n客户端已断开连接\r\n")
+                return
+            }
+            switch frame.Type {
+            case protocol.TypePTYData:
+                out.Write(frame.Payload)
+                rec.Write(frame.Payload)
+            case protocol.TypeExitStatus:
+                var status protocol.ExitStatus
+                if frame.Unmarshal(&status) == nil && status.PolicyDenied {
+                    fmt.Fprintf(out, "\r\n终端会话被客户端的执行策略拒绝: %s，可以使用 exec 逐行执行\r\n", status.Error)
+                    return
+                }
+                if status.TimedOut {
+                    fmt.Fprintf(out, "\r\n%s\r\n", status.Error)
+                    return
+                }
+                fmt.Fprint(out, "\r\n终端会话已结束\r\n")
+                return
+            case protocol.TypeError:
+                fmt.Fprintf(out, "\r\n终端会话出错: %s\r\n", frame.Payload)
+                return
+            }
+        case <-resize:
+            rows, cols := s.terminalSize()
+            c.enc.EncodeRequestJSON(protocol.TypePTYResize, ex.id, protocol.WindowSize{Rows: rows, Cols: cols})
+            rec.resize(rows, cols)
+        case <-detach:
+            fmt.Fprint(out, "\r\n正在关闭终端会话\r\n")
+            if _, err := ex.cancel(); err != nil && err != errClientGone {
+                fmt.Fprintf(out, "关闭终端会话失败: %v\r\n", err)
+            }
+            return
+        }
+    }
+}
+
+// terminalSize 返回本地终端的行列数，不是终端时使用 24x80
+func terminalSize() (uint16, uint16) {
+    cols, rows, err := term.GetSize(int(os.Stdout.Fd()))
+    if err != nil || rows <= 0 || cols <= 0 {
+        return 24, 80
+    }
+    return uint16(rows), uint16(cols)
+}
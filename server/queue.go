@@ -0,0 +1,622 @@
+package server
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// 排队命令的状态
+const (
+    queueQueued   = "queued"   // 等待节点连接
+    queueRunning  = "running"  // 已送达，正在执行
+    queueDone     = "done"     // 命令已结束，退出码见结果
+    queueFailed   = "failed"   // 命令没有运行或没有得到结果，原因见 error
+    queueExpired  = "expired"  // 过期前没有送达，不再执行
+    queueCanceled = "canceled" // 送达前被操作员取消
+)
+
+// 每条排队命令保存的 stdout/stderr 上限，超出部分在接收时丢弃
+const maxQueueOutput = 1 << 20
+
+// 最多保留的已结束排队命令数，超过时删除最早的
+const maxQueueResults = 1000
+
+// 排队命令的默认有效期，由 -queue-ttl 指定，0 表示不过期
+var queueTTL time.Duration
+
+// 通过 ssh-agent 签名的排队命令的最长签名有效期，与客户端 -max-signature-ttl 的默认值相同。
+// 签名过期后客户端拒绝执行，所以有效期更长或不过期的命令在签名过期时一起过期
+const queueSignatureTTL = 7 * 24 * time.Hour
+
+// queueItem 为一个节点排队的命令。节点离线时保存在数据库中，节点连接并获得批准后
+// 按排队的顺序依次执行，结果保存在同一条记录中供之后查看
+type queueItem struct {
+    ID           int        `json:"id"`
+    ClientID     int        `json:"client_id"`
+    NodeID       string     `json:"node_id"`
+    Command      string     `json:"command"`
+    Operator     string     `json:"operator"`
+    TimeoutMs    int64      `json:"timeout_ms"` // 0 表示不限制
+    State        string     `json:"state"`
+    CreatedAt    time.Time  `json:"created_at"`
+    ExpiresAt    *time.Time `json:"expires_at,omitempty"` // 为空表示不过期
+    DeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+    FinishedAt   *time.Time `json:"finished_at,omitempty"`
+    ExitCode     *int       `json:"exit_code,omitempty"`
+    DurationMs   int64      `json:"duration_ms,omitempty"`
+    TimedOut     bool       `json:"timed_out,omitempty"`
+    PolicyDenied bool       `json:"policy_denied,omitempty"`
+    Stdout       string     `json:"stdout,omitempty"`
+    Stderr       string     `json:"stderr,omitempty"`
+    Truncated    bool       `json:"truncated,omitempty"` // 输出超过上限，只保存了开头的部分
+    Error        string     `json:"error,omitempty"`
+    CanceledBy   string     `json:"canceled_by,omitempty"`
+
+    // 排队时生成的操作员签名，送达时原样转发，为空时不签名
+    Signature *protocol.Signature `json:"signature,omitempty"`
+}
+
+var (
+    queueMu     sync.Mutex
+    queueItems  = make(map[int]*queueItem)
+    nextQueueID = 0
+    delivering  = make(map[int]bool) // 正在依次执行排队命令的客户端编号
+    redeliver   = make(map[int]bool) // 投递期间又被要求投递的客户端编号，投递结束前需要重新检查
+)
+
+// restoreQueue 从数据库读取排队的命令。服务端停止时正在执行的命令没有结果，记为失败
+func restoreQueue() error {
+    items, err := db.loadQueue()
+    if err != nil {
+        return err
+    }
+    var interrupted []*queueItem
+    queueMu.Lock()
+    for _, item := range items {
+        if item.State == queueRunning {
+            item.State = queueFailed
+            item.Error = "服务端在命令结束前停止"
+            interrupted = append(interrupted, item)
+        }
+        queueItems[item.ID] = item
+        if item.ID > nextQueueID {
+            nextQueueID = item.ID
+        }
+    }
+    queueMu.Unlock()
+    if len(interrupted) > 0 {
+        return db.saveQueueItems(interrupted...)
+    }
+    return nil
+}
+
+// persistQueue 保存排队命令的当前状态
+func persistQueue(items ...*queueItem) {
+    queueMu.Lock()
+    copies := copyQueueLocked(items)
+    queueMu.Unlock()
+    if err := db.saveQueueItems(copies...); err != nil {
+        fmt.Printf("保存排队命令失败: %v\n> ", err)
+    }
+}
+
+// expiredLocked 判断等待中的命令是否已过期，调用者需持有 queueMu
+func (item *queueItem) expiredLocked(now time.Time) bool {
+    return item.State == queueQueued && item.ExpiresAt != nil && now.After(*item.ExpiresAt)
+}
+
+// expireQueue 把过期的等待中命令标记为已过期
+func expireQueue() {
+    now := time.Now()
+    var expired []*queueItem
+    queueMu.Lock()
+    for _, item := range queueItems {
+        if item.expiredLocked(now) {
+            item.State = queueExpired
+            expired = append(expired, item)
+        }
+    }
+    queueMu.Unlock()
+    if len(expired) > 0 {
+        persistQueue(expired...)
+    }
+}
+
+// watchQueueExpiry 定期标记过期的命令，送达前也会再检查一次
+func watchQueueExpiry() {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+    for range ticker.C {
+        expireQueue()
+    }
+}
+
+// enqueueCommand 为每个目标客户端排队一条命令，ttl 为 0 表示不过期。
+// 签名在排队时由 signer 生成并与命令一起保存，送达时不再签名。签名最多有效 queueSignatureTTL，
+// 签名的过期时间早于命令的有效期时，命令随签名一起过期，之后客户端不会再接受。
+// 在线的客户端立即开始执行，离线的客户端在下次连接时执行
+func enqueueCommand(operator string, targets []*client, command string, timeout, ttl time.Duration, signer requestSigner) ([]*queueItem, error) {
+    now := time.Now()
+    var expiresAt *time.Time
+    if ttl > 0 {
+        t := now.Add(ttl)
+        expiresAt = &t
+    }
+    signUntil := now.Add(queueSignatureTTL)
+    if expiresAt != nil && expiresAt.Before(signUntil) {
+        signUntil = *expiresAt
+    }
+    body := (&protocol.ExecRequest{Command: command, TimeoutMs: timeout.Milliseconds()}).SignedBody()
+
+    items := make([]*queueItem, len(targets))
+    for i, c := range targets {
+        sig, err := signRequest(signer, protocol.SignKindExec, c.nodeID, body, signUntil)
+        if err != nil {
+            return nil, fmt.Errorf("客户端 %d: %v", c.id, err)
+        }
+        items[i] = &queueItem{
+            ClientID:  c.id,
+            NodeID:    c.nodeID,
+            Command:   command,
+            Operator:  operator,
+            TimeoutMs: timeout.Milliseconds(),
+            State:     queueQueued,
+            CreatedAt: now,
+            ExpiresAt: expiresAt,
+            Signature: sig,
+        }
+        if sig != nil && sig.Expires != 0 && (expiresAt == nil || sig.ExpiresAt().Before(*expiresAt)) {
+            t := sig.ExpiresAt()
+            items[i].ExpiresAt = &t
+        }
+    }
+    queueMu.Lock()
+    for _, item := range items {
+        nextQueueID++
+        item.ID = nextQueueID
+    }
+    queueMu.Unlock()
+
+    if err := db.saveQueueItems(items...); err != nil {
+        return nil, fmt.Errorf("保存排队命令失败: %v", err)
+    }
+    queueMu.Lock()
+    for _, item := range items {
+        queueItems[item.ID] = item
+    }
+    queueMu.Unlock()
+
+    for _, item := range items {
+        entry := &auditEntry{Operator: operator, Action: "queue-add", ClientID: item.ClientID, NodeID: item.NodeID,
+            Command: command, Detail: fmt.Sprintf("排队编号 %d", item.ID)}
+        if item.Signature != nil {
+            entry.KeyID = item.Signature.KeyID
+        }
+        auditEvent(entry)
+        go deliverQueued(item.ClientID)
+    }
+    return items, nil
+}
+
+// cancelQueued 取消尚未送达的命令
+func cancelQueued(operator string, id int) error {
+    queueMu.Lock()
+    item, ok := queueItems[id]
+    if !ok {
+        queueMu.Unlock()
+        return fmt.Errorf("没有找到编号为 %d 的排队命令", id)
+    }
+    if item.State != queueQueued {
+        state := item.State
+        queueMu.Unlock()
+        return fmt.Errorf("排队命令 %d 的状态为 %s，只能取消等待中的命令", id, state)
+    }
+    item.State = queueCanceled
+    item.CanceledBy = operator
+    queueMu.Unlock()
+
+    persistQueue(item)
+    auditEvent(&auditEntry{Operator: operator, Action: "queue-cancel", ClientID: item.ClientID, NodeID: item.NodeID,
+        Command: item.Command, Detail: fmt.Sprintf("排队编号 %d", id)})
+    return nil
+}
+
+// deliverQueued 在客户端上依次执行为它排队的命令，直到没有等待中的命令或客户端不能执行命令。
+// 同一客户端同时只有一个协程在执行，在客户端连接、获得批准和有新命令排队时调用
+func deliverQueued(id int) {
+    queueMu.Lock()
+    if delivering[id] {
+        redeliver[id] = true
+        queueMu.Unlock()
+        return
+    }
+    delivering[id] = true
+    queueMu.Unlock()
+
+    for {
+        c, item := nextDelivery(id)
+        if item == nil {
+            return
+        }
+        runQueued(c, item)
+    }
+}
+
+// nextDelivery 取出客户端下一条等待中的命令并标记为正在执行，过期的命令跳过。
+// 没有可以执行的命令时结束投递并返回 nil。检查客户端时不持有 queueMu，
+// 检查之后又被要求投递 (例如客户端重新连接) 时重新检查，不会错过新的连接
+func nextDelivery(id int) (*client, *queueItem) {
+    for {
+        queueMu.Lock()
+        delete(redeliver, id)
+        queueMu.Unlock()
+
+        // 客户端可能已经重新连接，总是使用当前的连接
+        mu.Lock()
+        c := clients[id]
+        mu.Unlock()
+        ready := c != nil && checkExecTarget(c) == nil
+
+        now := time.Now()
+        var next *queueItem
+        var changed []*queueItem
+        queueMu.Lock()
+        if ready {
+            for _, item := range queueItems {
+                if item.ClientID != id || item.State != queueQueued {
+                    continue
+                }
+                if item.expiredLocked(now) {
+                    item.State = queueExpired
+                    changed = append(changed, item)
+                    continue
+                }
+                if next == nil || item.ID < next.ID {
+                    next = item
+                }
+            }
+            if next != nil {
+                next.State = queueRunning
+                next.DeliveredAt = &now
+                changed = append(changed, next)
+            }
+        }
+        retry := next == nil && redeliver[id]
+        if next == nil && !retry {
+            delete(delivering, id)
+        }
+        copies := copyQueueLocked(changed)
+        queueMu.Unlock()
+
+        if len(copies) > 0 {
+            if err := db.saveQueueItems(copies...); err != nil {
+                fmt.Printf("保存排队命令失败: %v\n> ", err)
+            }
+        }
+        if !retry {
+            if next == nil {
+                return nil, nil
+            }
+            return c, next
+        }
+    }
+}
+
+// copyQueueLocked 复制排队命令，用于在释放 queueMu 之后保存，调用者需持有 queueMu
+func copyQueueLocked(items []*queueItem) []*queueItem {
+    copies := make([]*queueItem, len(items))
+    for i, item := range items {
+        c := *item
+        copies[i] = &c
+    }
+    return copies
+}
+
+// runQueued 执行一条已送达的命令并保存结果，输出在接收时按 maxQueueOutput 截断
+func runQueued(c *client, item *queueItem) {
+    var (
+        result *commandResult
+        err    error
+    )
+    stdout := &cappedBuffer{max: maxQueueOutput}
+    stderr := &cappedBuffer{max: maxQueueOutput}
+    ex, err := c.startExec(item.Operator, item.Command, time.Duration(item.TimeoutMs)*time.Millisecond,
+        presignedSignatures{item.NodeID: item.Signature})
+    if err == nil {
+        result, err = ex.wait(stdout, stderr, nil)
+    }
+
+    now := time.Now()
+    queueMu.Lock()
+    if ex == nil && !c.isOnline() {
+        // 命令没有发出，客户端已经断开，留到下次连接时执行
+        item.State = queueQueued
+        item.DeliveredAt = nil
+        queueMu.Unlock()
+        persistQueue(item)
+        return
+    }
+    item.FinishedAt = &now
+    if err != nil {
+        item.State = queueFailed
+        item.Error = err.Error()
+    } else {
+        item.State = queueDone
+        if result.StartedAt.IsZero() || result.PolicyDenied {
+            item.State = queueFailed
+        } else {
+            exitCode := result.ExitCode
+            item.ExitCode = &exitCode
+            item.DurationMs = result.Duration.Milliseconds()
+        }
+        item.TimedOut = result.TimedOut
+        item.PolicyDenied = result.PolicyDenied
+        item.Error = result.Error
+        item.Stdout = stdout.String()
+        item.Stderr = stderr.String()
+        item.Truncated = stdout.truncated || stderr.truncated
+    }
+    outcome := item.outcome()
+    stale := pruneQueueLocked()
+    queueMu.Unlock()
+
+    persistQueue(item)
+    if len(stale) > 0 {
+        if err := db.deleteQueueItems(stale...); err != nil {
+            fmt.Printf("删除排队命令失败: %v\n> ", err)
+        }
+    }
+    fmt.Printf("排队命令 %d 已在客户端 %d 上执行: %s\n> ", item.ID, c.id, outcome)
+}
+
+// cappedBuffer 只保留写入内容开头的 max 字节，超出的部分丢弃，
+// 用于需要保存下来的命令输出
+type cappedBuffer struct {
+    max       int
+    buf       []byte
+    truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+    n := len(p)
+    if room := b.max - len(b.buf); n > room {
+        p = p[:room]
+        b.truncated = true
+    }
+    b.buf = append(b.buf, p...)
+    return n, nil
+}
+
+// String 返回保存的输出，截断时去掉末尾不完整的 UTF-8 字符
+func (b *cappedBuffer) String() string {
+    if b.truncated {
+        return string(b.buf[:utf8Boundary(b.buf)])
+    }
+    return string(b.buf)
+}
+
+// pruneQueueLocked 删除超出上限的最早结束的命令，返回需要从数据库删除的编号，调用者需持有 queueMu
+func pruneQueueLocked() []int {
+    var finished []int
+    for id, item := range queueItems {
+        if item.State != queueQueued && item.State != queueRunning {
+            finished = append(finished, id)
+        }
+    }
+    if len(finished) <= maxQueueResults {
+        return nil
+    }
+    sort.Ints(finished)
+    stale := finished[:len(finished)-maxQueueResults]
+    for _, id := range stale {
+        delete(queueItems, id)
+    }
+    return stale
+}
+
+// outcome 返回排队命令状态的一行描述，对 queueItems 中的记录调用时需持有 queueMu
+func (item *queueItem) outcome() string {
+    switch item.State {
+    case queueQueued:
+        if item.ExpiresAt == nil {
+            return "等待送达, 不过期"
+        }
+        return "等待送达, 过期: " + item.ExpiresAt.Format("2006-01-02 15:04:05")
+    case queueRunning:
+        return "正在执行, 送达: " + item.DeliveredAt.Format("2006-01-02 15:04:05")
+    case queueExpired:
+        return "已过期, 没有送达"
+    case queueCanceled:
+        return "已被 " + item.CanceledBy + " 取消"
+    }
+    t := jobTask{ExitCode: item.ExitCode, TimedOut: item.TimedOut, PolicyDenied: item.PolicyDenied, Error: item.Error}
+    line := t.outcome()
+    if item.ExitCode != nil {
+        line += fmt.Sprintf(", 耗时: %s", time.Duration(item.DurationMs)*time.Millisecond)
+    }
+    return line
+}
+
+// queueSnapshot 返回排队命令的副本，按编号排序。clientID 不为 0 时只返回该客户端的命令，
+// state 不为空时只返回该状态的命令
+func queueSnapshot(clientID int, state string) []queueItem {
+    expireQueue()
+    queueMu.Lock()
+    defer queueMu.Unlock()
+    list := []queueItem{}
+    for _, item := range queueItems {
+        if (clientID == 0 || item.ClientID == clientID) && (state == "" || item.State == state) {
+            list = append(list, *item)
+        }
+    }
+    sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+    return list
+}
+
+func getQueueItem(id int) (queueItem, bool) {
+    expireQueue()
+    queueMu.Lock()
+    defer queueMu.Unlock()
+    item, ok := queueItems[id]
+    if !ok {
+        return queueItem{}, false
+    }
+    return *item, true
+}
+
+// handleQueue 处理 queue 命令:
+//   queue [list] [客户端编号]                      列出排队的命令
+//   queue add [-t 超时] [-ttl 有效期] <目标> <命令>  为目标中的每个客户端排队命令
+//   queue show <编号>                              显示命令的结果
+//   queue cancel <编号>                            取消尚未送达的命令
+func handleQueue(w io.Writer, operator string, signer requestSigner, args string) {
+    usage := "命令格式错误，应为: queue [list] [客户端编号]、queue add [-t 超时] [-ttl 有效期] <目标> <命令>、queue show <编号> 或 queue cancel <编号>"
+    sub, rest := nextToken(args)
+    switch sub {
+    case "", "list":
+        clientID := 0
+        if rest != "" {
+            id, err := strconv.Atoi(rest)
+            if err != nil {
+                fmt.Fprintln(w, "客户端编号应为整数")
+                return
+            }
+            clientID = id
+        }
+        listQueue(w, clientID)
+    case "add":
+        addToQueue(w, operator, signer, rest)
+    case "show", "cancel":
+        id, err := strconv.Atoi(rest)
+        if err != nil {
+            fmt.Fprintln(w, usage)
+            return
+        }
+        if sub == "show" {
+            showQueueItem(w, id)
+            return
+        }
+        if err := cancelQueued(operator, id); err != nil {
+            fmt.Fprintln(w, err)
+            return
+        }
+        fmt.Fprintf(w, "排队命令 %d 已取消\n", id)
+    default:
+        fmt.Fprintln(w, usage)
+    }
+}
+
+// addToQueue 处理 queue add，目标的格式与 label 相同，包括离线的节点。
+// signer 在排队时为每个节点的命令签名
+func addToQueue(w io.Writer, operator string, signer requestSigner, args string) {
+    timeout, ttl := commandTimeout, queueTTL
+    for {
+        option, rest := nextToken(args)
+        if option != "-t" && option != "-ttl" {
+            break
+        }
+        value, rest := nextToken(rest)
+        d, err := time.ParseDuration(value)
+        if err != nil || d < 0 {
+            fmt.Fprintf(w, "%s 的时间格式错误，例如: 30s、24h，0 表示不限制\n", option)
+            return
+        }
+        if option == "-t" {
+            timeout = d
+        } else {
+            ttl = d
+        }
+        args = rest
+    }
+    target, command := nextToken(args)
+    if target == "" || command == "" {
+        fmt.Fprintln(w, "命令格式错误，应为: queue add [-t 超时] [-ttl 有效期] <编号列表|group:分组|选择器> <命令>")
+        return
+    }
+    targets, err := selectTargets(target, false)
+    if err != nil {
+        fmt.Fprintln(w, err)
+        return
+    }
+    if len(targets) == 0 {
+        fmt.Fprintln(w, "没有匹配的客户端")
+        return
+    }
+
+    items, err := enqueueCommand(operator, targets, command, timeout, ttl, signer)
+    if err != nil {
+        fmt.Fprintln(w, err)
+        return
+    }
+    for i, item := range items {
+        state := "离线，连接后执行"
+        if checkExecTarget(targets[i]) == nil {
+            state = "在线，立即执行"
+        }
+        fmt.Fprintf(w, "排队命令 %d: 客户端 %d (%s) %s\n", item.ID, item.ClientID, hostnameOf(item.ClientID), state)
+    }
+    if items[0].ExpiresAt != nil {
+        fmt.Fprintf(w, "过期时间: %s\n", items[0].ExpiresAt.Format("2006-01-02 15:04:05"))
+    }
+}
+
+// listQueue 列出排队的命令，clientID 不为 0 时只列出该客户端的命令
+func listQueue(w io.Writer, clientID int) {
+    list := queueSnapshot(clientID, "")
+    if len(list) == 0 {
+        fmt.Fprintln(w, "没有排队的命令")
+        return
+    }
+    fmt.Fprintln(w, "排队的命令:")
+    for i := range list {
+        item := &list[i]
+        fmt.Fprintf(w, "  %d [%s] 客户端 %d (%s), 操作员: %s, 创建: %s, %s, 命令: %s\n",
+            item.ID, item.State, item.ClientID, hostnameOf(item.ClientID), item.Operator,
+            item.CreatedAt.Format("2006-01-02 15:04:05"), item.outcome(), item.Command)
+    }
+}
+
+// showQueueItem 显示一条排队命令及其输出
+func showQueueItem(w io.Writer, id int) {
+    item, ok := getQueueItem(id)
+    if !ok {
+        fmt.Fprintf(w, "没有找到编号为 %d 的排队命令\n", id)
+        return
+    }
+    fmt.Fprintf(w, "排队命令 %d [%s] 客户端 %d (节点ID: %s), 操作员: %s, 命令: %s\n",
+        item.ID, item.State, item.ClientID, item.NodeID, item.Operator, item.Command)
+    fmt.Fprintf(w, "创建: %s", item.CreatedAt.Format("2006-01-02 15:04:05"))
+    if item.DeliveredAt != nil {
+        fmt.Fprintf(w, ", 送达: %s", item.DeliveredAt.Format("2006-01-02 15:04:05"))
+    }
+    if item.FinishedAt != nil {
+        fmt.Fprintf(w, ", 结束: %s", item.FinishedAt.Format("2006-01-02 15:04:05"))
+    }
+    if item.Signature != nil {
+        fmt.Fprintf(w, ", 签名公钥: %s", item.Signature.KeyID)
+    }
+    fmt.Fprintln(w)
+    if item.Stdout != "" {
+        fmt.Fprint(w, item.Stdout)
+        if !strings.HasSuffix(item.Stdout, "\n") {
+            fmt.Fprintln(w)
+        }
+    }
+    if item.Stderr != "" {
+        stderrWriter{w}.Write([]byte(item.Stderr))
+        if !strings.HasSuffix(item.Stderr, "\n") {
+            fmt.Fprintln(w)
+        }
+    }
+    if item.Truncated {
+        fmt.Fprintf(w, "(输出超过 %d 字节，只保存了开头的部分)\n", maxQueueOutput)
+    }
+    fmt.Fprintln(w, item.outcome())
+}
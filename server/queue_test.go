@@ -0,0 +1,235 @@
+package server
+
+import (
+    "reflect"
+    "testing"
+    "time"
+
+    "serverandclient/protocol"
+)
+
+// withQueue 在测试期间使用临时数据库和空的排队命令
+func withQueue(t *testing.T, cs map[int]*client, items ...*queueItem) {
+    t.Helper()
+    s, err := openStore(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    mu.Lock()
+    savedClients := clients
+    clients = cs
+    mu.Unlock()
+    queueMu.Lock()
+    savedDB, savedItems := db, queueItems
+    db, queueItems = s, make(map[int]*queueItem)
+    for _, item := range items {
+        queueItems[item.ID] = item
+    }
+    queueMu.Unlock()
+    t.Cleanup(func() {
+        queueMu.Lock()
+        db, queueItems = savedDB, savedItems
+        delete(delivering, 1)
+        delete(redeliver, 1)
+        queueMu.Unlock()
+        mu.Lock()
+        clients = savedClients
+        mu.Unlock()
+        s.Close()
+    })
+}
+
+func TestExpireQueue(t *testing.T) {
+    past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+    withQueue(t, map[int]*client{},
+        &queueItem{ID: 1, ClientID: 1, State: queueQueued, ExpiresAt: &past},
+        &queueItem{ID: 2, ClientID: 1, State: queueQueued, ExpiresAt: &future},
+        &queueItem{ID: 3, ClientID: 1, State: queueQueued},
+        &queueItem{ID: 4, ClientID: 1, State: queueRunning, ExpiresAt: &past},
+        &queueItem{ID: 5, ClientID: 1, State: queueDone, ExpiresAt: &past},
+    )
+    expireQueue()
+
+    want := map[int]string{1: queueExpired, 2: queueQueued, 3: queueQueued, 4: queueRunning, 5: queueDone}
+    for _, item := range queueSnapshot(0, "") {
+        if item.State != want[item.ID] {
+            t.Errorf("排队命令 %d 的状态为 %s，应为 %s", item.ID, item.State, want[item.ID])
+        }
+    }
+    // 状态同时保存到数据库
+    saved, err := db.loadQueue()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(saved) != 1 || saved[0].ID != 1 || saved[0].State != queueExpired {
+        t.Errorf("数据库中的排队命令为 %+v，应只有已过期的命令 1", saved)
+    }
+}
+
+func TestNextDeliveryOrder(t *testing.T) {
+    past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+    c := &client{id: 1, online: true, approval: approvalApproved, capabilities: []string{protocol.CapExec}}
+    withQueue(t, map[int]*client{1: c},
+        &queueItem{ID: 7, ClientID: 1, State: queueQueued},
+        &queueItem{ID: 3, ClientID: 1, State: queueQueued, ExpiresAt: &future},
+        &queueItem{ID: 2, ClientID: 1, State: queueQueued, ExpiresAt: &past},
+        &queueItem{ID: 1, ClientID: 2, State: queueQueued},
+        &queueItem{ID: 4, ClientID: 1, State: queueCanceled},
+        &queueItem{ID: 5, ClientID: 1, State: queueQueued},
+    )
+    queueMu.Lock()
+    delivering[1] = true
+    queueMu.Unlock()
+
+    var order []int
+    for {
+        got, item := nextDelivery(1)
+        if item == nil {
+            break
+        }
+        if got != c || item.State != queueRunning || item.DeliveredAt == nil {
+            t.Fatalf("排队命令 %d 送达时的状态为 %s", item.ID, item.State)
+        }
+        order = append(order, item.ID)
+        queueMu.Lock()
+        item.State = queueDone
+        queueMu.Unlock()
+    }
+    if !reflect.DeepEqual(order, []int{3, 5, 7}) {
+        t.Errorf("送达顺序为 %v，应为 [3 5 7]", order)
+    }
+    item, _ := getQueueItem(2)
+    if item.State != queueExpired {
+        t.Errorf("过期的排队命令 2 的状态为 %s，应为 %s", item.State, queueExpired)
+    }
+    if item, _ := getQueueItem(1); item.State != queueQueued {
+        t.Errorf("其他客户端的排队命令 1 的状态为 %s，应为 %s", item.State, queueQueued)
+    }
+    queueMu.Lock()
+    defer queueMu.Unlock()
+    if delivering[1] {
+        t.Error("没有命令时应结束投递")
+    }
+}
+
+func TestNextDeliveryOffline(t *testing.T) {
+    c := &client{id: 1, approval: approvalApproved, capabilities: []string{protocol.CapExec}}
+    withQueue(t, map[int]*client{1: c}, &queueItem{ID: 1, ClientID: 1, State: queueQueued})
+    queueMu.Lock()
+    delivering[1] = true
+    queueMu.Unlock()
+
+    if _, item := nextDelivery(1); item != nil {
+        t.Fatalf("离线的客户端不应送达排队命令 %d", item.ID)
+    }
+    if item, _ := getQueueItem(1); item.State != queueQueued {
+        t.Errorf("排队命令的状态为 %s，应为 %s", item.State, queueQueued)
+    }
+}
+
+func TestCappedBuffer(t *testing.T) {
+    b := &cappedBuffer{max: 7}
+    for _, chunk := range []string{"abc", "de", "中文"} {
+        if n, err := b.Write([]byte(chunk)); n != len(chunk) || err != nil {
+            t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+        }
+    }
+    // 截断在 "中" 的中间，不完整的字符被去掉
+    if got := b.String(); got != "abcde" || !b.truncated {
+        t.Errorf("String() = %q, truncated = %v，应为 \"abcde\", true", got, b.truncated)
+    }
+
+    b = &cappedBuffer{max: 8}
+    b.Write([]byte("12345678"))
+    if got := b.String(); got != "12345678" || b.truncated {
+        t.Errorf("恰好达到上限时 String() = %q, truncated = %v", got, b.truncated)
+    }
+}
+
+// recordingSigner 记录签名请求，返回的签名最多有效 maxTTL
+type recordingSigner struct {
+    maxTTL  time.Duration
+    nodeIDs []string
+    bodies  []string
+    expires []time.Time
+}
+
+func (r *recordingSigner) sign(kind, nodeID, body string, expires time.Time) (*protocol.Signature, error) {
+    r.nodeIDs = append(r.nodeIDs, nodeID)
+    r.bodies = append(r.bodies, body)
+    r.expires = append(r.expires, expires)
+    now := time.Now()
+    if limit := now.Add(r.maxTTL); expires.After(limit) {
+        expires = limit
+    }
+    return &protocol.Signature{KeyID: "op-key", Timestamp: now.UnixMilli(), Expires: expires.UnixMilli(), Nonce: nodeID}, nil
+}
+
+func TestEnqueueSignature(t *testing.T) {
+    a := &client{id: 1, nodeID: "node-a", approval: approvalApproved}
+    b := &client{id: 2, nodeID: "node-b", approval: approvalApproved}
+    withQueue(t, map[int]*client{1: a, 2: b})
+
+    // 签名在排队时生成，覆盖命令和超时，有效期与命令的有效期相同
+    signer := &recordingSigner{maxTTL: 48 * time.Hour}
+    items, err := enqueueCommand("alice", []*client{a, b}, "uptime", time.Minute, 24*time.Hour, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    wantBody := (&protocol.ExecRequest{Command: "uptime", TimeoutMs: 60000}).SignedBody()
+    if !reflect.DeepEqual(signer.nodeIDs, []string{"node-a", "node-b"}) || signer.bodies[0] != wantBody {
+        t.Errorf("签名的节点为 %v，内容为 %q", signer.nodeIDs, signer.bodies[0])
+    }
+    for i, item := range items {
+        if item.Signature == nil || item.Signature.Nonce != item.NodeID {
+            t.Fatalf("排队命令 %d 的签名为 %+v", item.ID, item.Signature)
+        }
+        // 签名的时间精确到毫秒
+        if !item.ExpiresAt.Equal(item.Signature.ExpiresAt()) || signer.expires[i].Sub(*item.ExpiresAt) >= time.Millisecond {
+            t.Errorf("签名的有效期为 %s，应与命令的过期时间 %s 相同", signer.expires[i], item.ExpiresAt)
+        }
+    }
+    saved, err := db.loadQueue()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(saved) != 2 || saved[0].Signature == nil || saved[0].Signature.KeyID != "op-key" {
+        t.Errorf("数据库中的排队命令应保存签名: %+v", saved)
+    }
+
+    // 签名先于命令过期时，命令随签名一起过期；不过期的命令使用 queueSignatureTTL
+    signer = &recordingSigner{maxTTL: time.Hour}
+    items, err = enqueueCommand("alice", []*client{a}, "uptime", time.Minute, 0, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d := time.Until(signer.expires[0]); d < queueSignatureTTL-time.Minute || d > queueSignatureTTL {
+        t.Errorf("不过期的命令请求的签名有效期为 %s，应为 %s", d, queueSignatureTTL)
+    }
+    if items[0].ExpiresAt == nil || !items[0].ExpiresAt.Equal(items[0].Signature.ExpiresAt()) {
+        t.Errorf("命令的过期时间为 %v，应与签名的过期时间相同", items[0].ExpiresAt)
+    }
+
+    // 有效期超过 queueSignatureTTL 的命令，签名只请求 queueSignatureTTL，命令随签名一起过期，
+    // 否则客户端按 -max-signature-ttl 拒绝，命令永远无法执行
+    signer = &recordingSigner{maxTTL: 60 * 24 * time.Hour}
+    items, err = enqueueCommand("alice", []*client{a}, "uptime", time.Minute, 30*24*time.Hour, signer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d := time.Until(signer.expires[0]); d < queueSignatureTTL-time.Minute || d > queueSignatureTTL {
+        t.Errorf("有效期 30 天的命令请求的签名有效期为 %s，应为 %s", d, queueSignatureTTL)
+    }
+    if items[0].ExpiresAt == nil || !items[0].ExpiresAt.Equal(items[0].Signature.ExpiresAt()) {
+        t.Errorf("命令的过期时间为 %v，应与签名的过期时间相同", items[0].ExpiresAt)
+    }
+
+    // 没有签名者时不签名
+    items, err = enqueueCommand("alice", []*client{a}, "uptime", time.Minute, 0, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if items[0].Signature != nil || items[0].ExpiresAt != nil {
+        t.Errorf("没有签名者时排队命令为 %+v", items[0])
+    }
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+var recordSessions bool
+
+// 会话编号: <客户端编号>-<开始时间>-<随机数>，例如 3-20240501-103000-a1b2
+var sessionIDPattern = regexp.MustCompile(`^(\d+)-\d{8}-\d{6}-[0-9a-f]{4}$`)
+
+// 回放时两次输出之间最长的等待时间，避免长时间空闲
+const replayMaxIdle = 3 * time.Second
+
+// cast 文件头，asciinema v2 格式
+type castHeader struct {
+    Version   int               `json:"version"`
+    Width     int               `json:"width"`
+    Height    int               `json:"height"`
+    Timestamp int64             `json:"timestamp"`
+    Title     string            `json:"title,omitempty"`
+    Env       map[string]string `json:"env,omitempty"`
+}
+
+// sessionRecorder 把终端会话的输出按时间记录为 asciinema v2 的 cast 文件，
+// 每个事件为一行 [距开始的秒数, "o", 输出] 或 [秒数, "r", "列x行"]。
+// 方法可以在 nil 上调用，未启用录像时什么也不做
+type sessionRecorder struct {
+    id    string
+    start time.Time
+
+    mu      sync.Mutex
+    f       *os.File
+    w       *bufio.Writer
+    pending []byte // 尚不完整的 UTF-8 字符
+    closed  bool
+}
+
+// startRecording 在数据目录的 sessions/<客户端编号>/ 下创建新的录像文件
+func startRecording(c *client, rows, cols uint16, title string) (*sessionRecorder, error) {
+    if !recordSessions {
+        return nil, nil
+    }
+    var suffix [2]byte
+    if _, err := rand.Read(suffix[:]); err != nil {
+        return nil, err
+    }
+    start := time.Now()
+    id := fmt.Sprintf("%d-%s-%s", c.id, start.Format("20060102-150405"), hex.EncodeToString(suffix[:]))
+
+    dir := filepath.Join(dataDir, "sessions", strconv.Itoa(c.id))
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    f, err := os.OpenFile(filepath.Join(dir, id+".cast"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err != nil {
+        return nil, err
+    }
+
+    r := &sessionRecorder{id: id, start: start, f: f, w: bufio.NewWriter(f)}
+    header, _ := json.Marshal(castHeader{
+        Version:   2,
+        Width:     int(cols),
+        Height:    int(rows),
+        Timestamp: start.Unix(),
+        Title:     title,
+        Env:       map[string]string{"TERM": os.Getenv("TERM")},
+    })
+    r.w.Write(header)
+    r.w.WriteByte('\n')
+    return r, nil
+}
+
+// openRecording 开始录制会话并告知操作员会话编号，失败时只提示，不影响会话
+func openRecording(s *operatorSession, c *client, rows, cols uint16, title string) *sessionRecorder {
+    rec, err := startRecording(c, rows, cols, title)
+    if err != nil {
+        fmt.Fprintf(s.raw, "创建会话录像失败: %v\r\n", err)
+        return nil
+    }
+    if rec != nil {
+        fmt.Fprintf(s.raw, "会话录像: %s\r\n", rec.id)
+        auditEvent(&auditEntry{Operator: s.name, Action: "session-record", ClientID: c.id,
+            NodeID: c.nodeID, Address: c.addr, Command: rec.id, Detail: title})
+    }
+    return rec
+}
+
+// event 写入一个事件，调用者需持有 r.mu
+func (r *sessionRecorder) event(kind, data string) {
+    enc := json.NewEncoder(r.w)
+    enc.SetEscapeHTML(false)
+    enc.Encode([]interface{}{time.Since(r.start).Seconds(), kind, data})
+}
+
+// Write 记录一段终端输出。JSON 字符串只能是合法的 UTF-8，
+// 被分在两次输出之间的多字节字符留到下一次一起记录
+func (r *sessionRecorder) Write(p []byte) (int, error) {
+    if r == nil {
+        return len(p), nil
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.closed {
+        return len(p), nil
+    }
+
+    data := append(r.pending, p...)
+    cut := utf8Boundary(data)
+    r.pending = append([]byte(nil), data[cut:]...)
+    if cut > 0 {
+        r.event("o", string(data[:cut]))
+    }
+    return len(p), nil
+}
+
+// utf8Boundary 返回 data 中完整 UTF-8 字符的长度，末尾被截断的多字节字符留到下一次输出
+func utf8Boundary(data []byte) int {
+    for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+        if utf8.RuneStart(data[i]) {
+            if !utf8.FullRune(data[i:]) {
+                return i
+            }
+            break
+        }
+    }
+    return len(data)
+}
+
+// resize 记录终端窗口大小变化
+func (r *sessionRecorder) resize(rows, cols uint16) {
+    if r == nil {
+        return
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if !r.closed {
+        r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+    }
+}
+
+// lineWriter 返回把 \n 转换为 \r\n 的 Writer，用于记录逐行执行模式的输出，
+// 使回放时在原始模式的终端中也能正确换行
+func (r *sessionRecorder) lineWriter() io.Writer {
+    if r == nil {
+        return io.Discard
+    }
+    return crlfWriter{r}
+}
+
+type crlfWriter struct {
+    w io.Writer
+}
+
+func (c crlfWriter) Write(p []byte) (int, error) {
+    if _, err := c.w.Write([]byte(strings.ReplaceAll(string(p), "\n", "\r\n"))); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+func (r *sessionRecorder) Close() error {
+    if r == nil {
+        return nil
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.closed {
+        return nil
+    }
+    r.closed = true
+    if len(r.pending) > 0 {
+        r.event("o", string(r.pending))
+    }
+    err := r.w.Flush()
+    if syncErr := r.f.Sync(); err == nil {
+        err = syncErr
+    }
+    if closeErr := r.f.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+// sessionPath 返回会话录像文件的路径
+func sessionPath(id string) (string, error) {
+    m := sessionIDPattern.FindStringSubmatch(id)
+    if m == nil {
+        return "", fmt.Errorf("会话编号格式错误: %s", id)
+    }
+    return filepath.Join(dataDir, "sessions", m[1], id+".cast"), nil
+}
+
+// listSessions 列出客户端 (id 为 0 时为所有客户端) 的会话录像
+func listSessions(w io.Writer, id int) {
+    pattern := filepath.Join(dataDir, "sessions", "*", "*.cast")
+    if id != 0 {
+        pattern = filepath.Join(dataDir, "sessions", strconv.Itoa(id), "*.cast")
+    }
+    files, err := filepath.Glob(pattern)
+    if err != nil {
+        fmt.Fprintf(w, "读取会话录像失败: %v\n", err)
+        return
+    }
+    if len(files) == 0 {
+        fmt.Fprintln(w, "没有会话录像")
+        return
+    }
+
+    sort.Slice(files, func(i, j int) bool {
+        return filepath.Base(files[i]) < filepath.Base(files[j])
+    })
+    fmt.Fprintln(w, "会话录像:")
+    for _, file := range files {
+        header, duration, err := castInfo(file)
+        if err != nil {
+            fmt.Fprintf(w, "  %s  (无法读取: %v)\n", strings.TrimSuffix(filepath.Base(file), ".cast"), err)
+            continue
+        }
+        fmt.Fprintf(w, "  %s  开始: %s, 时长: %s, %s\n", strings.TrimSuffix(filepath.Base(file), ".cast"),
+            time.Unix(header.Timestamp, 0).Format("2006-01-02 15:04:05"), duration.Round(time.Second), header.Title)
+    }
+}
+
+// castInfo 读取录像的文件头和总时长
+func castInfo(path string) (*castHeader, time.Duration, error) {
+    var header *castHeader
+    var last float64
+    err := readCast(path, func(h *castHeader) error {
+        header = h
+        return nil
+    }, func(at float64, kind, data string) error {
+        last = at
+        return nil
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+    return header, time.Duration(last * float64(time.Second)), nil
+}
+
+// readCast 依次读取录像的文件头和每个事件
+func readCast(path string, onHeader func(*castHeader) error, onEvent func(at float64, kind, data string) error) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 16<<20)
+    if !scanner.Scan() {
+        if err := scanner.Err(); err != nil {
+            return err
+        }
+        return errors.New("录像文件为空")
+    }
+    header := &castHeader{}
+    if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+        return fmt.Errorf("录像文件头无法解析: %v", err)
+    }
+    if err := onHeader(header); err != nil {
+        return err
+    }
+
+    for scanner.Scan() {
+        var ev []interface{}
+        if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || len(ev) != 3 {
+            // 服务端异常退出时最后一行可能不完整
+            continue
+        }
+        at, _ := ev[0].(float64)
+        kind, _ := ev[1].(string)
+        data, _ := ev[2].(string)
+        if err := onEvent(at, kind, data); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+var errReplayStopped = errors.New("回放已停止")
+
+// replaySession 按录制时的节奏回放会话，speed 为倍速，按 Ctrl-C 停止
+func replaySession(s *operatorSession, id string, speed float64) {
+    out := s.out
+    path, err := sessionPath(id)
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return
+    }
+
+    interrupt, stopWatching := s.watchInterrupt()
+    defer stopWatching()
+
+    var last float64
+    err = readCast(path, func(h *castHeader) error {
+        fmt.Fprintf(out, "回放会话 %s (%s, %dx%d, %g 倍速)，按 Ctrl-C 停止\n",
+            id, time.Unix(h.Timestamp, 0).Format("2006-01-02 15:04:05"), h.Width, h.Height, speed)
+        return nil
+    }, func(at float64, kind, data string) error {
+        wait := time.Duration((at - last) / speed * float64(time.Second))
+        if wait > replayMaxIdle {
+            wait = replayMaxIdle
+        }
+        last = at
+        if wait > 0 {
+            select {
+            case <-interrupt:
+                return errReplayStopped
+            case <-time.After(wait):
+            }
+        }
+        if kind == "o" {
+            io.WriteString(s.raw, data)
+        }
+        return nil
+    })
+    // 恢复终端的显示属性
+    fmt.Fprint(out, "\033[0m\r\n")
+    switch {
+    case err == errReplayStopped:
+        fmt.Fprintln(out, "回放已停止")
+    case os.IsNotExist(err):
+        fmt.Fprintf(out, "没有找到会话录像 %s\n", id)
+    case err != nil:
+        fmt.Fprintf(out, "回放失败: %v\n", err)
+    default:
+        fmt.Fprintln(out, "回放结束")
+    }
+}
+
+// parseSpeed 解析回放速度，例如 2 或 2x
+func parseSpeed(s string) (float64, error) {
+    speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+    if err != nil || speed <= 0 {
+        return 0, fmt.Errorf("回放速度应为正数，例如 2 或 0.5x")
+    }
+    return speed, nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+    "fmt"
+    "io"
+    "time"
+)
+
+// 节点信息数据库，在 Run 中打开
+var db *store
+
+// restoreClients 从数据库恢复所有节点，登记为离线客户端，
+// 使服务端重启后 list 和 search 仍能看到它们并沿用原来的编号
+func restoreClients() error {
+    records, err := db.loadNodes()
+    if err != nil {
+        return err
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+    for _, rec := range records {
+        c := &client{
+            id:              rec.ID,
+            nodeID:          rec.NodeID,
+            addr:            rec.Address,
+            firstSeen:       rec.FirstSeen,
+            lastSeen:        rec.LastSeen,
+            hello:           rec.Hello,
+            protocolVersion: rec.ProtocolVersion,
+            capabilities:    rec.Capabilities,
+            certIdentity:    rec.CertIdentity,
+            secretHash:      rec.SecretHash,
+            approval:        rec.Approval,
+            labels:          rec.Labels,
+            pending:         make(map[uint32]*execution),
+            closed:          true,
+        }
+        if c.approval == "" {
+            // 引入审批之前登记的节点已经被接受过
+            c.approval = approvalApproved
+        }
+        clients[c.id] = c
+        clientInfo[c.id] = rec.Inventory
+        if c.nodeID != "" {
+            nodeIDs[c.nodeID] = c.id
+        }
+        if c.certIdentity != "" {
+            certIdentities[c.certIdentity] = c.id
+        }
+        if c.id > clientID {
+            clientID = c.id
+        }
+    }
+    return nil
+}
+
+// recordLocked 生成客户端的持久化记录，调用者需持有 mu
+func (c *client) recordLocked() *nodeRecord {
+    return &nodeRecord{
+        ID:              c.id,
+        NodeID:          c.nodeID,
+        Address:         c.addr,
+        Hello:           c.hello,
+        ProtocolVersion: c.protocolVersion,
+        Capabilities:    c.capabilities,
+        CertIdentity:    c.certIdentity,
+        SecretHash:      c.secretHash,
+        Approval:        c.approval,
+        Labels:          c.labels,
+        Inventory:       clientInfo[c.id],
+        FirstSeen:       c.firstSeen,
+        LastSeen:        c.lastSeen,
+    }
+}
+
+// persistClients 把客户端的最新状态写入数据库
+func persistClients(cs ...*client) {
+    mu.Lock()
+    records := make([]*nodeRecord, 0, len(cs))
+    for _, c := range cs {
+        records = append(records, c.recordLocked())
+    }
+    mu.Unlock()
+
+    if err := db.saveNodes(records...); err != nil {
+        fmt.Printf("保存客户端信息失败: %v\n> ", err)
+    }
+}
+
+// recordConnection 记录一次连接或断开
+func recordConnection(c *client, event string) {
+    auditClient(c, "", event, "")
+    ev := connectionEvent{Time: time.Now(), Event: event, Address: c.addr}
+    if err := db.appendHistory(c.id, ev); err != nil {
+        fmt.Printf("保存连接记录失败: %v\n> ", err)
+    }
+}
+
+// showHistory 显示客户端的连接历史
+func showHistory(w io.Writer, id int) {
+    mu.Lock()
+    c, ok := clients[id]
+    var firstSeen, lastSeen time.Time
+    if ok {
+        firstSeen, lastSeen = c.firstSeen, c.lastSeen
+    }
+    mu.Unlock()
+
+    if !ok {
+        fmt.Fprintf(w, "没有找到编号为 %d 的客户端\n", id)
+        return
+    }
+
+    events, err := db.history(id, 50)
+    if err != nil {
+        fmt.Fprintf(w, "读取连接记录失败: %v\n", err)
+        return
+    }
+
+    fmt.Fprintf(w, "客户端 %d 首次连接: %s, 最后在线: %s\n",
+        id, firstSeen.Format("2006-01-02 15:04:05"), lastSeen.Format("2006-01-02 15:04:05"))
+    if len(events) == 0 {
+        fmt.Fprintln(w, "没有连接记录")
+        return
+    }
+    for _, ev := range events {
+        name := "连接"
+        if ev.Event == "disconnect" {
+            name = "断开"
+        }
+        fmt.Fprintf(w, "  %s  %s  %s\n", ev.Time.Format("2006-01-02 15:04:05"), name, ev.Address)
+    }
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// revocationList 本地的证书吊销列表 (CRL) 和拒绝名单。文件修改后
+// 在下一次检查时自动重新读取，无需重启服务端
+type revocationList struct {
+    crlFile  string
+    denyFile string
+    issuers  []*x509.Certificate // CRL 必须由其中之一签发
+
+    mu      sync.Mutex
+    crlMod  time.Time
+    denyMod time.Time
+    revoked map[string]bool // CRL 中的序列号 (十六进制)
+    denied  map[string]bool // 拒绝名单中的序列号、指纹或证书身份
+}
+
+// check 判断证书是否被吊销，读取列表失败时也拒绝，避免吊销失效
+func (r *revocationList) check(cert *x509.Certificate) error {
+    if err := r.reload(); err != nil {
+        return err
+    }
+
+    serial := cert.SerialNumber.Text(16)
+    sum := sha256.Sum256(cert.Raw)
+    fingerprint := hex.EncodeToString(sum[:])
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.revoked[serial] {
+        return fmt.Errorf("客户端证书 (序列号 %s) 已被 CRL 吊销", serial)
+    }
+    if r.denied[serial] || r.denied[fingerprint] || r.denied[certIdentity(cert)] {
+        return fmt.Errorf("客户端证书 %s (序列号 %s) 在拒绝名单中", certIdentity(cert), serial)
+    }
+    return nil
+}
+
+// reload 重新读取修改过的列表文件
+func (r *revocationList) reload() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.crlFile != "" {
+        info, err := os.Stat(r.crlFile)
+        if err != nil {
+            return fmt.Errorf("读取 CRL 失败: %v", err)
+        }
+        if !info.ModTime().Equal(r.crlMod) {
+            revoked, err := r.loadCRL()
+            if err != nil {
+                return err
+            }
+            r.revoked, r.crlMod = revoked, info.ModTime()
+        }
+    }
+
+    if r.denyFile != "" {
+        info, err := os.Stat(r.denyFile)
+        if err != nil {
+            return fmt.Errorf("读取拒绝名单失败: %v", err)
+        }
+        if !info.ModTime().Equal(r.denyMod) {
+            denied, err := loadDenyList(r.denyFile)
+            if err != nil {
+                return err
+            }
+            r.denied, r.denyMod = denied, info.ModTime()
+        }
+    }
+    return nil
+}
+
+// loadCRL 读取 PEM 或 DER 格式的 CRL，并校验其由客户端 CA 签发
+func (r *revocationList) loadCRL() (map[string]bool, error) {
+    data, err := os.ReadFile(r.crlFile)
+    if err != nil {
+        return nil, fmt.Errorf("读取 CRL 失败: %v", err)
+    }
+    if block, _ := pem.Decode(data); block != nil {
+        data = block.Bytes
+    }
+    crl, err := x509.ParseRevocationList(data)
+    if err != nil {
+        return nil, fmt.Errorf("解析 CRL 失败: %v", err)
+    }
+
+    signed := false
+    for _, issuer := range r.issuers {
+        if crl.CheckSignatureFrom(issuer) == nil {
+            signed = true
+            break
+        }
+    }
+    if !signed {
+        return nil, fmt.Errorf("CRL %s 不是由客户端 CA 签发的", r.crlFile)
+    }
+    if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+        fmt.Printf("警告: CRL 已过期 (下次更新时间: %s)\n", crl.NextUpdate.Format("2006-01-02 15:04:05"))
+    }
+
+    revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+    for _, entry := range crl.RevokedCertificateEntries {
+        revoked[entry.SerialNumber.Text(16)] = true
+    }
+    return revoked, nil
+}
+
+// loadDenyList 读取拒绝名单: 每行一个证书序列号、SHA-256 指纹 (十六进制，
+// 可用冒号分隔) 或证书身份 (CN)，# 开头的内容为注释
+func loadDenyList(path string) (map[string]bool, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取拒绝名单失败: %v", err)
+    }
+
+    denied := make(map[string]bool)
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        denied[line] = true
+        // 十六进制的序列号和指纹统一为小写、无冒号、无前导零的形式
+        hexValue := strings.ToLower(strings.ReplaceAll(line, ":", ""))
+        if isHex(hexValue) {
+            denied[hexValue] = true
+            if trimmed := strings.TrimLeft(hexValue, "0"); trimmed != "" {
+                denied[trimmed] = true
+            }
+        }
+    }
+    return denied, scanner.Err()
+}
+
+func isHex(s string) bool {
+    for _, r := range s {
+        if !strings.ContainsRune("0123456789abcdef", r) {
+            return false
+        }
+    }
+    return s != ""
+}
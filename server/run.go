@@ -0,0 +1,293 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// outputGroup 作业中结果完全相同 (状态、退出码、输出和错误都相同) 的一组节点
+type outputGroup struct {
+    Clients      []int       `json:"clients"`
+    State        string      `json:"state"`
+    ExitCode     *int        `json:"exit_code,omitempty"`
+    TimedOut     bool        `json:"timed_out,omitempty"`
+    Canceled     bool        `json:"canceled,omitempty"`
+    PolicyDenied bool        `json:"policy_denied,omitempty"`
+    Stdout       string      `json:"stdout"`
+    Stderr       string      `json:"stderr"`
+    Truncated    bool        `json:"truncated,omitempty"`
+    Error        string      `json:"error,omitempty"`
+    Health       *taskHealth `json:"health,omitempty"` // 只在健康检查失败时区分，通过的检查不影响分组
+}
+
+// groups 把已结束的节点按结果分组，节点多的组在前
+func (s *jobStatus) groups() []*outputGroup {
+    index := make(map[string]*outputGroup)
+    var groups []*outputGroup
+    for _, t := range s.Tasks {
+        if t.State != taskDone && t.State != taskFailed {
+            continue
+        }
+        exitCode := ""
+        if t.ExitCode != nil {
+            exitCode = strconv.Itoa(*t.ExitCode)
+        }
+        var health *taskHealth
+        healthKey := ""
+        if t.Health != nil && !t.Health.ok() {
+            health = t.Health
+            healthKey = strings.Join([]string{health.outcome(), health.Stdout, health.Stderr}, "\x00")
+        }
+        key := strings.Join([]string{t.State, exitCode, strconv.FormatBool(t.TimedOut), strconv.FormatBool(t.Canceled),
+            strconv.FormatBool(t.PolicyDenied), t.Stdout, t.Stderr, strconv.FormatBool(t.Truncated), t.Error, healthKey}, "\x00")
+        g, ok := index[key]
+        if !ok {
+            g = &outputGroup{State: t.State, ExitCode: t.ExitCode, TimedOut: t.TimedOut, Canceled: t.Canceled,
+                PolicyDenied: t.PolicyDenied, Stdout: t.Stdout, Stderr: t.Stderr, Truncated: t.Truncated, Error: t.Error, Health: health}
+            index[key] = g
+            groups = append(groups, g)
+        }
+        g.Clients = append(g.Clients, t.ClientID)
+    }
+    sort.SliceStable(groups, func(a, b int) bool { return len(groups[a].Clients) > len(groups[b].Clients) })
+    return groups
+}
+
+// outcome 返回结果的一行描述 (不含耗时)，例如 "退出码: 0, 已超时"
+func (t *jobTask) outcome() string {
+    if t.PolicyDenied {
+        return "被客户端的执行策略拒绝: " + t.Error
+    }
+    if t.ExitCode == nil {
+        return "失败: " + t.Error
+    }
+    line := fmt.Sprintf("退出码: %d", *t.ExitCode)
+    if t.TimedOut {
+        line += ", 已超时"
+    } else if t.Canceled {
+        line += ", 已取消"
+    } else if t.Error != "" {
+        line += ", 错误: " + t.Error
+    }
+    if t.Health != nil && !t.Health.ok() {
+        line += ", 健康检查" + t.Health.outcome()
+    }
+    return line
+}
+
+func (g *outputGroup) outcome() string {
+    t := jobTask{ExitCode: g.ExitCode, TimedOut: g.TimedOut, Canceled: g.Canceled, PolicyDenied: g.PolicyDenied, Error: g.Error, Health: g.Health}
+    return t.outcome()
+}
+
+// runOnTargets 处理 run 命令: run [-p 并发数] [-t 超时] [-b 每批节点数|百分比% [-max-fail 失败上限] [-check 健康检查]] <目标> <命令>
+func runOnTargets(s *operatorSession, args string) {
+    out := s.out
+    usage := "命令格式错误，应为: run [-p 并发数] [-t 超时] [-b N|X% [-max-fail N] [-check 命令]] <all|编号列表|group:分组|选择器> <命令>，包含空格的选择器需要加引号"
+    spec := jobSpec{Operator: s.name, Timeout: commandTimeout, Parallel: defaultParallel, Signer: s.signer, HealthSigner: s.signer}
+
+    args, err := parseRunOptions(args, &spec)
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return
+    }
+    target, command := nextToken(args)
+    if target == "" || command == "" {
+        fmt.Fprintln(out, usage)
+        return
+    }
+    spec.Command = command
+
+    targets, err := resolveTargets(target)
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return
+    }
+    if len(targets) == 0 {
+        fmt.Fprintln(out, "没有匹配的在线节点")
+        return
+    }
+
+    j := startJob(spec, targets)
+    parallel := "不限制"
+    if spec.Parallel > 0 {
+        parallel = strconv.Itoa(spec.Parallel)
+    }
+    fmt.Fprintf(out, "作业 %d: 在 %d 个节点上执行 (并发数: %s)，按 Ctrl-C 取消\n", j.ID, len(targets), parallel)
+    if j.BatchSize > 0 {
+        fmt.Fprintf(out, "滚动执行: %s\n", j.describeRollout())
+    }
+
+    interrupt, stopWatching := s.watchInterrupt()
+    defer stopWatching()
+    seq, done := 0, 0
+    for {
+        events, changed, finished := j.eventsSince(seq)
+        for _, ev := range events {
+            seq = ev.Seq
+            switch ev.Type {
+            case "batch":
+                b := ev.Data.(jobBatch)
+                fmt.Fprintf(out, "--- 第 %d/%d 批: 客户端 %s\n", b.Batch, b.Batches, formatIDs(b.Clients))
+                continue
+            case "health":
+                t := ev.Data.(jobTask)
+                fmt.Fprintf(out, "健康检查 客户端 %d (%s): %s\n", t.ClientID, hostnameOf(t.ClientID), t.Health.outcome())
+                continue
+            case "halt":
+                h := ev.Data.(jobHalt)
+                fmt.Fprintf(out, "滚动执行在第 %d 批后停止: %s\n", h.Batch, h.Reason)
+                continue
+            case "exit":
+            default:
+                continue
+            }
+            done++
+            t := ev.Data.(jobTask)
+            if t.State == taskSkipped {
+                continue
+            }
+            line := t.outcome()
+            if t.ExitCode != nil {
+                line += fmt.Sprintf(", 耗时: %s", time.Duration(t.DurationMs)*time.Millisecond)
+            }
+            fmt.Fprintf(out, "[%d/%d] 客户端 %d (%s): %s\n", done, len(targets), t.ClientID, hostnameOf(t.ClientID), line)
+        }
+        if finished {
+            break
+        }
+        select {
+        case <-changed:
+        case <-interrupt:
+            fmt.Fprintln(out, "正在取消作业，等待正在执行的命令结束")
+            j.cancel()
+            interrupt = nil
+        }
+    }
+    printJobGroups(out, j.status())
+}
+
+// parseRunOptions 解析 run 命令开头的选项并写入 spec，返回选项之后的部分 (目标和命令)
+func parseRunOptions(args string, spec *jobSpec) (string, error) {
+    for {
+        option, rest := nextToken(args)
+        switch option {
+        case "-p", "-t", "-b", "-max-fail", "-check":
+        default:
+            return args, spec.validate()
+        }
+        value, rest := nextToken(rest)
+        switch option {
+        case "-p":
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 0 {
+                return "", errors.New("并发数应为非负整数，0 表示不限制")
+            }
+            spec.Parallel = n
+        case "-t":
+            d, err := time.ParseDuration(value)
+            if err != nil || d < 0 {
+                return "", errors.New("超时时间格式错误，例如: 30s，0 表示不限制")
+            }
+            spec.Timeout = d
+        case "-b":
+            var err error
+            spec.BatchSize, spec.BatchPercent = 0, 0
+            if strings.HasSuffix(value, "%") {
+                spec.BatchPercent, err = strconv.Atoi(strings.TrimSuffix(value, "%"))
+            } else {
+                spec.BatchSize, err = strconv.Atoi(value)
+            }
+            if err != nil || spec.BatchSize < 0 || spec.BatchPercent < 0 || (spec.BatchSize == 0 && spec.BatchPercent == 0) {
+                return "", errors.New("每批的节点数应为正整数或 1 到 100 的百分比，例如: -b 5 或 -b 25%")
+            }
+        case "-max-fail":
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 0 {
+                return "", errors.New("失败上限应为非负整数")
+            }
+            spec.MaxFailures = n
+        case "-check":
+            if value == "" {
+                return "", errors.New("健康检查命令不能为空，包含空格时需要加引号")
+            }
+            spec.HealthCheck = value
+        }
+        args = rest
+    }
+}
+
+// printJobGroups 显示作业的汇总，并把相同的输出合并显示一次
+func printJobGroups(w io.Writer, s *jobStatus) {
+    fmt.Fprintf(w, "汇总: 共 %d 个节点, 成功 %d, 失败 %d", s.Total, s.Succeeded, s.Failed)
+    if s.Skipped > 0 {
+        fmt.Fprintf(w, ", 未执行 %d", s.Skipped)
+    }
+    fmt.Fprintln(w)
+    if s.Halted {
+        var skipped []int
+        for _, t := range s.Tasks {
+            if t.State == taskSkipped {
+                skipped = append(skipped, t.ClientID)
+            }
+        }
+        fmt.Fprintf(w, "滚动执行在第 %d 批后停止: %s", s.Batch, s.HaltReason)
+        if len(skipped) > 0 {
+            fmt.Fprintf(w, "，未执行的客户端: %s", formatIDs(skipped))
+        }
+        fmt.Fprintln(w)
+    }
+    for _, g := range s.groups() {
+        fmt.Fprintf(w, "=== %d 个节点 [客户端 %s] %s\n", len(g.Clients), formatIDs(g.Clients), g.outcome())
+        if g.Stdout != "" {
+            fmt.Fprint(w, g.Stdout)
+            if !strings.HasSuffix(g.Stdout, "\n") {
+                fmt.Fprintln(w)
+            }
+        }
+        if g.Stderr != "" {
+            stderrWriter{w}.Write([]byte(g.Stderr))
+            if !strings.HasSuffix(g.Stderr, "\n") {
+                fmt.Fprintln(w)
+            }
+        }
+        if g.Truncated {
+            fmt.Fprintln(w, "(输出超过上限，只保存了开头的部分)")
+        }
+        if g.Health != nil && (g.Health.Stdout != "" || g.Health.Stderr != "") {
+            fmt.Fprintln(w, "健康检查输出:")
+            printHealthOutput(w, g.Health)
+        }
+    }
+}
+
+// hostnameOf 返回客户端上报的主机名，尚未收到系统信息时为空
+func hostnameOf(id int) string {
+    mu.Lock()
+    defer mu.Unlock()
+    if info := clientInfo[id]; info != nil {
+        return info.Hostname
+    }
+    return ""
+}
+
+// nextToken 返回 s 中第一个以空白分隔的词和剩余部分，剩余部分保留原样 (只去掉开头的空白)。
+// 以单引号或双引号开头的词到对应的引号结束，可以包含空白，返回时去掉引号
+func nextToken(s string) (string, string) {
+    s = strings.TrimLeft(s, " \t")
+    if s != "" && (s[0] == '"' || s[0] == '\'') {
+        if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+            return s[1 : end+1], strings.TrimLeft(s[end+2:], " \t")
+        }
+    }
+    i := strings.IndexAny(s, " \t")
+    if i < 0 {
+        return s, ""
+    }
+    return s[:i], strings.TrimLeft(s[i:], " \t")
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseRunOptions(t *testing.T) {
+    tests := []struct {
+        args    string
+        want    jobSpec
+        rest    string
+        wantErr bool
+    }{
+        {args: "all uptime", want: jobSpec{Parallel: 50, Timeout: time.Minute}, rest: "all uptime"},
+        {args: "-p 5 -t 30s 1-3 uptime", want: jobSpec{Parallel: 5, Timeout: 30 * time.Second}, rest: "1-3 uptime"},
+        {args: "-p 0 all uptime", want: jobSpec{Parallel: 0, Timeout: time.Minute}, rest: "all uptime"},
+        {args: "-b 2 all uptime", want: jobSpec{Parallel: 50, Timeout: time.Minute, BatchSize: 2}, rest: "all uptime"},
+        {args: "-b 25% -max-fail 1 all uptime", want: jobSpec{Parallel: 50, Timeout: time.Minute, BatchPercent: 25, MaxFailures: 1}, rest: "all uptime"},
+        {args: "-b 1 -check 'systemctl is-active nginx' group:web systemctl restart nginx",
+            want: jobSpec{Parallel: 50, Timeout: time.Minute, BatchSize: 1, HealthCheck: "systemctl is-active nginx"},
+            rest: "group:web systemctl restart nginx"},
+        // 后面的 -b 覆盖前面的
+        {args: "-b 20% -b 3 all uptime", want: jobSpec{Parallel: 50, Timeout: time.Minute, BatchSize: 3}, rest: "all uptime"},
+        {args: "\"vendor = Dell\" uptime", want: jobSpec{Parallel: 50, Timeout: time.Minute}, rest: "\"vendor = Dell\" uptime"},
+
+        {args: "-p -1 all uptime", wantErr: true},
+        {args: "-p x all uptime", wantErr: true},
+        {args: "-t 1 all uptime", wantErr: true},
+        {args: "-t -1s all uptime", wantErr: true},
+        {args: "-b 0 all uptime", wantErr: true},
+        {args: "-b 00 all uptime", wantErr: true},
+        {args: "-b 0% all uptime", wantErr: true},
+        {args: "-b 000% all uptime", wantErr: true},
+        {args: "-b -2 all uptime", wantErr: true},
+        {args: "-b 101% all uptime", wantErr: true},
+        {args: "-b x all uptime", wantErr: true},
+        {args: "-max-fail -1 -b 2 all uptime", wantErr: true},
+        {args: "-max-fail 1 all uptime", wantErr: true},
+        {args: "-check true all uptime", wantErr: true},
+        {args: "-b 2 -check '' all uptime", wantErr: true},
+    }
+    for _, tt := range tests {
+        spec := jobSpec{Parallel: 50, Timeout: time.Minute}
+        rest, err := parseRunOptions(tt.args, &spec)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("parseRunOptions(%q) 应返回错误，得到 %+v", tt.args, spec)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parseRunOptions(%q): %v", tt.args, err)
+            continue
+        }
+        if spec != tt.want || rest != tt.rest {
+            t.Errorf("parseRunOptions(%q) = %+v, %q，应为 %+v, %q", tt.args, spec, rest, tt.want, tt.rest)
+        }
+    }
+}
+
+func TestBatchSize(t *testing.T) {
+    tests := []struct {
+        spec jobSpec
+        n    int
+        want int
+    }{
+        {jobSpec{}, 10, 0},
+        {jobSpec{BatchSize: 3}, 10, 3},
+        {jobSpec{BatchSize: 30}, 10, 30},
+        {jobSpec{BatchPercent: 25}, 10, 3},
+        {jobSpec{BatchPercent: 34}, 3, 2},
+        {jobSpec{BatchPercent: 1}, 3, 1},
+        {jobSpec{BatchPercent: 100}, 7, 7},
+    }
+    for _, tt := range tests {
+        if got := tt.spec.batchSize(tt.n); got != tt.want {
+            t.Errorf("%+v.batchSize(%d) = %d，应为 %d", tt.spec, tt.n, got, tt.want)
+        }
+    }
+}
+
+func TestNextToken(t *testing.T) {
+    tests := []struct {
+        s, token, rest string
+    }{
+        {"", "", ""},
+        {"  all  uptime -a", "all", "uptime -a"},
+        {"'a b' c", "a b", "c"},
+        {"\"x = 'y'\" z", "x = 'y'", "z"},
+        {"'unterminated z", "'unterminated", "z"},
+        {"single", "single", ""},
+    }
+    for _, tt := range tests {
+        token, rest := nextToken(tt.s)
+        if token != tt.token || rest != tt.rest {
+            t.Errorf("nextToken(%q) = %q, %q，应为 %q, %q", tt.s, token, rest, tt.token, tt.rest)
+        }
+    }
+}
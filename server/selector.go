@@ -0,0 +1,669 @@
+package server
+
+import (
+    "fmt"
+    "net"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode"
+
+    "serverandclient/protocol"
+)
+
+// 节点选择器: 在 list、search、run 和 API 中按结构化的系统信息选择节点，例如
+//
+//   memory > 64GB and vendor = Dell*
+//   (hostname = web-* or hostname ~ "^db[0-9]+$") and not offline
+//   disk.type = SSD and cpu.cores >= 16
+//   label.role = web and group = bj1-prod
+//   Intel                      不是字段比较的词在系统信息中搜索 (与原来的 search 相同)
+//
+// 相邻的条件之间默认为 and。字段有多个值时 (例如磁盘、网卡)，任一值满足即匹配，
+// != 和 !~ 表示没有任何值满足。= 比较文本时不区分大小写，可以使用 * 和 ? 通配符
+// (* 也匹配 /，其他字符都按原样比较)，ip = 10.0.0.0/8 按网段匹配；~ 为不区分大小写的正则表达式。
+type selector struct {
+    expr     selectorNode
+    keywords []string // 表达式中的搜索词，用于高亮显示
+}
+
+type selectorNode interface {
+    match(n *selectorNodeFacts) bool
+}
+
+// selectorNodeFacts 求值时的节点，调用者需持有 mu
+type selectorNodeFacts struct {
+    c      *client
+    info   *protocol.Inventory // 尚未收到系统信息时为 nil，此时系统信息字段没有值
+    groups map[string]bool     // 本次求值中已经确定的分组成员关系，每个分组只计算一次
+}
+
+// 字段值的类型，决定可以使用的比较运算和数值的单位
+const (
+    fieldText   = iota
+    fieldNumber // 无单位的整数
+    fieldSizeMB // 容量，无单位时为 MB
+    fieldSizeGB // 容量，无单位时为 GB
+    fieldGHz    // 频率，无单位时为 GHz
+    fieldIP     // IP 地址，= 可以使用网段
+)
+
+type selectorField struct {
+    kind   int
+    text   func(n *selectorNodeFacts) []string
+    number func(n *selectorNodeFacts) []float64
+}
+
+func textField(fn func(n *selectorNodeFacts) []string) *selectorField {
+    return &selectorField{kind: fieldText, text: fn}
+}
+
+func numberField(kind int, fn func(n *selectorNodeFacts) []float64) *selectorField {
+    return &selectorField{kind: kind, number: fn}
+}
+
+// inventoryText 返回系统信息中的一个文本值，没有系统信息时为空
+func inventoryText(fn func(info *protocol.Inventory) string) *selectorField {
+    return textField(func(n *selectorNodeFacts) []string {
+        if n.info == nil {
+            return nil
+        }
+        return []string{fn(n.info)}
+    })
+}
+
+func inventoryNumber(kind int, fn func(info *protocol.Inventory) float64) *selectorField {
+    return numberField(kind, func(n *selectorNodeFacts) []float64 {
+        if n.info == nil {
+            return nil
+        }
+        return []float64{fn(n.info)}
+    })
+}
+
+// selectorFields 可以在选择器中使用的字段，名称不区分大小写
+var selectorFields = map[string]*selectorField{
+    "id":      numberField(fieldNumber, func(n *selectorNodeFacts) []float64 { return []float64{float64(n.c.id)} }),
+    "node_id": textField(func(n *selectorNodeFacts) []string { return []string{n.c.nodeID} }),
+    "status": textField(func(n *selectorNodeFacts) []string {
+        if n.c.online {
+            return []string{"online"}
+        }
+        return []string{"offline"}
+    }),
+    "approval": textField(func(n *selectorNodeFacts) []string {
+        if n.c.approval == "" {
+            return []string{approvalApproved}
+        }
+        return []string{n.c.approval}
+    }),
+    "os":         textField(func(n *selectorNodeFacts) []string { return []string{n.c.hello.OS} }),
+    "arch":       textField(func(n *selectorNodeFacts) []string { return []string{n.c.hello.Arch} }),
+    "version":    textField(func(n *selectorNodeFacts) []string { return []string{n.c.hello.BuildVersion} }),
+    "protocol":   numberField(fieldNumber, func(n *selectorNodeFacts) []float64 { return []float64{float64(n.c.protocolVersion)} }),
+    "capability": textField(func(n *selectorNodeFacts) []string { return n.c.capabilities }),
+    "cert":       textField(func(n *selectorNodeFacts) []string { return []string{n.c.certIdentity} }),
+    "group":      textField(func(n *selectorNodeFacts) []string { return n.groupNamesLocked() }),
+    "ip": &selectorField{kind: fieldIP, text: func(n *selectorNodeFacts) []string {
+        var ips []string
+        if host, _, err := net.SplitHostPort(n.c.addr); err == nil {
+            ips = append(ips, host)
+        }
+        if n.info != nil {
+            for _, nic := range n.info.NetworkInterfaces {
+                for _, ip := range nic.IPs {
+                    ips = append(ips, strings.SplitN(ip, "/", 2)[0])
+                }
+            }
+        }
+        return ips
+    }},
+
+    "hostname":    inventoryText(func(info *protocol.Inventory) string { return info.Hostname }),
+    "cpu":         inventoryText(func(info *protocol.Inventory) string { return info.CPU.Model }),
+    "cpu.count":   inventoryNumber(fieldNumber, func(info *protocol.Inventory) float64 { return float64(info.CPU.PhysicalCPUs) }),
+    "cpu.cores":   inventoryNumber(fieldNumber, func(info *protocol.Inventory) float64 { return float64(info.CPU.TotalCores) }),
+    "cpu.threads": inventoryNumber(fieldNumber, func(info *protocol.Inventory) float64 { return float64(info.CPU.TotalThreads) }),
+    "cpu.freq":    inventoryNumber(fieldGHz, func(info *protocol.Inventory) float64 { return info.CPU.FrequencyGHz }),
+    "memory":      inventoryNumber(fieldSizeMB, func(info *protocol.Inventory) float64 { return float64(info.Memory.TotalMB) }),
+    "disk":        inventoryNumber(fieldSizeGB, func(info *protocol.Inventory) float64 { return float64(info.RootDisk.TotalGB) }),
+    "vendor":      inventoryText(func(info *protocol.Inventory) string { return info.Product.Vendor }),
+    "product":     inventoryText(func(info *protocol.Inventory) string { return info.Product.Name }),
+    "family":      inventoryText(func(info *protocol.Inventory) string { return info.Product.Family }),
+    "serial":      inventoryText(func(info *protocol.Inventory) string { return info.Product.SerialNumber }),
+    "sku":         inventoryText(func(info *protocol.Inventory) string { return info.Product.SKU }),
+    "uuid":        inventoryText(func(info *protocol.Inventory) string { return info.Product.UUID }),
+
+    "disk.count": inventoryNumber(fieldNumber, func(info *protocol.Inventory) float64 { return float64(len(info.Disks)) }),
+    "disk.name": textField(func(n *selectorNodeFacts) []string {
+        return eachDisk(n, func(d protocol.BlockDisk) string { return d.Name })
+    }),
+    "disk.type": textField(func(n *selectorNodeFacts) []string {
+        return eachDisk(n, func(d protocol.BlockDisk) string { return d.Type })
+    }),
+    "disk.size": numberField(fieldSizeGB, func(n *selectorNodeFacts) []float64 {
+        var sizes []float64
+        if n.info != nil {
+            for _, d := range n.info.Disks {
+                sizes = append(sizes, float64(d.SizeGB))
+            }
+        }
+        return sizes
+    }),
+    "raid": textField(func(n *selectorNodeFacts) []string {
+        var values []string
+        if n.info != nil {
+            for _, r := range n.info.RAID {
+                values = append(values, r.Product, r.Vendor, r.Description)
+            }
+        }
+        return values
+    }),
+    "nic": textField(func(n *selectorNodeFacts) []string {
+        return eachNIC(n, func(nic protocol.NetworkInterface) string { return nic.Name })
+    }),
+    "mac": textField(func(n *selectorNodeFacts) []string {
+        return eachNIC(n, func(nic protocol.NetworkInterface) string { return nic.MAC })
+    }),
+}
+
+func eachDisk(n *selectorNodeFacts, fn func(d protocol.BlockDisk) string) []string {
+    var values []string
+    if n.info != nil {
+        for _, d := range n.info.Disks {
+            values = append(values, fn(d))
+        }
+    }
+    return values
+}
+
+func eachNIC(n *selectorNodeFacts, fn func(nic protocol.NetworkInterface) string) []string {
+    var values []string
+    if n.info != nil {
+        for _, nic := range n.info.NetworkInterfaces {
+            values = append(values, fn(nic))
+        }
+    }
+    return values
+}
+
+// selectorHelp help select 显示的选择器语法
+const selectorHelp = `选择器语法:
+  <字段> <运算符> <值>   比较字段，例如 memory > 64GB、vendor = Dell*、hostname ~ "^web[0-9]+$"
+  online / offline       在线或离线的客户端
+  <词> 或 "<短语>"       在系统信息中搜索 (不区分大小写，与原来的 search 相同)
+  and (&&)、or (||)、not (!) 和括号组合条件，相邻的条件之间默认为 and
+运算符:
+  = (==)、!=             文本不区分大小写，匹配整个值，可以使用 * 和 ? 通配符 (* 也匹配 /)，
+                         例如 vendor = Dell 不匹配 "Dell Inc."，需要写为 Dell*；ip 可以使用网段，例如 ip = 10.0.0.0/8
+  > >= < <=              只用于数值字段
+  ~、!~                  不区分大小写的正则表达式，包含空格或括号时需要加引号
+  字段有多个值时 (磁盘、网卡等) 任一值满足即匹配，!= 和 !~ 表示没有任何值满足
+字段:
+  id、node_id、status、approval、os、arch、version、protocol、capability、cert、ip、group (所属的分组)
+  label.<键>             节点的标签，例如 label.role = web；label.role = * 表示有该标签
+  hostname、cpu (型号)、cpu.count、cpu.cores、cpu.threads、cpu.freq (GHz)、memory (MB)、disk (根分区, GB)
+  vendor、product、family、serial、sku、uuid
+  disk.count、disk.name、disk.type、disk.size (GB)、raid、nic、mac
+  容量可以带 KB、MB、GB、TB 单位，频率可以带 MHz、GHz 单位
+`
+
+// parseSelector 解析选择器表达式
+func parseSelector(s string) (*selector, error) {
+    tokens, err := scanSelector(s)
+    if err != nil {
+        return nil, err
+    }
+    p := &selectorParser{tokens: tokens, sel: &selector{}}
+    if p.peek().kind == tokEnd {
+        return nil, fmt.Errorf("选择器不能为空")
+    }
+    expr, err := p.parseOr()
+    if err != nil {
+        return nil, err
+    }
+    if t := p.peek(); t.kind != tokEnd {
+        return nil, p.errorf(t, "多余的 %q", t.text)
+    }
+    p.sel.expr = expr
+    return p.sel, nil
+}
+
+// matchLocked 判断客户端是否满足选择器，调用者需持有 mu
+func (s *selector) matchLocked(c *client) bool {
+    return s.expr.match(&selectorNodeFacts{c: c, info: clientInfo[c.id]})
+}
+
+// selectClientsLocked 返回满足选择器的客户端，按编号排序，调用者需持有 mu
+func (s *selector) selectClientsLocked() []*client {
+    var matched []*client
+    for _, id := range sortedClientIDs() {
+        if c := clients[id]; s.matchLocked(c) {
+            matched = append(matched, c)
+        }
+    }
+    return matched
+}
+
+type andNode struct{ left, right selectorNode }
+type orNode struct{ left, right selectorNode }
+type notNode struct{ expr selectorNode }
+type keywordNode struct{ keyword string } // 小写
+type statusNode struct{ online bool }
+type groupNode struct{ name string } // group = <名称>，只计算名称相同的分组
+
+func (e *andNode) match(n *selectorNodeFacts) bool { return e.left.match(n) && e.right.match(n) }
+func (e *orNode) match(n *selectorNodeFacts) bool  { return e.left.match(n) || e.right.match(n) }
+func (e *notNode) match(n *selectorNodeFacts) bool { return !e.expr.match(n) }
+func (e *keywordNode) match(n *selectorNodeFacts) bool {
+    return inventoryMatches(n.info, e.keyword)
+}
+func (e *statusNode) match(n *selectorNodeFacts) bool { return n.c.online == e.online }
+func (e *groupNode) match(n *selectorNodeFacts) bool {
+    for name := range groups {
+        if strings.EqualFold(name, e.name) && n.inGroupLocked(name) {
+            return true
+        }
+    }
+    return false
+}
+
+// compareNode 字段比较，值在解析时按字段类型预先处理
+type compareNode struct {
+    field  *selectorField
+    op     string
+    value  string // 小写的文本值或通配符
+    number float64
+    re     *regexp.Regexp
+    subnet *net.IPNet
+}
+
+func (e *compareNode) match(n *selectorNodeFacts) bool {
+    switch e.op {
+    case "!=":
+        return !e.matchAny(n, "=")
+    case "!~":
+        return !e.matchAny(n, "~")
+    }
+    return e.matchAny(n, e.op)
+}
+
+// matchAny 判断字段的任一值是否满足 op
+func (e *compareNode) matchAny(n *selectorNodeFacts, op string) bool {
+    if e.field.number != nil {
+        for _, v := range e.field.number(n) {
+            if compareNumbers(v, op, e.number) {
+                return true
+            }
+        }
+        return false
+    }
+    for _, v := range e.field.text(n) {
+        switch {
+        case op == "~":
+            if e.re.MatchString(v) {
+                return true
+            }
+        case e.subnet != nil:
+            if ip := net.ParseIP(v); ip != nil && e.subnet.Contains(ip) {
+                return true
+            }
+        default:
+            if globMatch(e.value, strings.ToLower(v)) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// globMatch 判断 s 是否匹配通配符 pattern: * 匹配任意字符 (包括 /)，? 匹配一个字符，
+// 其他字符 (包括 [ 和 \) 都按原样比较
+func globMatch(pattern, s string) bool {
+    p, t := []rune(pattern), []rune(s)
+    pi, ti := 0, 0
+    star, mark := -1, 0
+    for ti < len(t) {
+        switch {
+        case pi < len(p) && (p[pi] == '?' || p[pi] == t[ti]):
+            pi++
+            ti++
+        case pi < len(p) && p[pi] == '*':
+            star, mark = pi, ti
+            pi++
+        case star >= 0:
+            // 回到上一个 *，让它多匹配一个字符
+            mark++
+            pi, ti = star+1, mark
+        default:
+            return false
+        }
+    }
+    for pi < len(p) && p[pi] == '*' {
+        pi++
+    }
+    return pi == len(p)
+}
+
+func compareNumbers(a float64, op string, b float64) bool {
+    switch op {
+    case "=":
+        return a == b
+    case ">":
+        return a > b
+    case ">=":
+        return a >= b
+    case "<":
+        return a < b
+    case "<=":
+        return a <= b
+    }
+    return false
+}
+
+// 词法单元
+const (
+    tokEnd = iota
+    tokWord
+    tokString
+    tokLParen
+    tokRParen
+    tokCompare // = == != > >= < <= ~ !~
+    tokNot     // !
+    tokAnd     // &&
+    tokOr      // ||
+)
+
+type selectorToken struct {
+    kind int
+    text string
+    pos  int // 在表达式中的字符位置，从 1 开始，用于错误信息
+}
+
+// scanSelector 把表达式拆分为词法单元
+func scanSelector(s string) ([]selectorToken, error) {
+    var tokens []selectorToken
+    r := []rune(s)
+    for i := 0; i < len(r); {
+        c := r[i]
+        start := i
+        switch {
+        case unicode.IsSpace(c):
+            i++
+            continue
+        case c == '(':
+            tokens = append(tokens, selectorToken{tokLParen, "(", start + 1})
+            i++
+        case c == ')':
+            tokens = append(tokens, selectorToken{tokRParen, ")", start + 1})
+            i++
+        case c == '"' || c == '\'':
+            var b strings.Builder
+            i++
+            for i < len(r) && r[i] != c {
+                if r[i] == '\\' && i+1 < len(r) && (r[i+1] == c || r[i+1] == '\\') {
+                    i++
+                }
+                b.WriteRune(r[i])
+                i++
+            }
+            if i == len(r) {
+                return nil, fmt.Errorf("选择器语法错误 (位置 %d): 引号没有结束", start+1)
+            }
+            i++
+            tokens = append(tokens, selectorToken{tokString, b.String(), start + 1})
+        case strings.ContainsRune("=!<>~&|", c):
+            op := string(c)
+            if i+1 < len(r) {
+                if two := string(r[i : i+2]); two == "==" || two == "!=" || two == ">=" || two == "<=" ||
+                    two == "!~" || two == "&&" || two == "||" {
+                    op = two
+                }
+            }
+            i += len([]rune(op))
+            switch op {
+            case "&&":
+                tokens = append(tokens, selectorToken{tokAnd, op, start + 1})
+            case "||":
+                tokens = append(tokens, selectorToken{tokOr, op, start + 1})
+            case "!":
+                tokens = append(tokens, selectorToken{tokNot, op, start + 1})
+            case "&", "|":
+                return nil, fmt.Errorf("选择器语法错误 (位置 %d): 应为 %s%s", start+1, op, op)
+            case "==":
+                tokens = append(tokens, selectorToken{tokCompare, "=", start + 1})
+            default:
+                tokens = append(tokens, selectorToken{tokCompare, op, start + 1})
+            }
+        default:
+            for i < len(r) && !unicode.IsSpace(r[i]) && !strings.ContainsRune("()\"'=!<>~&|", r[i]) {
+                i++
+            }
+            tokens = append(tokens, selectorToken{tokWord, string(r[start:i]), start + 1})
+        }
+    }
+    return append(tokens, selectorToken{tokEnd, "", len(r) + 1}), nil
+}
+
+// selectorParser 递归下降解析，优先级从低到高为 or、and、not
+type selectorParser struct {
+    tokens []selectorToken
+    pos    int
+    sel    *selector
+}
+
+func (p *selectorParser) peek() selectorToken {
+    return p.tokens[p.pos]
+}
+
+func (p *selectorParser) next() selectorToken {
+    t := p.tokens[p.pos]
+    if t.kind != tokEnd {
+        p.pos++
+    }
+    return t
+}
+
+func (p *selectorParser) errorf(t selectorToken, format string, args ...interface{}) error {
+    return fmt.Errorf("选择器语法错误 (位置 %d): %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+// isWord 判断词法单元是否为指定的关键字 (and、or、not 等，不区分大小写)
+func (t selectorToken) isWord(word string) bool {
+    return t.kind == tokWord && strings.EqualFold(t.text, word)
+}
+
+func (p *selectorParser) parseOr() (selectorNode, error) {
+    left, err := p.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    for t := p.peek(); t.kind == tokOr || t.isWord("or"); t = p.peek() {
+        p.next()
+        right, err := p.parseAnd()
+        if err != nil {
+            return nil, err
+        }
+        left = &orNode{left, right}
+    }
+    return left, nil
+}
+
+// parseAnd 解析 and 连接的条件，相邻的条件之间省略 and
+func (p *selectorParser) parseAnd() (selectorNode, error) {
+    left, err := p.parseNot()
+    if err != nil {
+        return nil, err
+    }
+    for {
+        t := p.peek()
+        if t.kind == tokAnd || t.isWord("and") {
+            p.next()
+        } else if t.kind == tokEnd || t.kind == tokRParen || t.kind == tokOr || t.isWord("or") {
+            return left, nil
+        }
+        right, err := p.parseNot()
+        if err != nil {
+            return nil, err
+        }
+        left = &andNode{left, right}
+    }
+}
+
+func (p *selectorParser) parseNot() (selectorNode, error) {
+    if t := p.peek(); t.kind == tokNot || t.isWord("not") {
+        p.next()
+        expr, err := p.parseNot()
+        if err != nil {
+            return nil, err
+        }
+        return &notNode{expr}, nil
+    }
+    return p.parsePrimary()
+}
+
+func (p *selectorParser) parsePrimary() (selectorNode, error) {
+    t := p.next()
+    switch t.kind {
+    case tokLParen:
+        expr, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        if closing := p.next(); closing.kind != tokRParen {
+            return nil, p.errorf(closing, "缺少 )")
+        }
+        return expr, nil
+    case tokString:
+        return p.keyword(t), nil
+    case tokWord:
+        if p.peek().kind == tokCompare {
+            return p.parseComparison(t)
+        }
+        switch strings.ToLower(t.text) {
+        case "online":
+            return &statusNode{online: true}, nil
+        case "offline":
+            return &statusNode{online: false}, nil
+        case "and", "or":
+            return nil, p.errorf(t, "%s 前面缺少条件", t.text)
+        }
+        return p.keyword(t), nil
+    case tokEnd:
+        return nil, p.errorf(t, "表达式不完整")
+    }
+    return nil, p.errorf(t, "不应出现 %q", t.text)
+}
+
+func (p *selectorParser) keyword(t selectorToken) selectorNode {
+    p.sel.keywords = append(p.sel.keywords, t.text)
+    return &keywordNode{keyword: strings.ToLower(t.text)}
+}
+
+// labelField 返回标签 key 的值，节点没有该标签时没有值
+func labelField(key string) *selectorField {
+    return textField(func(n *selectorNodeFacts) []string {
+        if v, ok := n.c.labelsLocked()[key]; ok {
+            return []string{v}
+        }
+        return nil
+    })
+}
+
+// parseComparison 解析 <字段> <运算符> <值>
+func (p *selectorParser) parseComparison(name selectorToken) (selectorNode, error) {
+    field, ok := selectorFields[strings.ToLower(name.text)]
+    if !ok && len(name.text) > len("label.") && strings.EqualFold(name.text[:len("label.")], "label.") {
+        field, ok = labelField(name.text[len("label."):]), true
+    }
+    if !ok {
+        return nil, p.errorf(name, "未知的字段 %s", name.text)
+    }
+    op := p.next()
+    v := p.next()
+    if v.kind != tokWord && v.kind != tokString {
+        return nil, p.errorf(v, "%s %s 后面缺少值", name.text, op.text)
+    }
+    e := &compareNode{field: field, op: op.text}
+
+    if field.number != nil {
+        if op.text == "~" || op.text == "!~" {
+            return nil, p.errorf(op, "字段 %s 是数值，不支持正则表达式", name.text)
+        }
+        number, err := parseSelectorNumber(v.text, field.kind)
+        if err != nil {
+            return nil, p.errorf(v, "%v", err)
+        }
+        e.number = number
+        return e, nil
+    }
+
+    // 不含通配符的 group = <名称> 只计算该分组，不需要计算客户端所属的所有分组
+    if field == selectorFields["group"] && (op.text == "=" || op.text == "!=") && !strings.ContainsAny(v.text, "*?") {
+        if op.text == "!=" {
+            return &notNode{&groupNode{name: v.text}}, nil
+        }
+        return &groupNode{name: v.text}, nil
+    }
+
+    switch op.text {
+    case "~", "!~":
+        re, err := regexp.Compile("(?i)" + v.text)
+        if err != nil {
+            return nil, p.errorf(v, "正则表达式错误: %v", err)
+        }
+        e.re = re
+    case "=", "!=":
+        e.value = strings.ToLower(v.text)
+        if field.kind == fieldIP && strings.Contains(v.text, "/") {
+            _, subnet, err := net.ParseCIDR(v.text)
+            if err != nil {
+                return nil, p.errorf(v, "网段格式错误: %s", v.text)
+            }
+            e.subnet = subnet
+        }
+    default:
+        return nil, p.errorf(op, "字段 %s 是文本，不支持 %s", name.text, op.text)
+    }
+    return e, nil
+}
+
+// parseSelectorNumber 解析数值，容量可以带 KB、MB、GB、TB 单位 (按 1024 换算)，
+// 频率可以带 MHz、GHz 单位，结果换算为字段的单位
+func parseSelectorNumber(s string, kind int) (float64, error) {
+    i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' && r != '-' })
+    num, unit := s, ""
+    if i >= 0 {
+        num, unit = s[:i], strings.ToUpper(s[i:])
+    }
+    value, err := strconv.ParseFloat(num, 64)
+    if err != nil {
+        return 0, fmt.Errorf("应为数值: %s", s)
+    }
+    if unit == "" {
+        return value, nil
+    }
+
+    switch kind {
+    case fieldSizeMB, fieldSizeGB:
+        mb := map[string]float64{"K": 1.0 / 1024, "KB": 1.0 / 1024, "M": 1, "MB": 1, "G": 1024, "GB": 1024, "T": 1 << 20, "TB": 1 << 20}
+        factor, ok := mb[unit]
+        if !ok {
+            return 0, fmt.Errorf("无法识别的容量单位: %s", s)
+        }
+        value *= factor
+        if kind == fieldSizeGB {
+            value /= 1024
+        }
+        return value, nil
+    case fieldGHz:
+        switch unit {
+        case "GHZ":
+            return value, nil
+        case "MHZ":
+            return value / 1000, nil
+        }
+        return 0, fmt.Errorf("无法识别的频率单位: %s", s)
+    }
+    return 0, fmt.Errorf("应为数值: %s", s)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+    "testing"
+
+    "serverandclient/protocol"
+)
+
+func TestGlobMatch(t *testing.T) {
+    tests := []struct {
+        pattern, s string
+        want       bool
+    }{
+        {"", "", true},
+        {"", "a", false},
+        {"*", "", true},
+        {"*", "anything/at/all", true},
+        {"web-*", "web-01", true},
+        {"web-*", "db-01", false},
+        {"web-??", "web-01", true},
+        {"web-??", "web-1", false},
+        {"*-prod-*", "bj-prod-03", true},
+        {"a*b*c", "axxbyyc", true},
+        {"a*b*c", "axxbyy", false},
+        {"a*a", "aaaa", true},
+        // * 匹配 /，[ 和 \ 按原样比较
+        {"/dev/*", "/dev/nvme0n1", true},
+        {"*/data", "/mnt/disk1/data", true},
+        {"[raid]", "[raid]", true},
+        {"[raid]", "r", false},
+        {`c:\*`, `c:\windows`, true},
+        {"服务器?", "服务器a", true},
+    }
+    for _, tt := range tests {
+        if got := globMatch(tt.pattern, tt.s); got != tt.want {
+            t.Errorf("globMatch(%q, %q) = %v，应为 %v", tt.pattern, tt.s, got, tt.want)
+        }
+    }
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+    for _, expr := range []string{
+        "",
+        "   ",
+        "memory >",
+        "(vendor = Dell",
+        "vendor = Dell)",
+        "hostname = 'web",
+        "and vendor = Dell",
+        "vendor = Dell or",
+        "memory > big",
+        "vendor > Dell",
+        "hostname ~ \"(\"",
+        "ip = 10.0.0.0/33",
+        "vendor & Dell",
+        "unknown.field = x",
+    } {
+        if _, err := parseSelector(expr); err == nil {
+            t.Errorf("parseSelector(%q) 应返回错误", expr)
+        }
+    }
+}
+
+func TestSelectorMatch(t *testing.T) {
+    c := &client{id: 3, online: true, addr: "10.1.2.3:50000", labels: map[string]string{"role": "web"}}
+    info := &protocol.Inventory{
+        Hostname: "web-03.bj",
+        CPU:      protocol.CPUInfo{TotalCores: 32},
+        Memory:   protocol.MemoryInfo{TotalMB: 131072},
+        Product:  protocol.ProductInfo{Vendor: "Dell Inc.", Name: "PowerEdge R740"},
+        Disks: []protocol.BlockDisk{
+            {Name: "/dev/sda", Type: "HDD", SizeGB: 4000},
+            {Name: "/dev/nvme0n1", Type: "SSD", SizeGB: 960},
+        },
+        NetworkInterfaces: []protocol.NetworkInterface{{Name: "eth0", IPs: []string{"192.168.7.3/24"}}},
+    }
+    facts := &selectorNodeFacts{c: c, info: info}
+
+    tests := []struct {
+        expr string
+        want bool
+    }{
+        {"vendor = dell*", true},
+        {"vendor = Dell", false},
+        {"vendor == 'dell inc.'", true},
+        {"vendor != HP*", true},
+        {"memory > 64GB", true},
+        {"memory >= 128GB and cpu.cores >= 32", true},
+        {"memory < 128GB", false},
+        {"disk.type = SSD", true},
+        {"disk.type != SSD", false},
+        {"disk.name = /dev/*", true},
+        {"disk.size > 3TB", true},
+        {"hostname ~ '^web-[0-9]+'", true},
+        {"hostname !~ '^db'", true},
+        {"ip = 10.0.0.0/8", true},
+        {"ip = 192.168.7.0/24", true},
+        {"ip = 172.16.0.0/12", false},
+        {"label.role = web", true},
+        {"label.role = *", true},
+        {"label.dc = *", false},
+        {"online", true},
+        {"offline", false},
+        {"not offline && id = 3", true},
+        {"(vendor = HP* or vendor = dell*) and disk.type = SSD", true},
+        {"vendor = HP* or memory < 1GB", false},
+        {"PowerEdge", true},
+        {"\"poweredge r740\" SSD", true},
+        {"Supermicro", false},
+    }
+    for _, tt := range tests {
+        sel, err := parseSelector(tt.expr)
+        if err != nil {
+            t.Errorf("parseSelector(%q): %v", tt.expr, err)
+            continue
+        }
+        if got := sel.expr.match(facts); got != tt.want {
+            t.Errorf("%q 的匹配结果为 %v，应为 %v", tt.expr, got, tt.want)
+        }
+    }
+
+    // 尚未收到系统信息时系统信息字段没有值
+    for expr, want := range map[string]bool{"vendor = *": false, "vendor != *": true, "id = 3": true} {
+        sel, _ := parseSelector(expr)
+        if got := sel.expr.match(&selectorNodeFacts{c: c}); got != want {
+            t.Errorf("没有系统信息时 %q 的匹配结果为 %v，应为 %v", expr, got, want)
+        }
+    }
+}
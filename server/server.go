@@ -1,7 +1,7 @@
 package server
 
 import (
-    "bufio"
+    "io"
     "flag"
     "fmt"
     "net"
@@ -11,26 +11,112 @@ import (
     "sync"
     "time"
     "regexp"
-    "os/signal"
-    "syscall"
+    "sort"
+    "path/filepath"
+    "crypto/x509"
+    "serverandclient/protocol"
 )
 
 var (
     serverHost     string
     serverPort     int
     serverHelp     bool
-    clients  = make(map[int]net.Conn)
-    clientInfo = make(map[int]string) // 存储客户端信息
+    commandTimeout time.Duration
+    dataDir        string
+    clients  = make(map[int]*client) // 包含离线的客户端，重连后复用同一编号
+    clientInfo = make(map[int]*protocol.Inventory) // 存储客户端信息
+    nodeIDs  = make(map[string]int)  // 节点ID到客户端编号的映射
+    certIdentities = make(map[string]int) // 客户端证书身份到客户端编号的映射
     clientID = 0
     mu       sync.Mutex
-    commands = make(map[int][]string) // 命令队列
-    cmdMutex sync.Mutex
 )
 
+// 客户端连接。同一节点每次连接都会新建一个 client，但沿用相同的编号
+type client struct {
+    id     int
+    nodeID string
+    addr   string // 最近一次连接的远端地址
+    conn   net.Conn
+    enc    *protocol.Encoder
+    dec    *protocol.Decoder
+
+    // 以下字段由 mu 保护
+    online      bool
+    firstSeen   time.Time
+    connectedAt time.Time
+    lastSeen    time.Time
+
+    hello           protocol.Hello    // 客户端握手时声明的信息
+    protocolVersion int               // 协商后的协议版本
+    capabilities    []string          // 协商后双方都支持的能力
+    certIdentity    string            // 绑定的客户端证书身份，未使用客户端证书时为空
+    secretHash      string            // 颁发给节点的节点密钥的哈希，尚未颁发时为空
+    cert            *x509.Certificate // 本次连接出示的客户端证书
+    approval        string            // 审批状态，由 mu 保护
+    labels          map[string]string // 操作员设置的标签，与客户端声明的同名标签冲突时优先
+
+    execMu    sync.Mutex
+    nextReqID uint32
+    pending   map[uint32]*execution // 按请求ID索引的未完成命令
+    closed    bool
+}
+
+// 服务端支持的能力
+var serverCapabilities = []string{protocol.CapExec, protocol.CapPTY}
+
+func (c *client) hasCapability(name string) bool {
+    return protocol.HasCapability(c.capabilities, name)
+}
+
+func (c *client) isOnline() bool {
+    mu.Lock()
+    defer mu.Unlock()
+    return c.online
+}
+
+// statusLocked 返回在线状态的描述，调用者需持有 mu
+func (c *client) statusLocked() string {
+    if c.online {
+        return "在线"
+    }
+    return "离线, 最后在线: " + c.lastSeen.Format("2006-01-02 15:04:05")
+}
+
+// sortedClientIDs 返回按编号排序的客户端编号，调用者需持有 mu
+func sortedClientIDs() []int {
+    ids := make([]int, 0, len(clients))
+    for id := range clients {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    return ids
+}
+
 func init() {
     flag.StringVar(&serverHost, "h", "0.0.0.0", "监听的IP地址")
     flag.IntVar(&serverPort, "p", 4000, "监听的端口")
     flag.BoolVar(&serverHelp, "help", false, "显示帮助信息")
+    flag.DurationVar(&commandTimeout, "timeout", 10*time.Minute, "远程命令的默认超时时间，0 表示不限制")
+    flag.StringVar(&dataDir, "data-dir", "data", "数据目录，保存节点信息数据库")
+    flag.StringVar(&tlsCertFile, "tls-cert", "", "TLS 证书文件 (PEM)，与 -tls-key 同时指定时启用 TLS")
+    flag.StringVar(&tlsKeyFile, "tls-key", "", "TLS 私钥文件 (PEM)")
+    flag.StringVar(&tlsClientCAFile, "tls-client-ca", "", "客户端证书的 CA 文件 (PEM)，指定后只接受由该 CA 签发证书的客户端")
+    flag.StringVar(&tlsCRLFile, "tls-crl", "", "客户端证书吊销列表 (CRL) 文件，PEM 或 DER 格式")
+    flag.StringVar(&tlsDenyFile, "tls-denylist", "", "拒绝名单文件，每行一个证书序列号、SHA-256 指纹或证书身份")
+    flag.StringVar(&enrollTokenFile, "enroll-token-file", "", "注册令牌文件，每行一个令牌，新节点出示有效令牌时自动批准")
+    flag.BoolVar(&autoApprove, "auto-approve", false, "自动批准所有新节点，不需要令牌或人工审批")
+    flag.StringVar(&auditFile, "audit-log", "", "审计日志文件 (默认: <数据目录>/audit.log)")
+    flag.BoolVar(&auditHashChain, "audit-hash-chain", false, "审计日志的每条记录包含上一条记录的哈希，用于发现篡改")
+    flag.StringVar(&auditKeyFile, "audit-key", "", "审计日志的 HMAC 密钥文件，指定后哈希链使用 HMAC-SHA256 (隐含 -audit-hash-chain)")
+    flag.BoolVar(&recordSessions, "record-sessions", true, "录制 connect/exec 会话，保存在 <数据目录>/sessions 下")
+    flag.StringVar(&adminAddr, "admin-addr", "", "管理端口的监听地址 (例如 127.0.0.1:4022)，操作员使用 ssh 登录，为空时不启用")
+    flag.StringVar(&adminHostKey, "admin-host-key", "", "管理端口的 SSH 主机密钥 (默认: <数据目录>/admin_host_key，不存在时自动生成)")
+    flag.StringVar(&operatorsFile, "operators", "", "操作员文件 (JSON)，包含每个操作员的角色、密码哈希和 SSH 公钥")
+    flag.BoolVar(&hashPassword, "hash-password", false, "从标准输入读取密码，输出用于操作员文件的 bcrypt 哈希，然后退出")
+    flag.StringVar(&apiAddr, "api-addr", "", "HTTP API 的监听地址 (例如 127.0.0.1:8080)，为空时不启用")
+    flag.IntVar(&defaultParallel, "parallel", 50, "run 命令和作业同时执行的默认节点数，0 表示不限制")
+    flag.DurationVar(&queueTTL, "queue-ttl", 24*time.Hour, "排队命令的默认有效期，过期前没有送达的命令不再执行，0 表示不过期")
+    flag.BoolVar(&genAPIToken, "gen-api-token", false, "生成 HTTP API 令牌并输出用于操作员文件的哈希，然后退出")
 }
 
 func Run() {
@@ -39,12 +125,90 @@ func Run() {
         fmt.Println("服务端帮助信息:")
         fmt.Println("  -h: 监听的IP地址 (默认: 0.0.0.0)")
         fmt.Println("  -p: 监听的端口 (默认: 4000)")
+        fmt.Println("  -timeout: 远程命令的默认超时时间，0 表示不限制 (默认: 10m)")
+        fmt.Println("  -data-dir: 数据目录，保存节点信息数据库 (默认: data)")
+        fmt.Println("  -tls-cert: TLS 证书文件 (PEM)，与 -tls-key 同时指定时启用 TLS")
+        fmt.Println("  -tls-key: TLS 私钥文件 (PEM)")
+        fmt.Println("  -tls-client-ca: 客户端证书的 CA 文件 (PEM)，指定后只接受由该 CA 签发证书的客户端")
+        fmt.Println("  -tls-crl: 客户端证书吊销列表 (CRL) 文件，PEM 或 DER 格式，修改后自动重新读取")
+        fmt.Println("  -tls-denylist: 拒绝名单文件，每行一个证书序列号、SHA-256 指纹或证书身份，修改后自动重新读取")
+        fmt.Println("  -enroll-token-file: 注册令牌文件，每行一个令牌，新节点出示有效令牌时自动批准")
+        fmt.Println("  -auto-approve: 自动批准所有新节点，不需要令牌或人工审批")
+        fmt.Println("  -audit-log: 审计日志文件 (默认: <数据目录>/audit.log)")
+        fmt.Println("  -audit-hash-chain: 审计日志的每条记录包含上一条记录的哈希，用于发现篡改")
+        fmt.Println("  -audit-key: 审计日志的 HMAC 密钥文件，指定后哈希链使用 HMAC-SHA256 (隐含 -audit-hash-chain)，密钥应保存在数据目录之外")
+        fmt.Println("  -record-sessions: 录制 connect/exec 会话，保存在 <数据目录>/sessions 下 (默认: true)")
+        fmt.Println("  -admin-addr: 管理端口的监听地址 (例如 127.0.0.1:4022)，操作员使用 ssh 登录，为空时不启用")
+        fmt.Println("  -admin-host-key: 管理端口的 SSH 主机密钥 (默认: <数据目录>/admin_host_key，不存在时自动生成)")
+        fmt.Println("  -operators: 操作员文件 (JSON)，包含每个操作员的角色 (viewer/operator/admin)、密码哈希和 SSH 公钥，登录时重新读取")
+        fmt.Println("  -hash-password: 从标准输入读取密码，输出用于操作员文件的 bcrypt 哈希，然后退出")
+        fmt.Println("  -api-addr: HTTP API 的监听地址 (例如 127.0.0.1:8080)，为空时不启用，使用操作员文件中的 API 令牌认证")
+        fmt.Println("  -gen-api-token: 生成 HTTP API 令牌并输出用于操作员文件的哈希，然后退出")
+        fmt.Println("  -parallel: run 命令和作业同时执行的默认节点数，0 表示不限制 (默认: 50)")
+        fmt.Println("  -queue-ttl: 排队命令的默认有效期，过期前没有送达的命令不再执行，0 表示不过期 (默认: 24h)")
         fmt.Println("  -help: 显示帮助信息")
         return
     }
 
-    addr := fmt.Sprintf("%s:%d", serverHost, serverPort)
-    listener, err := net.Listen("tcp", addr)
+    if hashPassword {
+        if err := printPasswordHash(); err != nil {
+            fmt.Printf("生成密码哈希失败: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+    if genAPIToken {
+        if err := generateAPIToken(); err != nil {
+            fmt.Printf("生成 API 令牌失败: %v\n", err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    var err error
+    if enrollTokenFile != "" {
+        if enrollTokens, err = loadEnrollTokens(enrollTokenFile); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+
+    db, err = openStore(dataDir)
+    if err != nil {
+        fmt.Printf("打开数据目录失败: %v\n", err)
+        os.Exit(1)
+    }
+    defer db.Close()
+    if auditFile == "" {
+        auditFile = filepath.Join(dataDir, "audit.log")
+    }
+    var auditKey []byte
+    if auditKeyFile != "" {
+        if auditKey, err = loadAuditKey(auditKeyFile); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+    }
+    if audit, err = openAuditLog(auditFile, auditHashChain, auditKey, db); err != nil {
+        fmt.Printf("打开审计日志失败: %v\n", err)
+        os.Exit(1)
+    }
+    defer audit.Close()
+    if err := restoreClients(); err != nil {
+        fmt.Printf("读取节点信息失败: %v\n", err)
+        os.Exit(1)
+    }
+    if err := restoreGroups(); err != nil {
+        fmt.Printf("读取分组失败: %v\n", err)
+        os.Exit(1)
+    }
+    if err := restoreQueue(); err != nil {
+        fmt.Printf("读取排队命令失败: %v\n", err)
+        os.Exit(1)
+    }
+
+    addr := net.JoinHostPort(serverHost, strconv.Itoa(serverPort))
+    listener, err := listen(addr)
     if err != nil {
         fmt.Printf("监听端口失败: %v\n", err)
         os.Exit(1)
@@ -53,10 +217,33 @@ func Run() {
 
     fmt.Printf("服务端已启动，监听地址: %s\n", addr)
 
+    if adminAddr != "" {
+        if err := startAdminServer(adminAddr); err != nil {
+            fmt.Printf("启动管理端口失败: %v\n", err)
+            os.Exit(1)
+        }
+    }
+    if apiAddr != "" {
+        if err := startAPIServer(apiAddr); err != nil {
+            fmt.Printf("启动 HTTP API 失败: %v\n", err)
+            os.Exit(1)
+        }
+    }
+
     go acceptConnections(listener)
     go sendPingToClients()
+    go watchQueueExpiry()
 
-    handleCommands()
+    // 控制台输入结束 (例如作为后台服务运行) 时服务端继续运行，操作员可以通过管理端口登录
+    console := newConsoleSession()
+    if console.signer != nil {
+        fmt.Println("控制台通过 ssh-agent ($SSH_AUTH_SOCK) 为发往客户端的命令签名")
+    }
+    console.login()
+    handleCommands(console)
+    console.logout()
+    fmt.Println("控制台输入已结束，服务端继续运行")
+    select {}
 }
 
 
@@ -67,15 +254,42 @@ func sendPingToClients() {
     for {
         <-ticker.C
         mu.Lock()
-        for id, conn := range clients {
-            _, err := fmt.Fprintf(conn, "PING\n")
-            if err != nil {
-                fmt.Printf("客户端 %d (%s) 已断开连接\n> ", id, conn.RemoteAddr())
-                delete(clients, id)
-                delete(clientInfo, id)
+        var online []*client
+        for _, c := range clients {
+            if c.online {
+                online = append(online, c)
             }
         }
         mu.Unlock()
+
+        for _, c := range online {
+            if err := c.enc.Encode(protocol.TypePing, nil); err != nil {
+                markOffline(c)
+            }
+        }
+        // 定期保存在线客户端的最后在线时间
+        if len(online) > 0 {
+            persistClients(online...)
+        }
+        checkRevokedClients(online)
+    }
+}
+
+// markOffline 将客户端标记为离线并关闭连接，保留其编号和系统信息
+func markOffline(c *client) {
+    mu.Lock()
+    current := clients[c.id] == c && c.online
+    if current {
+        c.online = false
+        c.lastSeen = time.Now()
+    }
+    mu.Unlock()
+
+    c.conn.Close()
+    if current {
+        persistClients(c)
+        recordConnection(c, "disconnect")
+        fmt.Printf("客户端 %d (%s) 已断开连接\n> ", c.id, c.addr)
     }
 }
 
@@ -88,275 +302,615 @@ func acceptConnections(listener net.Listener) {
             continue
         }
 
+        go handshake(conn)
+    }
+}
+
+// 与新连接完成版本握手，成功后登记为客户端
+func handshake(conn net.Conn) {
+    enc := protocol.NewEncoder(conn)
+    dec := protocol.NewDecoder(conn)
+
+    reject := func(reason string) {
+        fmt.Printf("拒绝客户端 (%s): %s\n> ", conn.RemoteAddr(), reason)
+        auditEvent(&auditEntry{Action: "connect-rejected", Address: conn.RemoteAddr().String(), Detail: reason})
+        enc.EncodeJSON(protocol.TypeHello, protocol.HelloReply{
+            Reason:       reason,
+            BuildVersion: protocol.BuildVersion,
+        })
+        conn.Close()
+    }
+
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    frame, err := dec.Decode()
+    if err != nil {
+        // 旧版本客户端发送的是纯文本，无法按帧解析
+        fmt.Printf("客户端 (%s) 握手失败: %v\n> ", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+    conn.SetReadDeadline(time.Time{})
+
+    if frame.Type != protocol.TypeHello {
+        reject(fmt.Sprintf("第一帧应为 hello，实际为 %s", frame.Type))
+        return
+    }
+    var hello protocol.Hello
+    if err := frame.Unmarshal(&hello); err != nil {
+        reject(err.Error())
+        return
+    }
+
+    for key, value := range hello.Labels {
+        if err := protocol.ValidateLabel(key, value); err != nil {
+            fmt.Printf("忽略客户端 (%s) 声明的标签: %v\n> ", conn.RemoteAddr(), err)
+            delete(hello.Labels, key)
+        }
+    }
+
+    reply := protocol.Negotiate(&hello, protocol.MinProtocolVersion, protocol.ProtocolVersion, serverCapabilities)
+    if !reply.Accepted {
+        reject(reply.Reason)
+        return
+    }
+
+    // 使用客户端证书时，节点只能以绑定的证书身份连接
+    cert := peerCertificate(conn)
+    identity := ""
+    if cert != nil {
+        identity = certIdentity(cert)
+    }
+    if err := checkCertBinding(hello.NodeID, identity); err != nil {
+        reject(err.Error())
+        return
+    }
+
+    approval, proven, err := enrollmentStatus(&hello, identity)
+    if err != nil {
+        reject(err.Error())
+        return
+    }
+    reply.Pending = approval == approvalPending
+    // 还没有节点密钥的节点在这次握手中颁发，之后的连接必须出示
+    secretHash := ""
+    if proven {
         mu.Lock()
+        if old := clients[nodeIDs[hello.NodeID]]; old != nil {
+            secretHash = old.secretHash
+        }
+        mu.Unlock()
+    }
+    if secretHash == "" && hello.NodeID != "" && reply.ProtocolVersion >= protocol.NodeSecretVersion {
+        if reply.NodeSecret, secretHash, err = newNodeSecret(); err != nil {
+            reject(fmt.Sprintf("生成节点密钥失败: %v", err))
+            return
+        }
+    }
+    // 令牌和密钥不随节点信息保存
+    hello.EnrollToken, hello.NodeSecret = "", ""
+    if err := enc.EncodeJSON(protocol.TypeHello, reply); err != nil {
+        fmt.Printf("客户端 (%s) 握手失败: %v\n> ", conn.RemoteAddr(), err)
+        conn.Close()
+        return
+    }
+
+    now := time.Now()
+    mu.Lock()
+    id, known := nodeIDs[hello.NodeID]
+    if !known {
         clientID++
-        clients[clientID] = conn
+        id = clientID
+        if hello.NodeID != "" {
+            nodeIDs[hello.NodeID] = id
+        }
+    }
+    old := clients[id]
+    if old != nil && old.online && !proven {
+        // 握手期间同一节点的另一个连接已经上线
         mu.Unlock()
+        fmt.Printf("拒绝客户端 (%s): 节点 %s 已在线\n> ", conn.RemoteAddr(), hello.NodeID)
+        conn.Close()
+        return
+    }
+    firstSeen := now
+    var labels map[string]string
+    if old != nil {
+        firstSeen = old.firstSeen
+        labels = old.labels
+        if identity == "" {
+            identity = old.certIdentity
+        }
+    }
+    if identity != "" {
+        certIdentities[identity] = id
+    }
+    c := &client{
+        id:              id,
+        nodeID:          hello.NodeID,
+        addr:            conn.RemoteAddr().String(),
+        online:          true,
+        firstSeen:       firstSeen,
+        connectedAt:     now,
+        lastSeen:        now,
+        conn:            conn,
+        enc:             enc,
+        dec:             dec,
+        pending:         make(map[uint32]*execution),
+        hello:           hello,
+        protocolVersion: reply.ProtocolVersion,
+        capabilities:    reply.Capabilities,
+        certIdentity:    identity,
+        secretHash:      secretHash,
+        cert:            cert,
+        approval:        approval,
+        labels:          labels,
+    }
+    clients[c.id] = c
+    replaced := old != nil && old.online
+    if replaced {
+        old.online = false
+    }
+    mu.Unlock()
 
-        // 接收客户端信息
-        go receiveClientInfo(clientID, conn)
+    if replaced {
+        // 同一节点的旧连接尚未检测到断开，新连接已经证明了身份，以新连接为准
+        old.conn.Close()
+    }
+    persistClients(c)
+    recordConnection(c, "connect")
 
-        fmt.Printf("客户端 %d (%s) 已连接\n> ", clientID, conn.RemoteAddr())
+    state := "已连接"
+    if known {
+        state = "已重新连接"
+    }
+    fmt.Printf("客户端 %d (%s) %s, 版本: %s, 协议: v%d, 系统: %s/%s\n> ",
+        c.id, c.addr, state, hello.BuildVersion, c.protocolVersion, hello.OS, hello.Arch)
+    if approval == approvalPending {
+        fmt.Printf("客户端 %d 等待审批，使用 'approve %d' 批准或 'reject %d' 拒绝\n> ", c.id, c.id, c.id)
     }
+    // 执行节点离线时排队的命令，未批准的节点在批准后执行
+    go deliverQueued(c.id)
+
+    // 接收客户端信息
+    receiveClientInfo(c)
 }
 
-func receiveClientInfo(id int, conn net.Conn) {
-    reader := bufio.NewReader(conn)
-    var infoBuilder strings.Builder
+// 读取客户端发来的所有帧: 系统信息直接保存，命令输出按请求ID投递给对应的执行
+func receiveClientInfo(c *client) {
+    defer c.closeExecutions()
 
     for {
-        info, err := reader.ReadString('\n')
+        frame, err := c.dec.Decode()
         if err != nil {
-            mu.Lock()
-            delete(clients, id)
-            mu.Unlock()
-            conn.Close()
-            fmt.Printf("客户端 %d (%s) 已断开连接\n> ", id, conn.RemoteAddr())
+            markOffline(c)
             return
         }
 
-        if strings.HasPrefix(info, "SYSTEM_INFO:") {
-            continue // 跳过SYSTEM_INFO: 这行
-        }
-
-        infoBuilder.WriteString(info)
+        mu.Lock()
+        c.lastSeen = time.Now()
+        mu.Unlock()
 
-        if strings.TrimSpace(info) == "" { // 如果读取到空行，则认为信息读取完毕
-            clientInfo[id] = infoBuilder.String()
-            displayClientInfo(id, conn.RemoteAddr().String(), clientInfo[id])
-            return
+        switch frame.Type {
+        case protocol.TypeInventory:
+            info := &protocol.Inventory{}
+            if c.protocolVersion < protocol.InventoryJSONVersion {
+                info.Text = string(frame.Payload)
+            } else if err := frame.Unmarshal(info); err != nil {
+                fmt.Printf("客户端 %d 的系统信息无法解析: %v\n> ", c.id, err)
+                continue
+            }
+            if info.SchemaVersion > protocol.InventorySchemaVersion {
+                fmt.Printf("客户端 %d 的系统信息结构版本 (v%d) 高于服务端 (v%d)，部分字段可能无法显示\n",
+                    c.id, info.SchemaVersion, protocol.InventorySchemaVersion)
+            }
+            mu.Lock()
+            clientInfo[c.id] = info
+            mu.Unlock()
+            persistClients(c)
+            fmt.Printf("收到客户端 %d 系统信息: %s (完整信息: search id = %d)\n> ", c.id, inventorySummary(info), c.id)
+        case protocol.TypePong:
+            // 心跳应答，无需处理
+        case protocol.TypeError:
+            if frame.ID == 0 {
+                fmt.Printf("客户端 %d 报告错误: %s\n> ", c.id, frame.Payload)
+                continue
+            }
+            c.dispatch(frame)
+        case protocol.TypeStdout, protocol.TypeStderr, protocol.TypeExitStatus, protocol.TypePTYData:
+            c.dispatch(frame)
+        default:
+            fmt.Printf("客户端 %d 发送了未知类型的帧: %s\n> ", c.id, frame.Type)
         }
     }
 }
 
-func displayClientInfo(id int, addr string, info string) {
-    fmt.Printf("收到客户端 %d 系统信息:\n", id)
-    fmt.Printf("  IP地址和端口: %s\n", addr)
-    fmt.Println("系统信息:")
+func displayClientInfo(w io.Writer, id int, addr string, lines []string) {
+    fmt.Fprintf(w, "收到客户端 %d 系统信息:\n", id)
+    fmt.Fprintf(w, "  IP地址和端口: %s\n", addr)
+    fmt.Fprintln(w, "系统信息:")
 
     // 逐行打印系统信息
-    lines := strings.Split(info, "\n")
     for _, line := range lines {
-        if strings.TrimSpace(line) != "" {
-            fmt.Println(line)
-        }
+        fmt.Fprintln(w, line)
     }
-    fmt.Print("\n> ")
 }
 
+// 命令的帮助信息，按显示顺序排列
+var commandHelp = []struct {
+    name string
+    text string
+}{
+    {"list", "  list     - 列出所有连接的客户端，可以指定选择器只列出匹配的客户端 (格式: list [选择器])"},
+    {"connect", "  connect  - 打开指定客户端的交互式终端，不支持时使用逐行执行模式 (格式: connect <客户端编号>)"},
+    {"exec", "  exec     - 以逐行执行模式连接到指定客户端 (格式: exec <客户端编号>)"},
+    {"search", "  search   - 搜索客户端信息，支持选择器 (格式: search <关键字或选择器>)\n" +
+        "             例如: search memory > 64GB and vendor = Dell*，选择器的语法见 help select"},
+    {"history", "  history  - 查看客户端的连接历史 (格式: history <客户端编号>)"},
+    {"groups", "  groups   - 列出节点分组及其当前成员"},
+    {"label", "  label    - 设置或删除节点标签，key- 表示删除 (格式: label <编号列表|group:分组|选择器> key=value ... key- ...)"},
+    {"group", "  group    - 管理节点分组 (格式: group set|add|remove <名称> <编号列表>、group select <名称> <选择器>、group delete <名称>)"},
+    {"pending", "  pending  - 列出等待审批的客户端"},
+    {"approve", "  approve  - 批准客户端，批准后才能执行命令 (格式: approve <客户端编号>)"},
+    {"reject", "  reject   - 拒绝客户端并断开连接，之后不再接受该节点 (格式: reject <客户端编号>)"},
+    {"rekey", "  rekey    - 清除节点密钥，节点下次连接时颁发新的密钥并需要重新批准 (格式: rekey <客户端编号>)"},
+    {"audit", "  audit    - 查询审计日志 (格式: audit [node <客户端编号>] [since <时间>] [until <时间>] [limit <条数>] [关键字])\n" +
+        "             时间格式为 2006-01-02、2006-01-02T15:04:05 或 1h (一小时前)；audit verify 校验哈希链"},
+    {"sessions", "  sessions - 列出会话录像 (格式: sessions [客户端编号])"},
+    {"replay", "  replay   - 回放会话录像，可指定倍速，按 Ctrl-C 停止 (格式: replay <会话编号> [倍速])"},
+    {"run", "  run      - 在多个客户端上并发执行命令，按相同输出分组显示结果，按 Ctrl-C 取消\n" +
+        "             (格式: run [-p 并发数] [-t 超时] <all|编号列表|group:分组|选择器> <命令>，编号列表例如 1,3,5-8，\n" +
+        "             包含空格的选择器需要加引号，例如 run \"vendor = Dell* and memory > 64GB\" uptime)\n" +
+        "             滚动执行: -b <每批节点数|百分比%> 按批依次执行，-max-fail <N> 失败超过 N 个节点时停止 (默认 0)，\n" +
+        "             -check '<命令>' 每批结束后在成功的节点上执行健康检查，失败时停止，例如 run -b 25% -check 'systemctl is-active nginx' all ..."},
+    {"jobs", "  jobs     - 列出 run 命令和 HTTP API 创建的作业，指定编号时显示每个节点的结果 (格式: jobs [作业编号])"},
+    {"queue", "  queue    - 为节点排队命令，离线的节点在连接后自动执行，结果保存供之后查看\n" +
+        "             (格式: queue [list] [客户端编号]、queue add [-t 超时] [-ttl 有效期] <目标> <命令>、\n" +
+        "             queue show <编号>、queue cancel <编号>，目标的格式与 label 相同，包括离线的节点)"},
+    {"who", "  who      - 列出当前登录的操作员"},
+    {"exit", "  exit     - 退出服务端 (管理端口的会话只退出登录)"},
+}
 
-
-func handleCommands() {
-    reader := bufio.NewReader(os.Stdin)
-
+// handleCommands 读取并执行操作员的命令，直到输入结束或远程会话退出
+func handleCommands(s *operatorSession) {
     for {
-        fmt.Print("\n> ")
-        command, err := reader.ReadString('\n')
+        command, err := s.readLine("\n> ")
         if err != nil {
-            fmt.Printf("读取命令失败: %v\n", err)
-            continue
+            if err != io.EOF {
+                fmt.Fprintf(s.out, "读取命令失败: %v\n", err)
+            }
+            return
         }
         command = strings.TrimSpace(command)
 
         if command == "" {
             continue // 处理空命令，只返回提示符
         }
+        if !handleCommand(s, command) {
+            return
+        }
+    }
+}
 
-        if command == "exit" {
-            fmt.Println("服务端退出")
-            os.Exit(0)
-        } else if command == "help" {
-            fmt.Println("已有命令:")
-            fmt.Println("  list     - 列出所有连接的客户端")
-            fmt.Println("  connect  - 连接到指定客户端 (格式: connect <客户端编号>)")
-            fmt.Println("  search   - 搜索客户端信息 (格式: search <关键字>)")
-            fmt.Println("  exit     - 退出服务端")
-        } else if command == "list" {
-            listClients()
-        } else if strings.HasPrefix(command, "connect ") {
-            parts := strings.Split(command, " ")
-            if len(parts) != 2 {
-                fmt.Println("命令格式错误，应为: connect <客户端编号>")
-                continue
+// handleCommand 执行一条命令，返回 false 表示会话结束
+func handleCommand(s *operatorSession, command string) bool {
+    out := s.out
+    name := strings.Fields(command)[0]
+    if _, ok := commandRoles[name]; !ok {
+        fmt.Fprintln(out, "未知命令")
+        return true
+    }
+    if !s.can(name) {
+        fmt.Fprintf(out, "权限不足: %s 命令需要 %s 角色，当前角色为 %s\n", name, roleNames[commandRoles[name]], roleNames[s.role])
+        auditEvent(&auditEntry{Operator: s.name, Action: "denied", Command: command})
+        return true
+    }
+    auditEvent(&auditEntry{Operator: s.name, Action: "console", Command: command})
+
+    if command == "exit" {
+        if s.isRemote() {
+            fmt.Fprintln(out, "已退出登录")
+            return false
+        }
+        fmt.Println("服务端退出")
+        os.Exit(0)
+    } else if command == "help" {
+        fmt.Fprintf(out, "已有命令 (操作员: %s, 角色: %s):\n", s.name, roleNames[s.role])
+        for _, h := range commandHelp {
+            if s.can(h.name) {
+                fmt.Fprintln(out, h.text)
             }
-            id, err := strconv.Atoi(parts[1])
-            if err != nil {
-                fmt.Println("客户端编号应为整数")
-                continue
+        }
+    } else if command == "help select" {
+        fmt.Fprint(out, selectorHelp)
+    } else if name == "list" {
+        var sel *selector
+        if query := strings.TrimSpace(strings.TrimPrefix(command, "list")); query != "" {
+            var err error
+            if sel, err = parseSelector(query); err != nil {
+                fmt.Fprintln(out, err)
+                return true
             }
-            connectClient(id)
-        } else if strings.HasPrefix(command, "search ") {
-            parts := strings.SplitN(command, " ", 2)
-            if len(parts) != 2 {
-                fmt.Println("命令格式错误，应为: search <关键字>")
-                continue
+        }
+        listClients(out, sel)
+    } else if command == "who" {
+        listOperators(out)
+    } else if command == "groups" {
+        listGroups(out)
+    } else if name == "group" {
+        handleGroup(out, s.name, strings.TrimPrefix(command, "group"))
+    } else if name == "label" {
+        labelClients(out, s.name, strings.TrimPrefix(command, "label"))
+    } else if name == "run" {
+        runOnTargets(s, strings.TrimPrefix(command, "run"))
+    } else if name == "jobs" {
+        showJobs(out, strings.TrimSpace(strings.TrimPrefix(command, "jobs")))
+    } else if name == "queue" {
+        handleQueue(out, s.name, s.signer, strings.TrimPrefix(command, "queue"))
+    } else if name == "audit" {
+        showAudit(out, strings.Fields(command)[1:])
+    } else if name == "sessions" {
+        id := 0
+        if arg := strings.TrimSpace(strings.TrimPrefix(command, "sessions")); arg != "" {
+            var err error
+            if id, err = strconv.Atoi(arg); err != nil {
+                fmt.Fprintln(out, "客户端编号应为整数")
+                return true
+            }
+        }
+        listSessions(out, id)
+    } else if name == "replay" {
+        parts := strings.Fields(command)
+        if len(parts) < 2 || len(parts) > 3 {
+            fmt.Fprintln(out, "命令格式错误，应为: replay <会话编号> [倍速]")
+            return true
+        }
+        speed := 1.0
+        if len(parts) == 3 {
+            var err error
+            if speed, err = parseSpeed(parts[2]); err != nil {
+                fmt.Fprintln(out, err)
+                return true
             }
-            searchClients(parts[1])
-        } else {
-            fmt.Println("未知命令")
         }
+        replaySession(s, parts[1], speed)
+    } else if command == "pending" {
+        listPending(out)
+    } else if name == "approve" || name == "reject" || name == "rekey" {
+        parts := strings.Fields(command)
+        if len(parts) != 2 {
+            fmt.Fprintf(out, "命令格式错误，应为: %s <客户端编号>\n", parts[0])
+            return true
+        }
+        id, err := strconv.Atoi(parts[1])
+        if err != nil {
+            fmt.Fprintln(out, "客户端编号应为整数")
+            return true
+        }
+        switch parts[0] {
+        case "approve":
+            setApproval(out, s.name, id, approvalApproved)
+        case "reject":
+            setApproval(out, s.name, id, approvalRejected)
+        default:
+            resetNodeSecret(out, s.name, id)
+        }
+    } else if name == "connect" || name == "exec" {
+        parts := strings.Split(command, " ")
+        if len(parts) != 2 {
+            fmt.Fprintf(out, "命令格式错误，应为: %s <客户端编号>\n", parts[0])
+            return true
+        }
+        id, err := strconv.Atoi(parts[1])
+        if err != nil {
+            fmt.Fprintln(out, "客户端编号应为整数")
+            return true
+        }
+        connectClient(s, id, parts[0] == "connect")
+    } else if name == "history" {
+        id, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(command, "history")))
+        if err != nil {
+            fmt.Fprintln(out, "客户端编号应为整数")
+            return true
+        }
+        showHistory(out, id)
+    } else if name == "search" {
+        parts := strings.SplitN(command, " ", 2)
+        if len(parts) != 2 {
+            fmt.Fprintln(out, "命令格式错误，应为: search <关键字或选择器>")
+            return true
+        }
+        sel, err := parseSelector(parts[1])
+        if err != nil {
+            fmt.Fprintln(out, err)
+            return true
+        }
+        searchClients(out, sel)
+    } else {
+        fmt.Fprintln(out, "未知命令")
     }
+    return true
 }
 
 // 增加connectClient函数的定义
-func connectClient(id int) {
+// interactive 为真且客户端支持时打开交互式终端，否则逐行执行命令
+func connectClient(s *operatorSession, id int, interactive bool) {
+    out := s.out
     mu.Lock()
-    conn, ok := clients[id]
+    c, ok := clients[id]
     mu.Unlock()
 
     if !ok {
-        fmt.Printf("没有找到编号为 %d 的客户端\n> ", id)
+        fmt.Fprintf(out, "没有找到编号为 %d 的客户端\n", id)
+        return
+    }
+    if !c.isOnline() {
+        fmt.Fprintf(out, "客户端 %d 当前离线\n", id)
+        return
+    }
+    if !c.isApproved() {
+        fmt.Fprintf(out, "客户端 %d 尚未通过审批，请先使用 'approve %d' 批准\n", id, id)
+        return
+    }
+
+    if interactive && c.hasCapability(protocol.CapPTY) {
+        runTerminalSession(s, c)
+        return
+    }
+
+    if !c.hasCapability(protocol.CapExec) {
+        fmt.Fprintf(out, "客户端 %d 不支持远程执行命令\n", id)
         return
     }
 
-    clientAddr := conn.RemoteAddr().String()
-    fmt.Printf("与客户端 %d (%s) 交互，输入 'exit' 退出\n", id, clientAddr)
+    clientAddr := c.addr
+    fmt.Fprintf(out, "与客户端 %d (%s) 交互，输入 'exit' 退出，'timeout <时长>' 修改本次会话的命令超时\n", id, clientAddr)
+    timeout := commandTimeout
 
-    reader := bufio.NewReader(os.Stdin)
-    writer := bufio.NewWriter(conn)
-    connReader := bufio.NewReader(conn)
+    rows, cols := s.terminalSize()
+    rec := openRecording(s, c, rows, cols, fmt.Sprintf("客户端 %d (%s) 逐行执行", id, clientAddr))
+    defer rec.Close()
 
-    interrupt := make(chan os.Signal, 1)
-    signal.Notify(interrupt, syscall.SIGINT)
+    defer s.holdInterrupts()()
 
     for {
-        fmt.Printf("shell %s> ", clientAddr)
-        command, err := reader.ReadString('\n')
+        command, err := s.readLine(fmt.Sprintf("shell %s> ", clientAddr))
         if err != nil {
-            fmt.Printf("读取命令失败: %v\n> ", err)
+            if err != io.EOF {
+                fmt.Fprintf(out, "读取命令失败: %v\n", err)
+            }
             return
         }
         command = strings.TrimSpace(command)
 
         if command == "exit" {
-            fmt.Printf("与客户端 %d (%s) 断开连接\n", id, clientAddr)
+            fmt.Fprintf(out, "与客户端 %d (%s) 断开连接\n", id, clientAddr)
             break
         }
 
         if command == "" {
             continue
         }
+        fmt.Fprintf(rec.lineWriter(), "shell %s> %s\n", clientAddr, command)
+
+        if strings.HasPrefix(command, "timeout ") {
+            d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(command, "timeout ")))
+            if err != nil || d < 0 {
+                fmt.Fprintln(out, "超时时间格式错误，例如: timeout 30s，0 表示不限制")
+                continue
+            }
+            timeout = d
+            fmt.Fprintf(out, "命令超时已设置为 %s\n", timeout)
+            continue
+        }
+
+        // 以单个 & 结尾的命令在后台执行，完成后再输出结果
+        if strings.HasSuffix(command, "&") && !strings.HasSuffix(command, "&&") {
+            runInBackground(s, c, strings.TrimSpace(strings.TrimSuffix(command, "&")), timeout, rec)
+            continue
+        }
 
         // 将命令加入队列
-        addCommandsToQueue(id, command)
+        s.queue = append(s.queue, strings.Split(command, "\n")...)
 
         // 处理命令队列
-        processCommandQueue(id, writer, connReader, interrupt)
+        processCommandQueue(s, c, timeout, rec)
     }
 }
 
-// 增加extractField函数的定义
-func extractField(info, field string) string {
-    re := regexp.MustCompile(fmt.Sprintf(`%s: ([^|]+)`, field))
-    match := re.FindStringSubmatch(info)
-    if len(match) > 1 {
-        return strings.TrimSpace(match[1])
-    }
-    return "N/A"
-}
 
 
-func listClients() {
+// listClients 列出客户端，sel 不为 nil 时只列出满足选择器的客户端
+func listClients(w io.Writer, sel *selector) {
     mu.Lock()
     defer mu.Unlock()
 
     if len(clients) == 0 {
-        fmt.Println("当前没有连接的客户端")
-        fmt.Print("> ")
+        fmt.Fprintln(w, "当前没有连接的客户端")
         return
     }
 
-    fmt.Println("连接的客户端列表:")
-    for id, conn := range clients {
+    found := false
+    for _, id := range sortedClientIDs() {
+        c := clients[id]
         info := clientInfo[id]
-        ip := conn.RemoteAddr().String()
-
-        // 提取需要的字段信息
-        vendor := extractField(info, "Vendor")
-        sku := extractField(info, "SKU")
-        serialNumber := extractField(info, "Serial Number")
-        cpuModel := extractField(info, "Model")
-        physicalCPUs := extractField(info, "Physical CPUs")
-        logicalCPUs := extractField(info, "Logical CPUs")
-        totalCores := extractField(info, "Total Cores")
-        totalThreads := extractField(info, "Total Threads")
-
-        // 提取内存信息
-        memory := extractMemoryField(info)
-
-        // 提取磁盘信息
-        diskInfo := extractDiskInfo(info)
+        if sel != nil && !sel.matchLocked(c) {
+            continue
+        }
+        if !found {
+            fmt.Fprintln(w, "连接的客户端列表:")
+            found = true
+        }
+        ip := c.addr
 
-        fmt.Printf("  客户端 %d: IP地址: %s, Vendor: %s, SKU: %s, Serial Number: %s, CPU Model: %s, Physical CPUs: %s, Logical CPUs: %s, Total Cores: %s, Total Threads: %s, Memory: %s, Disk: %s\n",
-                   id, ip, vendor, sku, serialNumber, cpuModel, physicalCPUs, logicalCPUs, totalCores, totalThreads, memory, diskInfo)
+        status := c.statusLocked()
+        if approval := c.approvalLocked(); approval != "" {
+            status += ", " + approval
+        }
+        fmt.Fprintf(w, "  客户端 %d [%s]: 节点ID: %s\n", id, status, c.nodeID)
+        fmt.Fprintf(w, "           IP地址: %s, 版本: %s, 协议: v%d, 系统: %s/%s, 能力: %s\n",
+                   ip, c.hello.BuildVersion, c.protocolVersion, c.hello.OS, c.hello.Arch, strings.Join(c.capabilities, ","))
+        if c.certIdentity != "" {
+            fmt.Fprintf(w, "           证书身份: %s\n", c.certIdentity)
+        }
+        if labels := c.labelsLocked(); len(labels) > 0 {
+            fmt.Fprintf(w, "           标签: %s\n", formatLabels(labels))
+        }
+        if info == nil {
+            fmt.Fprintln(w, "           尚未收到系统信息")
+            continue
+        }
+        fmt.Fprintf(w, "           Hostname: %s, Vendor: %s, SKU: %s, Serial Number: %s, CPU Model: %s, Physical CPUs: %d, Logical CPUs: %d, Total Cores: %d, Total Threads: %d, Memory: %dMB, Disk: %s\n",
+                   info.Hostname, info.Product.Vendor, info.Product.SKU, info.Product.SerialNumber, info.CPU.Model,
+                   info.CPU.PhysicalCPUs, info.CPU.LogicalCPUs, info.CPU.TotalCores, info.CPU.TotalThreads,
+                   info.Memory.TotalMB, diskSummary(info.Disks))
     }
-    fmt.Print("> ")
-}
-
-func extractMemoryField(info string) string {
-    re := regexp.MustCompile(`Memory\s*\|\s*(\d+)MB`)
-    match := re.FindStringSubmatch(info)
-    if len(match) > 1 {
-        return strings.TrimSpace(match[1]) + "MB"
+    if !found {
+        fmt.Fprintln(w, "没有匹配的客户端")
     }
-    return "N/A"
 }
 
 
-func extractDiskInfo(info string) string {
-    re := regexp.MustCompile(`Disk Types \| (.+)`)
-    match := re.FindStringSubmatch(info)
-    if len(match) > 1 {
-        diskTypesStr := strings.TrimSpace(match[1])
-        diskTypes := strings.Split(diskTypesStr, "\n")
-        var diskInfos []string
-        for _, diskType := range diskTypes {
-            fields := strings.Split(diskType, " | ")
-            if len(fields) == 3 {
-                name := strings.TrimPrefix(fields[0], "Name: ")
-                diskType := strings.TrimPrefix(fields[1], "Type: ")
-                size := strings.TrimPrefix(fields[2], "Size: ")
-                diskInfos = append(diskInfos, fmt.Sprintf("%s (%s, %s)", name, diskType, size))
-            }
-        }
-        return strings.Join(diskInfos, ", ")
-    }
-    return ""
-}
 
-func searchClients(keyword string) {
+
+// searchClients 显示满足选择器的客户端的系统信息，并高亮其中的搜索词
+func searchClients(w io.Writer, sel *selector) {
     mu.Lock()
     defer mu.Unlock()
 
     if len(clients) == 0 {
-        fmt.Println("当前没有连接的客户端")
-        fmt.Print("> ")  // 确保搜索结束后有提示符
+        fmt.Fprintln(w, "当前没有连接的客户端")
         return
     }
 
-    keyword = strings.ToLower(keyword)
     found := false
-    for id, info := range clientInfo {
-        if strings.Contains(strings.ToLower(info), keyword) {
-            if !found {
-                fmt.Println("搜索结果:")
-                found = true
+    for _, id := range sortedClientIDs() {
+        if !sel.matchLocked(clients[id]) {
+            continue
+        }
+        lines := inventoryLines(clientInfo[id])
+        for i, line := range lines {
+            for _, keyword := range sel.keywords {
+                if strings.Contains(strings.ToLower(line), strings.ToLower(keyword)) {
+                    line = highlightKeyword(line, keyword)
+                }
             }
-            highlightedInfo := highlightKeyword(info, keyword)
-            displayClientInfo(id, clients[id].RemoteAddr().String(), highlightedInfo)
+            lines[i] = line
+        }
+        if !found {
+            fmt.Fprintln(w, "搜索结果:")
+            found = true
         }
+        displayClientInfo(w, id, clients[id].addr, lines)
     }
 
     if !found {
-        fmt.Println("没有找到匹配的客户端信息")
+        fmt.Fprintln(w, "没有找到匹配的客户端信息")
     }
-
-    // fmt.Print("\n> ")  // 确保搜索结束后有提示符
 }
 
 
 func highlightKeyword(text, keyword string) string {
-    re := regexp.MustCompile("(?i)" + keyword)
+    re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(keyword))
     highlighted := re.ReplaceAllStringFunc(text, func(match string) string {
         return "\033[31m" + match + "\033[0m" // 红色高亮
     })
@@ -367,78 +921,90 @@ func highlightKeyword(text, keyword string) string {
 
 
 
-func addCommandsToQueue(id int, command string) {
-    cmdMutex.Lock()
-    commands[id] = append(commands[id], strings.Split(command, "\n")...)
-    cmdMutex.Unlock()
-}
+// processCommandQueue 依次执行会话队列中的命令，输出同时写入会话录像 rec (可以为 nil)
+func processCommandQueue(s *operatorSession, c *client, timeout time.Duration, rec *sessionRecorder) {
+    id := c.id
+    out := s.out
+    for len(s.queue) > 0 {
+        command := s.queue[0]
+        s.queue = s.queue[1:]
 
-func processCommandQueue(id int, writer *bufio.Writer, connReader *bufio.Reader, interrupt chan os.Signal) {
-    for {
-        cmdMutex.Lock()
-        if len(commands[id]) == 0 {
-            cmdMutex.Unlock()
-            break
+        fmt.Fprintf(out, "发送命令到客户端 %d: %s\n", id, command)
+        ex, err := c.startExec(s.name, command, timeout, s.signer)
+        if err != nil {
+            fmt.Fprintf(out, "发送命令失败: %v\n", err)
+            s.queue = nil
+            return
         }
 
-        command := commands[id][0]
-        commands[id] = commands[id][1:]
-        cmdMutex.Unlock()
-
-        fmt.Printf("发送命令到客户端 %d: %s\n", id, command)
-        fmt.Fprintf(writer, "%s\n", command)
-        writer.Flush()
-
-        done := make(chan bool)
-        interrupted := make(chan struct{})
-
+        interrupt, stopWatching := s.watchInterrupt()
+        stop := make(chan struct{})
+        finished := make(chan struct{})
         go func() {
-            defer func() {
-                done <- true
-            }()
-            var response strings.Builder
-            started := false
-            for {
-                select {
-                case <-interrupted:
-                    return
-                default:
-                    line, err := connReader.ReadString('\n')
-                    if err != nil {
-                        mu.Lock()
-                        delete(clients, id)
-                        mu.Unlock()
-                        fmt.Printf("读取客户端响应失败: %v\n> ", err)
-                        return
-                    }
-                    line = strings.TrimSpace(line)
-                    if line == "SERVERANDCLIENTSTB" {
-                        started = true
-                        fmt.Printf("从客户端 %d 收到响应开始标记\n", id)
-                        continue
-                    }
-                    if line == "<SERVERANDCLIENTEOF>" {
-                        if started {
-                            fmt.Printf("从客户端 %d 收到完整响应:\n%s", id, response.String())
-                            return
-                        }
-                    }
-                    if started && line != "" {
-                        response.WriteString(line + "\n")  // 确保行尾带有换行符
-                    }
-                }
+            select {
+            case <-interrupt:
+                fmt.Fprintln(out, "\n命令执行被中断，正在取消远程命令")
+                close(stop)
+            case <-finished:
             }
         }()
 
-        select {
-        case <-interrupt:
-            fmt.Println("\n命令执行被中断")
-            close(interrupted)
-            // 清空剩余的信号，避免影响后续命令
-            for len(interrupt) > 0 {
-                <-interrupt
+        fmt.Fprintf(out, "从客户端 %d 收到响应:\n", id)
+        recOut := rec.lineWriter()
+        result, err := ex.wait(io.MultiWriter(out, recOut), io.MultiWriter(stderrWriter{out}, stderrWriter{recOut}), stop)
+        close(finished)
+        stopWatching()
+        if err == errInterrupted {
+            result, err = ex.cancel()
+            if err != nil && err != errClientGone {
+                fmt.Fprintf(out, "取消远程命令失败: %v\n", err)
+                continue
             }
-        case <-done:
         }
+        if err != nil {
+            fmt.Fprintf(out, "读取客户端响应失败: %v\n", err)
+            s.queue = nil
+            return
+        }
+        fmt.Fprintln(out, result.summary())
+        fmt.Fprintln(recOut, result.summary())
+    }
+}
+
+// stderrWriter 以红色输出远程命令的标准错误，与标准输出区分
+type stderrWriter struct {
+    w io.Writer
+}
+
+func (s stderrWriter) Write(p []byte) (int, error) {
+    if len(p) == 0 {
+        return 0, nil
+    }
+    if _, err := fmt.Fprintf(s.w, "\033[31m%s\033[0m", p); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// 在后台执行命令，与前台命令并发，结束后一次性输出结果。会话仍在录制时结果也写入录像
+func runInBackground(s *operatorSession, c *client, command string, timeout time.Duration, rec *sessionRecorder) {
+    ex, err := c.startExec(s.name, command, timeout, s.signer)
+    if err != nil {
+        fmt.Fprintf(s.out, "发送命令失败: %v\n", err)
+        return
     }
+    fmt.Fprintf(s.out, "[%d] 后台执行: %s\n", ex.id, command)
+
+    go func() {
+        result, err := ex.wait(nil, nil, nil)
+        if err != nil {
+            fmt.Fprintf(s.out, "\n[%d] 后台命令失败 (客户端 %d): %s: %v\n", ex.id, c.id, command, err)
+            return
+        }
+        out := io.MultiWriter(s.out, rec.lineWriter())
+        fmt.Fprintf(out, "\n[%d] 后台命令完成 (客户端 %d): %s\n", ex.id, c.id, command)
+        out.Write(result.Stdout)
+        stderrWriter{out}.Write(result.Stderr)
+        fmt.Fprintln(out, result.summary())
+    }()
 }
@@ -0,0 +1,90 @@
+package server
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+
+    "serverandclient/protocol"
+)
+
+// requestSigner 为发往节点 nodeID 的请求提供操作员的签名，没有签名时返回 nil，
+// 由客户端决定是否执行。服务端不持有操作员的私钥: 控制台和管理端口的会话通过
+// 操作员的 ssh-agent 签名，API 和排队的命令使用操作员预先生成的签名
+type requestSigner interface {
+    sign(kind, nodeID, body string, expires time.Time) (*protocol.Signature, error)
+}
+
+// signRequest 用 signer 为请求签名，signer 为 nil 时不签名
+func signRequest(signer requestSigner, kind, nodeID, body string, expires time.Time) (*protocol.Signature, error) {
+    if signer == nil {
+        return nil, nil
+    }
+    sig, err := signer.sign(kind, nodeID, body, expires)
+    if err != nil {
+        return nil, fmt.Errorf("签名请求失败: %v", err)
+    }
+    return sig, nil
+}
+
+// presignedSignatures 操作员预先生成的签名，按节点ID索引。签名是否与请求一致由客户端校验
+type presignedSignatures map[string]*protocol.Signature
+
+func (p presignedSignatures) sign(kind, nodeID, body string, expires time.Time) (*protocol.Signature, error) {
+    return p[nodeID], nil
+}
+
+// agentSigner 通过操作员的 ssh-agent 签名，每次签名时重新连接 agent，私钥始终留在操作员一侧
+type agentSigner struct {
+    dial     func() (io.ReadWriteCloser, error)
+    loginKey string // 操作员登录使用的公钥指纹 (SHA256:...)，agent 中有这个 ed25519 密钥时优先使用
+}
+
+// newConsoleSigner 返回控制台使用的签名者，socket 为 SSH_AUTH_SOCK，没有设置时返回 nil
+func newConsoleSigner(socket string) requestSigner {
+    if socket == "" {
+        return nil
+    }
+    return &agentSigner{dial: func() (io.ReadWriteCloser, error) {
+        return net.Dial("unix", socket)
+    }}
+}
+
+// newForwardedSigner 返回使用 ssh -A 转发的 agent 的签名者
+func newForwardedSigner(conn ssh.Conn, loginKey string) requestSigner {
+    return &agentSigner{
+        dial: func() (io.ReadWriteCloser, error) {
+            channel, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+            if err != nil {
+                return nil, err
+            }
+            go ssh.DiscardRequests(reqs)
+            return channel, nil
+        },
+        loginKey: loginKey,
+    }
+}
+
+func (a *agentSigner) sign(kind, nodeID, body string, expires time.Time) (*protocol.Signature, error) {
+    conn, err := a.dial()
+    if err != nil {
+        return nil, fmt.Errorf("连接 ssh-agent 失败: %v", err)
+    }
+    defer conn.Close()
+    signers, err := protocol.AgentSigners(agent.NewClient(conn))
+    if err != nil {
+        return nil, err
+    }
+    signer := signers[0]
+    for _, s := range signers {
+        if ssh.FingerprintSHA256(s.Key()) == a.loginKey {
+            signer = s
+            break
+        }
+    }
+    return protocol.Sign(signer, kind, nodeID, body, expires)
+}
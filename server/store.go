@@ -0,0 +1,272 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+    "serverandclient/protocol"
+)
+
+var (
+    nodesBucket   = []byte("nodes")   // 客户端编号 -> nodeRecord
+    historyBucket = []byte("history") // 客户端编号/时间 -> connectionEvent
+    groupsBucket  = []byte("groups")  // 分组名称 -> nodeGroup
+    queueBucket   = []byte("queue")   // 队列编号 -> queueItem
+    auditBucket   = []byte("audit")   // 审计日志的路径 -> auditHead
+)
+
+// 持久化的节点信息，服务端重启后用于恢复离线客户端
+type nodeRecord struct {
+    ID              int                 `json:"id"`
+    NodeID          string              `json:"node_id"`
+    Address         string              `json:"address"`
+    Hello           protocol.Hello      `json:"hello"`
+    ProtocolVersion int                 `json:"protocol_version"`
+    Capabilities    []string            `json:"capabilities"`
+    CertIdentity    string              `json:"cert_identity,omitempty"` // 绑定的客户端证书身份
+    SecretHash      string              `json:"secret_hash,omitempty"`   // 节点密钥的 SHA-256，旧记录为空
+    Approval        string              `json:"approval,omitempty"`      // 审批状态，旧记录为空，视为已批准
+    Labels          map[string]string   `json:"labels,omitempty"`        // 操作员设置的标签
+    Inventory       *protocol.Inventory `json:"inventory"`
+    FirstSeen       time.Time           `json:"first_seen"`
+    LastSeen        time.Time           `json:"last_seen"`
+}
+
+// 审计日志最后一条记录的序号和哈希，保存在日志之外，用于发现日志末尾被截断
+type auditHead struct {
+    Seq  uint64 `json:"seq"`
+    Hash string `json:"hash,omitempty"`
+}
+
+// 一次连接或断开的记录
+type connectionEvent struct {
+    Time    time.Time `json:"time"`
+    Event   string    `json:"event"` // connect 或 disconnect
+    Address string    `json:"address"`
+}
+
+// store 基于单文件嵌入式数据库的节点信息存储
+type store struct {
+    db *bolt.DB
+}
+
+// openStore 打开 dir 下的数据库文件，不存在时创建
+func openStore(dir string) (*store, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    db, err := bolt.Open(filepath.Join(dir, "server.db"), 0600, &bolt.Options{Timeout: time.Second})
+    if err != nil {
+        return nil, fmt.Errorf("打开数据库失败 (是否有其他服务端正在使用该数据目录?): %v", err)
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _, name := range [][]byte{nodesBucket, historyBucket, groupsBucket, queueBucket, auditBucket} {
+            if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &store{db: db}, nil
+}
+
+func (s *store) Close() error {
+    return s.db.Close()
+}
+
+func nodeKey(id int) []byte {
+    return []byte(fmt.Sprintf("%010d", id))
+}
+
+// saveNodes 在一个事务中写入多个节点
+func (s *store) saveNodes(records ...*nodeRecord) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(nodesBucket)
+        for _, rec := range records {
+            data, err := json.Marshal(rec)
+            if err != nil {
+                return err
+            }
+            if err := b.Put(nodeKey(rec.ID), data); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// loadNodes 按编号顺序读取所有节点
+func (s *store) loadNodes() ([]*nodeRecord, error) {
+    var records []*nodeRecord
+    err := s.db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket(nodesBucket).ForEach(func(k, v []byte) error {
+            rec := &nodeRecord{}
+            if err := json.Unmarshal(v, rec); err != nil {
+                // 旧版本保存的记录格式不同，跳过，节点重新连接后会覆盖
+                fmt.Printf("跳过无法解析的节点记录 %s: %v\n", k, err)
+                return nil
+            }
+            records = append(records, rec)
+            return nil
+        })
+    })
+    return records, err
+}
+
+// appendHistory 追加一条连接记录
+func (s *store) appendHistory(id int, ev connectionEvent) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        key := fmt.Sprintf("%s/%020d", nodeKey(id), ev.Time.UnixNano())
+        data, err := json.Marshal(ev)
+        if err != nil {
+            return err
+        }
+        return tx.Bucket(historyBucket).Put([]byte(key), data)
+    })
+}
+
+// history 返回节点最近的 limit 条连接记录，按时间先后排列
+func (s *store) history(id int, limit int) ([]connectionEvent, error) {
+    var events []connectionEvent
+    prefix := append(nodeKey(id), '/')
+    err := s.db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket(historyBucket).Cursor()
+        // 从该节点的最后一条记录开始向前读取
+        k, v := c.Seek(append(nodeKey(id), '0'))
+        if k == nil {
+            k, v = c.Last()
+        } else {
+            k, v = c.Prev()
+        }
+        for ; k != nil && len(events) < limit; k, v = c.Prev() {
+            if len(k) < len(prefix) || string(k[:len(prefix)]) != string(prefix) {
+                break
+            }
+            var ev connectionEvent
+            if err := json.Unmarshal(v, &ev); err != nil {
+                return err
+            }
+            events = append(events, ev)
+        }
+        return nil
+    })
+    for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+        events[i], events[j] = events[j], events[i]
+    }
+    return events, err
+}
+
+// saveGroup 写入或替换一个分组
+func (s *store) saveGroup(g *nodeGroup) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        data, err := json.Marshal(g)
+        if err != nil {
+            return err
+        }
+        return tx.Bucket(groupsBucket).Put([]byte(g.Name), data)
+    })
+}
+
+// deleteGroup 删除一个分组
+func (s *store) deleteGroup(name string) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket(groupsBucket).Delete([]byte(name))
+    })
+}
+
+// loadGroups 读取所有分组
+func (s *store) loadGroups() ([]*nodeGroup, error) {
+    var groups []*nodeGroup
+    err := s.db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket(groupsBucket).ForEach(func(k, v []byte) error {
+            g := &nodeGroup{}
+            if err := json.Unmarshal(v, g); err != nil {
+                fmt.Printf("跳过无法解析的分组 %s: %v\n", k, err)
+                return nil
+            }
+            groups = append(groups, g)
+            return nil
+        })
+    })
+    return groups, err
+}
+
+// saveQueueItems 在一个事务中写入或替换多条排队的命令
+func (s *store) saveQueueItems(items ...*queueItem) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(queueBucket)
+        for _, item := range items {
+            data, err := json.Marshal(item)
+            if err != nil {
+                return err
+            }
+            if err := b.Put(nodeKey(item.ID), data); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// deleteQueueItems 删除多条排队的命令
+func (s *store) deleteQueueItems(ids ...int) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(queueBucket)
+        for _, id := range ids {
+            if err := b.Delete(nodeKey(id)); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// loadQueue 按编号顺序读取所有排队的命令
+func (s *store) loadQueue() ([]*queueItem, error) {
+    var items []*queueItem
+    err := s.db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+            item := &queueItem{}
+            if err := json.Unmarshal(v, item); err != nil {
+                fmt.Printf("跳过无法解析的排队命令 %s: %v\n", k, err)
+                return nil
+            }
+            items = append(items, item)
+            return nil
+        })
+    })
+    return items, err
+}
+
+// saveAuditHead 保存审计日志 path 的最后一条记录
+func (s *store) saveAuditHead(path string, head *auditHead) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        data, err := json.Marshal(head)
+        if err != nil {
+            return err
+        }
+        return tx.Bucket(auditBucket).Put([]byte(path), data)
+    })
+}
+
+// loadAuditHead 读取审计日志 path 的最后一条记录，没有保存过时返回 nil
+func (s *store) loadAuditHead(path string) (*auditHead, error) {
+    var head *auditHead
+    err := s.db.View(func(tx *bolt.Tx) error {
+        data := tx.Bucket(auditBucket).Get([]byte(path))
+        if data == nil {
+            return nil
+        }
+        head = &auditHead{}
+        return json.Unmarshal(data, head)
+    })
+    return head, err
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// resolveTargets 解析 run 命令和作业 API 的目标节点:
+//   all            所有在线的节点
+//   1,3,5-8        编号列表，可以使用范围，包括离线的节点 (执行时报告离线)
+//   group:<名称>   分组中在线的节点
+//   search:<选择器> 满足选择器的在线节点，选择器的语法见 selector.go
+//   其他            作为选择器，例如 vendor=Dell* 或 "memory > 64GB and disk.type = SSD"
+func resolveTargets(expr string) ([]*client, error) {
+    return selectTargets(expr, true)
+}
+
+// selectTargets 解析目标表达式，onlineOnly 为 false 时 all、分组和选择器也包括离线的节点
+func selectTargets(expr string, onlineOnly bool) ([]*client, error) {
+    expr = strings.TrimSpace(expr)
+    if expr == "" {
+        return nil, fmt.Errorf("没有指定目标节点")
+    }
+
+    // 编号列表在加锁之前解析，范围不展开
+    var ranges []idRange
+    if isIDList(expr) {
+        var err error
+        if ranges, err = parseIDRanges(expr); err != nil {
+            return nil, err
+        }
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+
+    var targets []*client
+    if ranges != nil {
+        seen := make(map[int]bool)
+        for _, r := range ranges {
+            // 遇到第一个不存在的编号即返回，循环次数不超过已注册的客户端数
+            for id := r.lo; id <= r.hi; id++ {
+                c, ok := clients[id]
+                if !ok {
+                    return nil, fmt.Errorf("没有找到编号为 %d 的客户端", id)
+                }
+                if !seen[id] {
+                    seen[id] = true
+                    targets = append(targets, c)
+                }
+            }
+        }
+        return targets, nil
+    }
+
+    var matched []*client
+    switch {
+    case expr == "all":
+        for _, id := range sortedClientIDs() {
+            matched = append(matched, clients[id])
+        }
+    case strings.HasPrefix(expr, "group:"):
+        name := strings.TrimPrefix(expr, "group:")
+        g, ok := groups[name]
+        if !ok {
+            return nil, fmt.Errorf("没有名为 %s 的分组", name)
+        }
+        matched = g.membersLocked()
+    default:
+        sel, err := parseSelector(strings.TrimPrefix(expr, "search:"))
+        if err != nil {
+            return nil, err
+        }
+        matched = sel.selectClientsLocked()
+    }
+    for _, c := range matched {
+        if c.online || !onlineOnly {
+            targets = append(targets, c)
+        }
+    }
+    return targets, nil
+}
+
+// isIDList 判断目标是否只由数字、逗号和 - 组成
+func isIDList(expr string) bool {
+    return strings.Trim(expr, "0123456789,- ") == ""
+}
+
+// maxIDRange 是一个编号范围最多包含的编号数，拒绝 1-2000000000 这样的范围
+const maxIDRange = 100000
+
+// idRange 是编号列表中的一项，单个编号的 lo 和 hi 相同
+type idRange struct {
+    lo, hi int
+}
+
+// parseIDRanges 解析逗号分隔的编号列表，例如 1,3,5-8，范围不展开
+func parseIDRanges(s string) ([]idRange, error) {
+    var ranges []idRange
+    for _, part := range strings.Split(s, ",") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        if from, to, ok := strings.Cut(part, "-"); ok {
+            start, err1 := strconv.Atoi(from)
+            end, err2 := strconv.Atoi(to)
+            if err1 != nil || err2 != nil || start > end {
+                return nil, fmt.Errorf("编号范围格式错误: %s", part)
+            }
+            if end-start >= maxIDRange {
+                return nil, fmt.Errorf("编号范围 %s 过大，一个范围最多包含 %d 个编号", part, maxIDRange)
+            }
+            ranges = append(ranges, idRange{start, end})
+            continue
+        }
+        id, err := strconv.Atoi(part)
+        if err != nil {
+            return nil, fmt.Errorf("编号格式错误: %s", part)
+        }
+        ranges = append(ranges, idRange{id, id})
+    }
+    if len(ranges) == 0 {
+        return nil, fmt.Errorf("没有指定目标节点")
+    }
+    return ranges, nil
+}
+
+// parseIDList 解析逗号分隔的编号列表并展开范围，去掉重复的编号
+func parseIDList(s string) ([]int, error) {
+    ranges, err := parseIDRanges(s)
+    if err != nil {
+        return nil, err
+    }
+    total := 0
+    for _, r := range ranges {
+        if total += r.hi - r.lo + 1; total > maxIDRange {
+            return nil, fmt.Errorf("编号列表过长，最多包含 %d 个编号", maxIDRange)
+        }
+    }
+    var ids []int
+    seen := make(map[int]bool)
+    for _, r := range ranges {
+        for id := r.lo; id <= r.hi; id++ {
+            if !seen[id] {
+                seen[id] = true
+                ids = append(ids, id)
+            }
+        }
+    }
+    return ids, nil
+}
+
+// formatIDs 把编号列表压缩为范围形式，例如 1-3,5
+func formatIDs(ids []int) string {
+    var parts []string
+    for i := 0; i < len(ids); {
+        j := i
+        for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+            j++
+        }
+        if j > i {
+            parts = append(parts, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+        } else {
+            parts = append(parts, strconv.Itoa(ids[i]))
+        }
+        i = j + 1
+    }
+    return strings.Join(parts, ",")
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseIDList(t *testing.T) {
+    tests := []struct {
+        s       string
+        want    []int
+        wantErr bool
+    }{
+        {s: "1", want: []int{1}},
+        {s: "1,3,5-8", want: []int{1, 3, 5, 6, 7, 8}},
+        {s: " 3 , 1-2 ", want: []int{3, 1, 2}},
+        {s: "1-3,2,3-4", want: []int{1, 2, 3, 4}},
+        {s: "1,,2,", want: []int{1, 2}},
+        {s: "7-7", want: []int{7}},
+        {s: "1-100000", want: nil},
+
+        {s: "", wantErr: true},
+        {s: ",", wantErr: true},
+        {s: "x", wantErr: true},
+        {s: "5-3", wantErr: true},
+        {s: "1-", wantErr: true},
+        {s: "-3", wantErr: true},
+        {s: "1-2-3", wantErr: true},
+        {s: "1-100001", wantErr: true},
+        {s: "1-2000000000", wantErr: true},
+        {s: "1-60000,100001-160000", wantErr: true},
+    }
+    for _, tt := range tests {
+        got, err := parseIDList(tt.s)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("parseIDList(%q) 应返回错误，得到 %d 个编号", tt.s, len(got))
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parseIDList(%q): %v", tt.s, err)
+            continue
+        }
+        if tt.want == nil {
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseIDList(%q) = %v，应为 %v", tt.s, got, tt.want)
+        }
+    }
+}
+
+func TestSelectTargetsIDList(t *testing.T) {
+    mu.Lock()
+    saved := clients
+    clients = map[int]*client{1: {id: 1, online: true}, 2: {id: 2}, 3: {id: 3, online: true}}
+    mu.Unlock()
+    defer func() {
+        mu.Lock()
+        clients = saved
+        mu.Unlock()
+    }()
+
+    tests := []struct {
+        expr    string
+        want    []int
+        wantErr string
+    }{
+        {expr: "3,1-2", want: []int{3, 1, 2}},
+        {expr: "1-3,2", want: []int{1, 2, 3}},
+        {expr: "2-5", wantErr: "编号为 4"},
+        {expr: "1-99999", wantErr: "编号为 4"},
+        {expr: "1-2000000000", wantErr: "过大"},
+    }
+    for _, tt := range tests {
+        targets, err := selectTargets(tt.expr, true)
+        if tt.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("selectTargets(%q) 的错误为 %v，应包含 %q", tt.expr, err, tt.wantErr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("selectTargets(%q): %v", tt.expr, err)
+            continue
+        }
+        var got []int
+        for _, c := range targets {
+            got = append(got, c.id)
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("selectTargets(%q) = %v，应为 %v", tt.expr, got, tt.want)
+        }
+    }
+}
+
+func TestFormatIDs(t *testing.T) {
+    tests := []struct {
+        ids  []int
+        want string
+    }{
+        {nil, ""},
+        {[]int{1}, "1"},
+        {[]int{1, 2, 3, 5}, "1-3,5"},
+        {[]int{1, 3, 4, 6, 7, 8}, "1,3-4,6-8"},
+    }
+    for _, tt := range tests {
+        if got := formatIDs(tt.ids); got != tt.want {
+            t.Errorf("formatIDs(%v) = %q，应为 %q", tt.ids, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+)
+
+var (
+    tlsCertFile     string
+    tlsKeyFile      string
+    tlsClientCAFile string
+    tlsCRLFile      string
+    tlsDenyFile     string
+    revocation      *revocationList // 启用客户端证书校验时不为 nil
+)
+
+// listen 在 addr 上监听客户端连接，指定了证书和私钥时使用 TLS
+func listen(addr string) (net.Listener, error) {
+    if tlsCertFile == "" && tlsKeyFile == "" {
+        if tlsClientCAFile != "" || tlsCRLFile != "" || tlsDenyFile != "" {
+            return nil, errors.New("校验客户端证书需要同时指定 -tls-cert 和 -tls-key")
+        }
+        return net.Listen("tcp", addr)
+    }
+    if tlsCertFile == "" || tlsKeyFile == "" {
+        return nil, errors.New("-tls-cert 和 -tls-key 需要同时指定")
+    }
+
+    config, err := loadTLSConfig()
+    if err != nil {
+        return nil, err
+    }
+    return tls.Listen("tcp", addr, config)
+}
+
+// loadTLSConfig 构造监听使用的 TLS 配置。指定了客户端 CA 时要求客户端
+// 出示由该 CA 签发且未被吊销的证书
+func loadTLSConfig() (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("读取证书失败: %v", err)
+    }
+    // 显示证书指纹，便于客户端使用 -fingerprint 固定
+    sum := sha256.Sum256(cert.Certificate[0])
+    fmt.Printf("TLS 已启用，证书 SHA-256 指纹: %s\n", hex.EncodeToString(sum[:]))
+
+    config := &tls.Config{
+        MinVersion:   tls.VersionTLS12,
+        Certificates: []tls.Certificate{cert},
+    }
+
+    if tlsClientCAFile == "" {
+        if tlsCRLFile != "" || tlsDenyFile != "" {
+            return nil, errors.New("-tls-crl 和 -tls-denylist 需要与 -tls-client-ca 同时使用")
+        }
+        return config, nil
+    }
+
+    cas, err := loadCertificates(tlsClientCAFile)
+    if err != nil {
+        return nil, err
+    }
+    pool := x509.NewCertPool()
+    for _, ca := range cas {
+        pool.AddCert(ca)
+    }
+    revocation = &revocationList{crlFile: tlsCRLFile, denyFile: tlsDenyFile, issuers: cas}
+    if err := revocation.reload(); err != nil {
+        return nil, err
+    }
+
+    config.ClientAuth = tls.RequireAndVerifyClientCert
+    config.ClientCAs = pool
+    config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+        if len(chains) == 0 || len(chains[0]) == 0 {
+            return errors.New("客户端没有提供证书")
+        }
+        return revocation.check(chains[0][0])
+    }
+    fmt.Printf("已启用客户端证书校验 (CA: %s)\n", tlsClientCAFile)
+    return config, nil
+}
+
+// loadCertificates 读取 PEM 文件中的所有证书
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("读取 CA 证书失败: %v", err)
+    }
+    var certs []*x509.Certificate
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            break
+        }
+        if block.Type != "CERTIFICATE" {
+            continue
+        }
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, fmt.Errorf("解析 CA 证书失败: %v", err)
+        }
+        certs = append(certs, cert)
+    }
+    if len(certs) == 0 {
+        return nil, fmt.Errorf("CA 证书文件 %s 中没有有效的证书", path)
+    }
+    return certs, nil
+}
+
+// peerCertificate 返回 TLS 连接中客户端出示的证书，不是 TLS 或没有证书时返回 nil。
+// 需要在握手完成 (读取第一帧) 之后调用
+func peerCertificate(conn net.Conn) *x509.Certificate {
+    tc, ok := conn.(*tls.Conn)
+    if !ok {
+        return nil
+    }
+    certs := tc.ConnectionState().PeerCertificates
+    if len(certs) == 0 {
+        return nil
+    }
+    return certs[0]
+}
+
+// certIdentity 返回证书代表的身份: 优先使用 CN，其次第一个 DNS 或 URI SAN
+func certIdentity(cert *x509.Certificate) string {
+    if cert.Subject.CommonName != "" {
+        return cert.Subject.CommonName
+    }
+    if len(cert.DNSNames) > 0 {
+        return cert.DNSNames[0]
+    }
+    if len(cert.URIs) > 0 {
+        return cert.URIs[0].String()
+    }
+    return ""
+}
+
+// checkCertBinding 检查证书身份与节点的绑定关系: 节点首次使用证书连接时
+// 与证书身份绑定，之后只能使用相同身份的证书；一个证书身份也只能属于一个节点
+func checkCertBinding(nodeID, identity string) error {
+    if identity == "" {
+        return nil
+    }
+    mu.Lock()
+    defer mu.Unlock()
+
+    id, known := nodeIDs[nodeID]
+    if known && nodeID != "" {
+        if bound := clients[id].certIdentity; bound != "" && bound != identity {
+            return fmt.Errorf("节点 %s 已绑定证书身份 %s，不接受 %s", nodeID, bound, identity)
+        }
+    }
+    if owner, ok := certIdentities[identity]; ok && (!known || owner != id) {
+        return fmt.Errorf("证书身份 %s 已绑定到客户端 %d", identity, owner)
+    }
+    return nil
+}
+
+// checkRevokedClients 断开证书已被吊销的在线客户端，吊销列表更新后生效
+func checkRevokedClients(online []*client) {
+    if revocation == nil {
+        return
+    }
+    for _, c := range online {
+        if c.cert == nil {
+            continue
+        }
+        if err := revocation.check(c.cert); err != nil {
+            fmt.Printf("客户端 %d: %v，断开连接\n> ", c.id, err)
+            markOffline(c)
+        }
+    }
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package server
+
+import (
+    "os"
+    "os/signal"
+    "syscall"
+)
+
+// notifyWindowResize 在本地终端窗口大小变化时通知 ch
+func notifyWindowResize(ch chan<- os.Signal) {
+    signal.Notify(ch, syscall.SIGWINCH)
+}
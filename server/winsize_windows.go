@@ -0,0 +1,10 @@
+//go:build windows
+
+package server
+
+import (
+    "os"
+)
+
+// notifyWindowResize Windows 上没有 SIGWINCH，不跟踪窗口大小变化
+func notifyWindowResize(ch chan<- os.Signal) {}
@@ -0,0 +1,168 @@
+package signer
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/agent"
+
+    "serverandclient/protocol"
+)
+
+// 操作员一侧的签名工具: 在操作员自己的机器上用私钥文件或 ssh-agent 为命令签名，
+// 输出按节点ID索引的签名，作为 API 创建作业和排队命令时的 signatures 字段。
+// 服务端只转发签名，不持有私钥
+
+var (
+    genKey     string
+    keyFile    string
+    agentKey   string
+    listKeys   bool
+    nodeList   string
+    timeout    time.Duration
+    ttl        time.Duration
+    signerHelp bool
+)
+
+func init() {
+    flag.StringVar(&genKey, "gen-key", "", "生成 ed25519 签名密钥对并写入指定路径 (公钥为 <路径>.pub)，然后退出")
+    flag.StringVar(&keyFile, "key", "", "ed25519 签名私钥 (PEM)，不指定时使用 ssh-agent ($SSH_AUTH_SOCK) 中的密钥")
+    flag.StringVar(&agentKey, "agent-key", "", "使用 ssh-agent 中指定的密钥，可以是公钥指纹 (KeyID) 或 SHA256:... 格式的 SSH 指纹")
+    flag.BoolVar(&listKeys, "list-keys", false, "列出 ssh-agent 中可用于签名的 ed25519 密钥，然后退出")
+    flag.StringVar(&nodeList, "nodes", "", "目标节点ID，多个用逗号分隔")
+    flag.DurationVar(&timeout, "timeout", 10*time.Minute, "命令的超时时间，必须与提交请求时的 timeout 相同，0 表示不限制")
+    flag.DurationVar(&ttl, "ttl", 0, "签名的有效期，排队命令和分批执行的作业需要指定；0 表示只在客户端允许的时间偏差内有效")
+    flag.BoolVar(&signerHelp, "help", false, "显示帮助信息")
+}
+
+func Run() {
+    flag.Parse()
+    if signerHelp {
+        fmt.Println("签名工具帮助信息:")
+        fmt.Println("  signer [选项] -nodes <节点ID,...> <命令>")
+        fmt.Println("  -gen-key: 生成 ed25519 签名密钥对并写入指定路径 (公钥为 <路径>.pub)，然后退出")
+        fmt.Println("  -key: ed25519 签名私钥 (PEM)，不指定时使用 ssh-agent ($SSH_AUTH_SOCK) 中的密钥")
+        fmt.Println("  -agent-key: 使用 ssh-agent 中指定的密钥，可以是公钥指纹 (KeyID) 或 SHA256:... 格式的 SSH 指纹 (默认: 第一个 ed25519 密钥)")
+        fmt.Println("  -list-keys: 列出 ssh-agent 中可用于签名的 ed25519 密钥，然后退出")
+        fmt.Println("  -nodes: 目标节点ID，多个用逗号分隔，可以从 GET /api/v1/nodes 的 node_id 得到")
+        fmt.Println("  -timeout: 命令的超时时间，必须与提交请求时的 timeout 相同，0 表示不限制 (默认: 10m)")
+        fmt.Println("  -ttl: 签名的有效期，排队命令和分批执行的作业需要指定，不能超过客户端的 -max-signature-ttl；0 表示只在客户端允许的时间偏差内有效")
+        fmt.Println("  -help: 显示帮助信息")
+        fmt.Println("输出按节点ID索引的签名 (JSON)，作为 POST /api/v1/jobs 和 /api/v1/queue 的 signatures 字段。")
+        return
+    }
+
+    if genKey != "" {
+        pub, err := protocol.GenerateSigningKey(genKey)
+        if err != nil {
+            fmt.Printf("生成签名密钥失败: %v\n", err)
+            os.Exit(1)
+        }
+        fmt.Printf("已生成签名私钥 %s 和公钥 %s.pub (指纹: %s)\n", genKey, genKey, protocol.KeyID(pub))
+        fmt.Println("请把公钥分发到客户端，并使用 -trusted-keys 指定")
+        return
+    }
+
+    if listKeys {
+        signers, err := agentSigners()
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        for _, s := range signers {
+            fmt.Printf("%s %s\n", protocol.KeyID(s.Public()), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.Key()))))
+        }
+        return
+    }
+
+    command := strings.Join(flag.Args(), " ")
+    nodes := splitNodes(nodeList)
+    if strings.TrimSpace(command) == "" || len(nodes) == 0 {
+        fmt.Println("需要指定 -nodes 和要签名的命令，使用 -help 查看帮助")
+        os.Exit(1)
+    }
+    if timeout < 0 || ttl < 0 {
+        fmt.Println("-timeout 和 -ttl 不能为负数")
+        os.Exit(1)
+    }
+
+    signer, err := loadSigner()
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    var expires time.Time
+    if ttl > 0 {
+        expires = time.Now().Add(ttl)
+    }
+    body := (&protocol.ExecRequest{Command: command, TimeoutMs: timeout.Milliseconds()}).SignedBody()
+    sigs := make(map[string]*protocol.Signature, len(nodes))
+    for _, node := range nodes {
+        sig, err := protocol.Sign(signer, protocol.SignKindExec, node, body, expires)
+        if err != nil {
+            fmt.Printf("为节点 %s 签名失败: %v\n", node, err)
+            os.Exit(1)
+        }
+        sigs[node] = sig
+    }
+    data, _ := json.MarshalIndent(sigs, "", "  ")
+    fmt.Println(string(data))
+}
+
+// splitNodes 拆分逗号分隔的节点ID，忽略空白和重复的ID
+func splitNodes(list string) []string {
+    var nodes []string
+    seen := make(map[string]bool)
+    for _, node := range strings.Split(list, ",") {
+        node = strings.TrimSpace(node)
+        if node != "" && !seen[node] {
+            seen[node] = true
+            nodes = append(nodes, node)
+        }
+    }
+    return nodes
+}
+
+// loadSigner 返回 -key 指定的私钥，没有指定时使用 ssh-agent 中的密钥
+func loadSigner() (protocol.Signer, error) {
+    if keyFile != "" {
+        key, err := protocol.LoadSigningKey(keyFile)
+        if err != nil {
+            return nil, err
+        }
+        return protocol.KeySigner(key), nil
+    }
+    signers, err := agentSigners()
+    if err != nil {
+        return nil, err
+    }
+    if agentKey == "" {
+        return signers[0], nil
+    }
+    for _, s := range signers {
+        if protocol.KeyID(s.Public()) == agentKey || ssh.FingerprintSHA256(s.Key()) == agentKey {
+            return s, nil
+        }
+    }
+    return nil, fmt.Errorf("ssh-agent 中没有指纹为 %s 的 ed25519 密钥", agentKey)
+}
+
+// agentSigners 连接 $SSH_AUTH_SOCK，返回其中所有 ed25519 密钥，连接在进程结束前保持打开
+func agentSigners() ([]*protocol.AgentSigner, error) {
+    socket := os.Getenv("SSH_AUTH_SOCK")
+    if socket == "" {
+        return nil, errors.New("没有指定 -key，也没有设置 SSH_AUTH_SOCK")
+    }
+    conn, err := net.Dial("unix", socket)
+    if err != nil {
+        return nil, fmt.Errorf("连接 ssh-agent 失败: %v", err)
+    }
+    return protocol.AgentSigners(agent.NewClient(conn))
+}